@@ -19,7 +19,8 @@ type K8STestSetup struct {
 	WaitForPods         []string
 	PortForwardServices map[string]int
 
-	forwards map[string]int
+	forwards   map[string]int
+	namespaces map[string]string
 
 	cmd *exec.Cmd
 
@@ -41,6 +42,7 @@ var setupCMD = flag.String("setup", "", "the path to the it setup command")
 // to teardown the test namespace
 func (s *K8STestSetup) TestMain(m *testing.M) {
 	s.forwards = make(map[string]int)
+	s.namespaces = make(map[string]string)
 	wg := new(sync.WaitGroup)
 	wg.Add(2) // there will be 2 goroutines, one reading stdout and one reading stdin
 	os.Exit(func() int {
@@ -67,10 +69,17 @@ func (s *K8STestSetup) TestMain(m *testing.M) {
 	}())
 }
 
+// GetServiceLocalPort returns the local port forwarded to the service.
+// Services in additional namespaces are referred to as alias/serviceName.
 func (s *K8STestSetup) GetServiceLocalPort(serviceName string) int {
 	return s.forwards[serviceName]
 }
 
+// GetNamespace returns the name of the additional namespace created for the alias
+func (s *K8STestSetup) GetNamespace(alias string) string {
+	return s.namespaces[alias]
+}
+
 func (s *K8STestSetup) before(wg *sync.WaitGroup) {
 	log.Printf("setup command: %s\n", *setupCMD)
 
@@ -136,6 +145,10 @@ waitForReady:
 			localPort, _ := strconv.Atoi(parts[2])
 			s.forwards[parts[0]] = localPort
 		}
+		if strings.HasPrefix(str, "NAMESPACE ") {
+			alias, ns, _ := strings.Cut(strings.TrimSpace(str[10:]), "=")
+			s.namespaces[alias] = ns
+		}
 		if "READY\n" == str {
 			break waitForReady
 		}
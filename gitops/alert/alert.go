@@ -0,0 +1,181 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package alert reports failed gitops runs to Datadog and PagerDuty.
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Event describes a failed gitops run
+type Event struct {
+	// Train is the failed release train, empty if the failure is not train specific
+	Train string
+	// Phase of the run that failed, e.g. render or push
+	Phase string
+	Error string
+	// Source identifies the run, e.g. the pipeline name or host
+	Source string
+	// Link to the run, e.g. the CI build URL
+	Link string
+}
+
+func (e Event) summary() string {
+	s := "gitops run failed"
+	if e.Train != "" {
+		s += " for release train " + e.Train
+	}
+	if e.Phase != "" {
+		s += " in " + e.Phase
+	}
+	return s + ": " + e.Error
+}
+
+// Notifier sends failure events
+type Notifier interface {
+	Notify(e Event) error
+}
+
+// Notifiers sends events to all notifiers
+type Notifiers []Notifier
+
+// Notify sends the event to every notifier and returns the joined errors
+func (ns Notifiers) Notify(e Event) error {
+	var errs []error
+	for _, n := range ns {
+		if err := n.Notify(e); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func post(hc *http.Client, url string, header http.Header, in interface{}) error {
+	b, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header = header
+	req.Header.Set("Content-Type", "application/json")
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s: %s", url, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// Datadog posts error events to the Datadog events API
+type Datadog struct {
+	APIKey string
+	// Site is the Datadog site, e.g. datadoghq.com or datadoghq.eu
+	Site string
+	Tags []string
+	HTTP *http.Client
+	// URL overrides the events API endpoint derived from Site
+	URL string
+}
+
+// Notify implements Notifier
+func (d *Datadog) Notify(e Event) error {
+	url := d.URL
+	if url == "" {
+		url = "https://api." + d.Site + "/api/v1/events"
+	}
+	text := e.Error
+	if e.Link != "" {
+		text += "\n\n" + e.Link
+	}
+	tags := append([]string{"source:gitops"}, d.Tags...)
+	if e.Train != "" {
+		tags = append(tags, "train:"+e.Train)
+	}
+	if e.Phase != "" {
+		tags = append(tags, "phase:"+e.Phase)
+	}
+	event := map[string]interface{}{
+		"title":      e.summary(),
+		"text":       text,
+		"alert_type": "error",
+		"tags":       tags,
+	}
+	if e.Source != "" {
+		event["host"] = e.Source
+	}
+	h := http.Header{}
+	h.Set("DD-API-KEY", d.APIKey)
+	if err := post(d.HTTP, url, h, event); err != nil {
+		return fmt.Errorf("datadog: %w", err)
+	}
+	return nil
+}
+
+// PagerDuty triggers alerts with the PagerDuty Events API v2
+type PagerDuty struct {
+	RoutingKey string
+	HTTP       *http.Client
+	// URL overrides the events API endpoint
+	URL string
+}
+
+// Notify implements Notifier
+func (p *PagerDuty) Notify(e Event) error {
+	url := p.URL
+	if url == "" {
+		url = "https://events.pagerduty.com/v2/enqueue"
+	}
+	source := e.Source
+	if source == "" {
+		source = "gitops"
+	}
+	event := map[string]interface{}{
+		"routing_key":  p.RoutingKey,
+		"event_action": "trigger",
+		"payload": map[string]interface{}{
+			"summary":   e.summary(),
+			"source":    source,
+			"severity":  "error",
+			"component": e.Train,
+			"group":     e.Phase,
+			"custom_details": map[string]string{
+				"train": e.Train,
+				"phase": e.Phase,
+				"error": e.Error,
+			},
+		},
+	}
+	if e.Link != "" {
+		event["links"] = []map[string]string{{"href": e.Link, "text": "gitops run"}}
+	}
+	if err := post(p.HTTP, url, http.Header{}, event); err != nil {
+		return fmt.Errorf("pagerduty: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package alert
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type request struct {
+	header http.Header
+	body   map[string]interface{}
+}
+
+func recorder(t *testing.T, status int) (*httptest.Server, *request) {
+	r := &request{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.header = req.Header
+		if err := json.NewDecoder(req.Body).Decode(&r.body); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(ts.Close)
+	return ts, r
+}
+
+var event = Event{Train: "prod", Phase: "render", Error: "exit status 1", Source: "deploy-pipeline", Link: "https://ci/builds/1"}
+
+func TestDatadog(t *testing.T) {
+	ts, r := recorder(t, http.StatusAccepted)
+	d := &Datadog{APIKey: "key", Tags: []string{"team:sre"}, URL: ts.URL}
+	if err := d.Notify(event); err != nil {
+		t.Fatal(err)
+	}
+	if r.header.Get("DD-API-KEY") != "key" {
+		t.Errorf("missing api key header")
+	}
+	if r.body["title"] != "gitops run failed for release train prod in render: exit status 1" || r.body["alert_type"] != "error" || r.body["host"] != "deploy-pipeline" {
+		t.Errorf("unexpected event %v", r.body)
+	}
+	want := []interface{}{"source:gitops", "team:sre", "train:prod", "phase:render"}
+	if !reflect.DeepEqual(r.body["tags"], want) {
+		t.Errorf("tags %v, want %v", r.body["tags"], want)
+	}
+}
+
+func TestPagerDuty(t *testing.T) {
+	ts, r := recorder(t, http.StatusAccepted)
+	p := &PagerDuty{RoutingKey: "routing", URL: ts.URL}
+	if err := p.Notify(event); err != nil {
+		t.Fatal(err)
+	}
+	payload := r.body["payload"].(map[string]interface{})
+	if r.body["routing_key"] != "routing" || r.body["event_action"] != "trigger" || payload["component"] != "prod" || payload["group"] != "render" || payload["source"] != "deploy-pipeline" {
+		t.Errorf("unexpected event %v", r.body)
+	}
+}
+
+func TestNotifiersErrors(t *testing.T) {
+	failing, _ := recorder(t, http.StatusForbidden)
+	ok, r := recorder(t, http.StatusAccepted)
+	ns := Notifiers{&Datadog{URL: failing.URL}, &PagerDuty{URL: ok.URL}}
+	if err := ns.Notify(event); err == nil {
+		t.Error("expected datadog error")
+	}
+	if r.body == nil {
+		t.Error("pagerduty was not notified after datadog failure")
+	}
+}
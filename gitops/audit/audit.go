@@ -0,0 +1,194 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package audit maintains the deployment audit log committed into the deployment repository.
+//
+// The log is a JSON lines file. Every record carries the SHA-256 hash of the previous line,
+// so edits of past records break the chain and are detected by Verify.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Image is a container image deployed by a release train
+type Image struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Record is a single deployment of a release train
+type Record struct {
+	Time     time.Time `json:"timestamp"`
+	Actor    string    `json:"actor,omitempty"`
+	Train    string    `json:"train"`
+	Branch   string    `json:"branch,omitempty"`
+	Commit   string    `json:"commit"`
+	BuildURL string    `json:"build_url,omitempty"`
+	Images   []Image   `json:"images,omitempty"`
+	// Prev is the SHA-256 hash of the previous line of the log, empty for the first record
+	Prev string `json:"prev,omitempty"`
+}
+
+// Append adds the record to the log file at path, creating the file and its directory if needed
+func Append(path string, rec Record) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("unable to read audit log %s: %w", path, err)
+	}
+	rec.Prev = hashLine(lastLine(content))
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	content = append(append(content, line...), '\n')
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// Verify checks the hash chain of the log file at path and returns the number of records
+func Verify(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var prev []byte
+	n := 0
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := s.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		n++
+		var rec Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return n, fmt.Errorf("%s: record %d: %w", path, n, err)
+		}
+		if rec.Prev != hashLine(prev) {
+			return n, fmt.Errorf("%s: record %d does not match the previous record", path, n)
+		}
+		prev = append(prev[:0], line...)
+	}
+	return n, s.Err()
+}
+
+func lastLine(content []byte) []byte {
+	lines := bytes.Split(bytes.TrimRight(content, "\n"), []byte("\n"))
+	return lines[len(lines)-1]
+}
+
+func hashLine(line []byte) string {
+	if len(line) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+var imageRe = regexp.MustCompile(`(?m)^\s*-?\s*image:\s*["']?([^\s"'#]+)`)
+
+// Images returns the sorted unique images referenced by the manifest files.
+// YAML files of directories are scanned recursively.
+func Images(files ...string) ([]Image, error) {
+	seen := make(map[string]bool)
+	var images []Image
+	scan := func(file string) error {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, img := range ParseImages(content) {
+			if ref := img.Name + "@" + img.Digest; !seen[ref] {
+				seen[ref] = true
+				images = append(images, img)
+			}
+		}
+		return nil
+	}
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			// deleted manifest
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			if err := scan(file); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		// new directories are reported by git as a whole
+		err = filepath.WalkDir(file, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			if ext := filepath.Ext(path); ext != ".yaml" && ext != ".yml" {
+				return nil
+			}
+			return scan(path)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name != images[j].Name {
+			return images[i].Name < images[j].Name
+		}
+		return images[i].Digest < images[j].Digest
+	})
+	return images, nil
+}
+
+// ParseImages returns the unique images referenced by the manifest content in order of appearance
+func ParseImages(content []byte) []Image {
+	seen := make(map[string]bool)
+	var images []Image
+	for _, m := range imageRe.FindAllSubmatch(content, -1) {
+		ref := string(m[1])
+		if !seen[ref] {
+			seen[ref] = true
+			images = append(images, parseImage(ref))
+		}
+	}
+	return images
+}
+
+func parseImage(ref string) Image {
+	if i := strings.IndexByte(ref, '@'); i >= 0 {
+		return Image{Name: ref[:i], Digest: ref[i+1:]}
+	}
+	return Image{Name: ref}
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package audit
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAppendVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit", "prod.jsonl")
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, commit := range []string{"abc1234", "def5678", "0123456"} {
+		if err := Append(path, Record{Time: ts, Train: "prod", Commit: commit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := Verify(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("Verify() = %d records, want 3", n)
+	}
+
+	content, _ := os.ReadFile(path)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if strings.Contains(lines[0], `"prev"`) {
+		t.Errorf("first record has prev hash: %s", lines[0])
+	}
+	tampered := strings.Replace(string(content), "def5678", "bad5678", 1)
+	if err := os.WriteFile(path, []byte(tampered), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(path); err == nil {
+		t.Error("Verify() of tampered log succeeded")
+	}
+}
+
+func TestImages(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.yaml")
+	b := filepath.Join(dir, "b.yaml")
+	os.WriteFile(a, []byte(`spec:
+  containers:
+  - name: app
+    image: gcr.io/repo/app@sha256:1111
+  - image: "gcr.io/repo/sidecar:v1"
+`), 0644)
+	os.WriteFile(b, []byte(`      image: gcr.io/repo/app@sha256:1111 # comment
+`), 0644)
+	sub := filepath.Join(dir, "new")
+	os.MkdirAll(sub, 0755)
+	os.WriteFile(filepath.Join(sub, "c.yaml"), []byte("    image: gcr.io/repo/worker@sha256:2222\n"), 0644)
+	os.WriteFile(filepath.Join(sub, "README"), []byte("image: ignored\n"), 0644)
+	images, err := Images(a, b, sub, filepath.Join(dir, "deleted.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Image{
+		{Name: "gcr.io/repo/app", Digest: "sha256:1111"},
+		{Name: "gcr.io/repo/sidecar:v1"},
+		{Name: "gcr.io/repo/worker", Digest: "sha256:2222"},
+	}
+	if !reflect.DeepEqual(images, want) {
+		t.Errorf("Images() = %v, want %v", images, want)
+	}
+}
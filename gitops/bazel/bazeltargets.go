@@ -11,14 +11,18 @@ governing permissions and limitations under the License.
 */
 package bazel
 
-import "strings"
+import (
+	"path/filepath"
+	"strings"
+)
 
-// TargetToExecutable converts bazel target name to respective executable name in bazel-bin
+// TargetToExecutable converts bazel target name to respective executable name in bazel-bin.
+// The path uses the separator of the platform and has no executable suffix, e.g. .exe on Windows.
 func TargetToExecutable(target string) string {
 	if !strings.HasPrefix(target, "//") {
 		return target
 	}
 	target = "bazel-bin/" + target[2:]
 	target = strings.Replace(target, ":", "/", 1)
-	return target
+	return filepath.FromSlash(target)
 }
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package canary derives canary variants of rendered kubernetes manifests.
+package canary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	yamlenc "github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// Config describes the canary variant
+type Config struct {
+	// Suffix is appended to names of canary objects
+	Suffix string `json:"suffix"`
+	// Replicas of canary workloads. Replicas are not changed if nil.
+	Replicas *int64 `json:"replicas,omitempty"`
+	// Labels are added to canary objects, their selectors and pod templates
+	Labels map[string]string `json:"labels"`
+	// Kinds of objects included in the canary variant. Objects of other kinds are dropped.
+	Kinds []string `json:"kinds"`
+}
+
+// DefaultConfig returns the configuration used for fields missing in the config file
+func DefaultConfig() *Config {
+	replicas := int64(1)
+	return &Config{
+		Suffix:   "-canary",
+		Replicas: &replicas,
+		Labels:   map[string]string{"track": "canary"},
+		Kinds:    []string{"Deployment", "StatefulSet"},
+	}
+}
+
+// LoadConfig reads the JSON config file. Missing fields are set to defaults.
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// workload kinds with a pod template and a label selector
+var workloads = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"ReplicaSet":  true,
+}
+
+// Transform writes canary variants of the objects of the YAML or JSON stream in to out.
+// It returns the number of objects written.
+func Transform(in io.Reader, out io.Writer, cfg *Config) (int, error) {
+	kinds := make(map[string]bool)
+	for _, k := range cfg.Kinds {
+		kinds[k] = true
+	}
+	decoder := yaml.NewYAMLOrJSONDecoder(in, 1024)
+	n := 0
+	for {
+		var obj unstructured.Unstructured
+		if err := decoder.Decode(&obj.Object); err != nil {
+			if err == io.EOF {
+				return n, nil
+			}
+			return n, err
+		}
+		if obj.Object == nil || !kinds[obj.GetKind()] {
+			continue
+		}
+		if err := variant(&obj, cfg); err != nil {
+			return n, fmt.Errorf("%s %s: %w", obj.GetKind(), obj.GetName(), err)
+		}
+		buf, err := yamlenc.Marshal(obj.Object)
+		if err != nil {
+			return n, err
+		}
+		if n > 0 {
+			if _, err := out.Write([]byte("---\n")); err != nil {
+				return n, err
+			}
+		}
+		if _, err := out.Write(buf); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+func variant(obj *unstructured.Unstructured, cfg *Config) error {
+	obj.SetName(obj.GetName() + cfg.Suffix)
+	obj.SetLabels(merge(obj.GetLabels(), cfg.Labels))
+	if obj.GetKind() == "Service" {
+		// canary services route to canary pods only
+		selector, found, err := unstructured.NestedStringMap(obj.Object, "spec", "selector")
+		if err != nil || !found {
+			return err
+		}
+		return unstructured.SetNestedStringMap(obj.Object, merge(selector, cfg.Labels), "spec", "selector")
+	}
+	if !workloads[obj.GetKind()] {
+		return nil
+	}
+	if cfg.Replicas != nil && obj.GetKind() != "DaemonSet" {
+		if err := unstructured.SetNestedField(obj.Object, *cfg.Replicas, "spec", "replicas"); err != nil {
+			return err
+		}
+	}
+	for _, path := range [][]string{{"spec", "selector", "matchLabels"}, {"spec", "template", "metadata", "labels"}} {
+		labels, _, err := unstructured.NestedStringMap(obj.Object, path...)
+		if err != nil {
+			return err
+		}
+		if err := unstructured.SetNestedStringMap(obj.Object, merge(labels, cfg.Labels), path...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func merge(labels, extra map[string]string) map[string]string {
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range extra {
+		labels[k] = v
+	}
+	return labels
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package canary
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const manifests = `apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  selector:
+    app: app
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  labels:
+    app: app
+spec:
+  replicas: 10
+  selector:
+    matchLabels:
+      app: app
+  template:
+    metadata:
+      labels:
+        app: app
+    spec:
+      containers:
+      - name: app
+        image: app:v2
+`
+
+const want = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: app
+    track: canary
+  name: app-canary
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: app
+      track: canary
+  template:
+    metadata:
+      labels:
+        app: app
+        track: canary
+    spec:
+      containers:
+      - image: app:v2
+        name: app
+`
+
+func TestTransform(t *testing.T) {
+	var out bytes.Buffer
+	n, err := Transform(strings.NewReader(manifests), &out, DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 || out.String() != want {
+		t.Errorf("Transform() = %d objects\n%s\nwant\n%s", n, out.String(), want)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "canary.json")
+	if err := os.WriteFile(path, []byte(`{"suffix": "-c", "kinds": ["Deployment", "Service"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Suffix != "-c" || len(cfg.Kinds) != 2 || cfg.Labels["track"] != "canary" || *cfg.Replicas != 1 {
+		t.Errorf("unexpected config %+v", cfg)
+	}
+	var out bytes.Buffer
+	if n, err := Transform(strings.NewReader(manifests), &out, cfg); err != nil || n != 2 {
+		t.Fatalf("Transform() = %d, %v", n, err)
+	}
+	if !strings.Contains(out.String(), "name: app-c\n") || !strings.Contains(out.String(), "selector:\n    app: app\n    track: canary\n") {
+		t.Errorf("unexpected output\n%s", out.String())
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package changelog describes source repository changes shipped by a deployment.
+package changelog
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+)
+
+// Entry is a source repository commit
+type Entry struct {
+	Commit  string
+	Author  string
+	Subject string
+	// PR is the number of the pull request the commit was merged with, 0 if unknown
+	PR int
+}
+
+var prRe = regexp.MustCompile(`(?:\(#(\d+)\)$|^Merge pull request #(\d+))`)
+
+const format = "--format=%H%x1f%an%x1f%s"
+
+// Generate returns the commits of the git repository in dir reachable from to but not from
+func Generate(dir, from, to string) ([]Entry, error) {
+	out, err := exec.Ex(dir, "git", "log", "--first-parent", format, from+".."+to)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read log %s..%s: %w", from, to, err)
+	}
+	return parse(out), nil
+}
+
+func parse(out string) []Entry {
+	var entries []Entry
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Split(line, "\x1f")
+		if len(fields) != 3 {
+			continue
+		}
+		e := Entry{Commit: fields[0], Author: fields[1], Subject: fields[2]}
+		if m := prRe.FindStringSubmatch(e.Subject); m != nil {
+			fmt.Sscan(m[1]+m[2], &e.PR)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Markdown renders at most max entries as a markdown list. Commits and PRs are linked if repoURL of a GitHub or GitLab repository is set.
+func Markdown(entries []Entry, repoURL string, max int) string {
+	repoURL = strings.TrimSuffix(repoURL, "/")
+	var sb strings.Builder
+	for i, e := range entries {
+		if max > 0 && i == max {
+			fmt.Fprintf(&sb, "- ... and %d more\n", len(entries)-max)
+			break
+		}
+		short := e.Commit
+		if len(short) > 7 {
+			short = short[:7]
+		}
+		subject := e.Subject
+		if repoURL != "" {
+			short = fmt.Sprintf("[%s](%s/commit/%s)", short, repoURL, e.Commit)
+			if e.PR != 0 {
+				subject = strings.Replace(subject, fmt.Sprintf("#%d", e.PR), fmt.Sprintf("[#%d](%s/pull/%d)", e.PR, repoURL, e.PR), 1)
+			}
+		}
+		fmt.Fprintf(&sb, "- %s %s (%s)\n", short, subject, e.Author)
+	}
+	return sb.String()
+}
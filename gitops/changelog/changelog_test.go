@@ -0,0 +1,85 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package changelog
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	out := "aaaaaaaaaa\x1fAlice\x1fFix login (#12)\n" +
+		"bbbbbbbbbb\x1fBob\x1fMerge pull request #13 from org/feature\n" +
+		"cccccccccc\x1fCarol\x1fBump version\n"
+	want := []Entry{
+		{"aaaaaaaaaa", "Alice", "Fix login (#12)", 12},
+		{"bbbbbbbbbb", "Bob", "Merge pull request #13 from org/feature", 13},
+		{"cccccccccc", "Carol", "Bump version", 0},
+	}
+	if got := parse(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parse() = %+v, want %+v", got, want)
+	}
+}
+
+func TestMarkdown(t *testing.T) {
+	entries := []Entry{
+		{"aaaaaaaaaa", "Alice", "Fix login (#12)", 12},
+		{"bbbbbbbbbb", "Bob", "Bump version", 0},
+	}
+	got := Markdown(entries, "https://github.com/org/app/", 0)
+	want := "- [aaaaaaa](https://github.com/org/app/commit/aaaaaaaaaa) Fix login ([#12](https://github.com/org/app/pull/12)) (Alice)\n" +
+		"- [bbbbbbb](https://github.com/org/app/commit/bbbbbbbbbb) Bump version (Bob)\n"
+	if got != want {
+		t.Errorf("Markdown() = %q, want %q", got, want)
+	}
+	got = Markdown(entries, "", 1)
+	want = "- aaaaaaa Fix login (#12) (Alice)\n- ... and 1 more\n"
+	if got != want {
+		t.Errorf("Markdown() = %q, want %q", got, want)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	dir := t.TempDir()
+	git := func(args ...string) string {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Alice", "-c", "user.email=alice@example.com"}, args...)...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-b", "main")
+	var commits []string
+	for _, msg := range []string{"first", "second (#2)", "third"} {
+		os.WriteFile(filepath.Join(dir, "file"), []byte(msg), 0644)
+		git("add", "file")
+		git("commit", "-m", msg)
+		commits = append(commits, git("rev-parse", "HEAD"))
+	}
+	entries, err := Generate(dir, commits[0], commits[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Entry{{commits[2], "Alice", "third", 0}, {commits[1], "Alice", "second (#2)", 2}}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Generate() = %+v, want %+v", entries, want)
+	}
+	if _, err := Generate(dir, "0000000", commits[2]); err == nil {
+		t.Error("expected error for unknown commit")
+	}
+}
@@ -12,15 +12,132 @@ governing permissions and limitations under the License.
 package commitmsg
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"regexp"
 	"strings"
 )
 
 const begin = "--- gitops targets begin ---"
 const end = "--- gitops targets end ---"
 
-// ExtractTargets extracts list of gitops targets used in a commit
+const metadataBegin = "--- gitops metadata begin ---"
+const metadataEnd = "--- gitops metadata end ---"
+
+// Image is a container image deployed by a gitops commit
+type Image struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Target is a gitops target rendered by a gitops commit
+type Target struct {
+	Label string `json:"label"`
+	// Files are the manifests written by the target, relative to the deployment repository root
+	Files  []string `json:"files,omitempty"`
+	Images []Image  `json:"images,omitempty"`
+}
+
+// Metadata is the machine readable description of a gitops commit
+type Metadata struct {
+	Train        string   `json:"train,omitempty"`
+	SourceBranch string   `json:"source_branch,omitempty"`
+	SourceCommit string   `json:"source_commit,omitempty"`
+	Targets      []Target `json:"targets"`
+	// Files are the files changed by the commit, including files not written by a target
+	Files []string `json:"files,omitempty"`
+	// Images are the images referenced by the changed files
+	Images []Image `json:"images,omitempty"`
+}
+
+// TargetFiles returns the files written by every target of the commit
+func (m *Metadata) TargetFiles() map[string][]string {
+	files := make(map[string][]string)
+	for _, t := range m.Targets {
+		files[t.Label] = t.Files
+	}
+	return files
+}
+
+// FindTargetFiles returns the files written by the target according to the most recent commit message
+// with metadata of the target. messages are ordered from the newest to the oldest commit.
+// found is false if no message describes the target.
+func FindTargetFiles(messages []string, label string) (files []string, found bool) {
+	for _, msg := range messages {
+		m, err := ExtractMetadata(msg)
+		if err != nil || m == nil {
+			continue
+		}
+		if files, ok := m.TargetFiles()[label]; ok {
+			return files, true
+		}
+	}
+	return nil, false
+}
+
+// Labels returns the labels of the metadata targets
+func (m *Metadata) Labels() []string {
+	var labels []string
+	for _, t := range m.Targets {
+		labels = append(labels, t.Label)
+	}
+	return labels
+}
+
+// GenerateMetadata generates the structured part of a commit message.
+// The metadata is embedded as a JSON document between marker lines.
+func GenerateMetadata(m Metadata) (string, error) {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	sb.WriteByte('\n')
+	sb.WriteString(metadataBegin)
+	sb.WriteByte('\n')
+	sb.Write(b)
+	sb.WriteByte('\n')
+	sb.WriteString(metadataEnd)
+	sb.WriteByte('\n')
+	return sb.String(), nil
+}
+
+// ExtractMetadata extracts the structured metadata of a commit message. It returns nil if the message has no metadata.
+func ExtractMetadata(msg string) (*Metadata, error) {
+	var lines []string
+	betweenMarkers, found := false, false
+	for _, s := range strings.Split(msg, "\n") {
+		switch {
+		case s == metadataBegin:
+			betweenMarkers, found = true, true
+		case s == metadataEnd && betweenMarkers:
+			betweenMarkers = false
+		case betweenMarkers:
+			lines = append(lines, s)
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	if betweenMarkers {
+		return nil, fmt.Errorf("unable to find metadata end marker in commit message")
+	}
+	var m Metadata
+	if err := json.Unmarshal([]byte(strings.Join(lines, "\n")), &m); err != nil {
+		return nil, fmt.Errorf("invalid commit metadata: %w", err)
+	}
+	return &m, nil
+}
+
+// ExtractTargets extracts list of gitops targets used in a commit.
+// Targets of the structured metadata are returned if the message has no target list.
 func ExtractTargets(msg string) (packages []string) {
+	if !strings.Contains(msg, begin) {
+		if m, err := ExtractMetadata(msg); err == nil && m != nil {
+			return m.Labels()
+		}
+	}
 	betweenMarkers := false
 	for _, s := range strings.Split(msg, "\n") {
 		switch s {
@@ -40,6 +157,34 @@ func ExtractTargets(msg string) (packages []string) {
 	return
 }
 
+var sourceCommitRe = regexp.MustCompile(`(?m)^GitOps for release branch \S+ from \S+ commit ([0-9a-f]{7,40})$`)
+
+// ExtractSourceCommit extracts the source repository commit a gitops commit was rendered from
+func ExtractSourceCommit(msg string) string {
+	m := sourceCommitRe.FindStringSubmatch(msg)
+	if m == nil {
+		return ""
+	}
+	return m[1]
+}
+
+// Conventional returns a Conventional Commits message "<type>(<scope>): <description>" followed by the body.
+// The scope is omitted if empty.
+func Conventional(typ, scope, description, body string) string {
+	var sb strings.Builder
+	sb.WriteString(typ)
+	if scope != "" {
+		sb.WriteString("(" + scope + ")")
+	}
+	sb.WriteString(": ")
+	sb.WriteString(description)
+	if body = strings.TrimLeft(body, "\n"); body != "" {
+		sb.WriteString("\n\n")
+		sb.WriteString(body)
+	}
+	return sb.String()
+}
+
 // Generate generates a commit message from a list of targets
 func Generate(targets []string) string {
 	var sb strings.Builder
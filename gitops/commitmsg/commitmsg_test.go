@@ -28,6 +28,105 @@ func TestRoundtrip(t *testing.T) {
 	}
 }
 
+func TestMetadataRoundtrip(t *testing.T) {
+	m := commitmsg.Metadata{
+		Train:        "prod",
+		SourceBranch: "main",
+		SourceCommit: "0a1b2c3d",
+		Targets: []commitmsg.Target{
+			{Label: "//app:gitops", Files: []string{"cloud/prod/app.yaml"}, Images: []commitmsg.Image{{Name: "gcr.io/app", Digest: "sha256:1111"}}},
+			{Label: "//db:gitops"},
+		},
+	}
+	md, err := commitmsg.GenerateMetadata(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := "GitOps for release branch master from main commit 0a1b2c3d\n" + md
+	got, err := commitmsg.ExtractMetadata(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&m, got) {
+		t.Errorf("Unexpected metadata after parsing: %+v", got)
+	}
+	if targets := commitmsg.ExtractTargets(msg); !reflect.DeepEqual(targets, []string{"//app:gitops", "//db:gitops"}) {
+		t.Errorf("Unexpected targets from metadata: %v", targets)
+	}
+	if targets := commitmsg.ExtractTargets(msg + commitmsg.Generate([]string{"target1"})); !reflect.DeepEqual(targets, []string{"target1"}) {
+		t.Errorf("Unexpected targets with both formats: %v", targets)
+	}
+}
+
+func TestFindTargetFiles(t *testing.T) {
+	generate := func(m commitmsg.Metadata) string {
+		md, err := commitmsg.GenerateMetadata(m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "GitOps for release branch master from main commit 0a1b2c3d\n" + md
+	}
+	messages := []string{
+		generate(commitmsg.Metadata{Targets: []commitmsg.Target{{Label: "//app:gitops", Files: []string{"cloud/app-v2.yaml"}}}}),
+		"manual change without metadata",
+		generate(commitmsg.Metadata{Targets: []commitmsg.Target{
+			{Label: "//app:gitops", Files: []string{"cloud/app.yaml"}},
+			{Label: "//db:gitops", Files: []string{"cloud/db.yaml"}},
+		}}),
+	}
+	for label, want := range map[string][]string{
+		"//app:gitops": {"cloud/app-v2.yaml"},
+		"//db:gitops":  {"cloud/db.yaml"},
+	} {
+		files, found := commitmsg.FindTargetFiles(messages, label)
+		if !found || !reflect.DeepEqual(files, want) {
+			t.Errorf("FindTargetFiles(%s) = %v, %v, want %v", label, files, found, want)
+		}
+	}
+	if _, found := commitmsg.FindTargetFiles(messages, "//other:gitops"); found {
+		t.Error("FindTargetFiles() found unknown target")
+	}
+}
+
+func TestExtractMetadataMissing(t *testing.T) {
+	if m, err := commitmsg.ExtractMetadata(commitmsg.Generate([]string{"target1"})); m != nil || err != nil {
+		t.Errorf("ExtractMetadata() = %v, %v, want nil", m, err)
+	}
+	if _, err := commitmsg.ExtractMetadata("--- gitops metadata begin ---\n{\n"); err == nil {
+		t.Error("ExtractMetadata() of unterminated metadata succeeded")
+	}
+}
+
+func TestExtractSourceCommit(t *testing.T) {
+	for msg, want := range map[string]string{
+		"GitOps for release branch master from feature/x commit 0a1b2c3d\n" + commitmsg.Generate([]string{"target1"}): "0a1b2c3d",
+		"GitOps for release branch master from feature/x commit unknown\n":                                            "",
+		"Merge pull request #1 from org/deploy/prod\n\nGitOps for release branch master from main commit abcdef0\n":   "abcdef0",
+	} {
+		if got := commitmsg.ExtractSourceCommit(msg); got != want {
+			t.Errorf("ExtractSourceCommit(%q) = %q, want %q", msg, got, want)
+		}
+	}
+}
+
+func TestConventional(t *testing.T) {
+	for _, tc := range []struct {
+		typ, scope, description, body string
+		want                          string
+	}{
+		{"deploy", "prod", "update 2 services", "GitOps for release branch master\n", "deploy(prod): update 2 services\n\nGitOps for release branch master\n"},
+		{"chore", "", "update 1 service", "", "chore: update 1 service"},
+	} {
+		if got := commitmsg.Conventional(tc.typ, tc.scope, tc.description, tc.body); got != tc.want {
+			t.Errorf("Conventional() = %q, want %q", got, tc.want)
+		}
+	}
+	msg := commitmsg.Conventional("deploy", "prod", "update 1 service", "GitOps for release branch master from main commit abcdef0\n")
+	if got := commitmsg.ExtractSourceCommit(msg); got != "abcdef0" {
+		t.Errorf("ExtractSourceCommit() of conventional message = %q", got)
+	}
+}
+
 func ExampleGenerate() {
 	targets := []string{"target1", "target2"}
 	msg := commitmsg.Generate(targets)
@@ -12,20 +12,75 @@ governing permissions and limitations under the License.
 package exec
 
 import (
+	"bufio"
 	"log"
+	"os"
 	"os/exec"
+	"path"
 	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/redact"
 )
 
+// Command returns the command executing name without a shell. On Windows, where scripts are
+// not executable, a script starting with a #! line runs with the interpreter of the line found in PATH.
+func Command(name string, arg ...string) *exec.Cmd {
+	return command(name, arg...)
+}
+
+// Find returns the executable file of path: path if it is a regular file, otherwise on Windows
+// path with the first suffix of an existing file, e.g. .exe of binaries built by Bazel
+func Find(path string) (string, bool) {
+	for _, p := range append([]string{path}, suffixed(path)...) {
+		if fi, err := os.Stat(p); err == nil && fi.Mode().IsRegular() {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// suffixed returns path with every executable suffix of the platform
+func suffixed(path string) []string {
+	var paths []string
+	for _, s := range suffixes {
+		paths = append(paths, path+s)
+	}
+	return paths
+}
+
+// interpreter returns the program and arguments of the #! line of the script, without directories,
+// so they are found in PATH. It returns an empty program if the file is not a script.
+func interpreter(script string) (string, []string) {
+	f, err := os.Open(script)
+	if err != nil {
+		return "", nil
+	}
+	defer f.Close()
+	line, _ := bufio.NewReader(f).ReadString('\n')
+	if !strings.HasPrefix(line, "#!") {
+		return "", nil
+	}
+	fields := strings.Fields(line[2:])
+	if len(fields) == 0 {
+		return "", nil
+	}
+	program, args := path.Base(fields[0]), fields[1:]
+	// #!/usr/bin/env bash runs bash
+	if program == "env" && len(args) > 0 {
+		program, args = path.Base(args[0]), args[1:]
+	}
+	return program, args
+}
+
 // Ex is a shortcut for executing the command in specified dir
 func Ex(dir, name string, arg ...string) (output string, err error) {
-	log.Println("executing:", name, strings.Join(arg, " "))
-	cmd := exec.Command(name, arg...)
+	log.Println("executing:", name, redact.String(strings.Join(arg, " ")))
+	cmd := Command(name, arg...)
 	if dir != "" {
 		cmd.Dir = dir
 	}
 	b, err := cmd.CombinedOutput()
-	log.Printf("%s", string(b))
+	log.Printf("%s", redact.String(string(b)))
 	return string(b), err
 }
 
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package exec
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestInterpreter(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		content string
+		program string
+		args    []string
+	}{
+		{"#!/bin/bash -e\necho\n", "bash", []string{"-e"}},
+		{"#!/usr/bin/env python3\nprint()\n", "python3", []string{}},
+		{"#!\n", "", nil},
+		{"\x7fELF", "", nil},
+	} {
+		script := filepath.Join(dir, "script")
+		if err := os.WriteFile(script, []byte(tc.content), 0755); err != nil {
+			t.Fatal(err)
+		}
+		program, args := interpreter(script)
+		if program != tc.program || (len(args) > 0 || len(tc.args) > 0) && !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("interpreter(%q) = %q %q, want %q %q", tc.content, program, args, tc.program, tc.args)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "push")
+	if _, ok := Find(bin); ok {
+		t.Errorf("Find() found the missing %s", bin)
+	}
+	file := bin
+	if runtime.GOOS == "windows" {
+		file = bin + ".exe"
+	}
+	if err := os.WriteFile(file, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := Find(bin); !ok || got != file {
+		t.Errorf("Find(%s) = %s, %v, want %s", bin, got, ok, file)
+	}
+	if _, ok := Find(dir); ok {
+		t.Errorf("Find() found the directory %s", dir)
+	}
+}
@@ -0,0 +1,42 @@
+//go:build windows
+
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package exec
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// suffixes of executable files
+var suffixes = []string{".exe", ".bat", ".cmd"}
+
+func command(name string, arg ...string) *exec.Cmd {
+	if file, ok := Find(name); ok && !hasSuffix(file) {
+		if program, args := interpreter(file); program != "" {
+			return exec.Command(program, append(append(args, file), arg...)...)
+		}
+	}
+	return exec.Command(name, arg...)
+}
+
+// hasSuffix reports whether the file has an executable suffix
+func hasSuffix(file string) bool {
+	for _, s := range suffixes {
+		if strings.HasSuffix(strings.ToLower(file), s) {
+			return true
+		}
+	}
+	return false
+}
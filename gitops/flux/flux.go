@@ -0,0 +1,67 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package flux generates Flux sync objects for release trains.
+package flux
+
+import (
+	"regexp"
+	"strings"
+	"text/template"
+)
+
+// Kustomization describes a Flux Kustomization syncing a release train
+type Kustomization struct {
+	Name      string
+	Namespace string
+	// Path is the directory in the source repository containing the release train manifests
+	Path string
+	// Source is the name of the Flux GitRepository the manifests are read from
+	Source   string
+	Interval string
+	Prune    bool
+}
+
+var kustomizationTemplate = template.Must(template.New("kustomization").Parse(`apiVersion: kustomize.toolkit.fluxcd.io/v1
+kind: Kustomization
+metadata:
+  name: {{.Name}}
+  namespace: {{.Namespace}}
+spec:
+  interval: {{.Interval}}
+  path: {{.Path}}
+  prune: {{.Prune}}
+  sourceRef:
+    kind: GitRepository
+    name: {{.Source}}
+`))
+
+// Generate renders the Kustomization manifest
+func (k Kustomization) Generate() ([]byte, error) {
+	var sb strings.Builder
+	if err := kustomizationTemplate.Execute(&sb, k); err != nil {
+		return nil, err
+	}
+	return []byte(sb.String()), nil
+}
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// ObjectName converts a release train name into a valid kubernetes object name
+func ObjectName(train string) string {
+	name := invalidNameChars.ReplaceAllString(strings.ToLower(train), "-")
+	name = strings.Trim(name, "-")
+	if len(name) > 63 {
+		name = strings.TrimRight(name[:63], "-")
+	}
+	return name
+}
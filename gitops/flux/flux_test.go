@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package flux_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/flux"
+)
+
+func TestObjectName(t *testing.T) {
+	for train, want := range map[string]string{
+		"monitoring-prod":     "monitoring-prod",
+		"Team/Prod_US.east":   "team-prod-us-east",
+		"-leading/trailing-/": "leading-trailing",
+	} {
+		if got := flux.ObjectName(train); got != want {
+			t.Errorf("ObjectName(%q) = %q, want %q", train, got, want)
+		}
+	}
+}
+
+func ExampleKustomization_Generate() {
+	k := flux.Kustomization{
+		Name:      flux.ObjectName("monitoring-prod"),
+		Namespace: "flux-system",
+		Path:      "./cloud/monitoring-prod",
+		Source:    "flux-system",
+		Interval:  "5m",
+		Prune:     true,
+	}
+	b, _ := k.Generate()
+	fmt.Print(string(b))
+	// Output:
+	// apiVersion: kustomize.toolkit.fluxcd.io/v1
+	// kind: Kustomization
+	// metadata:
+	//   name: monitoring-prod
+	//   namespace: flux-system
+	// spec:
+	//   interval: 5m
+	//   path: ./cloud/monitoring-prod
+	//   prune: true
+	//   sourceRef:
+	//     kind: GitRepository
+	//     name: flux-system
+}
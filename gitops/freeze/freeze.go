@@ -0,0 +1,148 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package freeze evaluates deployment freeze windows.
+//
+// Two window formats are supported:
+//
+//	2026-12-20T00:00:00Z/2027-01-04T08:00:00Z   absolute interval (RFC 3339)
+//	Fri 18:00/Mon 08:00                          weekly recurring interval
+//
+// Weekly intervals are evaluated in the configured location.
+package freeze
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Window is a period of time when deployments are frozen
+type Window interface {
+	Contains(t time.Time) bool
+	String() string
+}
+
+type absolute struct {
+	start, end time.Time
+}
+
+func (w absolute) Contains(t time.Time) bool {
+	return !t.Before(w.start) && t.Before(w.end)
+}
+
+func (w absolute) String() string {
+	return w.start.Format(time.RFC3339) + "/" + w.end.Format(time.RFC3339)
+}
+
+type weekly struct {
+	// start and end are offsets from the beginning of the week (Sunday 00:00)
+	start, end time.Duration
+	loc        *time.Location
+	text       string
+}
+
+const week = 7 * 24 * time.Hour
+
+func (w weekly) Contains(t time.Time) bool {
+	t = t.In(w.loc)
+	offset := time.Duration(t.Weekday())*24*time.Hour + time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+	// window wraps around the end of the week
+	return offset >= w.start || offset < w.end
+}
+
+func (w weekly) String() string {
+	return w.text
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+func parseWeekOffset(s string) (time.Duration, error) {
+	day, hm, found := strings.Cut(strings.TrimSpace(s), " ")
+	if !found {
+		return 0, fmt.Errorf("expected \"<weekday> <HH:MM>\", got %q", s)
+	}
+	wd, ok := weekdays[strings.ToLower(day)[:min(3, len(day))]]
+	if !ok {
+		return 0, fmt.Errorf("unknown weekday %q", day)
+	}
+	t, err := time.Parse("15:04", strings.TrimSpace(hm))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %w", hm, err)
+	}
+	return time.Duration(wd)*24*time.Hour + time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseWindow parses a freeze window
+func ParseWindow(s string, loc *time.Location) (Window, error) {
+	from, to, found := strings.Cut(s, "/")
+	if !found {
+		return nil, fmt.Errorf("invalid freeze window %q: expected <start>/<end>", s)
+	}
+	if start, err := time.Parse(time.RFC3339, strings.TrimSpace(from)); err == nil {
+		end, err := time.Parse(time.RFC3339, strings.TrimSpace(to))
+		if err != nil {
+			return nil, fmt.Errorf("invalid freeze window %q: %w", s, err)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("invalid freeze window %q: end is before start", s)
+		}
+		return absolute{start, end}, nil
+	}
+	start, err := parseWeekOffset(from)
+	if err != nil {
+		return nil, fmt.Errorf("invalid freeze window %q: %w", s, err)
+	}
+	end, err := parseWeekOffset(to)
+	if err != nil {
+		return nil, fmt.Errorf("invalid freeze window %q: %w", s, err)
+	}
+	if start == end {
+		return nil, fmt.Errorf("invalid freeze window %q: empty window", s)
+	}
+	return weekly{start: start, end: end % week, loc: loc, text: strings.TrimSpace(s)}, nil
+}
+
+// ParseFile parses a freeze file. Every non-empty line not starting with # is a freeze window.
+// A file without any windows declares a freeze until it is removed.
+func ParseFile(content string, loc *time.Location) (windows []Window, indefinite bool, err error) {
+	s := bufio.NewScanner(strings.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		w, err := ParseWindow(line, loc)
+		if err != nil {
+			return nil, false, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, len(windows) == 0, s.Err()
+}
+
+// Active returns the first window containing t
+func Active(windows []Window, t time.Time) (Window, bool) {
+	for _, w := range windows {
+		if w.Contains(t) {
+			return w, true
+		}
+	}
+	return nil, false
+}
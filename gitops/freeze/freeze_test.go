@@ -0,0 +1,76 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package freeze
+
+import (
+	"testing"
+	"time"
+)
+
+func mustTime(s string) time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestWindows(t *testing.T) {
+	tests := []struct {
+		window string
+		at     string
+		want   bool
+	}{
+		{"2026-12-20T00:00:00Z/2027-01-04T08:00:00Z", "2026-12-25T12:00:00Z", true},
+		{"2026-12-20T00:00:00Z/2027-01-04T08:00:00Z", "2027-01-04T08:00:00Z", false},
+		// 2026-10-16 is a Friday
+		{"Fri 18:00/Mon 08:00", "2026-10-16T17:59:00Z", false},
+		{"Fri 18:00/Mon 08:00", "2026-10-16T18:00:00Z", true},
+		{"Fri 18:00/Mon 08:00", "2026-10-18T12:00:00Z", true},
+		{"Fri 18:00/Mon 08:00", "2026-10-19T08:00:00Z", false},
+		{"Wed 10:00/Wed 12:00", "2026-10-14T11:00:00Z", true},
+		{"Wed 10:00/Wed 12:00", "2026-10-15T11:00:00Z", false},
+	}
+	for _, tt := range tests {
+		w, err := ParseWindow(tt.window, time.UTC)
+		if err != nil {
+			t.Fatalf("ParseWindow(%q): %v", tt.window, err)
+		}
+		if got := w.Contains(mustTime(tt.at)); got != tt.want {
+			t.Errorf("%q.Contains(%s) = %v, want %v", tt.window, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestParseWindowErrors(t *testing.T) {
+	for _, s := range []string{"tomorrow", "Fri 18:00", "Foo 18:00/Mon 08:00", "2027-01-04T08:00:00Z/2026-12-20T00:00:00Z"} {
+		if _, err := ParseWindow(s, time.UTC); err == nil {
+			t.Errorf("ParseWindow(%q) expected error", s)
+		}
+	}
+}
+
+func TestParseFile(t *testing.T) {
+	windows, indefinite, err := ParseFile("# holidays\n2026-12-20T00:00:00Z/2027-01-04T08:00:00Z\n\nFri 18:00/Mon 08:00\n", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if indefinite || len(windows) != 2 {
+		t.Fatalf("ParseFile() = %v, %v", windows, indefinite)
+	}
+	if w, ok := Active(windows, mustTime("2026-10-17T00:00:00Z")); !ok || w.String() != "Fri 18:00/Mon 08:00" {
+		t.Errorf("Active() = %v, %v", w, ok)
+	}
+	if _, indefinite, _ := ParseFile("# incident 1234, ask #sre before removing\n", time.UTC); !indefinite {
+		t.Error("expected indefinite freeze for file without windows")
+	}
+}
@@ -0,0 +1,412 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+// Package azuredevops creates pull requests with the REST API of Azure DevOps Repos.
+// Requests authenticate with a personal access token, or with a Microsoft Entra ID access token
+// of a workload identity federated with the OIDC token of the CI job.
+package azuredevops
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+var (
+	serverURL = flag.String("azuredevops_url", "https://dev.azure.com", "base URL of Azure DevOps Services, or of the collections of an Azure DevOps Server")
+	org       = flag.String("azuredevops_org", "", "the Azure DevOps organization, or the collection of an Azure DevOps Server")
+	project   = flag.String("azuredevops_project", "", "the Azure DevOps project of the gitops repository")
+	repo      = flag.String("azuredevops_repo", "", "the name or ID of the gitops repository")
+	pat       = flag.String("azuredevops_pat", os.Getenv("AZURE_DEVOPS_EXT_PAT"), "the personal access token to authenticate requests, with the Code (Read & write) scope")
+	tenantID  = flag.String("azuredevops_tenant_id", "", "the Microsoft Entra ID tenant of azuredevops_client_id")
+	clientID  = flag.String("azuredevops_client_id", "", "the client ID of the Microsoft Entra ID application or managed identity federated with the OIDC token of the Buildkite or GitHub Actions job, used instead of azuredevops_pat")
+	loginURL  = flag.String("azuredevops_login_url", "https://login.microsoftonline.com", "base URL of the Microsoft Entra ID token endpoint, e.g. of a national cloud")
+)
+
+var (
+	// tokenMu guards the cached Entra ID access token
+	tokenMu     sync.Mutex
+	accessToken string
+	tokenExpiry time.Time
+)
+
+const (
+	apiVersion = "7.1"
+	// pageSize is the number of pull requests requested per page
+	pageSize = 100
+	// headsPrefix is the ref prefix of branches
+	headsPrefix = "refs/heads/"
+	// audience is the audience of the OIDC tokens exchanged with Entra ID
+	audience = "api://AzureADTokenExchange"
+	// scope requests access tokens of the Azure DevOps resource
+	scope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+	// expiryMargin renews access tokens before they expire during a request
+	expiryMargin = time.Minute
+)
+
+type pullRequest struct {
+	PullRequestID int    `json:"pullRequestId"`
+	Description   string `json:"description"`
+	SourceRefName string `json:"sourceRefName"`
+	TargetRefName string `json:"targetRefName"`
+}
+
+func (pr pullRequest) toPR() *git.PR {
+	branch := strings.TrimPrefix(pr.SourceRefName, headsPrefix)
+	return &git.PR{Number: pr.PullRequestID, URL: webURL(pr.PullRequestID), Body: pr.Description, Branch: branch}
+}
+
+// Validate reports all missing or invalid flags of the provider without contacting Azure DevOps
+func Validate() error {
+	var errs []error
+	if u, err := url.Parse(*serverURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("azuredevops_url %q must be an absolute URL", *serverURL))
+	}
+	required := []struct{ name, value string }{
+		{"azuredevops_org", *org},
+		{"azuredevops_project", *project},
+		{"azuredevops_repo", *repo},
+	}
+	if *clientID == "" {
+		required = append(required, struct{ name, value string }{"azuredevops_pat", *pat})
+	} else {
+		required = append(required, struct{ name, value string }{"azuredevops_tenant_id", *tenantID})
+		if u, err := url.Parse(*loginURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("azuredevops_login_url %q must be an absolute URL", *loginURL))
+		}
+	}
+	for _, f := range required {
+		if f.value == "" {
+			errs = append(errs, fmt.Errorf("%s must be set", f.name))
+		}
+	}
+	redact.Add(*pat)
+	return errors.Join(errs...)
+}
+
+// Check verifies that the token has access to the repository
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	if err := call(ctx, "GET", apiURL(""), nil, nil); err != nil {
+		return fmt.Errorf("unable to get repository %s/%s: %w", *project, *repo, err)
+	}
+	return nil
+}
+
+// CreatePR creates a pull request using branch names from and to
+func CreatePR(from, to, title, body string) error {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// CreatePRWithPolicy creates the pull request, or reuses the active one, and enforces the policy.
+// Reviewers are identity IDs or unique names of users and groups; team reviewers are added as required reviewers.
+// Assignees are not supported.
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	if owner, _ := git.SplitHead(from); owner != "" {
+		return fmt.Errorf("azuredevops does not support pull requests from forks: %s", from)
+	}
+	if len(policy.Assignees) > 0 {
+		return fmt.Errorf("azuredevops does not support assignees, unable to enforce %+v", policy)
+	}
+	in := map[string]string{"sourceRefName": headsPrefix + from, "targetRefName": headsPrefix + to, "title": title, "description": body}
+	var pr pullRequest
+	err := call(context.Background(), "POST", apiURL("/pullrequests"), in, &pr)
+	var se *git.StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusConflict {
+		log.Printf("reusing existing PR from %s", from)
+		found, err := FindOpenPR(from, to)
+		if err != nil || found == nil {
+			return err
+		}
+		return applyPolicy(found.Number, policy)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create PR from %s: %w", from, err)
+	}
+	log.Printf("PR %s was created", webURL(pr.PullRequestID))
+	return applyPolicy(pr.PullRequestID, policy)
+}
+
+// FindOpenPR returns the active pull request from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	if owner, _ := git.SplitHead(from); owner != "" {
+		return nil, nil
+	}
+	prs, err := listActive(url.Values{"searchCriteria.sourceRefName": {headsPrefix + from}, "searchCriteria.targetRefName": {headsPrefix + to}})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find PR from %s: %w", from, err)
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+	return prs[0], nil
+}
+
+// ListOpenPRs returns the active pull requests into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	prs, err := listActive(url.Values{"searchCriteria.targetRefName": {headsPrefix + to}})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list PRs into %s: %w", to, err)
+	}
+	var matching []*git.PR
+	for _, pr := range prs {
+		if strings.HasPrefix(pr.Branch, prefix) {
+			matching = append(matching, pr)
+		}
+	}
+	return matching, nil
+}
+
+// listActive returns all active pull requests matching the search criteria
+func listActive(q url.Values) ([]*git.PR, error) {
+	if err := Validate(); err != nil {
+		return nil, err
+	}
+	q.Set("searchCriteria.status", "active")
+	q.Set("$top", strconv.Itoa(pageSize))
+	var prs []*git.PR
+	for skip := 0; ; skip += pageSize {
+		q.Set("$skip", strconv.Itoa(skip))
+		var page struct {
+			Value []pullRequest `json:"value"`
+		}
+		if err := call(context.Background(), "GET", apiURL("/pullrequests?"+q.Encode()), nil, &page); err != nil {
+			return nil, err
+		}
+		for _, pr := range page.Value {
+			prs = append(prs, pr.toPR())
+		}
+		if len(page.Value) < pageSize {
+			return prs, nil
+		}
+	}
+}
+
+// UpdateOpenPR replaces the title and the description of the active pull request and enforces the policy
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	if len(policy.Assignees) > 0 {
+		return fmt.Errorf("azuredevops does not support assignees, unable to enforce %+v", policy)
+	}
+	if err := call(context.Background(), "PATCH", apiURL(fmt.Sprintf("/pullrequests/%d", pr.Number)), map[string]string{"title": title, "description": body}, nil); err != nil {
+		return fmt.Errorf("unable to update PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Updated PR %d", pr.Number)
+	return applyPolicy(pr.Number, policy)
+}
+
+// CommentOpenPR adds the comment to the active pull request in an active thread
+func CommentOpenPR(pr *git.PR, comment string) error {
+	return postThread(pr, comment, "active")
+}
+
+// CloseOpenPR comments on the active pull request and abandons it
+func CloseOpenPR(pr *git.PR, comment string) error {
+	if err := postThread(pr, comment, "closed"); err != nil {
+		return err
+	}
+	if err := call(context.Background(), "PATCH", apiURL(fmt.Sprintf("/pullrequests/%d", pr.Number)), map[string]string{"status": "abandoned"}, nil); err != nil {
+		return fmt.Errorf("unable to abandon PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Abandoned PR %d", pr.Number)
+	return nil
+}
+
+// postThread adds the comment to the pull request in a thread of the status
+func postThread(pr *git.PR, comment, status string) error {
+	thread := map[string]interface{}{
+		"comments": []map[string]interface{}{{"content": comment, "commentType": 1}},
+		"status":   status,
+	}
+	if err := call(context.Background(), "POST", apiURL(fmt.Sprintf("/pullrequests/%d/threads", pr.Number)), thread, nil); err != nil {
+		return fmt.Errorf("unable to comment on PR %d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+// DefaultBranch returns the default branch of the repository
+func DefaultBranch() (string, error) {
+	if err := Validate(); err != nil {
+		return "", err
+	}
+	var r struct {
+		DefaultBranch string `json:"defaultBranch"`
+	}
+	if err := call(context.Background(), "GET", apiURL(""), nil, &r); err != nil {
+		return "", fmt.Errorf("unable to get the default branch: %w", err)
+	}
+	if r.DefaultBranch == "" {
+		return "", errors.New("the repository has no default branch")
+	}
+	return strings.TrimPrefix(r.DefaultBranch, headsPrefix), nil
+}
+
+// applyPolicy adds the reviewers and the labels of the policy and sets the pull request
+// to complete automatically once the branch policies pass if auto-merge is enabled
+func applyPolicy(number int, policy git.ReviewPolicy) error {
+	var reviewers []map[string]interface{}
+	for _, r := range policy.Reviewers {
+		reviewers = append(reviewers, map[string]interface{}{"id": r})
+	}
+	for _, r := range policy.TeamReviewers {
+		reviewers = append(reviewers, map[string]interface{}{"id": r, "isRequired": true})
+	}
+	if len(reviewers) > 0 {
+		if err := call(context.Background(), "POST", apiURL(fmt.Sprintf("/pullrequests/%d/reviewers", number)), reviewers, nil); err != nil {
+			return fmt.Errorf("unable to add reviewers to PR %d: %w", number, err)
+		}
+	}
+	for _, l := range policy.Labels {
+		if err := call(context.Background(), "POST", apiURL(fmt.Sprintf("/pullrequests/%d/labels", number)), map[string]string{"name": l}, nil); err != nil {
+			return fmt.Errorf("unable to label PR %d: %w", number, err)
+		}
+	}
+	if policy.AutoMerge {
+		var me struct {
+			AuthenticatedUser struct {
+				ID string `json:"id"`
+			} `json:"authenticatedUser"`
+		}
+		if err := call(context.Background(), "GET", orgURL("/_apis/connectionData"), nil, &me); err != nil {
+			return fmt.Errorf("unable to get the authenticated user: %w", err)
+		}
+		autoComplete := map[string]interface{}{"autoCompleteSetBy": map[string]string{"id": me.AuthenticatedUser.ID}}
+		if err := call(context.Background(), "PATCH", apiURL(fmt.Sprintf("/pullrequests/%d", number)), autoComplete, nil); err != nil {
+			return fmt.Errorf("unable to enable auto-complete of PR %d: %w", number, err)
+		}
+	}
+	return nil
+}
+
+// orgURL returns the URL of the path of the organization
+func orgURL(path string) string {
+	return strings.TrimSuffix(*serverURL, "/") + "/" + url.PathEscape(*org) + path
+}
+
+// apiURL returns the API URL of the path of the repository
+func apiURL(path string) string {
+	u := orgURL("/" + url.PathEscape(*project) + "/_apis/git/repositories/" + url.PathEscape(*repo) + path)
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return u + sep + "api-version=" + apiVersion
+}
+
+// webURL returns the URL of the pull request page
+func webURL(number int) string {
+	return orgURL(fmt.Sprintf("/%s/_git/%s/pullrequest/%d", url.PathEscape(*project), url.PathEscape(*repo), number))
+}
+
+// call sends the JSON request to the Azure DevOps API and decodes the response into out if it is not nil
+func call(ctx context.Context, method, endpoint string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *clientID != "" {
+		token, err := federatedToken(ctx)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.SetBasicAuth("", *pat)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &git.StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("azure devops responded with %s", resp.Status)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// federatedToken returns the Entra ID access token of azuredevops_client_id, exchanging the OIDC token
+// of the CI job as the client assertion. The token is cached until shortly before it expires.
+func federatedToken(ctx context.Context) (string, error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+	if accessToken != "" && time.Now().Add(expiryMargin).Before(tokenExpiry) {
+		return accessToken, nil
+	}
+	assertion, err := git.CIToken(ctx, audience)
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":            {"client_credentials"},
+		"client_id":             {*clientID},
+		"scope":                 {scope},
+		"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		"client_assertion":      {assertion},
+	}
+	endpoint := strings.TrimSuffix(*loginURL, "/") + "/" + url.PathEscape(*tenantID) + "/oauth2/v2.0/token"
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", &git.StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("unable to exchange the OIDC token: entra id responded with %s", resp.Status)}
+	}
+	var r struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	if r.AccessToken == "" {
+		return "", errors.New("entra id returned an empty access token")
+	}
+	redact.Add(r.AccessToken)
+	accessToken, tokenExpiry = r.AccessToken, time.Now().Add(time.Duration(r.ExpiresIn)*time.Second)
+	return accessToken, nil
+}
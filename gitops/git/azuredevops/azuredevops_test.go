@@ -0,0 +1,187 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package azuredevops
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+const reposPath = "/contoso/deploy/_apis/git/repositories/gitops"
+
+// fakeAzureDevOps serves the pull request endpoints of the contoso/deploy/gitops repository
+func fakeAzureDevOps(t *testing.T, requests *[]string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/contoso/_apis/connectionData", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"authenticatedUser": {"id": "bot-id"}}`))
+	})
+	mux.HandleFunc(reposPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"defaultBranch": "refs/heads/main"}`))
+	})
+	mux.HandleFunc(reposPath+"/pullrequests", func(w http.ResponseWriter, r *http.Request) {
+		if _, pass, _ := r.BasicAuth(); pass != "secret" || r.URL.Query().Get("api-version") != apiVersion {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		if r.Method == "GET" {
+			q := r.URL.Query()
+			if q.Get("searchCriteria.status") != "active" || q.Get("$skip") != "0" {
+				w.Write([]byte(`{"value": []}`))
+				return
+			}
+			prs := []pullRequest{
+				{PullRequestID: 7, SourceRefName: "refs/heads/deploy/app", TargetRefName: "refs/heads/main"},
+				{PullRequestID: 8, SourceRefName: "refs/heads/feature", TargetRefName: "refs/heads/main"},
+			}
+			if src := q.Get("searchCriteria.sourceRefName"); src != "" {
+				prs = prs[:1]
+				if src != prs[0].SourceRefName {
+					prs = nil
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": prs})
+			return
+		}
+		var pr map[string]string
+		json.NewDecoder(r.Body).Decode(&pr)
+		if pr["sourceRefName"] == "refs/heads/deploy/app" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"pullRequestId": 9}`))
+	})
+	mux.HandleFunc(reposPath+"/", func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.Method+" "+strings.TrimPrefix(r.URL.Path, reposPath))
+		w.Write([]byte(`{}`))
+	})
+	ts := httptest.NewServer(mux)
+	*serverURL, *org, *project, *repo, *pat = ts.URL, "contoso", "deploy", "gitops", "secret"
+	return ts
+}
+
+func TestCreatePRWithPolicy(t *testing.T) {
+	var requests []string
+	ts := fakeAzureDevOps(t, &requests)
+	defer ts.Close()
+
+	policy := git.ReviewPolicy{Reviewers: []string{"alice-id"}, Labels: []string{"gitops"}, AutoMerge: true}
+	if err := CreatePRWithPolicy("deploy/web", "main", "title", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreatePRWithPolicy("deploy/app", "main", "title", "body", git.ReviewPolicy{TeamReviewers: []string{"sre-id"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"POST /pullrequests/9/reviewers", "POST /pullrequests/9/labels", "PATCH /pullrequests/9", "POST /pullrequests/7/reviewers"}
+	if strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+	if err := CreatePRWithPolicy("deploybot:deploy/web", "main", "title", "body", git.ReviewPolicy{}); err == nil {
+		t.Error("expected fork heads to be rejected")
+	}
+}
+
+func TestOpenPRs(t *testing.T) {
+	var requests []string
+	ts := fakeAzureDevOps(t, &requests)
+	defer ts.Close()
+
+	prs, err := ListOpenPRs("deploy/", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 1 || prs[0].Number != 7 || prs[0].Branch != "deploy/app" {
+		t.Errorf("ListOpenPRs() = %+v", prs)
+	}
+	pr, err := FindOpenPR("deploy/app", "main")
+	if err != nil || pr == nil || pr.URL != ts.URL+"/contoso/deploy/_git/gitops/pullrequest/7" {
+		t.Errorf("FindOpenPR() = %+v, %v", pr, err)
+	}
+	if pr, err := FindOpenPR("deploy/web", "main"); err != nil || pr != nil {
+		t.Errorf("FindOpenPR() of a branch without PR = %+v, %v", pr, err)
+	}
+	if err := CloseOpenPR(prs[0], "retired"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(requests, ",") != "POST /pullrequests/7/threads,PATCH /pullrequests/7" {
+		t.Errorf("requests = %v", requests)
+	}
+	if branch, err := DefaultBranch(); err != nil || branch != "main" {
+		t.Errorf("DefaultBranch() = %q, %v", branch, err)
+	}
+	if err := Check(context.Background()); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	*serverURL, *org, *project, *repo, *pat = "dev.azure.com", "contoso", "", "gitops", ""
+	err := Validate()
+	for _, want := range []string{"azuredevops_url", "azuredevops_project", "azuredevops_pat"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want %s", err, want)
+		}
+	}
+}
+
+func TestFederatedToken(t *testing.T) {
+	gha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"value": "gha-jwt"}`))
+	}))
+	defer gha.Close()
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", gha.URL)
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+	logins := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/tenant-id/oauth2/v2.0/token", func(w http.ResponseWriter, r *http.Request) {
+		logins++
+		r.ParseForm()
+		if r.Form.Get("client_id") != "client-id" || r.Form.Get("client_assertion") != "gha-jwt" || r.Form.Get("scope") != scope {
+			t.Errorf("unexpected token request %v", r.Form)
+		}
+		w.Write([]byte(`{"access_token": "entra-token", "expires_in": 3600}`))
+	})
+	mux.HandleFunc(reposPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer entra-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"defaultBranch": "refs/heads/main"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	*serverURL, *org, *project, *repo, *pat = ts.URL, "contoso", "deploy", "gitops", ""
+	*tenantID, *clientID, *loginURL = "tenant-id", "client-id", ts.URL
+	defer func() {
+		*tenantID, *clientID, accessToken = "", "", ""
+	}()
+
+	for i := 0; i < 2; i++ {
+		if branch, err := DefaultBranch(); err != nil || branch != "main" {
+			t.Errorf("DefaultBranch() = %q, %v", branch, err)
+		}
+	}
+	if logins != 1 {
+		t.Errorf("%d token requests, want the access token to be cached", logins)
+	}
+
+	*tenantID = ""
+	if err := Validate(); err == nil || !strings.Contains(err.Error(), "azuredevops_tenant_id") || strings.Contains(err.Error(), "azuredevops_pat") {
+		t.Errorf("Validate() = %v, want azuredevops_tenant_id", err)
+	}
+}
@@ -13,13 +13,22 @@ package bitbucket
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/redact"
 )
 
 var (
@@ -62,12 +71,89 @@ type pullrequest struct {
 	Reviewers   []account            `json:"reviewers,omitempty"`
 }
 
+// openPullrequest is a pull request listed or updated with the Bitbucket API
+type openPullrequest struct {
+	ID          int       `json:"id,omitempty"`
+	Version     int       `json:"version"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Reviewers   []account `json:"reviewers,omitempty"`
+	FromRef     *struct {
+		ID         string     `json:"id"`
+		Repository repository `json:"repository"`
+	} `json:"fromRef,omitempty"`
+	ToRef *struct {
+		ID string `json:"id"`
+	} `json:"toRef,omitempty"`
+	Links *struct {
+		Self []struct {
+			Href string `json:"href"`
+		} `json:"self"`
+	} `json:"links,omitempty"`
+}
+
+// Validate reports all missing or invalid flags of the provider without contacting Bitbucket
+func Validate() error {
+	var errs []error
+	if u, err := url.Parse(*apiEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("bitbucket_api_pr_endpoint %q must be an absolute URL", *apiEndpoint))
+	}
+	if *bitbucketUser == "" {
+		errs = append(errs, errors.New("bitbucket_user must be set"))
+	}
+	if *bitbucketPassword == "" {
+		errs = append(errs, errors.New("bitbucket_password must be set"))
+	}
+	redact.Add(*bitbucketPassword)
+	return errors.Join(errs...)
+}
+
+// Check verifies that the credentials can list pull requests of the api endpoint
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", *apiEndpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(*bitbucketUser, *bitbucketPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to reach %s: %w", *apiEndpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", *apiEndpoint, resp.Status)
+	}
+	return nil
+}
+
 // CreatePR creates a pull request using branch names from and to
 func CreatePR(from, to, title, body string) error {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// CreatePRWithPolicy creates a pull request with the policy reviewers and merges it on build success if
+// the policy enables auto-merge. Team reviewers, labels and assignees are not supported.
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	if len(policy.TeamReviewers) > 0 || len(policy.Labels) > 0 || len(policy.Assignees) > 0 {
+		return fmt.Errorf("bitbucket supports only user reviewers and auto-merge, unable to enforce %+v", policy)
+	}
+	reviewers := []account{}
+	for _, name := range policy.Reviewers {
+		reviewers = append(reviewers, account{User: user{Name: name}})
+	}
 	repo := repository{
 		Slug:    "repo",
 		Project: project{"TM"},
 	}
+	// branches of a fork are pushed to the repository of the same slug in the project of the fork owner
+	forkOwner, branch := git.SplitHead(from)
+	fromRepo := repo
+	if forkOwner != "" {
+		fromRepo.Project = project{forkOwner}
+	}
 	prReq := pullrequest{
 		Title:       title,
 		Description: body,
@@ -75,25 +161,26 @@ func CreatePR(from, to, title, body string) error {
 		Open:        true,
 		Closed:      false,
 		FromRef: &pullrequestEndpoint{
-			ID:         "refs/heads/" + from,
-			Repository: repo,
+			ID:         "refs/heads/" + branch,
+			Repository: fromRepo,
 		},
 		ToRef: &pullrequestEndpoint{
 			ID:         "refs/heads/" + to,
 			Repository: repo,
 		},
 		Locked:    false,
-		Reviewers: []account{},
+		Reviewers: reviewers,
 	}
-	json, err := json.Marshal(&prReq)
+	reqBody, err := json.Marshal(&prReq)
 	if err != nil {
 		return fmt.Errorf("Unable to marshal CreatePR request: %w", err)
 	}
-	req, err := http.NewRequest("POST", *apiEndpoint, bytes.NewBuffer(json))
+	req, err := http.NewRequest("POST", *apiEndpoint, bytes.NewBuffer(reqBody))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	redact.Add(*bitbucketPassword)
 	req.SetBasicAuth(*bitbucketUser, *bitbucketPassword)
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -107,11 +194,204 @@ func CreatePR(from, to, title, body string) error {
 	// 409 already exists
 	if resp.StatusCode == 201 {
 		log.Print("PR was created")
-		return nil
+		if !policy.AutoMerge {
+			return nil
+		}
+		var created openPullrequest
+		if err := json.Unmarshal(responseBody, &created); err != nil {
+			return fmt.Errorf("unable to decode the created PR: %w", err)
+		}
+		return enableAutoMerge(created.ID)
 	}
 	if resp.StatusCode == 409 {
 		log.Print("reusing existing PR")
+		if len(reviewers) > 0 {
+			log.Printf("WARNING: reviewers %v are not added to the existing PR", policy.Reviewers)
+		}
+		if !policy.AutoMerge {
+			return nil
+		}
+		pr, err := FindOpenPR(from, to)
+		if err != nil {
+			return err
+		}
+		if pr == nil {
+			return fmt.Errorf("unable to find the existing PR from %s into %s", from, to)
+		}
+		return enableAutoMerge(pr.Number)
+	}
+	return &git.StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("Unrecognized bitbucket response %d", resp.StatusCode)}
+}
+
+// FindOpenPR returns the open pull request from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	if err := Validate(); err != nil {
+		return nil, err
+	}
+	forkOwner, branch := git.SplitHead(from)
+	q := url.Values{"at": {"refs/heads/" + branch}, "direction": {"OUTGOING"}, "state": {"OPEN"}}
+	if forkOwner != "" {
+		// the branch of a fork is not a ref of the repository, list PRs into to instead
+		q = url.Values{"at": {"refs/heads/" + to}, "direction": {"INCOMING"}, "state": {"OPEN"}}
+	}
+	var page struct {
+		Values []openPullrequest `json:"values"`
+	}
+	if err := call("GET", *apiEndpoint+"?"+q.Encode(), nil, &page); err != nil {
+		return nil, fmt.Errorf("unable to find PR from %s: %w", from, err)
+	}
+	for _, pr := range page.Values {
+		if pr.ToRef != nil && pr.ToRef.ID != "refs/heads/"+to {
+			continue
+		}
+		if forkOwner != "" && (pr.FromRef == nil || pr.FromRef.ID != "refs/heads/"+branch || pr.FromRef.Repository.Project.Key != forkOwner) {
+			continue
+		}
+		return pr.toPR(), nil
+	}
+	return nil, nil
+}
+
+func (pr openPullrequest) toPR() *git.PR {
+	found := &git.PR{Number: pr.ID, Body: pr.Description, Version: pr.Version}
+	if pr.Links != nil && len(pr.Links.Self) > 0 {
+		found.URL = pr.Links.Self[0].Href
+	}
+	if pr.FromRef != nil {
+		found.Branch = strings.TrimPrefix(pr.FromRef.ID, "refs/heads/")
+	}
+	return found
+}
+
+// ListOpenPRs returns the open pull requests into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	if err := Validate(); err != nil {
+		return nil, err
+	}
+	q := url.Values{"at": {"refs/heads/" + to}, "direction": {"INCOMING"}, "state": {"OPEN"}, "limit": {"100"}}
+	var prs []*git.PR
+	for {
+		var page struct {
+			Values        []openPullrequest `json:"values"`
+			IsLastPage    bool              `json:"isLastPage"`
+			NextPageStart int               `json:"nextPageStart"`
+		}
+		if err := call("GET", *apiEndpoint+"?"+q.Encode(), nil, &page); err != nil {
+			return nil, fmt.Errorf("unable to list PRs into %s: %w", to, err)
+		}
+		for _, pr := range page.Values {
+			if pr.FromRef != nil && strings.HasPrefix(pr.FromRef.ID, "refs/heads/"+prefix) {
+				prs = append(prs, pr.toPR())
+			}
+		}
+		if page.IsLastPage || page.NextPageStart == 0 {
+			return prs, nil
+		}
+		q.Set("start", strconv.Itoa(page.NextPageStart))
+	}
+}
+
+// CommentOpenPR adds the comment to the open pull request
+func CommentOpenPR(pr *git.PR, comment string) error {
+	if err := call("POST", fmt.Sprintf("%s/%d/comments", *apiEndpoint, pr.Number), map[string]string{"text": comment}, nil); err != nil {
+		return fmt.Errorf("unable to comment on PR %d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+// CloseOpenPR comments on the open pull request and declines it
+func CloseOpenPR(pr *git.PR, comment string) error {
+	if err := CommentOpenPR(pr, comment); err != nil {
+		return err
+	}
+	if err := call("POST", fmt.Sprintf("%s/%d/decline?version=%d", *apiEndpoint, pr.Number, pr.Version), struct{}{}, nil); err != nil {
+		return fmt.Errorf("unable to decline PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Declined PR %d", pr.Number)
+	return nil
+}
+
+// DefaultBranch returns the default branch of the repository of the pull request endpoint
+func DefaultBranch() (string, error) {
+	if err := Validate(); err != nil {
+		return "", err
+	}
+	var branch struct {
+		DisplayID string `json:"displayId"`
+	}
+	endpoint := strings.TrimSuffix(*apiEndpoint, "/pull-requests") + "/branches/default"
+	if err := call("GET", endpoint, nil, &branch); err != nil {
+		return "", fmt.Errorf("unable to get the default branch: %w", err)
+	}
+	if branch.DisplayID == "" {
+		return "", errors.New("the repository has no default branch")
+	}
+	return branch.DisplayID, nil
+}
+
+// UpdateOpenPR replaces the title and the description of the open pull request, sets the policy reviewers
+// and enables auto-merge. Team reviewers, labels and assignees are not supported.
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	if len(policy.TeamReviewers) > 0 || len(policy.Labels) > 0 || len(policy.Assignees) > 0 {
+		return fmt.Errorf("bitbucket supports only user reviewers and auto-merge, unable to enforce %+v", policy)
+	}
+	update := openPullrequest{Version: pr.Version, Title: title, Description: body}
+	for _, name := range policy.Reviewers {
+		update.Reviewers = append(update.Reviewers, account{User: user{Name: name}})
+	}
+	if err := call("PUT", fmt.Sprintf("%s/%d", *apiEndpoint, pr.Number), update, nil); err != nil {
+		return fmt.Errorf("unable to update PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Updated PR %d", pr.Number)
+	if policy.AutoMerge {
+		return enableAutoMerge(pr.Number)
+	}
+	return nil
+}
+
+// enableAutoMerge requests the pull request to be merged once its builds succeed and its merge checks pass.
+// Auto-merge requires Bitbucket Data Center 8.15 or later and must be enabled for the repository.
+func enableAutoMerge(id int) error {
+	err := call("POST", fmt.Sprintf("%s/%d/auto-merge", *apiEndpoint, id), struct{}{}, nil)
+	var statusErr *git.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict {
+		// auto-merge was already requested for the PR
+		log.Printf("Auto-merge of PR %d is already requested", id)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to enable auto-merge of PR %d: %w", id, err)
+	}
+	log.Printf("Enabled auto-merge of PR %d", id)
+	return nil
+}
+
+// call sends the JSON request to the Bitbucket API and decodes the response into out if it is not nil
+func call(method, endpoint string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.SetBasicAuth(*bitbucketUser, *bitbucketPassword)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &git.StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("bitbucket responded with %s", resp.Status)}
+	}
+	if out == nil {
 		return nil
 	}
-	return fmt.Errorf("Unrecognized bitbucket response %d", resp.StatusCode)
+	return json.NewDecoder(resp.Body).Decode(out)
 }
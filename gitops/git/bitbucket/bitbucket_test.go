@@ -17,6 +17,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
 )
 
 func TestCreatePRRemote(t *testing.T) {
@@ -55,3 +57,176 @@ func TestCreatePRNew(t *testing.T) {
 		t.Error("Unexpected request body: ", string(buf))
 	}
 }
+
+func TestCreatePRFromFork(t *testing.T) {
+	var buf []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+	}))
+	defer ts.Close()
+	oldendpoint := *apiEndpoint
+	defer func() { *apiEndpoint = oldendpoint }()
+	*apiEndpoint = ts.URL
+	if err := CreatePR("~deploybot:deploy/test1", "master", "test", "hello world"); err != nil {
+		t.Fatal(err)
+	}
+	expectedreq := `{"title":"test","description":"hello world","state":"OPEN","open":true,"closed":false,"fromRef":{"id":"refs/heads/deploy/test1","repository":{"slug":"repo","project":{"key":"~deploybot"}}},"toRef":{"id":"refs/heads/master","repository":{"slug":"repo","project":{"key":"TM"}}},"locked":false}`
+	if string(buf) != expectedreq {
+		t.Error("Unexpected request body: ", string(buf))
+	}
+}
+
+func TestUpdateOpenPR(t *testing.T) {
+	var update []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("at") == "refs/heads/deploy/test1":
+			fmt.Fprintln(w, `{"values":[
+				{"id":3,"version":1,"description":"other","toRef":{"id":"refs/heads/release"}},
+				{"id":4,"version":2,"description":"old","toRef":{"id":"refs/heads/master"},"links":{"self":[{"href":"https://bitbucket/pr/4"}]}}]}`)
+		case r.Method == "GET":
+			fmt.Fprintln(w, `{"values":[]}`)
+		case r.Method == "PUT" && r.URL.Path == "/4":
+			update, _ = ioutil.ReadAll(r.Body)
+			fmt.Fprintln(w, `{}`)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+	oldendpoint := *apiEndpoint
+	defer func() { *apiEndpoint = oldendpoint }()
+	*apiEndpoint = ts.URL
+	user, pass := "user", "pass"
+	bitbucketUser, bitbucketPassword = &user, &pass
+
+	pr, err := FindOpenPR("deploy/test1", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pr == nil || pr.Number != 4 || pr.Version != 2 || pr.Body != "old" || pr.URL != "https://bitbucket/pr/4" {
+		t.Fatalf("unexpected PR %+v", pr)
+	}
+	if pr, err := FindOpenPR("deploy/test2", "master"); err != nil || pr != nil {
+		t.Errorf("FindOpenPR(deploy/test2) = %+v, %v", pr, err)
+	}
+	if err := UpdateOpenPR(pr, "test", "new", git.ReviewPolicy{Reviewers: []string{"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	expectedreq := `{"version":2,"title":"test","description":"new","reviewers":[{"user":{"name":"alice"}}]}`
+	if string(update) != expectedreq {
+		t.Error("Unexpected request body: ", string(update))
+	}
+}
+
+func TestAutoMerge(t *testing.T) {
+	var requests []string
+	exists := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/" && exists:
+			http.Error(w, "exists", http.StatusConflict)
+		case r.Method == "POST" && r.URL.Path == "/":
+			w.WriteHeader(201)
+			fmt.Fprintln(w, `{"id":7,"version":0}`)
+		case r.Method == "GET":
+			fmt.Fprintln(w, `{"values":[{"id":8,"version":3,"toRef":{"id":"refs/heads/master"}}]}`)
+		case r.Method == "PUT":
+			fmt.Fprintln(w, `{}`)
+		case r.Method == "POST" && r.URL.Path == "/9/auto-merge":
+			http.Error(w, "already requested", http.StatusConflict)
+		case r.Method == "POST":
+			requests = append(requests, r.URL.Path)
+			fmt.Fprintln(w, `{}`)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+	oldendpoint := *apiEndpoint
+	defer func() { *apiEndpoint = oldendpoint }()
+	*apiEndpoint = ts.URL
+	user, pass := "user", "pass"
+	bitbucketUser, bitbucketPassword = &user, &pass
+
+	policy := git.ReviewPolicy{AutoMerge: true}
+	if err := CreatePRWithPolicy("deploy/test1", "master", "test", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	exists = true
+	if err := CreatePRWithPolicy("deploy/test1", "master", "test", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateOpenPR(&git.PR{Number: 9, Version: 1}, "test", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/7/auto-merge", "/8/auto-merge"}
+	if fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Errorf("unexpected requests %q", requests)
+	}
+	if err := CreatePRWithPolicy("deploy/test1", "master", "test", "body", git.ReviewPolicy{Labels: []string{"gitops"}}); err == nil {
+		t.Error("expected labels to be rejected")
+	}
+}
+
+func TestListAndCloseOpenPRs(t *testing.T) {
+	var requests []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "GET" && r.URL.Query().Get("start") == "":
+			fmt.Fprintln(w, `{"isLastPage":false,"nextPageStart":2,"values":[
+				{"id":3,"version":1,"fromRef":{"id":"refs/heads/deploy/app/prod"}},
+				{"id":4,"version":1,"fromRef":{"id":"refs/heads/feature/x"}}]}`)
+		case r.Method == "GET":
+			fmt.Fprintln(w, `{"isLastPage":true,"values":[{"id":5,"version":7,"fromRef":{"id":"refs/heads/deploy/app/qa"}}]}`)
+		case r.Method == "POST":
+			b, _ := ioutil.ReadAll(r.Body)
+			requests = append(requests, r.URL.RequestURI()+" "+string(b))
+			fmt.Fprintln(w, `{}`)
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+	}))
+	defer ts.Close()
+	oldendpoint := *apiEndpoint
+	defer func() { *apiEndpoint = oldendpoint }()
+	*apiEndpoint = ts.URL
+	user, pass := "user", "pass"
+	bitbucketUser, bitbucketPassword = &user, &pass
+
+	prs, err := ListOpenPRs("deploy/app/", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 2 || prs[0].Branch != "deploy/app/prod" || prs[1].Number != 5 || prs[1].Version != 7 {
+		t.Fatalf("unexpected PRs %+v", prs)
+	}
+	if err := CloseOpenPR(prs[1], "retired"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`/5/comments {"text":"retired"}`, `/5/decline?version=7 {}`}
+	if fmt.Sprint(requests) != fmt.Sprint(expected) {
+		t.Errorf("unexpected requests %q", requests)
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/1.0/projects/TM/repos/deploy/branches/default" {
+			http.Error(w, "unexpected request", http.StatusNotFound)
+			return
+		}
+		fmt.Fprintln(w, `{"id":"refs/heads/main","displayId":"main","type":"BRANCH","isDefault":true}`)
+	}))
+	defer ts.Close()
+	oldendpoint := *apiEndpoint
+	defer func() { *apiEndpoint = oldendpoint }()
+	*apiEndpoint = ts.URL + "/rest/api/1.0/projects/TM/repos/deploy/pull-requests"
+	user, pass := "user", "pass"
+	bitbucketUser, bitbucketPassword = &user, &pass
+
+	if branch, err := DefaultBranch(); err != nil || branch != "main" {
+		t.Errorf("DefaultBranch() = %q, %v", branch, err)
+	}
+}
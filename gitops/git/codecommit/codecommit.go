@@ -0,0 +1,386 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+// Package codecommit creates pull requests in AWS CodeCommit repositories.
+// Requests are signed with the credentials of the default AWS credential chain, or of the IAM role
+// assumed with the OIDC token of the CI job.
+package codecommit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/codecommit"
+	"github.com/aws/aws-sdk-go-v2/service/codecommit/types"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+var (
+	repo     = flag.String("codecommit_repo", "", "the name of the CodeCommit repository to create pull requests in")
+	region   = flag.String("codecommit_region", "", "the AWS region of the CodeCommit repository, the region of the AWS configuration if empty")
+	endpoint = flag.String("codecommit_endpoint", "", "the URL of the CodeCommit API, e.g. of a VPC endpoint, the regional endpoint if empty")
+	roleARN  = flag.String("codecommit_role_arn", "", "the IAM role to assume with the OIDC token of the Buildkite or GitHub Actions job instead of the credentials of the default AWS chain")
+)
+
+const (
+	// headsPrefix is the ref prefix of branches
+	headsPrefix = "refs/heads/"
+	// approvalRuleName names the approval rule requiring the reviewers of the review policy
+	approvalRuleName = "gitops reviewers"
+	// audience is the audience of the OIDC tokens exchanged with AWS STS
+	audience = "sts.amazonaws.com"
+	// sessionName names the sessions of the role assumed with the OIDC token
+	sessionName = "rules_gitops"
+)
+
+// Validate reports all missing or invalid flags of the provider without contacting AWS
+func Validate() error {
+	var errs []error
+	if *repo == "" {
+		errs = append(errs, errors.New("codecommit_repo must be set"))
+	}
+	if *endpoint != "" {
+		if u, err := url.Parse(*endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("codecommit_endpoint %q must be an absolute URL", *endpoint))
+		}
+	}
+	if *roleARN != "" && (!strings.HasPrefix(*roleARN, "arn:") || !strings.Contains(*roleARN, ":role/")) {
+		errs = append(errs, fmt.Errorf("codecommit_role_arn %q must be the ARN of an IAM role", *roleARN))
+	}
+	return errors.Join(errs...)
+}
+
+// Check verifies that the AWS credentials resolve and have access to the repository
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	cc, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	if _, err := cc.GetRepository(ctx, &codecommit.GetRepositoryInput{RepositoryName: repo}); err != nil {
+		return fmt.Errorf("unable to get repository %s: %w", *repo, err)
+	}
+	return nil
+}
+
+// newClient returns the CodeCommit client with the configuration and the credentials of the
+// default AWS chain, or of codecommit_role_arn. The client uses the TLS configuration applied by git.TLS.
+func newClient(ctx context.Context) (*codecommit.Client, error) {
+	var opts []func(*config.LoadOptions) error
+	if *region != "" {
+		opts = append(opts, config.WithRegion(*region))
+	}
+	if hc := git.HTTPClient(); hc != nil {
+		opts = append(opts, config.WithHTTPClient(hc))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the AWS configuration: %w", err)
+	}
+	if cfg.Region == "" {
+		return nil, errors.New("the AWS region is not configured, set codecommit_region or AWS_REGION")
+	}
+	if *roleARN != "" {
+		cfg.Credentials = webIdentity(cfg, *roleARN)
+	}
+	return codecommit.NewFromConfig(cfg, func(o *codecommit.Options) {
+		if *endpoint != "" {
+			o.BaseEndpoint = endpoint
+		}
+	}), nil
+}
+
+// CreatePR creates a pull request using branch names from and to
+func CreatePR(from, to, title, body string) error {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// CreatePRWithPolicy creates the pull request and enforces the policy. Reviewers are approval
+// pool members (IAM user or role ARNs); team reviewers, labels, auto-merge and assignees are not supported.
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	if err := supported(policy); err != nil {
+		return err
+	}
+	if owner, _ := git.SplitHead(from); owner != "" {
+		return fmt.Errorf("codecommit does not support pull requests from forks: %s", from)
+	}
+	ctx := context.Background()
+	cc, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	resp, err := cc.CreatePullRequest(ctx, &codecommit.CreatePullRequestInput{
+		Title:       aws.String(title),
+		Description: aws.String(body),
+		Targets: []types.Target{{
+			RepositoryName:       repo,
+			SourceReference:      aws.String(from),
+			DestinationReference: aws.String(to),
+		}},
+	})
+	if err != nil {
+		return fmt.Errorf("unable to create PR from %s: %w", from, err)
+	}
+	id := aws.ToString(resp.PullRequest.PullRequestId)
+	log.Printf("PR %s was created", consoleURL(cc, id))
+	return applyPolicy(ctx, cc, id, policy)
+}
+
+// FindOpenPR returns the open pull request from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	if owner, _ := git.SplitHead(from); owner != "" {
+		return nil, nil
+	}
+	var found *git.PR
+	err := listOpen(func(pr *git.PR, target types.PullRequestTarget) bool {
+		if pr.Branch == from && aws.ToString(target.DestinationReference) == headsPrefix+to {
+			found = pr
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find PR from %s: %w", from, err)
+	}
+	return found, nil
+}
+
+// ListOpenPRs returns the open pull requests into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	var prs []*git.PR
+	err := listOpen(func(pr *git.PR, target types.PullRequestTarget) bool {
+		if strings.HasPrefix(pr.Branch, prefix) && aws.ToString(target.DestinationReference) == headsPrefix+to {
+			prs = append(prs, pr)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list PRs into %s: %w", to, err)
+	}
+	return prs, nil
+}
+
+// listOpen calls f with the open pull requests of the repository and their targets until it returns false
+func listOpen(f func(pr *git.PR, target types.PullRequestTarget) bool) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	cc, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	p := codecommit.NewListPullRequestsPaginator(cc, &codecommit.ListPullRequestsInput{RepositoryName: repo, PullRequestStatus: types.PullRequestStatusEnumOpen})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, id := range page.PullRequestIds {
+			resp, err := cc.GetPullRequest(ctx, &codecommit.GetPullRequestInput{PullRequestId: aws.String(id)})
+			if err != nil {
+				return err
+			}
+			for _, target := range resp.PullRequest.PullRequestTargets {
+				if aws.ToString(target.RepositoryName) != *repo {
+					continue
+				}
+				number, err := strconv.Atoi(id)
+				if err != nil {
+					return fmt.Errorf("unexpected pull request ID %q", id)
+				}
+				pr := &git.PR{
+					Number: number,
+					URL:    consoleURL(cc, id),
+					Body:   aws.ToString(resp.PullRequest.Description),
+					Branch: strings.TrimPrefix(aws.ToString(target.SourceReference), headsPrefix),
+				}
+				if !f(pr, target) {
+					return nil
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// UpdateOpenPR replaces the title and the description of the open pull request and enforces the policy
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	if err := supported(policy); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	cc, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	id := aws.String(strconv.Itoa(pr.Number))
+	if _, err := cc.UpdatePullRequestTitle(ctx, &codecommit.UpdatePullRequestTitleInput{PullRequestId: id, Title: aws.String(title)}); err != nil {
+		return fmt.Errorf("unable to update PR %d: %w", pr.Number, err)
+	}
+	if _, err := cc.UpdatePullRequestDescription(ctx, &codecommit.UpdatePullRequestDescriptionInput{PullRequestId: id, Description: aws.String(body)}); err != nil {
+		return fmt.Errorf("unable to update PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Updated PR %d", pr.Number)
+	return applyPolicy(ctx, cc, *id, policy)
+}
+
+// CommentOpenPR adds the comment to the open pull request
+func CommentOpenPR(pr *git.PR, comment string) error {
+	ctx := context.Background()
+	cc, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	return postComment(ctx, cc, pr, comment)
+}
+
+// CloseOpenPR comments on the open pull request and closes it
+func CloseOpenPR(pr *git.PR, comment string) error {
+	ctx := context.Background()
+	cc, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := postComment(ctx, cc, pr, comment); err != nil {
+		return err
+	}
+	id := aws.String(strconv.Itoa(pr.Number))
+	if _, err := cc.UpdatePullRequestStatus(ctx, &codecommit.UpdatePullRequestStatusInput{PullRequestId: id, PullRequestStatus: types.PullRequestStatusEnumClosed}); err != nil {
+		return fmt.Errorf("unable to close PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Closed PR %d", pr.Number)
+	return nil
+}
+
+// postComment comments on the changes of every target of the pull request
+func postComment(ctx context.Context, cc *codecommit.Client, pr *git.PR, comment string) error {
+	id := aws.String(strconv.Itoa(pr.Number))
+	resp, err := cc.GetPullRequest(ctx, &codecommit.GetPullRequestInput{PullRequestId: id})
+	if err != nil {
+		return fmt.Errorf("unable to get PR %d: %w", pr.Number, err)
+	}
+	for _, target := range resp.PullRequest.PullRequestTargets {
+		_, err := cc.PostCommentForPullRequest(ctx, &codecommit.PostCommentForPullRequestInput{
+			PullRequestId:  id,
+			RepositoryName: target.RepositoryName,
+			BeforeCommitId: target.DestinationCommit,
+			AfterCommitId:  target.SourceCommit,
+			Content:        aws.String(comment),
+		})
+		if err != nil {
+			return fmt.Errorf("unable to comment on PR %d: %w", pr.Number, err)
+		}
+	}
+	return nil
+}
+
+// DefaultBranch returns the default branch of the repository
+func DefaultBranch() (string, error) {
+	if err := Validate(); err != nil {
+		return "", err
+	}
+	ctx := context.Background()
+	cc, err := newClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	resp, err := cc.GetRepository(ctx, &codecommit.GetRepositoryInput{RepositoryName: repo})
+	if err != nil {
+		return "", fmt.Errorf("unable to get the default branch: %w", err)
+	}
+	branch := aws.ToString(resp.RepositoryMetadata.DefaultBranch)
+	if branch == "" {
+		return "", errors.New("the repository has no default branch")
+	}
+	return branch, nil
+}
+
+// supported rejects the parts of the policy CodeCommit cannot apply
+func supported(policy git.ReviewPolicy) error {
+	if len(policy.TeamReviewers) > 0 || len(policy.Labels) > 0 || policy.AutoMerge || len(policy.Assignees) > 0 {
+		return fmt.Errorf("codecommit supports reviewers only, unable to enforce %+v", policy)
+	}
+	return nil
+}
+
+// applyPolicy requires an approval of one of the reviewers of the policy with an approval rule of the pull request
+func applyPolicy(ctx context.Context, cc *codecommit.Client, id string, policy git.ReviewPolicy) error {
+	if len(policy.Reviewers) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(map[string]interface{}{
+		"Version": "2018-11-08",
+		"Statements": []map[string]interface{}{{
+			"Type":                    "Approvers",
+			"NumberOfApprovalsNeeded": 1,
+			"ApprovalPoolMembers":     policy.Reviewers,
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = cc.CreatePullRequestApprovalRule(ctx, &codecommit.CreatePullRequestApprovalRuleInput{
+		PullRequestId:       aws.String(id),
+		ApprovalRuleName:    aws.String(approvalRuleName),
+		ApprovalRuleContent: aws.String(string(content)),
+	})
+	var exists *types.ApprovalRuleNameAlreadyExistsException
+	if errors.As(err, &exists) {
+		_, err = cc.UpdatePullRequestApprovalRuleContent(ctx, &codecommit.UpdatePullRequestApprovalRuleContentInput{
+			PullRequestId:    aws.String(id),
+			ApprovalRuleName: aws.String(approvalRuleName),
+			NewRuleContent:   aws.String(string(content)),
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to require reviewers of PR %s: %w", id, err)
+	}
+	return nil
+}
+
+// consoleURL returns the URL of the pull request in the AWS console
+func consoleURL(cc *codecommit.Client, id string) string {
+	r := cc.Options().Region
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/codesuite/codecommit/repositories/%s/pull-requests/%s/details?region=%s", r, url.PathEscape(*repo), id, r)
+}
+
+// ciToken retrieves the OIDC token of the CI job for AWS STS
+type ciToken struct{}
+
+func (ciToken) GetIdentityToken() ([]byte, error) {
+	token, err := git.CIToken(context.Background(), audience)
+	return []byte(token), err
+}
+
+// webIdentity returns the cached short-lived credentials of the role assumed with the OIDC token of the CI job
+func webIdentity(cfg aws.Config, role string, optFns ...func(*sts.Options)) aws.CredentialsProvider {
+	provider := stscreds.NewWebIdentityRoleProvider(sts.NewFromConfig(cfg, optFns...), role, ciToken{}, func(o *stscreds.WebIdentityRoleOptions) {
+		o.RoleSessionName = sessionName
+	})
+	return aws.NewCredentialsCache(provider)
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package codecommit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// fakeCodeCommit serves the CodeCommit operations of the gitops repository with two open pull requests
+// and records the names of the operations called
+func fakeCodeCommit(t *testing.T, ops *[]string) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") {
+			t.Errorf("unsigned request %q", r.Header.Get("Authorization"))
+		}
+		op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "CodeCommit_20150413.")
+		*ops = append(*ops, op)
+		var in map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&in)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch op {
+		case "CreatePullRequest":
+			w.Write([]byte(`{"pullRequest": {"pullRequestId": "9"}}`))
+		case "ListPullRequests":
+			w.Write([]byte(`{"pullRequestIds": ["7", "8"]}`))
+		case "GetPullRequest":
+			source := map[string]string{"7": "refs/heads/deploy/app", "8": "refs/heads/feature"}[in["pullRequestId"].(string)]
+			json.NewEncoder(w).Encode(map[string]interface{}{"pullRequest": map[string]interface{}{
+				"pullRequestId": in["pullRequestId"],
+				"description":   "body",
+				"pullRequestTargets": []map[string]string{{
+					"repositoryName":       "gitops",
+					"sourceReference":      source,
+					"destinationReference": "refs/heads/main",
+					"sourceCommit":         "abc",
+					"destinationCommit":    "def",
+				}},
+			}})
+		case "CreatePullRequestApprovalRule":
+			if in["pullRequestId"] == "7" {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"__type": "ApprovalRuleNameAlreadyExistsException", "message": "exists"}`))
+				return
+			}
+			w.Write([]byte(`{}`))
+		case "GetRepository":
+			w.Write([]byte(`{"repositoryMetadata": {"defaultBranch": "main"}}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDTEST")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_CONFIG_FILE", t.TempDir()+"/config")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", t.TempDir()+"/credentials")
+	*repo, *region, *endpoint = "gitops", "us-east-1", ts.URL
+	return ts
+}
+
+func TestCreatePRWithPolicy(t *testing.T) {
+	var ops []string
+	ts := fakeCodeCommit(t, &ops)
+	defer ts.Close()
+
+	policy := git.ReviewPolicy{Reviewers: []string{"arn:aws:iam::123456789012:role/deployers"}}
+	if err := CreatePRWithPolicy("deploy/web", "main", "title", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := UpdateOpenPR(&git.PR{Number: 7}, "title", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	want := "CreatePullRequest,CreatePullRequestApprovalRule,UpdatePullRequestTitle,UpdatePullRequestDescription,CreatePullRequestApprovalRule,UpdatePullRequestApprovalRuleContent"
+	if strings.Join(ops, ",") != want {
+		t.Errorf("operations = %v, want %s", ops, want)
+	}
+	if err := CreatePRWithPolicy("deploy/web", "main", "title", "body", git.ReviewPolicy{AutoMerge: true}); err == nil {
+		t.Error("expected auto-merge to be rejected")
+	}
+}
+
+func TestOpenPRs(t *testing.T) {
+	var ops []string
+	ts := fakeCodeCommit(t, &ops)
+	defer ts.Close()
+
+	prs, err := ListOpenPRs("deploy/", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 1 || prs[0].Number != 7 || prs[0].Branch != "deploy/app" || prs[0].Body != "body" {
+		t.Errorf("ListOpenPRs() = %+v", prs)
+	}
+	pr, err := FindOpenPR("deploy/app", "main")
+	if err != nil || pr == nil || !strings.HasSuffix(pr.URL, "/repositories/gitops/pull-requests/7/details?region=us-east-1") {
+		t.Errorf("FindOpenPR() = %+v, %v", pr, err)
+	}
+	ops = nil
+	if err := CloseOpenPR(prs[0], "retired"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(ops, ",") != "GetPullRequest,PostCommentForPullRequest,UpdatePullRequestStatus" {
+		t.Errorf("operations = %v", ops)
+	}
+	if branch, err := DefaultBranch(); err != nil || branch != "main" {
+		t.Errorf("DefaultBranch() = %q, %v", branch, err)
+	}
+}
+
+func TestWebIdentity(t *testing.T) {
+	gha := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("audience") != audience {
+			t.Errorf("unexpected audience %q", r.URL.Query().Get("audience"))
+		}
+		w.Write([]byte(`{"value": "gha-jwt"}`))
+	}))
+	defer gha.Close()
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_URL", gha.URL)
+	t.Setenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN", "request-token")
+	stsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("Action") != "AssumeRoleWithWebIdentity" || r.Form.Get("WebIdentityToken") != "gha-jwt" ||
+			r.Form.Get("RoleArn") != "arn:aws:iam::123456789012:role/gitops" || r.Form.Get("RoleSessionName") != sessionName {
+			t.Errorf("unexpected STS request %v", r.Form)
+		}
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+<AssumeRoleWithWebIdentityResult><Credentials><AccessKeyId>ASIATEST</AccessKeyId><SecretAccessKey>secret</SecretAccessKey>
+<SessionToken>session</SessionToken><Expiration>2099-01-01T00:00:00Z</Expiration></Credentials></AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer stsServer.Close()
+
+	provider := webIdentity(aws.Config{Region: "us-east-1"}, "arn:aws:iam::123456789012:role/gitops", func(o *sts.Options) {
+		o.BaseEndpoint = aws.String(stsServer.URL)
+	})
+	creds, err := provider.Retrieve(context.Background())
+	if err != nil || creds.AccessKeyID != "ASIATEST" || creds.SessionToken != "session" {
+		t.Errorf("Retrieve() = %+v, %v", creds, err)
+	}
+
+	*repo, *roleARN = "gitops", "gitops-role"
+	defer func() { *roleARN = "" }()
+	if err := Validate(); err == nil || !strings.Contains(err.Error(), "codecommit_role_arn") {
+		t.Errorf("expected invalid codecommit_role_arn, got %v", err)
+	}
+}
@@ -0,0 +1,186 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package external implements git servers delegating pull requests to a bespoke review system:
+// exec runs a command with the pull request on stdin, webhook posts the pull request to a URL.
+package external
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	osexec "os/exec"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+var (
+	command      = flag.String("exec_pr_command", "", "the command creating pull requests when git_server is exec, with arguments separated by spaces. The pull request is written to its stdin as JSON")
+	webhookURL   = flag.String("webhook_pr_url", "", "the URL the pull requests are posted to as JSON when git_server is webhook")
+	webhookToken = flag.String("webhook_pr_token", os.Getenv("GITOPS_WEBHOOK_PR_TOKEN"), "bearer token of the webhook_pr_url requests")
+)
+
+// Action values of the payload
+const (
+	// ActionCreate asks to create the pull request, or to update the open one of the same branches
+	ActionCreate = "create"
+	// ActionCheck verifies that the webhook accepts requests, it must not create anything
+	ActionCheck = "check"
+)
+
+// Payload is the pull request passed to the command or posted to the webhook
+type Payload struct {
+	Action        string   `json:"action"`
+	From          string   `json:"from,omitempty"`
+	To            string   `json:"to,omitempty"`
+	Title         string   `json:"title,omitempty"`
+	Body          string   `json:"body,omitempty"`
+	Reviewers     []string `json:"reviewers,omitempty"`
+	TeamReviewers []string `json:"team_reviewers,omitempty"`
+	AutoMerge     bool     `json:"auto_merge,omitempty"`
+	Labels        []string `json:"labels,omitempty"`
+	Assignees     []string `json:"assignees,omitempty"`
+}
+
+func newPayload(from, to, title, body string, policy git.ReviewPolicy) Payload {
+	return Payload{
+		Action:        ActionCreate,
+		From:          from,
+		To:            to,
+		Title:         title,
+		Body:          body,
+		Reviewers:     policy.Reviewers,
+		TeamReviewers: policy.TeamReviewers,
+		AutoMerge:     policy.AutoMerge,
+		Labels:        policy.Labels,
+		Assignees:     policy.Assignees,
+	}
+}
+
+// ValidateExec reports a missing exec_pr_command
+func ValidateExec() error {
+	if strings.TrimSpace(*command) == "" {
+		return errors.New("exec_pr_command must be set")
+	}
+	return nil
+}
+
+// CheckExec verifies that the program of exec_pr_command exists, without running it
+func CheckExec(ctx context.Context) error {
+	if err := ValidateExec(); err != nil {
+		return err
+	}
+	program := strings.Fields(*command)[0]
+	if _, ok := exec.Find(program); ok {
+		return nil
+	}
+	if _, err := osexec.LookPath(program); err != nil {
+		return fmt.Errorf("exec_pr_command %s not found: %w", program, err)
+	}
+	return nil
+}
+
+// CreatePRWithExec runs exec_pr_command with the pull request on stdin. The policy is passed to the command,
+// which fails with a non-zero exit status if it can not create the pull request.
+func CreatePRWithExec(from, to, title, body string, policy git.ReviewPolicy) error {
+	if err := ValidateExec(); err != nil {
+		return err
+	}
+	in, err := json.Marshal(newPayload(from, to, title, body, policy))
+	if err != nil {
+		return err
+	}
+	args := strings.Fields(*command)
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	out, err := cmd.CombinedOutput()
+	if len(out) > 0 {
+		log.Printf("%s: %s", args[0], bytes.TrimSpace(out))
+	}
+	if err != nil {
+		return fmt.Errorf("exec_pr_command failed to create PR from %s: %w", from, err)
+	}
+	log.Printf("PR from %s created by %s", from, args[0])
+	return nil
+}
+
+// ValidateWebhook reports a missing or invalid webhook_pr_url
+func ValidateWebhook() error {
+	if u, err := url.Parse(*webhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook_pr_url %q must be an absolute http or https URL", *webhookURL)
+	}
+	redact.Add(*webhookToken)
+	return nil
+}
+
+// CheckWebhook posts a check payload to webhook_pr_url, which must respond with a 2xx status
+func CheckWebhook(ctx context.Context) error {
+	if err := ValidateWebhook(); err != nil {
+		return err
+	}
+	return post(ctx, Payload{Action: ActionCheck})
+}
+
+// CreatePRWithWebhook posts the pull request to webhook_pr_url. The policy is passed to the webhook,
+// which responds with a non-2xx status if it can not create the pull request.
+func CreatePRWithWebhook(from, to, title, body string, policy git.ReviewPolicy) error {
+	if err := ValidateWebhook(); err != nil {
+		return err
+	}
+	if err := post(context.Background(), newPayload(from, to, title, body, policy)); err != nil {
+		return fmt.Errorf("unable to create PR from %s: %w", from, err)
+	}
+	log.Printf("PR from %s posted to %s", from, *webhookURL)
+	return nil
+}
+
+// post sends the payload to webhook_pr_url. Non-2xx responses are *git.StatusError,
+// so ambiguous failures are retried with the idempotency key of the PR body.
+func post(ctx context.Context, p Payload) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", *webhookURL, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if *webhookToken != "" {
+		req.Header.Set("Authorization", "Bearer "+*webhookToken)
+	}
+	client := git.HTTPClient()
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &git.StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("%s responded with %s: %s", *webhookURL, resp.Status, bytes.TrimSpace(msg))}
+	}
+	return nil
+}
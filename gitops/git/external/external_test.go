@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package external
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+func TestCreatePRWithExec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script")
+	}
+	dir := t.TempDir()
+	out := filepath.Join(dir, "pr.json")
+	script := filepath.Join(dir, "create-pr")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat > \"$1\"\necho created\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	old := *command
+	defer func() { *command = old }()
+	*command = script + " " + out
+
+	policy := git.ReviewPolicy{Reviewers: []string{"alice"}, AutoMerge: true}
+	if err := CreatePRWithExec("deploy/prod", "master", "title", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Payload
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := Payload{Action: ActionCreate, From: "deploy/prod", To: "master", Title: "title", Body: "body", Reviewers: []string{"alice"}, AutoMerge: true}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payload = %+v, want %+v", got, want)
+	}
+	if err := CheckExec(context.Background()); err != nil {
+		t.Errorf("CheckExec() = %v", err)
+	}
+
+	*command = "false"
+	if err := CreatePRWithExec("deploy/prod", "master", "title", "body", policy); err == nil {
+		t.Error("expected failing command to fail")
+	}
+	*command = filepath.Join(dir, "missing")
+	if err := CheckExec(context.Background()); err == nil {
+		t.Error("expected missing command to fail the check")
+	}
+}
+
+func TestCreatePRWithWebhook(t *testing.T) {
+	var payloads []Payload
+	status := http.StatusCreated
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var p Payload
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		payloads = append(payloads, p)
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	oldURL, oldToken := *webhookURL, *webhookToken
+	defer func() { *webhookURL, *webhookToken = oldURL, oldToken }()
+	*webhookURL, *webhookToken = ts.URL, "secret"
+
+	if err := CheckWebhook(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreatePRWithWebhook("deploy/prod", "master", "title", "body", git.ReviewPolicy{Labels: []string{"gitops"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []Payload{
+		{Action: ActionCheck},
+		{Action: ActionCreate, From: "deploy/prod", To: "master", Title: "title", Body: "body", Labels: []string{"gitops"}},
+	}
+	if !reflect.DeepEqual(payloads, want) {
+		t.Errorf("payloads = %+v, want %+v", payloads, want)
+	}
+
+	status = http.StatusBadGateway
+	err := CreatePRWithWebhook("deploy/prod", "master", "title", "body", git.ReviewPolicy{})
+	var se *git.StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusBadGateway || !git.Retryable(err) {
+		t.Errorf("expected retryable status error, got %v", err)
+	}
+
+	*webhookURL = "ftp://example.com"
+	if err := ValidateWebhook(); err == nil {
+		t.Error("expected invalid webhook_pr_url")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+// Package gerrit submits deployment branches as Gerrit changes: the branch is pushed to
+// refs/for/<target> as a single commit with a Change-Id trailer, no review API is called.
+package gerrit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+var (
+	topic = flag.String("gerrit_topic", "", "the topic of the Gerrit changes of the deployment, no topic if empty")
+)
+
+// ChangeIDTrailer is the commit message trailer identifying the Gerrit change
+const ChangeIDTrailer = "Change-Id"
+
+// noNewChanges is the rejection of a push of a patch set identical to the current one
+const noNewChanges = "no new changes"
+
+// Validate reports invalid flags of the provider
+func Validate() error {
+	if strings.ContainsAny(*topic, ", \t\n") {
+		return fmt.Errorf("gerrit_topic %q must not contain commas or whitespace", *topic)
+	}
+	return nil
+}
+
+// Check verifies the flags of the provider. The remote is verified by the git_repo check.
+func Check(ctx context.Context) error {
+	return Validate()
+}
+
+// ChangeID returns the Change-Id derived from the idempotency key, so a retried deployment
+// uploads a new patch set of its change instead of creating another change
+func ChangeID(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return "I" + hex.EncodeToString(sum[:])
+}
+
+// PushChange squashes the commits of the branch over to into one commit carrying the Change-Id trailer
+// and pushes it to refs/for/<to> of the remote, creating the change or uploading a new patch set.
+// Reviewers and labels of the policy become reviewers and hashtags of the change; team reviewers
+// auto-merge and assignees are not supported.
+func PushChange(dir, remote, branch, to, changeID string, policy git.ReviewPolicy) error {
+	if len(policy.TeamReviewers) > 0 || policy.AutoMerge || len(policy.Assignees) > 0 {
+		return fmt.Errorf("gerrit supports reviewers and labels only, unable to enforce %+v", policy)
+	}
+	msg, err := exec.Ex(dir, "git", "log", "-1", "--format=%B", branch)
+	if err != nil {
+		return fmt.Errorf("unable to read the commit message of %s: %w", branch, err)
+	}
+	f, err := os.CreateTemp("", "gerrit-msg")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(msg)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	msgFile, err := filepath.Abs(f.Name())
+	if err != nil {
+		return err
+	}
+	if _, err := exec.Ex(dir, "git", "interpret-trailers", "--in-place", "--if-exists", "replace", "--trailer", ChangeIDTrailer+": "+changeID, msgFile); err != nil {
+		return fmt.Errorf("unable to add the Change-Id of %s: %w", branch, err)
+	}
+	out, err := exec.Ex(dir, "git", "commit-tree", branch+"^{tree}", "-p", to, "-F", msgFile)
+	if err != nil {
+		return fmt.Errorf("unable to squash %s: %w", branch, err)
+	}
+	commit := strings.TrimSpace(out)
+	if _, err := exec.Ex(dir, "git", "update-ref", "refs/heads/"+branch, commit); err != nil {
+		return fmt.Errorf("unable to update %s: %w", branch, err)
+	}
+
+	args := []string{"push"}
+	if *topic != "" {
+		args = append(args, "-o", "topic="+*topic)
+	}
+	for _, r := range policy.Reviewers {
+		args = append(args, "-o", "r="+r)
+	}
+	for _, l := range policy.Labels {
+		args = append(args, "-o", "hashtag="+l)
+	}
+	args = append(args, remote, commit+":refs/for/"+to)
+	out, err = exec.Ex(dir, "git", args...)
+	if err != nil && strings.Contains(out, noNewChanges) {
+		log.Printf("Change %s of %s is up to date", changeID, branch)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to push change of %s: %w", branch, err)
+	}
+	log.Printf("Pushed change %s of %s for review into %s", changeID, branch, to)
+	return nil
+}
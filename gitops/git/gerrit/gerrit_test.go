@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package gerrit
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+func TestPushChange(t *testing.T) {
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(v, "test")
+	}
+	for _, v := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(v, "test@example.com")
+	}
+	remote := filepath.Join(t.TempDir(), "deploy.git")
+	exec.Mustex("", "git", "init", "-q", "--bare", "-b", "main", remote)
+	exec.Mustex(remote, "git", "config", "receive.advertisePushOptions", "true")
+	dir := t.TempDir()
+	exec.Mustex(dir, "git", "clone", "-q", remote, ".")
+	exec.Mustex(dir, "git", "commit", "-q", "--allow-empty", "-m", "initial")
+	exec.Mustex(dir, "git", "push", "-q", "origin", "HEAD:main")
+	exec.Mustex(dir, "git", "checkout", "-q", "-b", "deploy/app")
+	exec.Mustex(dir, "git", "commit", "-q", "--allow-empty", "-m", "GitOps for app\n\nfirst")
+	exec.Mustex(dir, "git", "commit", "-q", "--allow-empty", "-m", "GitOps for app\n\nsecond")
+
+	*topic = "release-42"
+	id := ChangeID("key")
+	if err := PushChange(dir, "origin", "deploy/app", "main", id, git.ReviewPolicy{Reviewers: []string{"alice"}, Labels: []string{"service:app"}}); err != nil {
+		t.Fatal(err)
+	}
+	msg := exec.Mustex(remote, "git", "log", "-1", "--format=%B", "refs/for/main")
+	if !strings.Contains(msg, "second") || !strings.HasSuffix(strings.TrimSpace(msg), "Change-Id: "+id) {
+		t.Errorf("unexpected change commit message %q", msg)
+	}
+	parent := exec.Mustex(remote, "git", "rev-parse", "refs/for/main^")
+	if main := exec.Mustex(remote, "git", "rev-parse", "main"); parent != main {
+		t.Errorf("change is based on %s, want main %s", parent, main)
+	}
+	if len(id) != 41 || id[0] != 'I' {
+		t.Errorf("invalid Change-Id %q", id)
+	}
+
+	if err := PushChange(dir, "origin", "deploy/app", "main", id, git.ReviewPolicy{AutoMerge: true}); err == nil {
+		t.Error("expected auto-merge to be rejected")
+	}
+}
@@ -14,9 +14,11 @@ package git
 import (
 	"fmt"
 	"log"
+	"net/url"
 	"os"
 	oe "os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/fasterci/rules_gitops/gitops/exec"
@@ -38,10 +40,14 @@ func Clone(repo, dir, mirrorDir, primaryBranch, gitopsPath string) (*Repo, error
 		exec.Mustex("", "git", "clone", "-n", repo, dir)
 	}
 	exec.Mustex(dir, "git", "config", "--local", "core.sparsecheckout", "true")
-	genPath := fmt.Sprintf("%s/\n", gitopsPath)
-	if err := os.WriteFile(filepath.Join(dir, ".git/info/sparse-checkout"), []byte(genPath), 0644); err != nil {
+	// git patterns separate directories with / on every platform
+	genPath := fmt.Sprintf("%s/\n/%s\n/%s\n", filepath.ToSlash(gitopsPath), IgnoreFile, FreezeFile)
+	if err := os.WriteFile(filepath.Join(dir, ".git", "info", "sparse-checkout"), []byte(genPath), 0644); err != nil {
 		return nil, fmt.Errorf("unable to create .git/info/sparse-checkout: %w", err)
 	}
+	if err := configureIgnoreFile(dir); err != nil {
+		return nil, err
+	}
 	exec.Mustex(dir, "git", "checkout", primaryBranch)
 
 	return &Repo{
@@ -51,7 +57,7 @@ func Clone(repo, dir, mirrorDir, primaryBranch, gitopsPath string) (*Repo, error
 
 func CloneOrCheckout(repo, dir, mirrorDir, primaryBranch, gitopsPath, branchPrefix string) (r *Repo, err error) {
 	newRepo := false
-	if _, err = os.Stat(dir + "/.git"); os.IsNotExist(err) {
+	if _, err = os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
 		newRepo = true
 		if err = os.MkdirAll(filepath.Dir(dir), os.ModePerm); err != nil && !os.IsExist(err) {
 			return nil, err
@@ -66,6 +72,9 @@ func CloneOrCheckout(repo, dir, mirrorDir, primaryBranch, gitopsPath, branchPref
 		exec.Mustex(dir, "git", "remote", "set-url", "origin", repo)
 		exec.Mustex(dir, "git", "reset", "--hard")
 	}
+	if err = configureIgnoreFile(dir); err != nil {
+		return nil, err
+	}
 	exec.Mustex(dir, "git", "checkout", "-f", primaryBranch)
 	if !newRepo {
 		exec.Mustex(dir, "git", "fetch", "origin", "--prune")
@@ -77,6 +86,80 @@ func CloneOrCheckout(repo, dir, mirrorDir, primaryBranch, gitopsPath, branchPref
 	}, nil
 }
 
+// RemoteBranches returns the branches of the remote repository starting with prefix
+func RemoteBranches(repo, prefix string) ([]string, error) {
+	out, err := exec.Ex("", "git", "ls-remote", "--heads", repo, "refs/heads/"+prefix+"*")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list branches of %s: %s", repo, strings.TrimSpace(out))
+	}
+	var branches []string
+	for _, line := range strings.Split(out, "\n") {
+		if _, ref, found := strings.Cut(line, "\t"); found {
+			branches = append(branches, strings.TrimPrefix(ref, "refs/heads/"))
+		}
+	}
+	return branches, nil
+}
+
+// RemoteDefaultBranch returns the branch HEAD of the remote repository points to
+func RemoteDefaultBranch(repo string) (string, error) {
+	out, err := exec.Ex("", "git", "ls-remote", "--symref", repo, "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("unable to reach %s: %s", repo, strings.TrimSpace(out))
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if ref, found := strings.CutPrefix(line, "ref: refs/heads/"); found {
+			if branch, _, found := strings.Cut(ref, "\tHEAD"); found {
+				return branch, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unable to find the default branch of %s", repo)
+}
+
+// DeleteRemoteBranches deletes the branches of the remote repository.
+// The push runs in a bare repository created in the empty scratch directory dir.
+func DeleteRemoteBranches(dir, repo string, branches []string) error {
+	if out, err := exec.Ex(dir, "git", "init", "--bare", "-q"); err != nil {
+		return fmt.Errorf("unable to init %s: %s", dir, strings.TrimSpace(out))
+	}
+	args := append([]string{"push", repo, "--delete"}, branches...)
+	if out, err := exec.Ex(dir, "git", args...); err != nil {
+		return fmt.Errorf("unable to delete branches of %s: %s", repo, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// RemoteBranchExists reports whether the branch exists in the remote repository.
+// It fails if the repository is not reachable.
+func RemoteBranchExists(repo, branch string) (bool, error) {
+	out, err := exec.Ex("", "git", "ls-remote", "--heads", repo, "refs/heads/"+branch)
+	if err != nil {
+		return false, fmt.Errorf("unable to reach %s: %s", repo, strings.TrimSpace(out))
+	}
+	return strings.TrimSpace(out) != "", nil
+}
+
+// IgnoreFile is the name of the file in the root of the deployment repository listing
+// paths (in gitignore syntax) that should never be committed by gitops.
+const IgnoreFile = ".gitopsignore"
+
+// FreezeFile is the name of the file in the root of the deployment repository declaring deployment freezes.
+const FreezeFile = ".gitopsfreeze"
+
+// configureIgnoreFile makes git treat the deployment repository IgnoreFile as an excludes file,
+// so matching files are neither reported as modified nor committed.
+func configureIgnoreFile(dir string) error {
+	abs, err := filepath.Abs(filepath.Join(dir, IgnoreFile))
+	if err != nil {
+		return fmt.Errorf("unable to resolve %s: %w", IgnoreFile, err)
+	}
+	if _, err := exec.Ex(dir, "git", "config", "--local", "core.excludesFile", filepath.ToSlash(abs)); err != nil {
+		return fmt.Errorf("unable to configure %s: %w", IgnoreFile, err)
+	}
+	return nil
+}
+
 // DeleteLocalBranches removes local branches by prefix.
 func DeleteLocalBranches(dir, branchprefix string) {
 	branches := exec.Mustex(dir, "git", "for-each-ref", "--format", "%(refname)", "refs/heads/"+branchprefix)
@@ -100,6 +183,45 @@ func DeleteLocalBranches(dir, branchprefix string) {
 type Repo struct {
 	// Dir is the location of the git repo.
 	Dir string
+	// PushRemote is the remote branches are pushed to, origin if empty
+	PushRemote string
+}
+
+// forkRemote is the name of the remote added by AddPushRemote
+const forkRemote = "fork"
+
+// AddPushRemote makes the repository push branches to the fork repo instead of origin.
+// Existing branches of the fork are checked out by SwitchToBranch.
+func (r *Repo) AddPushRemote(repo string) error {
+	if _, err := exec.Ex(r.Dir, "git", "remote", "add", forkRemote, repo); err != nil {
+		if _, err := exec.Ex(r.Dir, "git", "remote", "set-url", forkRemote, repo); err != nil {
+			return fmt.Errorf("unable to add remote %s: %w", repo, err)
+		}
+	}
+	if _, err := exec.Ex(r.Dir, "git", "fetch", "--prune", forkRemote); err != nil {
+		return fmt.Errorf("unable to fetch %s: %w", repo, err)
+	}
+	if _, err := exec.Ex(r.Dir, "git", "config", "--local", "checkout.defaultRemote", forkRemote); err != nil {
+		return err
+	}
+	r.PushRemote = forkRemote
+	return nil
+}
+
+// RepoOwner returns the owner (user, organization or group path) of the repository URL,
+// e.g. forkowner of https://github.com/forkowner/deploy.git or git@github.com:forkowner/deploy.git
+func RepoOwner(repo string) string {
+	p := repo
+	if u, err := url.Parse(repo); err == nil && u.Scheme != "" {
+		p = u.Path
+	} else if _, after, found := strings.Cut(repo, ":"); found {
+		p = after
+	}
+	p = strings.Trim(strings.TrimSuffix(p, ".git"), "/")
+	if i := strings.LastIndex(p, "/"); i > 0 {
+		return p[:i]
+	}
+	return ""
 }
 
 // Clean cleans up the repo
@@ -126,6 +248,53 @@ func (r *Repo) RecreateBranch(branch, primaryBranch string) {
 	exec.Mustex(r.Dir, "git", "checkout", branch)
 }
 
+// Discard drops all uncommitted changes, including untracked files under gitopsPath
+func (r *Repo) Discard(gitopsPath string) {
+	exec.Mustex(r.Dir, "git", "reset", "-q", "--hard")
+	exec.Mustex(r.Dir, "git", "clean", "-q", "-fd", "--", gitopsPath)
+}
+
+// Restore resets content of the paths (both index and working tree) to their state at ref.
+// Files added after ref are removed.
+func (r *Repo) Restore(ref string, paths ...string) error {
+	args := append([]string{"restore", "--source", ref, "--staged", "--worktree", "--"}, paths...)
+	if _, err := exec.Ex(r.Dir, "git", args...); err != nil {
+		return fmt.Errorf("unable to restore %v from %s: %w", paths, ref, err)
+	}
+	return nil
+}
+
+// ReadTree returns the content of all files under dir at the specified ref keyed by path
+func (r *Repo) ReadTree(ref, dir string) (map[string][]byte, error) {
+	out, err := exec.Ex(r.Dir, "git", "ls-tree", "-r", "--name-only", ref, "--", dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s at %s: %w", dir, ref, err)
+	}
+	files := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimSpace(out), "\n") {
+		if name == "" {
+			continue
+		}
+		cmd := oe.Command("git", "show", ref+":"+name)
+		cmd.Dir = r.Dir
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s at %s: %w", name, ref, err)
+		}
+		files[name] = b
+	}
+	return files, nil
+}
+
+// Head returns the commit hash of the current branch
+func (r *Repo) Head() (string, error) {
+	out, err := exec.Ex(r.Dir, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve HEAD: %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
 // GetLastCommitMessage fetches the commit message from the most recent change of the branch
 func (r *Repo) GetLastCommitMessage() (msg string) {
 	msg, err := exec.Ex(r.Dir, "git", "log", "-1", "--pretty=%B")
@@ -135,6 +304,37 @@ func (r *Repo) GetLastCommitMessage() (msg string) {
 	return msg
 }
 
+// FindCommitMessage returns the message of the most recent commit reachable from ref containing text, or empty string if there is none
+func (r *Repo) FindCommitMessage(ref, text string) string {
+	msg, err := exec.Ex(r.Dir, "git", "log", "-1", "--pretty=%B", "--fixed-strings", "--grep="+text, ref)
+	if err != nil {
+		return ""
+	}
+	return msg
+}
+
+// CommitMessages returns messages of at most max commits reachable from ref containing text, newest first.
+// All matching commits are returned if max is not positive.
+func (r *Repo) CommitMessages(ref, text string, max int) ([]string, error) {
+	args := []string{"log", "-z", "--pretty=%B", "--fixed-strings", "--grep=" + text}
+	if max > 0 {
+		args = append(args, fmt.Sprintf("-n%d", max))
+	}
+	cmd := oe.Command("git", append(args, ref, "--")...)
+	cmd.Dir = r.Dir
+	b, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read commit messages of %s: %w", ref, err)
+	}
+	var messages []string
+	for _, msg := range strings.Split(string(b), "\x00") {
+		if msg = strings.TrimSpace(msg); msg != "" {
+			messages = append(messages, msg)
+		}
+	}
+	return messages, nil
+}
+
 // Commit all changes to the current branch. returns true if there were any changes
 func (r *Repo) Commit(message, gitopsPath string) bool {
 	exec.Mustex(r.Dir, "git", "add", gitopsPath)
@@ -145,6 +345,125 @@ func (r *Repo) Commit(message, gitopsPath string) bool {
 	return true
 }
 
+// Add stages the paths, including untracked files outside of the sparse checkout
+func (r *Repo) Add(paths ...string) error {
+	args := append([]string{"add", "--sparse", "--"}, paths...)
+	if _, err := exec.Ex(r.Dir, "git", args...); err != nil {
+		return fmt.Errorf("unable to stage %v: %w", paths, err)
+	}
+	return nil
+}
+
+// DiffStat summarizes the size of a change set
+type DiffStat struct {
+	// Files is the number of changed files
+	Files int
+	// Lines is the number of added plus removed lines
+	Lines int
+}
+
+// StagedDiffStat stages all changes under gitopsPath and returns the size of the staged diff
+func (r *Repo) StagedDiffStat(gitopsPath string) (DiffStat, error) {
+	if _, err := exec.Ex(r.Dir, "git", "add", gitopsPath); err != nil {
+		return DiffStat{}, fmt.Errorf("unable to stage %s: %w", gitopsPath, err)
+	}
+	cmd := oe.Command("git", "diff", "--cached", "--numstat", "--", gitopsPath)
+	cmd.Dir = r.Dir
+	b, err := cmd.Output()
+	if err != nil {
+		return DiffStat{}, fmt.Errorf("unable to compute diff: %w", err)
+	}
+	return parseNumstat(string(b)), nil
+}
+
+// StagedDiff stages all changes under gitopsPath and returns the staged diff, or the diff stat if stat is set
+func (r *Repo) StagedDiff(gitopsPath string, stat bool) (string, error) {
+	if _, err := exec.Ex(r.Dir, "git", "add", gitopsPath); err != nil {
+		return "", fmt.Errorf("unable to stage %s: %w", gitopsPath, err)
+	}
+	args := []string{"diff", "--cached"}
+	if stat {
+		args = append(args, "--stat")
+	}
+	cmd := oe.Command("git", append(args, "--", gitopsPath)...)
+	cmd.Dir = r.Dir
+	b, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("unable to compute diff: %w", err)
+	}
+	return string(b), nil
+}
+
+// FileChange is a file changed between two commits
+type FileChange struct {
+	Path string
+	// Status is A for added, M for modified and D for deleted files
+	Status string
+	// Added and Removed are the numbers of added and removed lines, zero for binary files
+	Added   int
+	Removed int
+}
+
+// ChangedFiles returns the files under path changed by head since its merge base with base, the files
+// a PR from head into base changes. The merge base is returned to read the previous content of the files.
+func (r *Repo) ChangedFiles(base, head, path string) (string, []FileChange, error) {
+	out, err := exec.Ex(r.Dir, "git", "merge-base", base, head)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to find the merge base of %s and %s: %w", base, head, err)
+	}
+	mergeBase := strings.TrimSpace(out)
+	diff := func(format string) ([]string, error) {
+		cmd := oe.Command("git", "diff", "--no-renames", "-z", format, mergeBase, head, "--", path)
+		cmd.Dir = r.Dir
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute diff of %s: %w", head, err)
+		}
+		return strings.Split(strings.TrimSuffix(string(b), "\x00"), "\x00"), nil
+	}
+	statuses, err := diff("--name-status")
+	if err != nil {
+		return "", nil, err
+	}
+	numstat, err := diff("--numstat")
+	if err != nil {
+		return "", nil, err
+	}
+	// -z --name-status separates the status and the path with NUL, --numstat the counts and the path with tabs
+	lines := make(map[string][2]int)
+	for _, entry := range numstat {
+		fields := strings.SplitN(entry, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		added, _ := strconv.Atoi(fields[0])
+		removed, _ := strconv.Atoi(fields[1])
+		lines[fields[2]] = [2]int{added, removed}
+	}
+	var changes []FileChange
+	for i := 0; i+1 < len(statuses); i += 2 {
+		name := statuses[i+1]
+		changes = append(changes, FileChange{Path: name, Status: statuses[i], Added: lines[name][0], Removed: lines[name][1]})
+	}
+	return mergeBase, changes, nil
+}
+
+// parseNumstat parses the output of git diff --numstat.
+// Binary files are reported as "-" and count as changed files without lines.
+func parseNumstat(out string) (ds DiffStat) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		ds.Files++
+		added, _ := strconv.Atoi(fields[0])
+		removed, _ := strconv.Atoi(fields[1])
+		ds.Lines += added + removed
+	}
+	return
+}
+
 // IsClean returns true if there is no local changes (nothing to commit)
 func (r *Repo) IsClean() bool {
 	cmd := oe.Command("git", "status", "--porcelain")
@@ -159,7 +478,11 @@ func (r *Repo) IsClean() bool {
 // Push pushes all local changes to the remote repository
 // all changes should be already commited
 func (r *Repo) Push(branches []string) {
-	args := append([]string{"push", "origin", "-f", "--set-upstream"}, branches...)
+	remote := r.PushRemote
+	if remote == "" {
+		remote = "origin"
+	}
+	args := append([]string{"push", remote, "-f", "--set-upstream"}, branches...)
 	exec.Mustex(r.Dir, "git", args...)
 }
 
@@ -0,0 +1,288 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+// Package gitea creates pull requests with the REST API of a Gitea server.
+package gitea
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+var (
+	giteaURL    = flag.String("gitea_url", os.Getenv("GITEA_URL"), "base URL of the Gitea server, e.g. https://gitea.example.com")
+	repo        = flag.String("gitea_repo", "", "the owner/name of the gitea repository to create pull requests in")
+	accessToken = flag.String("gitea_access_token", os.Getenv("GITEA_TOKEN"), "the access token to authenticate requests, with the write:repository scope")
+)
+
+// pageSize is the number of pull requests requested per page
+const pageSize = 50
+
+type branch struct {
+	Ref  string `json:"ref"`
+	Repo *struct {
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repo"`
+}
+
+type pullRequest struct {
+	Number  int    `json:"number"`
+	HTMLURL string `json:"html_url"`
+	Body    string `json:"body"`
+	Head    branch `json:"head"`
+	Base    branch `json:"base"`
+}
+
+func (pr pullRequest) toPR() *git.PR {
+	return &git.PR{Number: pr.Number, URL: pr.HTMLURL, Body: pr.Body, Branch: pr.Head.Ref}
+}
+
+// Validate reports all missing or invalid flags of the provider without contacting Gitea
+func Validate() error {
+	var errs []error
+	if u, err := url.Parse(*giteaURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("gitea_url %q must be an absolute URL", *giteaURL))
+	}
+	if owner, name, found := strings.Cut(*repo, "/"); !found || owner == "" || name == "" {
+		errs = append(errs, fmt.Errorf("gitea_repo %q must be owner/name", *repo))
+	}
+	if *accessToken == "" {
+		errs = append(errs, errors.New("gitea_access_token must be set"))
+	}
+	redact.Add(*accessToken)
+	return errors.Join(errs...)
+}
+
+// Check verifies that the token has push permission to the repository
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	var r struct {
+		Permissions struct {
+			Push bool `json:"push"`
+		} `json:"permissions"`
+	}
+	if err := call(ctx, "GET", repoURL(""), nil, &r); err != nil {
+		return fmt.Errorf("unable to get repository %s: %w", *repo, err)
+	}
+	if !r.Permissions.Push {
+		return fmt.Errorf("gitea_access_token lacks push permission to %s", *repo)
+	}
+	return nil
+}
+
+// CreatePR creates a pull request using branch names from and to
+func CreatePR(from, to, title, body string) error {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// CreatePRWithPolicy creates the pull request, or reuses the open one, and enforces the policy.
+// Labels and assignees are not supported.
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	if len(policy.Labels) > 0 || len(policy.Assignees) > 0 {
+		return fmt.Errorf("gitea does not support labels and assignees, unable to enforce %+v", policy)
+	}
+	var pr pullRequest
+	err := call(context.Background(), "POST", repoURL("/pulls"), map[string]string{"head": from, "base": to, "title": title, "body": body}, &pr)
+	var se *git.StatusError
+	if errors.As(err, &se) && se.StatusCode == http.StatusConflict {
+		log.Printf("reusing existing PR from %s", from)
+		found, err := FindOpenPR(from, to)
+		if err != nil || found == nil {
+			return err
+		}
+		return applyPolicy(found.Number, policy)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create PR from %s: %w", from, err)
+	}
+	log.Printf("PR %s was created", pr.HTMLURL)
+	return applyPolicy(pr.Number, policy)
+}
+
+// FindOpenPR returns the open pull request from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	forkOwner, name := git.SplitHead(from)
+	var found *git.PR
+	err := listOpen(func(pr pullRequest) bool {
+		if pr.Head.Ref != name || pr.Base.Ref != to {
+			return true
+		}
+		if forkOwner != "" && (pr.Head.Repo == nil || pr.Head.Repo.Owner.Login != forkOwner) {
+			return true
+		}
+		found = pr.toPR()
+		return false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find PR from %s: %w", from, err)
+	}
+	return found, nil
+}
+
+// ListOpenPRs returns the open pull requests into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	var prs []*git.PR
+	err := listOpen(func(pr pullRequest) bool {
+		if pr.Base.Ref == to && strings.HasPrefix(pr.Head.Ref, prefix) {
+			prs = append(prs, pr.toPR())
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list PRs into %s: %w", to, err)
+	}
+	return prs, nil
+}
+
+// listOpen calls f with the open pull requests of the repository until it returns false
+func listOpen(f func(pr pullRequest) bool) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	for page := 1; ; page++ {
+		q := url.Values{"state": {"open"}, "page": {strconv.Itoa(page)}, "limit": {strconv.Itoa(pageSize)}}
+		var prs []pullRequest
+		if err := call(context.Background(), "GET", repoURL("/pulls?"+q.Encode()), nil, &prs); err != nil {
+			return err
+		}
+		for _, pr := range prs {
+			if !f(pr) {
+				return nil
+			}
+		}
+		if len(prs) < pageSize {
+			return nil
+		}
+	}
+}
+
+// UpdateOpenPR replaces the title and the body of the open pull request and enforces the policy.
+// Labels and assignees are not supported.
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	if len(policy.Labels) > 0 || len(policy.Assignees) > 0 {
+		return fmt.Errorf("gitea does not support labels and assignees, unable to enforce %+v", policy)
+	}
+	if err := call(context.Background(), "PATCH", repoURL(fmt.Sprintf("/pulls/%d", pr.Number)), map[string]string{"title": title, "body": body}, nil); err != nil {
+		return fmt.Errorf("unable to update PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Updated PR %d", pr.Number)
+	return applyPolicy(pr.Number, policy)
+}
+
+// CommentOpenPR adds the comment to the open pull request
+func CommentOpenPR(pr *git.PR, comment string) error {
+	if err := call(context.Background(), "POST", repoURL(fmt.Sprintf("/issues/%d/comments", pr.Number)), map[string]string{"body": comment}, nil); err != nil {
+		return fmt.Errorf("unable to comment on PR %d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+// CloseOpenPR comments on the open pull request and closes it
+func CloseOpenPR(pr *git.PR, comment string) error {
+	if err := CommentOpenPR(pr, comment); err != nil {
+		return err
+	}
+	if err := call(context.Background(), "PATCH", repoURL(fmt.Sprintf("/pulls/%d", pr.Number)), map[string]string{"state": "closed"}, nil); err != nil {
+		return fmt.Errorf("unable to close PR %d: %w", pr.Number, err)
+	}
+	log.Printf("Closed PR %d", pr.Number)
+	return nil
+}
+
+// DefaultBranch returns the default branch of the repository
+func DefaultBranch() (string, error) {
+	if err := Validate(); err != nil {
+		return "", err
+	}
+	var r struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+	if err := call(context.Background(), "GET", repoURL(""), nil, &r); err != nil {
+		return "", fmt.Errorf("unable to get the default branch: %w", err)
+	}
+	if r.DefaultBranch == "" {
+		return "", errors.New("the repository has no default branch")
+	}
+	return r.DefaultBranch, nil
+}
+
+// applyPolicy requests the reviewers of the policy and schedules the merge once the checks succeed if auto-merge is enabled
+func applyPolicy(number int, policy git.ReviewPolicy) error {
+	if len(policy.Reviewers) > 0 || len(policy.TeamReviewers) > 0 {
+		reviewers := map[string][]string{"reviewers": policy.Reviewers, "team_reviewers": policy.TeamReviewers}
+		if err := call(context.Background(), "POST", repoURL(fmt.Sprintf("/pulls/%d/requested_reviewers", number)), reviewers, nil); err != nil {
+			return fmt.Errorf("unable to request reviewers of PR %d: %w", number, err)
+		}
+	}
+	if policy.AutoMerge {
+		merge := map[string]interface{}{"Do": "merge", "merge_when_checks_succeed": true}
+		if err := call(context.Background(), "POST", repoURL(fmt.Sprintf("/pulls/%d/merge", number)), merge, nil); err != nil {
+			return fmt.Errorf("unable to enable auto-merge of PR %d: %w", number, err)
+		}
+	}
+	return nil
+}
+
+// repoURL returns the API URL of the path of the repository
+func repoURL(path string) string {
+	return strings.TrimSuffix(*giteaURL, "/") + "/api/v1/repos/" + *repo + path
+}
+
+// call sends the JSON request to the Gitea API and decodes the response into out if it is not nil
+func call(ctx context.Context, method, endpoint string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "token "+*accessToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return &git.StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("gitea responded with %s", resp.Status)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,125 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package gitea
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// fakeGitea serves the pull request endpoints of the deploy/gitops repository
+func fakeGitea(t *testing.T, requests *[]string) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/repos/deploy/gitops", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"default_branch": "main", "permissions": {"push": true}}`))
+	})
+	mux.HandleFunc("/api/v1/repos/deploy/gitops/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token secret" {
+			t.Errorf("unexpected authorization %q", r.Header.Get("Authorization"))
+		}
+		if r.Method == "GET" {
+			if r.URL.Query().Get("page") != "1" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"number": 7, "html_url": "https://gitea/deploy/gitops/pulls/7", "head": {"ref": "deploy/app"}, "base": {"ref": "main"}},
+				{"number": 8, "html_url": "https://gitea/deploy/gitops/pulls/8", "head": {"ref": "feature"}, "base": {"ref": "main"}}]`))
+			return
+		}
+		var pr map[string]string
+		json.NewDecoder(r.Body).Decode(&pr)
+		if pr["head"] == "deploy/app" {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"number": 9, "html_url": "https://gitea/deploy/gitops/pulls/9"}`))
+	})
+	mux.HandleFunc("/api/v1/repos/deploy/gitops/", func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.Method+" "+strings.TrimPrefix(r.URL.Path, "/api/v1/repos/deploy/gitops"))
+		w.Write([]byte(`{}`))
+	})
+	ts := httptest.NewServer(mux)
+	*giteaURL, *repo, *accessToken = ts.URL+"/", "deploy/gitops", "secret"
+	return ts
+}
+
+func TestCreatePRWithPolicy(t *testing.T) {
+	var requests []string
+	ts := fakeGitea(t, &requests)
+	defer ts.Close()
+
+	policy := git.ReviewPolicy{Reviewers: []string{"alice"}, AutoMerge: true}
+	if err := CreatePRWithPolicy("deploy/web", "main", "title", "body", policy); err != nil {
+		t.Fatal(err)
+	}
+	if err := CreatePRWithPolicy("deploy/app", "main", "title", "body", git.ReviewPolicy{Reviewers: []string{"bob"}}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"POST /pulls/9/requested_reviewers", "POST /pulls/9/merge", "POST /pulls/7/requested_reviewers"}
+	if strings.Join(requests, ",") != strings.Join(want, ",") {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+	if err := CreatePRWithPolicy("deploy/web", "main", "title", "body", git.ReviewPolicy{Labels: []string{"x"}}); err == nil {
+		t.Error("expected labels to be rejected")
+	}
+}
+
+func TestOpenPRs(t *testing.T) {
+	var requests []string
+	ts := fakeGitea(t, &requests)
+	defer ts.Close()
+
+	prs, err := ListOpenPRs("deploy/", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 1 || prs[0].Number != 7 || prs[0].Branch != "deploy/app" {
+		t.Errorf("ListOpenPRs() = %+v", prs)
+	}
+	pr, err := FindOpenPR("deploy/app", "main")
+	if err != nil || pr == nil || pr.URL != "https://gitea/deploy/gitops/pulls/7" {
+		t.Errorf("FindOpenPR() = %+v, %v", pr, err)
+	}
+	if pr, err := FindOpenPR("deploybot:deploy/app", "main"); err != nil || pr != nil {
+		t.Errorf("FindOpenPR() of a fork = %+v, %v", pr, err)
+	}
+	if err := CloseOpenPR(prs[0], "retired"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(requests, ",") != "POST /issues/7/comments,PATCH /pulls/7" {
+		t.Errorf("requests = %v", requests)
+	}
+	if branch, err := DefaultBranch(); err != nil || branch != "main" {
+		t.Errorf("DefaultBranch() = %q, %v", branch, err)
+	}
+	if err := Check(context.Background()); err != nil {
+		t.Errorf("Check() = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	*giteaURL, *repo, *accessToken = "gitea.example.com", "gitops", ""
+	err := Validate()
+	for _, want := range []string{"gitea_url", "gitea_repo", "gitea_access_token"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want %s", err, want)
+		}
+	}
+}
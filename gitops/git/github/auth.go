@@ -0,0 +1,170 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/redact"
+	"github.com/google/go-github/v68/github"
+)
+
+var (
+	deviceFlow    = flag.Bool("github_device_flow", false, "authenticate interactively with the OAuth device flow when github_access_token is not set")
+	oauthClientID = flag.String("github_oauth_client_id", "", "the client ID of the OAuth app used by github_device_flow")
+)
+
+// fineGrainedPrefix is the prefix of fine-grained personal access tokens
+const fineGrainedPrefix = "github_pat_"
+
+// FineGrained reports whether the token is a fine-grained personal access token.
+// Fine-grained tokens have repository permissions instead of OAuth scopes.
+func FineGrained(token string) bool {
+	return strings.HasPrefix(token, fineGrainedPrefix)
+}
+
+// fineGrainedPermissions are probed by CheckFineGrained: the endpoint of each permission
+// answers a request with an empty body 422 if the token has the permission, 403 otherwise
+var fineGrainedPermissions = []struct {
+	name string
+	path string
+}{
+	{"contents: write", "git/refs"},
+	{"pull_requests: write", "pulls"},
+}
+
+// CheckFineGrained verifies that a fine-grained token has the repository permissions to push
+// deployment branches and create PRs. The probes fail validation and do not modify the repository.
+func CheckFineGrained(ctx context.Context, gh *github.Client, owner, repo string) error {
+	var missing []string
+	for _, p := range fineGrainedPermissions {
+		req, err := gh.NewRequest("POST", fmt.Sprintf("repos/%s/%s/%s", owner, repo, p.path), struct{}{})
+		if err != nil {
+			return err
+		}
+		resp, err := gh.Do(ctx, req, nil)
+		if resp == nil {
+			return err
+		}
+		switch resp.StatusCode {
+		case http.StatusUnprocessableEntity:
+		case http.StatusForbidden, http.StatusNotFound:
+			missing = append(missing, p.name)
+		default:
+			return fmt.Errorf("unable to verify %s permission of repository %s/%s: %w", p.name, owner, repo, err)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("fine-grained access token lacks %s permissions of repository %s/%s", strings.Join(missing, ", "), owner, repo)
+	}
+	return nil
+}
+
+var (
+	deviceOnce  sync.Once
+	deviceToken string
+	deviceErr   error
+)
+
+// accessToken returns github_access_token, or the token of the device flow if it is enabled.
+// The device flow runs once per process.
+func accessToken(ctx context.Context) (string, error) {
+	if *pat != "" || !*deviceFlow {
+		return *pat, nil
+	}
+	deviceOnce.Do(func() {
+		deviceToken, deviceErr = DeviceFlow(ctx, loginURL(), *oauthClientID)
+		redact.Add(deviceToken)
+	})
+	return deviceToken, deviceErr
+}
+
+// loginURL returns the OAuth endpoint of github.com or of the enterprise server
+func loginURL() string {
+	if *githubEnterpriseHost != "" {
+		return "https://" + *githubEnterpriseHost + "/login/"
+	}
+	return "https://github.com/login/"
+}
+
+const deviceGrantType = "urn:ietf:params:oauth:grant-type:device_code"
+
+// DeviceFlow authorizes the OAuth app with the repo scope interactively: it prints the
+// verification URL and the user code and polls for the access token until the user enters the code
+func DeviceFlow(ctx context.Context, login, clientID string) (string, error) {
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURI string `json:"verification_uri"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+	}
+	if err := postForm(ctx, login+"device/code", url.Values{"client_id": {clientID}, "scope": {"repo"}}, &code); err != nil {
+		return "", fmt.Errorf("unable to start the device flow: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "To authenticate with GitHub, open %s and enter the code %s\n", code.VerificationURI, code.UserCode)
+
+	interval := time.Duration(code.Interval) * time.Second
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(interval):
+		}
+		var token struct {
+			AccessToken      string `json:"access_token"`
+			Error            string `json:"error"`
+			ErrorDescription string `json:"error_description"`
+			Interval         int    `json:"interval"`
+		}
+		err := postForm(ctx, login+"oauth/access_token", url.Values{
+			"client_id":   {clientID},
+			"device_code": {code.DeviceCode},
+			"grant_type":  {deviceGrantType},
+		}, &token)
+		if err != nil {
+			return "", fmt.Errorf("unable to complete the device flow: %w", err)
+		}
+		switch token.Error {
+		case "":
+			return token.AccessToken, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += 5 * time.Second
+			if token.Interval > 0 {
+				interval = time.Duration(token.Interval) * time.Second
+			}
+		default:
+			return "", fmt.Errorf("device flow failed: %s: %s", token.Error, token.ErrorDescription)
+		}
+	}
+	return "", errors.New("device flow failed: the user code expired")
+}
+
+// postForm posts the form and decodes the JSON response
+func postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,69 @@
+package github
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v68/github"
+)
+
+func TestCheckFineGrained(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/deploy/git/refs", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		w.Write([]byte(`{"message": "Invalid request"}`))
+	})
+	mux.HandleFunc("/repos/org/deploy/pulls", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accepted-GitHub-Permissions", "pull_requests=write")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"message": "Resource not accessible by personal access token"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(ts.URL + "/")
+	err := CheckFineGrained(context.Background(), gh, "org", "deploy")
+	if err == nil || !strings.Contains(err.Error(), "lacks pull_requests: write permissions") {
+		t.Errorf("CheckFineGrained() = %v", err)
+	}
+	if FineGrained("ghp_classic") || !FineGrained("github_pat_11AB") {
+		t.Error("unexpected FineGrained() token kind")
+	}
+}
+
+func TestDeviceFlow(t *testing.T) {
+	polls := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/device/code", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "app" || r.FormValue("scope") != "repo" {
+			t.Errorf("unexpected device code request %v", r.Form)
+		}
+		w.Write([]byte(`{"device_code": "dc", "user_code": "ABCD-1234", "verification_uri": "https://github.com/login/device", "expires_in": 60, "interval": 0}`))
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("device_code") != "dc" || r.FormValue("grant_type") != deviceGrantType {
+			t.Errorf("unexpected access token request %v", r.Form)
+		}
+		polls++
+		if polls < 2 {
+			w.Write([]byte(`{"error": "authorization_pending"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token": "gho_token", "token_type": "bearer", "scope": "repo"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	token, err := DeviceFlow(context.Background(), ts.URL+"/login/", "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "gho_token" || polls != 2 {
+		t.Errorf("DeviceFlow() = %q after %d polls", token, polls)
+	}
+}
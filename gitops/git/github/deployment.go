@@ -0,0 +1,37 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/google/go-github/v68/github"
+)
+
+// Deploy creates a GitHub deployment of the ref and marks it queued until the PR of the ref is merged.
+// The deployment does not merge the default branch into the ref and does not wait for commit statuses,
+// the checks of the deployment PR gate the merge instead.
+func Deploy(ctx context.Context, gh *github.Client, owner, repo string, d git.Deployment) (string, error) {
+	noContexts := []string{}
+	deployment, _, err := gh.Repositories.CreateDeployment(ctx, owner, repo, &github.DeploymentRequest{
+		Ref:              github.Ptr(d.Ref),
+		Environment:      github.Ptr(d.Environment),
+		Description:      github.Ptr(d.Description),
+		Payload:          d.Payload,
+		AutoMerge:        github.Ptr(false),
+		RequiredContexts: &noContexts,
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to create deployment of %s to %s: %w", d.Ref, d.Environment, err)
+	}
+	_, _, err = gh.Repositories.CreateDeploymentStatus(ctx, owner, repo, deployment.GetID(), &github.DeploymentStatusRequest{
+		State:       github.Ptr("queued"),
+		Description: github.Ptr("Waiting for the deployment PR to merge"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to set the status of deployment %d: %w", deployment.GetID(), err)
+	}
+	log.Printf("Created deployment %d of %s to %s", deployment.GetID(), d.Ref, d.Environment)
+	return deployment.GetURL(), nil
+}
@@ -9,6 +9,8 @@ import (
 	"net/http"
 	"os"
 
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/redact"
 	"github.com/google/go-github/v68/github"
 	"golang.org/x/oauth2"
 )
@@ -21,34 +23,74 @@ var (
 )
 
 func CreatePR(from, to, title, body string) error {
-	if *repoOwner == "" {
-		return errors.New("github_repo_owner must be set")
-	}
-	if *repo == "" {
-		return errors.New("github_repo must be set")
-	}
-	if *pat == "" {
-		return errors.New("github_access_token must be set")
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// newClient validates flags and returns the API client
+func newClient(ctx context.Context) (*github.Client, error) {
+	if err := Validate(); err != nil {
+		return nil, err
 	}
 
-	ctx := context.Background()
+	token, err := accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
 	ts := oauth2.StaticTokenSource(
-		&oauth2.Token{AccessToken: *pat},
+		&oauth2.Token{AccessToken: token},
 	)
 	tc := oauth2.NewClient(ctx, ts)
 
-	var gh *github.Client
 	if *githubEnterpriseHost != "" {
 		baseUrl := "https://" + *githubEnterpriseHost + "/api/v3/"
 		uploadUrl := "https://" + *githubEnterpriseHost + "/api/uploads/"
-		var err error
-		gh, err = github.NewEnterpriseClient(baseUrl, uploadUrl, tc)
-		if err != nil {
-			log.Println("Error in creating github client", err)
-			return nil
-		}
-	} else {
-		gh = github.NewClient(tc)
+		return github.NewEnterpriseClient(baseUrl, uploadUrl, tc)
+	}
+	return github.NewClient(tc), nil
+}
+
+// Validate reports all missing flags of the provider without contacting GitHub
+func Validate() error {
+	var errs []error
+	if *repoOwner == "" {
+		errs = append(errs, errors.New("github_repo_owner must be set"))
+	}
+	if *repo == "" {
+		errs = append(errs, errors.New("github_repo must be set"))
+	}
+	if *pat == "" && !*deviceFlow {
+		errs = append(errs, errors.New("github_access_token must be set"))
+	}
+	if *pat == "" && *deviceFlow && *oauthClientID == "" {
+		errs = append(errs, errors.New("github_oauth_client_id must be set for github_device_flow"))
+	}
+	redact.Add(*pat)
+	return errors.Join(errs...)
+}
+
+// Check verifies that the access token can push to the repository.
+// The permissions of fine-grained tokens are verified in place of the scopes of classic tokens.
+func Check(ctx context.Context) error {
+	gh, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := CheckRepo(ctx, gh, *repoOwner, *repo); err != nil {
+		return err
+	}
+	if FineGrained(*pat) {
+		return CheckFineGrained(ctx, gh, *repoOwner, *repo)
+	}
+	return nil
+}
+
+// CreatePRWithPolicy creates the PR, or reuses the open one, and enforces the review policy
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		log.Println("Error in creating github client", err)
+		return err
 	}
 
 	pr := &github.NewPullRequest{
@@ -63,13 +105,24 @@ func CreatePR(from, to, title, body string) error {
 	createdPr, resp, err := gh.PullRequests.Create(ctx, *repoOwner, *repo, pr)
 	if err == nil {
 		log.Println("Created PR: ", *createdPr.URL)
+		return ApplyPolicy(ctx, gh, *repoOwner, *repo, createdPr, policy)
+	}
+	if resp == nil {
+		// the request failed in transit
 		return err
 	}
 
 	if resp.StatusCode == http.StatusUnprocessableEntity {
 		// Handle the case: "Create PR" request fails because it already exists
 		log.Println("Reusing existing PR")
-		return nil
+		if policy.IsZero() {
+			return nil
+		}
+		existing, err := FindPR(ctx, gh, *repoOwner, *repo, from, to)
+		if err != nil {
+			return err
+		}
+		return ApplyPolicy(ctx, gh, *repoOwner, *repo, existing, policy)
 	}
 
 	// All other github responses
@@ -81,5 +134,90 @@ func CreatePR(from, to, title, body string) error {
 		log.Println("github response: ", string(responseBody))
 	}
 
-	return err
+	return &git.StatusError{StatusCode: resp.StatusCode, Err: err}
+}
+
+// FindOpenPR returns the open PR from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := OpenPR(ctx, gh, *repoOwner, *repo, from, to)
+	return ToPR(pr), err
+}
+
+// UpdateOpenPR replaces the title and the body of the open PR and enforces the review policy
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	return UpdatePR(ctx, gh, *repoOwner, *repo, pr, title, body, policy)
+}
+
+// ListOpenPRs returns the open PRs into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ListPRs(ctx, gh, *repoOwner, *repo, prefix, to)
+}
+
+// CloseOpenPR comments on the open PR and closes it without merging
+func CloseOpenPR(pr *git.PR, comment string) error {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	return ClosePR(ctx, gh, *repoOwner, *repo, pr, comment)
+}
+
+// CommentOpenPR adds the comment to the open PR
+func CommentOpenPR(pr *git.PR, comment string) error {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return err
+	}
+	return CommentPR(ctx, gh, *repoOwner, *repo, pr, comment)
+}
+
+// DefaultBranch returns the default branch of the repository
+func DefaultBranch() (string, error) {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return RepositoryDefaultBranch(ctx, gh, *repoOwner, *repo)
+}
+
+// EnqueueOpenPR adds the open PR from the branch into to to the merge queue of to
+func EnqueueOpenPR(from, to string) (*git.QueueEntry, error) {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pr, err := FindPR(ctx, gh, *repoOwner, *repo, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return EnqueuePR(ctx, gh, pr)
+}
+
+// CreateDeployment records the deployment of a release train in the repository
+func CreateDeployment(d git.Deployment) (string, error) {
+	ctx := context.Background()
+	gh, err := newClient(ctx)
+	if err != nil {
+		return "", err
+	}
+	return Deploy(ctx, gh, *repoOwner, *repo, d)
 }
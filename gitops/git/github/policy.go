@@ -0,0 +1,252 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/google/go-github/v68/github"
+)
+
+// CheckRepo verifies that the client is able to push to the repository.
+// Classic tokens must also have the repo or public_repo scope to create PRs.
+func CheckRepo(ctx context.Context, gh *github.Client, owner, repo string) error {
+	r, resp, err := gh.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return fmt.Errorf("unable to access repository %s/%s: %w", owner, repo, err)
+	}
+	if perms := r.GetPermissions(); perms != nil && !perms["push"] {
+		return fmt.Errorf("no push permission to repository %s/%s", owner, repo)
+	}
+	if scopes, ok := resp.Header["X-Oauth-Scopes"]; ok {
+		for _, scope := range strings.Split(strings.Join(scopes, ","), ",") {
+			if s := strings.TrimSpace(scope); s == "repo" || s == "public_repo" {
+				return nil
+			}
+		}
+		return fmt.Errorf("access token scopes %v do not include repo", scopes)
+	}
+	return nil
+}
+
+// FindPR returns the open PR from branch from into branch to
+func FindPR(ctx context.Context, gh *github.Client, owner, repo, from, to string) (*github.PullRequest, error) {
+	pr, err := OpenPR(ctx, gh, owner, repo, from, to)
+	if err == nil && pr == nil {
+		err = fmt.Errorf("no open PR from %s into %s", from, to)
+	}
+	return pr, err
+}
+
+// OpenPR returns the open PR from the branch into to, nil if there is none
+func OpenPR(ctx context.Context, gh *github.Client, owner, repo, from, to string) (*github.PullRequest, error) {
+	prs, _, err := gh.PullRequests.List(ctx, owner, repo, &github.PullRequestListOptions{
+		State: "open",
+		Head:  head(owner, from),
+		Base:  to,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find PR from %s: %w", from, err)
+	}
+	if len(prs) == 0 {
+		return nil, nil
+	}
+	return prs[0], nil
+}
+
+// UpdatePR replaces the title and the body of the PR and enforces the review policy
+func UpdatePR(ctx context.Context, gh *github.Client, owner, repo string, pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	updated, _, err := gh.PullRequests.Edit(ctx, owner, repo, pr.Number, &github.PullRequest{Title: &title, Body: &body})
+	if err != nil {
+		return fmt.Errorf("unable to update PR #%d: %w", pr.Number, err)
+	}
+	log.Println("Updated PR: ", updated.GetHTMLURL())
+	return ApplyPolicy(ctx, gh, owner, repo, updated, policy)
+}
+
+// ListPRs returns the open PRs into to from branches starting with prefix
+func ListPRs(ctx context.Context, gh *github.Client, owner, repo, prefix, to string) ([]*git.PR, error) {
+	opts := &github.PullRequestListOptions{State: "open", Base: to, ListOptions: github.ListOptions{PerPage: 100}}
+	var prs []*git.PR
+	for {
+		page, resp, err := gh.PullRequests.List(ctx, owner, repo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list PRs into %s: %w", to, err)
+		}
+		for _, pr := range page {
+			if strings.HasPrefix(pr.GetHead().GetRef(), prefix) {
+				prs = append(prs, ToPR(pr))
+			}
+		}
+		if resp.NextPage == 0 {
+			return prs, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// CommentPR adds the comment to the PR
+func CommentPR(ctx context.Context, gh *github.Client, owner, repo string, pr *git.PR, comment string) error {
+	if _, _, err := gh.Issues.CreateComment(ctx, owner, repo, pr.Number, &github.IssueComment{Body: &comment}); err != nil {
+		return fmt.Errorf("unable to comment on PR #%d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+// ClosePR comments on the PR and closes it without merging
+func ClosePR(ctx context.Context, gh *github.Client, owner, repo string, pr *git.PR, comment string) error {
+	if err := CommentPR(ctx, gh, owner, repo, pr, comment); err != nil {
+		return err
+	}
+	closed := "closed"
+	if _, _, err := gh.PullRequests.Edit(ctx, owner, repo, pr.Number, &github.PullRequest{State: &closed}); err != nil {
+		return fmt.Errorf("unable to close PR #%d: %w", pr.Number, err)
+	}
+	log.Printf("Closed PR #%d", pr.Number)
+	return nil
+}
+
+// RepositoryDefaultBranch returns the default branch of the repository
+func RepositoryDefaultBranch(ctx context.Context, gh *github.Client, owner, repo string) (string, error) {
+	r, _, err := gh.Repositories.Get(ctx, owner, repo)
+	if err != nil {
+		return "", fmt.Errorf("unable to get repository %s/%s: %w", owner, repo, err)
+	}
+	if r.GetDefaultBranch() == "" {
+		return "", fmt.Errorf("repository %s/%s has no default branch", owner, repo)
+	}
+	return r.GetDefaultBranch(), nil
+}
+
+// ToPR converts the github PR, nil if pr is nil
+func ToPR(pr *github.PullRequest) *git.PR {
+	if pr == nil {
+		return nil
+	}
+	return &git.PR{Number: pr.GetNumber(), URL: pr.GetHTMLURL(), Body: pr.GetBody(), Branch: pr.GetHead().GetRef()}
+}
+
+// ApplyPolicy requests the policy reviewers, adds the policy labels and assignees and enables auto-merge of the PR if the policy allows it
+func ApplyPolicy(ctx context.Context, gh *github.Client, owner, repo string, pr *github.PullRequest, policy git.ReviewPolicy) error {
+	if len(policy.Labels) > 0 {
+		// labels that do not exist are created
+		if _, _, err := gh.Issues.AddLabelsToIssue(ctx, owner, repo, pr.GetNumber(), policy.Labels); err != nil {
+			return fmt.Errorf("unable to add labels to PR #%d: %w", pr.GetNumber(), err)
+		}
+		log.Printf("Added labels %v to PR #%d", policy.Labels, pr.GetNumber())
+	}
+	if len(policy.Assignees) > 0 {
+		if _, _, err := gh.Issues.AddAssignees(ctx, owner, repo, pr.GetNumber(), policy.Assignees); err != nil {
+			return fmt.Errorf("unable to add assignees to PR #%d: %w", pr.GetNumber(), err)
+		}
+		log.Printf("Assigned PR #%d to %v", pr.GetNumber(), policy.Assignees)
+	}
+	if len(policy.Reviewers) > 0 || len(policy.TeamReviewers) > 0 {
+		req := github.ReviewersRequest{Reviewers: policy.Reviewers, TeamReviewers: policy.TeamReviewers}
+		if _, _, err := gh.PullRequests.RequestReviewers(ctx, owner, repo, pr.GetNumber(), req); err != nil {
+			return fmt.Errorf("unable to request reviewers of PR #%d: %w", pr.GetNumber(), err)
+		}
+		log.Printf("Requested reviewers %v of PR #%d", append(policy.Reviewers, policy.TeamReviewers...), pr.GetNumber())
+	}
+	if policy.AutoMerge {
+		if err := enableAutoMerge(ctx, gh, pr); err != nil {
+			return fmt.Errorf("unable to enable auto-merge of PR #%d: %w", pr.GetNumber(), err)
+		}
+		log.Printf("Enabled auto-merge of PR #%d", pr.GetNumber())
+	}
+	return nil
+}
+
+const enableAutoMergeMutation = `mutation($id: ID!) { enablePullRequestAutoMerge(input: {pullRequestId: $id}) { clientMutationId } }`
+
+// enableAutoMerge calls the GraphQL API, auto-merge is not available in the REST API
+func enableAutoMerge(ctx context.Context, gh *github.Client, pr *github.PullRequest) error {
+	return graphql(ctx, gh, enableAutoMergeMutation, map[string]string{"id": pr.GetNodeID()}, nil)
+}
+
+const (
+	mergeQueueEntryQuery = `query($id: ID!) { node(id: $id) { ... on PullRequest { mergeQueueEntry { position state } } } }`
+	enqueueMutation      = `mutation($id: ID!) { enqueuePullRequest(input: {pullRequestId: $id}) { mergeQueueEntry { position state } } }`
+)
+
+type mergeQueueEntry struct {
+	Position int    `json:"position"`
+	State    string `json:"state"`
+}
+
+// EnqueuePR adds the PR to the merge queue of its base branch unless it is queued already and returns its entry.
+// Merge queues are only available in the GraphQL API.
+func EnqueuePR(ctx context.Context, gh *github.Client, pr *github.PullRequest) (*git.QueueEntry, error) {
+	vars := map[string]string{"id": pr.GetNodeID()}
+	var queued struct {
+		Node struct {
+			MergeQueueEntry *mergeQueueEntry `json:"mergeQueueEntry"`
+		} `json:"node"`
+	}
+	if err := graphql(ctx, gh, mergeQueueEntryQuery, vars, &queued); err != nil {
+		return nil, fmt.Errorf("unable to get the merge queue entry of PR #%d: %w", pr.GetNumber(), err)
+	}
+	entry := queued.Node.MergeQueueEntry
+	if entry == nil {
+		var enqueued struct {
+			EnqueuePullRequest struct {
+				MergeQueueEntry *mergeQueueEntry `json:"mergeQueueEntry"`
+			} `json:"enqueuePullRequest"`
+		}
+		if err := graphql(ctx, gh, enqueueMutation, vars, &enqueued); err != nil {
+			return nil, fmt.Errorf("unable to add PR #%d to the merge queue: %w", pr.GetNumber(), err)
+		}
+		if entry = enqueued.EnqueuePullRequest.MergeQueueEntry; entry == nil {
+			return nil, fmt.Errorf("PR #%d was not added to the merge queue", pr.GetNumber())
+		}
+		log.Printf("Added PR #%d to the merge queue at position %d", pr.GetNumber(), entry.Position)
+	}
+	return &git.QueueEntry{Position: entry.Position, State: entry.State}, nil
+}
+
+// graphql runs the GraphQL query and decodes its data into out if it is not nil
+func graphql(ctx context.Context, gh *github.Client, query string, vars map[string]string, out interface{}) error {
+	req, err := gh.NewRequest("POST", graphqlURL(gh), map[string]interface{}{
+		"query":     query,
+		"variables": vars,
+	})
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if _, err := gh.Do(ctx, req, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		return fmt.Errorf("%s", resp.Errors[0].Message)
+	}
+	if out == nil || len(resp.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(resp.Data, out)
+}
+
+// graphqlURL returns the GraphQL endpoint of github.com or of the enterprise server
+func graphqlURL(gh *github.Client) string {
+	base := gh.BaseURL.String()
+	if strings.HasSuffix(base, "/api/v3/") {
+		return strings.TrimSuffix(base, "v3/") + "graphql"
+	}
+	return base + "graphql"
+}
+
+// head returns the PR head filter of the branch, which is qualified with the owner of its repository
+func head(owner, from string) string {
+	if forkOwner, _ := git.SplitHead(from); forkOwner != "" {
+		return from
+	}
+	return git.Head(owner, from)
+}
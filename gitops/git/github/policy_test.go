@@ -0,0 +1,243 @@
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/google/go-github/v68/github"
+)
+
+func TestApplyPolicy(t *testing.T) {
+	var reviewers github.ReviewersRequest
+	var labels []string
+	var assignees struct {
+		Assignees []string `json:"assignees"`
+	}
+	var mutation map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/deploy/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("head") != "org:deploy/prod" {
+			t.Errorf("unexpected head %q", r.URL.Query().Get("head"))
+		}
+		w.Write([]byte(`[{"number": 7, "node_id": "PR_7"}]`))
+	})
+	mux.HandleFunc("/repos/org/deploy/pulls/7/requested_reviewers", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&reviewers)
+		w.Write([]byte(`{"number": 7}`))
+	})
+	mux.HandleFunc("/repos/org/deploy/issues/7/labels", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&labels)
+		w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("/repos/org/deploy/issues/7/assignees", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&assignees)
+		w.Write([]byte(`{"number": 7}`))
+	})
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&mutation)
+		w.Write([]byte(`{"data": {}}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(ts.URL + "/")
+	ctx := context.Background()
+	pr, err := FindPR(ctx, gh, "org", "deploy", "deploy/prod", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := git.ReviewPolicy{Reviewers: []string{"alice"}, TeamReviewers: []string{"sre"}, AutoMerge: true, Labels: []string{"namespace:shop"}, Assignees: []string{"oncall"}}
+	if err := ApplyPolicy(ctx, gh, "org", "deploy", pr, policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(reviewers.Reviewers) != 1 || reviewers.Reviewers[0] != "alice" || len(reviewers.TeamReviewers) != 1 || reviewers.TeamReviewers[0] != "sre" {
+		t.Errorf("unexpected reviewers request %+v", reviewers)
+	}
+	if len(labels) != 1 || labels[0] != "namespace:shop" {
+		t.Errorf("unexpected labels request %v", labels)
+	}
+	if !reflect.DeepEqual(assignees.Assignees, []string{"oncall"}) {
+		t.Errorf("unexpected assignees request %v", assignees)
+	}
+	if vars, _ := mutation["variables"].(map[string]interface{}); vars["id"] != "PR_7" {
+		t.Errorf("unexpected auto-merge mutation %v", mutation)
+	}
+}
+
+func TestEnqueuePR(t *testing.T) {
+	var queries []string
+	queued := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/graphql", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Query     string            `json:"query"`
+			Variables map[string]string `json:"variables"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if req.Variables["id"] != "PR_7" {
+			t.Errorf("unexpected variables %v", req.Variables)
+		}
+		queries = append(queries, strings.Fields(req.Query)[0])
+		switch {
+		case strings.HasPrefix(req.Query, "mutation"):
+			queued = true
+			w.Write([]byte(`{"data": {"enqueuePullRequest": {"mergeQueueEntry": {"position": 3, "state": "AWAITING_CHECKS"}}}}`))
+		case queued:
+			w.Write([]byte(`{"data": {"node": {"mergeQueueEntry": {"position": 2, "state": "QUEUED"}}}}`))
+		default:
+			w.Write([]byte(`{"data": {"node": {"mergeQueueEntry": null}}}`))
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(ts.URL + "/")
+	pr := &github.PullRequest{Number: github.Ptr(7), NodeID: github.Ptr("PR_7")}
+	entry, err := EnqueuePR(context.Background(), gh, pr)
+	if err != nil || *entry != (git.QueueEntry{Position: 3, State: "AWAITING_CHECKS"}) {
+		t.Fatalf("EnqueuePR() = %v, %v", entry, err)
+	}
+	// a queued PR is not enqueued again
+	entry, err = EnqueuePR(context.Background(), gh, pr)
+	if err != nil || *entry != (git.QueueEntry{Position: 2, State: "QUEUED"}) {
+		t.Fatalf("EnqueuePR() of a queued PR = %v, %v", entry, err)
+	}
+	if want := []string{"query($id:", "mutation($id:", "query($id:"}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("unexpected requests %v, want %v", queries, want)
+	}
+}
+
+func TestGraphqlURL(t *testing.T) {
+	gh, _ := github.NewClient(nil).WithEnterpriseURLs("https://git.example.com/api/v3/", "https://git.example.com/api/uploads/")
+	if got := graphqlURL(gh); got != "https://git.example.com/api/graphql" {
+		t.Errorf("enterprise graphql url %s", got)
+	}
+	if got := graphqlURL(github.NewClient(nil)); got != "https://api.github.com/graphql" {
+		t.Errorf("graphql url %s", got)
+	}
+}
+
+func TestCheckRepo(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []string
+		body    string
+		wantErr bool
+	}{
+		{name: "fine-grained token", body: `{"permissions": {"push": true}}`},
+		{name: "classic token", scopes: []string{"repo, read:org"}, body: `{"permissions": {"push": true}}`},
+		{name: "missing scope", scopes: []string{"read:org"}, body: `{"permissions": {"push": true}}`, wantErr: true},
+		{name: "read only", body: `{"permissions": {"push": false, "pull": true}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/repos/org/deploy" {
+					http.NotFound(w, r)
+					return
+				}
+				for _, s := range tt.scopes {
+					w.Header().Add("X-OAuth-Scopes", s)
+				}
+				w.Write([]byte(tt.body))
+			}))
+			defer ts.Close()
+			gh := github.NewClient(nil)
+			gh.BaseURL, _ = url.Parse(ts.URL + "/")
+			if err := CheckRepo(context.Background(), gh, "org", "deploy"); (err != nil) != tt.wantErr {
+				t.Errorf("CheckRepo() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestListAndClosePRs(t *testing.T) {
+	var comment github.IssueComment
+	var edit github.PullRequest
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/deploy/pulls", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("base") != "master" || r.URL.Query().Get("state") != "open" {
+			t.Errorf("unexpected list query %v", r.URL.Query())
+		}
+		w.Write([]byte(`[{"number": 7, "head": {"ref": "deploy/app/prod"}}, {"number": 8, "head": {"ref": "feature/x"}}]`))
+	})
+	mux.HandleFunc("/repos/org/deploy/issues/7/comments", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&comment)
+		w.Write([]byte(`{}`))
+	})
+	mux.HandleFunc("/repos/org/deploy/pulls/7", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&edit)
+		w.Write([]byte(`{"number": 7}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(ts.URL + "/")
+	ctx := context.Background()
+	prs, err := ListPRs(ctx, gh, "org", "deploy", "deploy/app/", "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 1 || prs[0].Number != 7 || prs[0].Branch != "deploy/app/prod" {
+		t.Fatalf("unexpected PRs %+v", prs)
+	}
+	if err := ClosePR(ctx, gh, "org", "deploy", prs[0], "retired"); err != nil {
+		t.Fatal(err)
+	}
+	if comment.GetBody() != "retired" || edit.GetState() != "closed" {
+		t.Errorf("unexpected comment %q and state %q", comment.GetBody(), edit.GetState())
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	var deployment map[string]interface{}
+	var status map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/deploy/deployments", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&deployment)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 42, "url": "https://api.github.com/repos/org/deploy/deployments/42"}`))
+	})
+	mux.HandleFunc("/repos/org/deploy/deployments/42/statuses", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&status)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id": 1}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(ts.URL + "/")
+	d := git.Deployment{Ref: "deploy/prod", Environment: "prod", Description: "deploy", Payload: map[string]string{"commit": "abc"}}
+	u, err := Deploy(context.Background(), gh, "org", "deploy", d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u != "https://api.github.com/repos/org/deploy/deployments/42" {
+		t.Errorf("unexpected deployment URL %q", u)
+	}
+	want := map[string]interface{}{
+		"ref":               "deploy/prod",
+		"environment":       "prod",
+		"description":       "deploy",
+		"payload":           map[string]interface{}{"commit": "abc"},
+		"auto_merge":        false,
+		"required_contexts": []interface{}{},
+	}
+	if !reflect.DeepEqual(deployment, want) {
+		t.Errorf("deployment request %v, want %v", deployment, want)
+	}
+	if status["state"] != "queued" {
+		t.Errorf("unexpected deployment status %v", status)
+	}
+}
@@ -13,6 +13,9 @@ import (
 	"strings"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
+	"github.com/fasterci/rules_gitops/gitops/git"
+	ghpolicy "github.com/fasterci/rules_gitops/gitops/git/github"
+	"github.com/fasterci/rules_gitops/gitops/redact"
 	"github.com/google/go-github/v68/github"
 )
 
@@ -25,43 +28,68 @@ var (
 	gitHubAppInstallationId = flag.Int64("github_installation_id", 0, "GitHub App Id")
 )
 
+// privateKeyPEM replaces the private_key file if set
+var privateKeyPEM []byte
+
+// SetPrivateKey sets the app private key, e.g. read from a secret store, in place of the private_key file
+func SetPrivateKey(pem []byte) {
+	redact.Add(string(pem))
+	redact.Add(strings.Split(string(pem), "\n")...)
+	privateKeyPEM = pem
+}
+
+// keyTransport returns the installation token transport of the app private key
+func keyTransport() (*ghinstallation.Transport, error) {
+	if privateKeyPEM != nil {
+		return ghinstallation.New(http.DefaultTransport, *gitHubAppId, *gitHubAppInstallationId, privateKeyPEM)
+	}
+	redact.AddFile(*privateKey)
+	return ghinstallation.NewKeyFromFile(http.DefaultTransport, *gitHubAppId, *gitHubAppInstallationId, *privateKey)
+}
+
 type FileEntry struct {
 	RelativePath string // Path for GitHub repository
 	FullPath     string // Path for local file reading
 }
 
 func CreatePR(from, to, title, body string) error {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// newClient validates flags and returns the API client authenticated as the app installation
+func newClient() (*github.Client, error) {
 	if *repoOwner == "" {
-		return errors.New("github_app_repo_owner must be set")
+		return nil, errors.New("github_app_repo_owner must be set")
 	}
 	if *repo == "" {
-		return errors.New("github_app_repo must be set")
+		return nil, errors.New("github_app_repo must be set")
 	}
 	if *gitHubAppId == 0 {
-		return errors.New("github_app_id must be set")
+		return nil, errors.New("github_app_id must be set")
 	}
 
-	ctx := context.Background()
-
 	// get an installation token request handler for the github app
-	itr, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, *gitHubAppId, *gitHubAppInstallationId, *privateKey)
+	itr, err := keyTransport()
 	if err != nil {
 		log.Println("failed reading key", "key", *privateKey, "err", err)
-		return err
+		return nil, err
 	}
 
-	var gh *github.Client
 	if *githubEnterpriseHost != "" {
 		baseUrl := "https://" + *githubEnterpriseHost + "/api/v3/"
 		uploadUrl := "https://" + *githubEnterpriseHost + "/api/uploads/"
-		var err error
-		gh, err = github.NewEnterpriseClient(baseUrl, uploadUrl, &http.Client{Transport: itr})
-		if err != nil {
-			log.Println("Error in creating github client", err)
-			return nil
-		}
-	} else {
-		gh = github.NewClient(&http.Client{Transport: itr})
+		return github.NewEnterpriseClient(baseUrl, uploadUrl, &http.Client{Transport: itr})
+	}
+	return github.NewClient(&http.Client{Transport: itr}), nil
+}
+
+// CreatePRWithPolicy creates the PR, or reuses the open one, and enforces the review policy
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	ctx := context.Background()
+	gh, err := newClient()
+	if err != nil {
+		log.Println("Error in creating github client", err)
+		return err
 	}
 
 	pr := &github.NewPullRequest{
@@ -76,13 +104,24 @@ func CreatePR(from, to, title, body string) error {
 	createdPr, resp, err := gh.PullRequests.Create(ctx, *repoOwner, *repo, pr)
 	if err == nil {
 		log.Println("Created PR: ", *createdPr.URL)
+		return ghpolicy.ApplyPolicy(ctx, gh, *repoOwner, *repo, createdPr, policy)
+	}
+	if resp == nil {
+		// the request failed in transit
 		return err
 	}
 
 	if resp.StatusCode == http.StatusUnprocessableEntity {
 		// Handle the case: "Create PR" request fails because it already exists
 		log.Println("Reusing existing PR")
-		return nil
+		if policy.IsZero() {
+			return nil
+		}
+		existing, err := ghpolicy.FindPR(ctx, gh, *repoOwner, *repo, from, to)
+		if err != nil {
+			return err
+		}
+		return ghpolicy.ApplyPolicy(ctx, gh, *repoOwner, *repo, existing, policy)
 	}
 
 	// All other github responses
@@ -94,12 +133,147 @@ func CreatePR(from, to, title, body string) error {
 		log.Println("github response: ", string(responseBody))
 	}
 
-	return err
+	return &git.StatusError{StatusCode: resp.StatusCode, Err: err}
+}
+
+// FindOpenPR returns the open PR from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	gh, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	pr, err := ghpolicy.OpenPR(context.Background(), gh, *repoOwner, *repo, from, to)
+	return ghpolicy.ToPR(pr), err
+}
+
+// UpdateOpenPR replaces the title and the body of the open PR and enforces the review policy
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	gh, err := newClient()
+	if err != nil {
+		return err
+	}
+	return ghpolicy.UpdatePR(context.Background(), gh, *repoOwner, *repo, pr, title, body, policy)
+}
+
+// ListOpenPRs returns the open PRs into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	gh, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	return ghpolicy.ListPRs(context.Background(), gh, *repoOwner, *repo, prefix, to)
+}
+
+// CloseOpenPR comments on the open PR and closes it without merging
+func CloseOpenPR(pr *git.PR, comment string) error {
+	gh, err := newClient()
+	if err != nil {
+		return err
+	}
+	return ghpolicy.ClosePR(context.Background(), gh, *repoOwner, *repo, pr, comment)
+}
+
+// CommentOpenPR adds the comment to the open PR
+func CommentOpenPR(pr *git.PR, comment string) error {
+	gh, err := newClient()
+	if err != nil {
+		return err
+	}
+	return ghpolicy.CommentPR(context.Background(), gh, *repoOwner, *repo, pr, comment)
+}
+
+// DefaultBranch returns the default branch of the repository
+func DefaultBranch() (string, error) {
+	gh, err := newClient()
+	if err != nil {
+		return "", err
+	}
+	return ghpolicy.RepositoryDefaultBranch(context.Background(), gh, *repoOwner, *repo)
 }
 
-func CreateCommit(baseBranch string, commitBranch string, gitopsPath string, files []string, prTitle string, prDescription string) {
+// EnqueueOpenPR adds the open PR from the branch into to to the merge queue of to
+func EnqueueOpenPR(from, to string) (*git.QueueEntry, error) {
+	gh, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	pr, err := ghpolicy.FindPR(ctx, gh, *repoOwner, *repo, from, to)
+	if err != nil {
+		return nil, err
+	}
+	return ghpolicy.EnqueuePR(ctx, gh, pr)
+}
+
+// CreateDeployment records the deployment of a release train in the repository
+func CreateDeployment(d git.Deployment) (string, error) {
+	gh, err := newClient()
+	if err != nil {
+		return "", err
+	}
+	return ghpolicy.Deploy(context.Background(), gh, *repoOwner, *repo, d)
+}
+
+// Validate reports all missing flags of the provider and an unreadable private key without contacting GitHub
+func Validate() error {
+	var errs []error
+	if *repoOwner == "" {
+		errs = append(errs, errors.New("github_app_repo_owner must be set"))
+	}
+	if *repo == "" {
+		errs = append(errs, errors.New("github_app_repo must be set"))
+	}
+	if *gitHubAppId == 0 {
+		errs = append(errs, errors.New("github_app_id must be set"))
+	}
+	if privateKeyPEM == nil {
+		if _, err := os.Stat(*privateKey); err != nil {
+			errs = append(errs, fmt.Errorf("private_key: %w", err))
+		}
+		redact.AddFile(*privateKey)
+	}
+	return errors.Join(errs...)
+}
+
+// Check verifies the app private key, the app installation and access to the repository
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	itr, err := keyTransport()
+	if err != nil {
+		return fmt.Errorf("unable to read private key %s: %w", *privateKey, err)
+	}
+	gh := github.NewClient(&http.Client{Transport: itr})
+	if *githubEnterpriseHost != "" {
+		itr.BaseURL = "https://" + *githubEnterpriseHost + "/api/v3"
+		gh, err = gh.WithEnterpriseURLs("https://"+*githubEnterpriseHost+"/api/v3/", "https://"+*githubEnterpriseHost+"/api/uploads/")
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := itr.Token(ctx); err != nil {
+		return fmt.Errorf("unable to get a token of installation %d of app %d: %w", *gitHubAppInstallationId, *gitHubAppId, err)
+	}
+	return ghpolicy.CheckRepo(ctx, gh, *repoOwner, *repo)
+}
+
+// CreateCommit commits files to commitBranch created from baseBranch, opens the PR and returns the SHA of the commit.
+// key is the idempotency key of the commit and the PR: a retried run finding the branch head committed with the
+// same key reuses the commit and the open PR instead of failing or creating duplicates.
+func CreateCommit(baseBranch string, commitBranch string, gitopsPath string, files []string, prTitle string, prDescription string, policy git.ReviewPolicy, key string) string {
 	ctx := context.Background()
 	gh := createGithubClient()
+	prDescription += "\n\n" + git.Marker(key)
+
+	if sha, ok := committed(ctx, gh, commitBranch, key); ok {
+		log.Printf("Branch %s is already committed with idempotency key %s", commitBranch, key)
+		pr := createPR(ctx, gh, baseBranch, commitBranch, prTitle, prDescription)
+		if err := ghpolicy.ApplyPolicy(ctx, gh, *repoOwner, *repo, pr, policy); err != nil {
+			log.Fatalf("%v", err)
+		}
+		return sha
+	}
 
 	log.Printf("Starting Create Commit: Commit branch: %s\n", commitBranch)
 	log.Printf("Starting Create Commit: Base branch: %s\n", baseBranch)
@@ -117,8 +291,12 @@ func CreateCommit(baseBranch string, commitBranch string, gitopsPath string, fil
 		log.Fatalf("failed to create tree: %v", err)
 	}
 
-	pushCommit(ctx, gh, ref, tree, prTitle)
-	createPR(ctx, gh, baseBranch, commitBranch, prTitle, prDescription)
+	sha := pushCommit(ctx, gh, ref, tree, fmt.Sprintf("%s\n\n%s: %s", prTitle, git.KeyTrailer, key))
+	pr := createPR(ctx, gh, baseBranch, commitBranch, prTitle, prDescription)
+	if err := ghpolicy.ApplyPolicy(ctx, gh, *repoOwner, *repo, pr, policy); err != nil {
+		log.Fatalf("%v", err)
+	}
+	return sha
 }
 
 func getFilesToCommit(gitopsPath string, inputPaths []string) ([]FileEntry, error) {
@@ -170,7 +348,7 @@ func getFilesToCommit(gitopsPath string, inputPaths []string) ([]FileEntry, erro
 	return allFileEntries, nil
 }
 
-func createPR(ctx context.Context, gh *github.Client, baseBranch string, commitBranch string, prSubject string, prDescription string) {
+func createPR(ctx context.Context, gh *github.Client, baseBranch string, commitBranch string, prSubject string, prDescription string) *github.PullRequest {
 	newPR := &github.NewPullRequest{
 		Title:               &prSubject,
 		Head:                &commitBranch,
@@ -179,12 +357,32 @@ func createPR(ctx context.Context, gh *github.Client, baseBranch string, commitB
 		MaintainerCanModify: github.Ptr(true),
 	}
 
-	pr, _, err := gh.PullRequests.Create(ctx, *repoOwner, *repo, newPR)
+	pr, resp, err := gh.PullRequests.Create(ctx, *repoOwner, *repo, newPR)
+	if err != nil && resp != nil && resp.StatusCode == http.StatusUnprocessableEntity {
+		log.Println("Reusing existing PR")
+		if pr, err = ghpolicy.FindPR(ctx, gh, *repoOwner, *repo, commitBranch, baseBranch); err == nil {
+			return pr
+		}
+	}
 	if err != nil {
 		log.Fatalf("failed to create PR: %v", err)
 	}
 
 	log.Printf("PR created: %s\n", pr.GetHTMLURL())
+	return pr
+}
+
+// committed reports whether the head commit of the branch has the idempotency key trailer
+func committed(ctx context.Context, gh *github.Client, branch, key string) (string, bool) {
+	ref, _, err := gh.Git.GetRef(ctx, *repoOwner, *repo, "refs/heads/"+branch)
+	if err != nil {
+		return "", false
+	}
+	head, _, err := gh.Git.GetCommit(ctx, *repoOwner, *repo, ref.GetObject().GetSHA())
+	if err != nil {
+		return "", false
+	}
+	return head.GetSHA(), strings.Contains(head.GetMessage(), git.KeyTrailer+": "+key)
 }
 
 func createGithubClient() *github.Client {
@@ -199,7 +397,7 @@ func createGithubClient() *github.Client {
 	}
 
 	// get an installation token request handler for the github app
-	itr, err := ghinstallation.NewKeyFromFile(http.DefaultTransport, *gitHubAppId, *gitHubAppInstallationId, *privateKey)
+	itr, err := keyTransport()
 	if err != nil {
 		log.Println("failed reading key", "key", *privateKey, "err", err)
 		log.Fatal(err)
@@ -250,7 +448,7 @@ func getTree(ctx context.Context, gh *github.Client, ref *github.Reference, file
 	return tree, err
 }
 
-func pushCommit(ctx context.Context, gh *github.Client, ref *github.Reference, tree *github.Tree, commitMessage string) {
+func pushCommit(ctx context.Context, gh *github.Client, ref *github.Reference, tree *github.Tree, commitMessage string) string {
 	// Get the parent commit to attach the commit to.
 	parent, _, err := gh.Repositories.GetCommit(ctx, *repoOwner, *repo, *ref.Object.SHA, nil)
 	if err != nil {
@@ -274,4 +472,5 @@ func pushCommit(ctx context.Context, gh *github.Client, ref *github.Reference, t
 	if err != nil {
 		log.Fatalf("failed to update ref: %v", err)
 	}
+	return newCommit.GetSHA()
 }
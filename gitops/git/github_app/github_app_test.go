@@ -1,11 +1,17 @@
 package github_app
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"sort"
 	"testing"
+
+	"github.com/google/go-github/v68/github"
 )
 
 func TestGetFilesToCommit(t *testing.T) {
@@ -151,3 +157,30 @@ func TestGetFilesToCommit(t *testing.T) {
 		})
 	}
 }
+
+func TestCommitted(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/org/deploy/git/ref/heads/gitops", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ref": "refs/heads/gitops", "object": {"sha": "abc"}}`))
+	})
+	mux.HandleFunc("/repos/org/deploy/git/commits/abc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha": "abc", "message": "Gitops Deploy\n\nGitops-Idempotency-Key: 1a2b"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	*repoOwner, *repo = "org", "deploy"
+	defer func() { *repoOwner, *repo = "", "" }()
+
+	gh := github.NewClient(nil)
+	gh.BaseURL, _ = url.Parse(ts.URL + "/")
+	ctx := context.Background()
+	if sha, ok := committed(ctx, gh, "gitops", "1a2b"); !ok || sha != "abc" {
+		t.Errorf("expected branch committed with key 1a2b at abc, got %q", sha)
+	}
+	if _, ok := committed(ctx, gh, "gitops", "3c4d"); ok {
+		t.Error("unexpected branch committed with key 3c4d")
+	}
+	if _, ok := committed(ctx, gh, "missing", "1a2b"); ok {
+		t.Error("unexpected missing branch committed")
+	}
+}
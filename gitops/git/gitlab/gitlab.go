@@ -1,58 +1,141 @@
 package gitlab
 
 import (
+	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+	"github.com/hashicorp/go-retryablehttp"
 	"github.com/xanzy/go-gitlab"
 )
 
 var (
-	gitlabHost  = flag.String("gitlab_host", "https://gitlab.com", "The host name of the gitlab instance")
-	repo        = flag.String("gitlab_repo", "", "the repo to use for gitlab api requests")
-	accessToken = flag.String("gitlab_access_token", os.Getenv("GITLAB_TOKEN"), "the access token to authenticate requests")
+	gitlabHost  = flag.String("gitlab_host", serverURL(), "The host name of the gitlab instance, $CI_SERVER_URL in GitLab CI")
+	repo        = flag.String("gitlab_repo", "", "the repo to use for gitlab api requests, the project path or numeric project ID")
+	accessToken = flag.String("gitlab_access_token", os.Getenv("GITLAB_TOKEN"), "the access token to authenticate requests: a personal, project or group access token")
+	jobToken    = flag.String("gitlab_job_token", os.Getenv("CI_JOB_TOKEN"), "the CI_JOB_TOKEN of the GitLab CI job to authenticate requests if gitlab_access_token is not set")
+
+	assigneeIDs               = flag.String("gitlab_assignee_ids", "", "comma-separated IDs of the users assigned to every MR")
+	labels                    = flag.String("gitlab_labels", "", "comma-separated labels added to every MR")
+	mergeWhenPipelineSucceeds = flag.Bool("gitlab_merge_when_pipeline_succeeds", false, "merge every MR when its pipeline succeeds")
+	squash                    = flag.Bool("gitlab_squash", false, "squash the commits of every MR when it is merged")
+	removeSourceBranch        = flag.Bool("gitlab_remove_source_branch", false, "delete the deployment branch when its MR is merged")
 )
 
+// serverURL returns the GitLab instance of the GitLab CI job, gitlab.com outside of GitLab CI
+func serverURL() string {
+	if u := os.Getenv("CI_SERVER_URL"); u != "" {
+		return u
+	}
+	return "https://gitlab.com"
+}
+
 func CreatePR(from, to, title, body string) error {
-	if *accessToken == "" {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// CreatePRWithPolicy creates the MR, or reuses the open one, and enforces the review policy.
+// Team reviewers are not supported.
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	if *accessToken == "" && *jobToken == "" {
 		return errors.New("gitlab_access_token must be set")
 	}
+	redact.Add(*accessToken, *jobToken)
+	if len(policy.TeamReviewers) > 0 {
+		return errors.New("gitlab does not support team reviewers")
+	}
+	if len(policy.Assignees) > 0 {
+		return errors.New("gitlab does not support assignees of the review policy, use gitlab_assignee_ids")
+	}
+	settings, err := mrSettings()
+	if err != nil {
+		return err
+	}
+	policy.AutoMerge = policy.AutoMerge || *mergeWhenPipelineSucceeds
 
+	forkOwner, branch := git.SplitHead(from)
 	opts := gitlab.CreateMergeRequestOptions{
 		Title:              &title,
-		Description:        nil,
-		SourceBranch:       &from,
+		Description:        &body,
+		SourceBranch:       &branch,
 		TargetBranch:       &to,
-		Labels:             nil,
+		Labels:             settings.AddLabels,
 		AssigneeID:         nil,
-		AssigneeIDs:        nil,
+		AssigneeIDs:        settings.AssigneeIDs,
 		ReviewerIDs:        nil,
 		TargetProjectID:    nil,
 		MilestoneID:        nil,
-		RemoveSourceBranch: nil,
-		Squash:             nil,
+		RemoveSourceBranch: settings.RemoveSourceBranch,
+		Squash:             settings.Squash,
 		AllowCollaboration: nil,
 	}
 
-	gl, err := gitlab.NewClient(*accessToken, gitlab.WithBaseURL(*gitlabHost))
+	gl, err := newClient()
+	if err != nil {
+		return err
+	}
+	reviewerIDs, err := userIDs(gl, policy.Reviewers)
 	if err != nil {
 		return err
 	}
+	if len(reviewerIDs) > 0 {
+		opts.ReviewerIDs = &reviewerIDs
+	}
 
-	createdPr, resp, err := gl.MergeRequests.CreateMergeRequest(*repo, &opts)
+	// MRs from a fork are created in the fork project targeting the project of gitlab_repo.
+	// The fork path is derived from the project path, gitlab_repo may be a numeric project ID.
+	source := *repo
+	if forkOwner != "" {
+		target, _, err := gl.Projects.GetProject(*repo, nil)
+		if err != nil {
+			return fmt.Errorf("unable to get project %s: %w", *repo, err)
+		}
+		source = forkOwner + "/" + target.Path
+		opts.TargetProjectID = &target.ID
+	}
+
+	createdPr, resp, err := gl.MergeRequests.CreateMergeRequest(source, &opts)
 	if err == nil {
 		log.Println("Created MR: ", createdPr.WebURL)
-		return nil
+		return applyPolicy(gl, createdPr.IID, nil, policy)
+	}
+	if resp == nil {
+		// the request failed in transit
+		return err
 	}
 
 	if resp.StatusCode == http.StatusConflict {
 		// Handle the case: "Create MR" request fails because it already exists for this source branch
 		log.Println("Reusing existing MR")
-		return nil
+		if policy.IsZero() && *settings == (gitlab.UpdateMergeRequestOptions{}) {
+			return nil
+		}
+		opened := "opened"
+		mrs, _, err := gl.MergeRequests.ListProjectMergeRequests(*repo, &gitlab.ListProjectMergeRequestsOptions{
+			State:        &opened,
+			SourceBranch: &branch,
+			TargetBranch: &to,
+		})
+		if err != nil {
+			return err
+		}
+		if len(mrs) == 0 {
+			return fmt.Errorf("no open MR from %s into %s", from, to)
+		}
+		if err := applySettings(gl, mrs[0].IID, settings); err != nil {
+			return err
+		}
+		return applyPolicy(gl, mrs[0].IID, reviewerIDs, policy)
 	}
 
 	// All other gitlab responses
@@ -64,5 +147,324 @@ func CreatePR(from, to, title, body string) error {
 		log.Println("gitlab response: ", string(responseBody))
 	}
 
-	return err
+	return &git.StatusError{StatusCode: resp.StatusCode, Err: err}
+}
+
+// FindOpenPR returns the open MR from the branch into to, nil if there is none
+func FindOpenPR(from, to string) (*git.PR, error) {
+	if err := Validate(); err != nil {
+		return nil, err
+	}
+	gl, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	opened := "opened"
+	_, branch := git.SplitHead(from)
+	mrs, _, err := gl.MergeRequests.ListProjectMergeRequests(*repo, &gitlab.ListProjectMergeRequestsOptions{
+		State:        &opened,
+		SourceBranch: &branch,
+		TargetBranch: &to,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to find MR from %s: %w", from, err)
+	}
+	if len(mrs) == 0 {
+		return nil, nil
+	}
+	return &git.PR{Number: mrs[0].IID, URL: mrs[0].WebURL, Body: mrs[0].Description, Branch: mrs[0].SourceBranch}, nil
+}
+
+// ListOpenPRs returns the open MRs into to from branches starting with prefix
+func ListOpenPRs(prefix, to string) ([]*git.PR, error) {
+	if err := Validate(); err != nil {
+		return nil, err
+	}
+	gl, err := newClient()
+	if err != nil {
+		return nil, err
+	}
+	opts := &gitlab.ListProjectMergeRequestsOptions{
+		State:        gitlab.String("opened"),
+		TargetBranch: &to,
+		ListOptions:  gitlab.ListOptions{PerPage: 100},
+	}
+	var prs []*git.PR
+	for {
+		mrs, resp, err := gl.MergeRequests.ListProjectMergeRequests(*repo, opts)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list MRs into %s: %w", to, err)
+		}
+		for _, mr := range mrs {
+			if strings.HasPrefix(mr.SourceBranch, prefix) {
+				prs = append(prs, &git.PR{Number: mr.IID, URL: mr.WebURL, Body: mr.Description, Branch: mr.SourceBranch})
+			}
+		}
+		if resp.NextPage == 0 {
+			return prs, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// CommentOpenPR adds the comment to the open MR
+func CommentOpenPR(pr *git.PR, comment string) error {
+	gl, err := newClient()
+	if err != nil {
+		return err
+	}
+	if _, _, err := gl.Notes.CreateMergeRequestNote(*repo, pr.Number, &gitlab.CreateMergeRequestNoteOptions{Body: &comment}); err != nil {
+		return fmt.Errorf("unable to comment on MR !%d: %w", pr.Number, err)
+	}
+	return nil
+}
+
+// CloseOpenPR comments on the open MR and closes it without merging
+func CloseOpenPR(pr *git.PR, comment string) error {
+	if err := CommentOpenPR(pr, comment); err != nil {
+		return err
+	}
+	gl, err := newClient()
+	if err != nil {
+		return err
+	}
+	if _, _, err := gl.MergeRequests.UpdateMergeRequest(*repo, pr.Number, &gitlab.UpdateMergeRequestOptions{StateEvent: gitlab.String("close")}); err != nil {
+		return fmt.Errorf("unable to close MR !%d: %w", pr.Number, err)
+	}
+	log.Printf("Closed MR !%d", pr.Number)
+	return nil
+}
+
+// DefaultBranch returns the default branch of the project
+func DefaultBranch() (string, error) {
+	if err := Validate(); err != nil {
+		return "", err
+	}
+	gl, err := newClient()
+	if err != nil {
+		return "", err
+	}
+	project, _, err := gl.Projects.GetProject(*repo, nil)
+	if err != nil {
+		return "", fmt.Errorf("unable to get project %s: %w", *repo, err)
+	}
+	if project.DefaultBranch == "" {
+		return "", fmt.Errorf("project %s has no default branch", *repo)
+	}
+	return project.DefaultBranch, nil
+}
+
+// UpdateOpenPR replaces the title and the description of the open MR and enforces the review policy.
+// Team reviewers are not supported.
+func UpdateOpenPR(pr *git.PR, title, body string, policy git.ReviewPolicy) error {
+	if len(policy.TeamReviewers) > 0 {
+		return errors.New("gitlab does not support team reviewers")
+	}
+	if len(policy.Assignees) > 0 {
+		return errors.New("gitlab does not support assignees of the review policy, use gitlab_assignee_ids")
+	}
+	settings, err := mrSettings()
+	if err != nil {
+		return err
+	}
+	policy.AutoMerge = policy.AutoMerge || *mergeWhenPipelineSucceeds
+	gl, err := newClient()
+	if err != nil {
+		return err
+	}
+	reviewerIDs, err := userIDs(gl, policy.Reviewers)
+	if err != nil {
+		return err
+	}
+	updated, _, err := gl.MergeRequests.UpdateMergeRequest(*repo, pr.Number, &gitlab.UpdateMergeRequestOptions{Title: &title, Description: &body})
+	if err != nil {
+		return fmt.Errorf("unable to update MR !%d: %w", pr.Number, err)
+	}
+	log.Println("Updated MR: ", updated.WebURL)
+	if err := applySettings(gl, pr.Number, settings); err != nil {
+		return err
+	}
+	return applyPolicy(gl, pr.Number, reviewerIDs, policy)
+}
+
+// Validate reports all missing flags of the provider without contacting GitLab
+func Validate() error {
+	var errs []error
+	if *accessToken == "" && *jobToken == "" {
+		errs = append(errs, errors.New("gitlab_access_token must be set"))
+	}
+	if *repo == "" {
+		errs = append(errs, errors.New("gitlab_repo must be set"))
+	}
+	if _, err := mrSettings(); err != nil {
+		errs = append(errs, err)
+	}
+	redact.Add(*accessToken, *jobToken)
+	return errors.Join(errs...)
+}
+
+// newClient returns the API client counting retried requests in the metrics of the run.
+// The client uses the TLS configuration applied by git.TLS, it does not use http.DefaultTransport.
+func newClient() (*gitlab.Client, error) {
+	opts := []gitlab.ClientOptionFunc{
+		gitlab.WithBaseURL(*gitlabHost),
+		gitlab.WithRequestLogHook(func(_ retryablehttp.Logger, _ *http.Request, attempt int) {
+			if attempt > 0 {
+				metrics.Add(metrics.APIRetries, 1, "server", "gitlab")
+			}
+		}),
+	}
+	if hc := git.HTTPClient(); hc != nil {
+		opts = append(opts, gitlab.WithHTTPClient(hc))
+	}
+	if *accessToken == "" && *jobToken != "" {
+		return gitlab.NewJobClient(*jobToken, opts...)
+	}
+	return gitlab.NewClient(*accessToken, opts...)
+}
+
+// checkScopes verifies that the personal, project or group access token has the api scope.
+// Job tokens and GitLab versions without the endpoint are not checked.
+func checkScopes(ctx context.Context, gl *gitlab.Client) error {
+	if *accessToken == "" {
+		return nil
+	}
+	req, err := gl.NewRequest(http.MethodGet, "personal_access_tokens/self", nil, []gitlab.RequestOptionFunc{gitlab.WithContext(ctx)})
+	if err != nil {
+		return err
+	}
+	var token struct {
+		Scopes []string `json:"scopes"`
+	}
+	resp, err := gl.Do(req, &token)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read the access token: %w", err)
+	}
+	for _, scope := range token.Scopes {
+		if scope == "api" {
+			return nil
+		}
+	}
+	return fmt.Errorf("access token scopes %v do not include api", token.Scopes)
+}
+
+// Check verifies that the access token can create merge requests in the project.
+// Members of a group are granted access by the group, e.g. the bot user of a group access token.
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	gl, err := newClient()
+	if err != nil {
+		return err
+	}
+	project, _, err := gl.Projects.GetProject(*repo, nil, gitlab.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("unable to access project %s: %w", *repo, err)
+	}
+	if p := project.Permissions; p != nil {
+		level := gitlab.NoPermissions
+		if p.ProjectAccess != nil {
+			level = p.ProjectAccess.AccessLevel
+		}
+		if p.GroupAccess != nil && p.GroupAccess.AccessLevel > level {
+			level = p.GroupAccess.AccessLevel
+		}
+		if level < gitlab.DeveloperPermissions {
+			return fmt.Errorf("developer access to project %s is required to create merge requests", *repo)
+		}
+	}
+	return checkScopes(ctx, gl)
+}
+
+// userIDs resolves user names to ids
+func userIDs(gl *gitlab.Client, names []string) ([]int, error) {
+	var ids []int
+	for _, name := range names {
+		name := name
+		users, _, err := gl.Users.ListUsers(&gitlab.ListUsersOptions{Username: &name})
+		if err != nil {
+			return nil, fmt.Errorf("unable to find gitlab user %s: %w", name, err)
+		}
+		if len(users) == 0 {
+			return nil, fmt.Errorf("unknown gitlab user %s", name)
+		}
+		ids = append(ids, users[0].ID)
+	}
+	return ids, nil
+}
+
+// mrSettings returns the assignees, labels and merge options set on every MR by the gitlab_* flags.
+// Only the configured settings are set.
+func mrSettings() (*gitlab.UpdateMergeRequestOptions, error) {
+	var settings gitlab.UpdateMergeRequestOptions
+	var ids []int
+	for _, s := range strings.Split(*assigneeIDs, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		id, err := strconv.Atoi(s)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid gitlab_assignee_ids %q, expected comma-separated user IDs", *assigneeIDs)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) > 0 {
+		settings.AssigneeIDs = &ids
+	}
+	var l gitlab.Labels
+	for _, s := range strings.Split(*labels, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			l = append(l, s)
+		}
+	}
+	if len(l) > 0 {
+		settings.AddLabels = &l
+	}
+	if *squash {
+		settings.Squash = squash
+	}
+	if *removeSourceBranch {
+		settings.RemoveSourceBranch = removeSourceBranch
+	}
+	return &settings, nil
+}
+
+// applySettings sets the assignees, labels and merge options of the gitlab_* flags on an existing MR
+func applySettings(gl *gitlab.Client, iid int, settings *gitlab.UpdateMergeRequestOptions) error {
+	if *settings == (gitlab.UpdateMergeRequestOptions{}) {
+		return nil
+	}
+	if _, _, err := gl.MergeRequests.UpdateMergeRequest(*repo, iid, settings); err != nil {
+		return fmt.Errorf("unable to update settings of MR !%d: %w", iid, err)
+	}
+	return nil
+}
+
+// applyPolicy sets reviewerIDs of an existing MR and enables merge when pipeline succeeds if the policy allows it
+func applyPolicy(gl *gitlab.Client, iid int, reviewerIDs []int, policy git.ReviewPolicy) error {
+	if len(reviewerIDs) > 0 {
+		if _, _, err := gl.MergeRequests.UpdateMergeRequest(*repo, iid, &gitlab.UpdateMergeRequestOptions{ReviewerIDs: &reviewerIDs}); err != nil {
+			return fmt.Errorf("unable to set reviewers of MR !%d: %w", iid, err)
+		}
+		log.Printf("Requested reviewers %v of MR !%d", policy.Reviewers, iid)
+	}
+	if len(policy.Labels) > 0 {
+		labels := gitlab.Labels(policy.Labels)
+		if _, _, err := gl.MergeRequests.UpdateMergeRequest(*repo, iid, &gitlab.UpdateMergeRequestOptions{AddLabels: &labels}); err != nil {
+			return fmt.Errorf("unable to add labels to MR !%d: %w", iid, err)
+		}
+		log.Printf("Added labels %v to MR !%d", policy.Labels, iid)
+	}
+	if policy.AutoMerge {
+		mwps := true
+		if _, _, err := gl.MergeRequests.AcceptMergeRequest(*repo, iid, &gitlab.AcceptMergeRequestOptions{MergeWhenPipelineSucceeds: &mwps}); err != nil {
+			return fmt.Errorf("unable to enable auto-merge of MR !%d: %w", iid, err)
+		}
+		log.Printf("Enabled merge when pipeline succeeds of MR !%d", iid)
+	}
+	return nil
 }
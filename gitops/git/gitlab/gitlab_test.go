@@ -1,6 +1,12 @@
 package gitlab
 
-import "testing"
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
 
 func TestCreatePRRemote(t *testing.T) {
 	t.Skip("Manual")
@@ -58,3 +64,98 @@ func TestCreatePRRemote(t *testing.T) {
 		})
 	}
 }
+
+func TestValidate(t *testing.T) {
+	empty, token, project := "", "token", "group/project"
+	accessToken, repo = &empty, &empty
+	err := Validate()
+	if err == nil || !strings.Contains(err.Error(), "gitlab_access_token") || !strings.Contains(err.Error(), "gitlab_repo") {
+		t.Errorf("expected both missing flags to be reported, got %v", err)
+	}
+	accessToken, repo = &token, &project
+	if err := Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	accessToken, jobToken = &empty, &token
+	if err := Validate(); err != nil {
+		t.Errorf("unexpected error with job token: %v", err)
+	}
+}
+
+func TestCreatePRJobTokenFromFork(t *testing.T) {
+	var created map[string]interface{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v4/" {
+			// rate limit probe of the client
+			return
+		}
+		if r.Header.Get("JOB-TOKEN") != "job-token" || r.Header.Get("PRIVATE-TOKEN") != "" {
+			t.Errorf("unexpected authentication headers %v", r.Header)
+		}
+		switch r.URL.EscapedPath() {
+		case "/api/v4/projects/42":
+			w.Write([]byte(`{"id": 42, "path": "deploy", "path_with_namespace": "org/deploy"}`))
+		case "/api/v4/projects/deploybot%2Fdeploy/merge_requests":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"iid": 7, "web_url": "https://gitlab.example.com/org/deploy/-/merge_requests/7"}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	empty, job, project, host := "", "job-token", "42", ts.URL
+	accessToken, jobToken, repo, gitlabHost = &empty, &job, &project, &host
+
+	if err := CreatePR("deploybot:deploy/prod", "master", "deploy", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if created["source_branch"] != "deploy/prod" || created["target_project_id"] != float64(42) {
+		t.Errorf("unexpected merge request %v", created)
+	}
+}
+
+func TestCreatePRSettings(t *testing.T) {
+	var created map[string]interface{}
+	var merged bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/api/v4/":
+		case "/api/v4/projects/org%2Fdeploy/merge_requests":
+			json.NewDecoder(r.Body).Decode(&created)
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"iid": 7, "web_url": "https://gitlab.example.com/org/deploy/-/merge_requests/7"}`))
+		case "/api/v4/projects/org%2Fdeploy/merge_requests/7/merge":
+			merged = true
+			w.Write([]byte(`{"iid": 7}`))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.EscapedPath())
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	token, project, host, ids, l, yes := "token", "org/deploy", ts.URL, "3, 5", "gitops,deploy", true
+	accessToken, repo, gitlabHost = &token, &project, &host
+	assigneeIDs, labels, mergeWhenPipelineSucceeds, squash, removeSourceBranch = &ids, &l, &yes, &yes, &yes
+	defer func() {
+		empty, no := "", false
+		assigneeIDs, labels, mergeWhenPipelineSucceeds, squash, removeSourceBranch = &empty, &empty, &no, &no, &no
+	}()
+
+	if err := CreatePR("deploy/prod", "master", "deploy", "body"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := json.Marshal(created["assignee_ids"]); string(ids) != "[3,5]" || created["labels"] != "gitops,deploy" || created["squash"] != true || created["remove_source_branch"] != true {
+		t.Errorf("unexpected merge request %v", created)
+	}
+	if !merged {
+		t.Error("merge when pipeline succeeds was not enabled")
+	}
+
+	bad := "3,x"
+	assigneeIDs = &bad
+	if err := Validate(); err == nil || !strings.Contains(err.Error(), "gitlab_assignee_ids") {
+		t.Errorf("expected invalid gitlab_assignee_ids, got %v", err)
+	}
+}
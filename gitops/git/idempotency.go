@@ -0,0 +1,110 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package git
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+)
+
+// KeyTrailer is the commit message trailer with the idempotency key of the commit
+const KeyTrailer = "Gitops-Idempotency-Key"
+
+// maxAttempts of a PR creation failing with an ambiguous response
+const maxAttempts = 3
+
+// retryDelay is multiplied by the attempt number between attempts
+var retryDelay = 2 * time.Second
+
+var markerRe = regexp.MustCompile(`<!-- gitops-idempotency-key: ([0-9a-f]+) -->`)
+
+// Marker returns the hidden PR body comment with the idempotency key
+func Marker(key string) string {
+	return fmt.Sprintf("<!-- gitops-idempotency-key: %s -->", key)
+}
+
+// MarkerKey returns the idempotency key of the PR body, empty if it has none
+func MarkerKey(body string) string {
+	if m := markerRe.FindStringSubmatch(body); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// StatusError is an unexpected response of the git server API
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether err is an ambiguous failure of a write: the server responded with 5xx or 429,
+// or the request failed in transit, so the write may or may not have been applied
+func Retryable(err error) bool {
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500 || se.StatusCode == 429
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
+
+// CreatePRIdempotent creates the PR with the idempotency key marker in its body and retries ambiguous failures.
+// Retries are safe because servers reuse the open PR of the branch instead of creating another one.
+// A DedupServer updates the open PR of the branch carrying a marker, i.e. created by gitops in any run,
+// rather than creating a new one.
+func CreatePRIdempotent(s Server, from, to, title, body string, policy ReviewPolicy, key string) error {
+	if body == "" {
+		body = title
+	}
+	body += "\n\n" + Marker(key)
+	for attempt := 1; ; attempt++ {
+		err := createOrUpdatePR(s, from, to, title, body, policy)
+		if err == nil || !Retryable(err) || attempt == maxAttempts {
+			return err
+		}
+		log.Printf("Creating PR from %s failed ambiguously, retrying with idempotency key %s: %v", from, key, err)
+		metrics.Add(metrics.APIRetries, 1, "server", "pr")
+		time.Sleep(time.Duration(attempt) * retryDelay)
+	}
+}
+
+// createOrUpdatePR updates the open PR of the branch created by gitops if the server supports it,
+// otherwise creates the PR
+func createOrUpdatePR(s Server, from, to, title, body string, policy ReviewPolicy) error {
+	ds, ok := s.(DedupServer)
+	if !ok {
+		return CreatePRWithPolicy(s, from, to, title, body, policy)
+	}
+	pr, err := ds.FindOpenPR(from, to)
+	if err != nil {
+		return err
+	}
+	if pr == nil || MarkerKey(pr.Body) == "" {
+		return ds.CreatePRWithPolicy(from, to, title, body, policy)
+	}
+	log.Printf("Updating PR %s created by gitops for %s", pr.URL, from)
+	return ds.UpdatePR(pr, title, body, policy)
+}
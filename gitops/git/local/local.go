@@ -0,0 +1,142 @@
+// Package local is a git server that records pull requests as JSON files instead of calling an API.
+// Use it with a file:// git_repo to run the prer end to end without touching real repositories.
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+var (
+	prDir = flag.String("local_pr_dir", "", "the directory to record pull requests to when git_server is local")
+)
+
+// PullRequest is a pull request recorded by the local server
+type PullRequest struct {
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	Title         string    `json:"title"`
+	Body          string    `json:"body"`
+	Reviewers     []string  `json:"reviewers,omitempty"`
+	TeamReviewers []string  `json:"team_reviewers,omitempty"`
+	AutoMerge     bool      `json:"auto_merge,omitempty"`
+	Labels        []string  `json:"labels,omitempty"`
+	Assignees     []string  `json:"assignees,omitempty"`
+	Created       time.Time `json:"created"`
+	Updated       time.Time `json:"updated"`
+}
+
+func CreatePR(from, to, title, body string) error {
+	return CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+// CreatePRWithPolicy records the PR in local_pr_dir, or updates the recorded one for the same branches
+func CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	if *prDir == "" {
+		return errors.New("local_pr_dir must be set")
+	}
+	return Record(*prDir, from, to, title, body, policy)
+}
+
+// Validate reports missing flags of the provider
+func Validate() error {
+	if *prDir == "" {
+		return errors.New("local_pr_dir must be set")
+	}
+	return nil
+}
+
+// Check verifies that local_pr_dir is writable
+func Check(ctx context.Context) error {
+	if err := Validate(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*prDir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(*prDir, ".check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// Record writes the PR to dir as <from>.json. The creation time of an existing record is preserved
+func Record(dir, from, to, title, body string, policy git.ReviewPolicy) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, FileName(from))
+	now := time.Now().UTC()
+	pr := PullRequest{
+		From:          from,
+		To:            to,
+		Title:         title,
+		Body:          body,
+		Reviewers:     policy.Reviewers,
+		TeamReviewers: policy.TeamReviewers,
+		AutoMerge:     policy.AutoMerge,
+		Labels:        policy.Labels,
+		Assignees:     policy.Assignees,
+		Created:       now,
+		Updated:       now,
+	}
+	if existing, err := Read(path); err == nil && existing.To == to {
+		log.Println("Reusing existing PR")
+		pr.Created = existing.Created
+	}
+	b, err := json.MarshalIndent(pr, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	log.Println("Created PR: ", path)
+	return nil
+}
+
+// Read reads a recorded PR
+func Read(path string) (*PullRequest, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pr PullRequest
+	if err := json.Unmarshal(b, &pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// List returns all PRs recorded in dir
+func List(dir string) ([]*PullRequest, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var prs []*PullRequest
+	for _, path := range paths {
+		pr, err := Read(path)
+		if err != nil {
+			return nil, err
+		}
+		prs = append(prs, pr)
+	}
+	return prs, nil
+}
+
+// FileName returns the record file name of the PR from the branch
+func FileName(from string) string {
+	return strings.ReplaceAll(from, "/", "_") + ".json"
+}
@@ -0,0 +1,52 @@
+package local
+
+import (
+	"testing"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+func TestRecord(t *testing.T) {
+	dir := t.TempDir()
+	if err := Record(dir, "deploy/prod", "main", "title", "body", git.ReviewPolicy{Reviewers: []string{"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	first, err := Read(dir + "/deploy_prod.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.From != "deploy/prod" || first.To != "main" || first.Title != "title" || first.Body != "body" {
+		t.Errorf("unexpected PR %+v", first)
+	}
+	if len(first.Reviewers) != 1 || first.Reviewers[0] != "alice" {
+		t.Errorf("unexpected reviewers %v", first.Reviewers)
+	}
+
+	// the existing PR is reused
+	if err := Record(dir, "deploy/prod", "main", "new title", "body", git.ReviewPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Record(dir, "deploy/dev", "main", "dev", "body", git.ReviewPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	prs, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prs) != 2 {
+		t.Fatalf("expected 2 PRs, got %d", len(prs))
+	}
+	updated := prs[1]
+	if updated.From != "deploy/prod" || updated.Title != "new title" {
+		t.Errorf("unexpected PR %+v", updated)
+	}
+	if !updated.Created.Equal(first.Created) {
+		t.Errorf("expected creation time %v to be preserved, got %v", first.Created, updated.Created)
+	}
+}
+
+func TestCreatePRRequiresDir(t *testing.T) {
+	if err := CreatePR("from", "to", "title", ""); err == nil {
+		t.Error("expected error when local_pr_dir is not set")
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package git
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+// ErrNoOIDC is returned by CIToken outside of a CI job able to issue OIDC tokens
+var ErrNoOIDC = errors.New("the CI job can not issue OIDC tokens: run in GitHub Actions with the id-token: write permission or in Buildkite")
+
+// CIToken returns an OIDC token of the running CI job for the audience, to exchange for
+// short-lived credentials of the cloud provider of a git server. GitHub Actions tokens are
+// requested from the ACTIONS_ID_TOKEN_REQUEST_URL endpoint, Buildkite tokens from the buildkite-agent.
+func CIToken(ctx context.Context, audience string) (string, error) {
+	var token string
+	var err error
+	switch {
+	case os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL") != "":
+		token, err = actionsToken(ctx, audience)
+	case os.Getenv("BUILDKITE_AGENT_ACCESS_TOKEN") != "":
+		token, err = buildkiteToken(audience)
+	default:
+		return "", ErrNoOIDC
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to get the OIDC token of the CI job: %w", err)
+	}
+	redact.Add(token)
+	return token, nil
+}
+
+// actionsToken requests the OIDC token of the GitHub Actions job
+func actionsToken(ctx context.Context, audience string) (string, error) {
+	u, err := url.Parse(os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"))
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("audience", audience)
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", &StatusError{StatusCode: resp.StatusCode, Err: fmt.Errorf("github actions responded with %s", resp.Status)}
+	}
+	var r struct {
+		Value string `json:"value"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return "", err
+	}
+	if r.Value == "" {
+		return "", errors.New("github actions returned an empty token")
+	}
+	return r.Value, nil
+}
+
+// buildkiteToken requests the OIDC token of the Buildkite job from the agent
+func buildkiteToken(audience string) (string, error) {
+	cmd := exec.Command("buildkite-agent", "oidc", "request-token", "--audience", audience)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(out))
+	if token == "" {
+		return "", errors.New("buildkite-agent returned an empty token")
+	}
+	return token, nil
+}
@@ -1,5 +1,11 @@
 package git
 
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
 type Server interface {
 	CreatePR(from, to, title, body string) error
 }
@@ -13,3 +19,245 @@ func (f ServerFunc) CreatePR(from, to, title, body string) error {
 
 	return f(from, to, title, body)
 }
+
+// ReviewPolicy describes review requirements of a pull request
+type ReviewPolicy struct {
+	// Reviewers are user names requested to review the PR
+	Reviewers []string
+	// TeamReviewers are team names requested to review the PR
+	TeamReviewers []string
+	// AutoMerge enables merging the PR once its requirements are met
+	AutoMerge bool
+	// Labels are added to the PR, e.g. to route notifications
+	Labels []string
+	// Assignees are user names assigned to the PR
+	Assignees []string
+}
+
+// IsZero reports whether the policy has no requirements
+func (p ReviewPolicy) IsZero() bool {
+	return len(p.Reviewers) == 0 && len(p.TeamReviewers) == 0 && !p.AutoMerge && len(p.Labels) == 0 && len(p.Assignees) == 0
+}
+
+// PolicyServer is a Server able to enforce review policies
+type PolicyServer interface {
+	Server
+	CreatePRWithPolicy(from, to, title, body string, policy ReviewPolicy) error
+}
+
+type PolicyServerFunc func(from, to, title, body string, policy ReviewPolicy) error
+
+func (f PolicyServerFunc) CreatePR(from, to, title, body string) error {
+	return f.CreatePRWithPolicy(from, to, title, body, ReviewPolicy{})
+}
+
+func (f PolicyServerFunc) CreatePRWithPolicy(from, to, title, body string, policy ReviewPolicy) error {
+	if body == "" {
+		body = title
+	}
+
+	return f(from, to, title, body, policy)
+}
+
+// CreatePRWithPolicy creates the PR and enforces the policy.
+// It fails if the server is unable to enforce a policy with requirements.
+func CreatePRWithPolicy(s Server, from, to, title, body string, policy ReviewPolicy) error {
+	if ps, ok := s.(PolicyServer); ok {
+		return ps.CreatePRWithPolicy(from, to, title, body, policy)
+	}
+	if !policy.IsZero() {
+		return fmt.Errorf("git server does not support review policies, unable to enforce %+v", policy)
+	}
+	return s.CreatePR(from, to, title, body)
+}
+
+// Head returns the PR head of the branch: owner:branch for branches pushed to a fork of owner,
+// the branch if owner is empty
+func Head(owner, branch string) string {
+	if owner == "" {
+		return branch
+	}
+	return owner + ":" + branch
+}
+
+// SplitHead returns the fork owner and the branch of the PR head. The owner is empty
+// for branches of the PR target repository.
+func SplitHead(head string) (owner, branch string) {
+	if owner, branch, found := strings.Cut(head, ":"); found {
+		return owner, branch
+	}
+	return "", head
+}
+
+// PR is an open pull request of a git server
+type PR struct {
+	Number int
+	URL    string
+	Body   string
+	// Branch is the head branch of the PR, set by ListOpenPRs
+	Branch string
+	// Version is the revision of the PR required to update it by servers with optimistic locking
+	Version int
+}
+
+// DedupServer is a PolicyServer able to find and update the open PR of a branch,
+// so the PR created by gitops is updated instead of creating another one
+type DedupServer interface {
+	PolicyServer
+	// FindOpenPR returns the open PR from the branch into to, nil if there is none
+	FindOpenPR(from, to string) (*PR, error)
+	// UpdatePR replaces the title and the body of the PR and enforces the policy
+	UpdatePR(pr *PR, title, body string, policy ReviewPolicy) error
+}
+
+// PruneServer is a DedupServer able to list and close the open PRs of deployment branches,
+// so PRs of release trains that no longer exist are closed
+type PruneServer interface {
+	DedupServer
+	// ListOpenPRs returns the open PRs into to from branches starting with prefix
+	ListOpenPRs(prefix, to string) ([]*PR, error)
+	// ClosePR comments on the PR and closes it without merging
+	ClosePR(pr *PR, comment string) error
+}
+
+// CommentServer is a DedupServer able to comment on open PRs, e.g. to report why a release train failed
+type CommentServer interface {
+	DedupServer
+	// CommentPR adds the comment to the PR
+	CommentPR(pr *PR, comment string) error
+}
+
+// DefaultBranchServer is a Server able to tell the default branch of the repository
+type DefaultBranchServer interface {
+	Server
+	// DefaultBranch returns the name of the default branch of the repository
+	DefaultBranch() (string, error)
+}
+
+// DefaultBranch returns the default branch of the repository reported by the server,
+// or the branch HEAD of the remote repository points to if the server is unable to tell it
+func DefaultBranch(s Server, repo string) (string, error) {
+	if ds, ok := s.(DefaultBranchServer); ok {
+		return ds.DefaultBranch()
+	}
+	return RemoteDefaultBranch(repo)
+}
+
+// QueueEntry is the state of a PR in the merge queue of its target branch
+type QueueEntry struct {
+	// Position is the 1-based position of the PR in the queue
+	Position int
+	// State is the provider state of the entry, e.g. QUEUED or AWAITING_CHECKS
+	State string
+}
+
+// MergeQueueServer is a Server able to add PRs to the merge queue of their target branch
+type MergeQueueServer interface {
+	Server
+	// EnqueuePR adds the open PR from the branch into to to the merge queue, unless it is queued already,
+	// and returns its queue entry
+	EnqueuePR(from, to string) (*QueueEntry, error)
+}
+
+// EnqueuePR adds the open PR from the branch into to to the merge queue of to.
+// It fails if the server does not support merge queues.
+func EnqueuePR(s Server, from, to string) (*QueueEntry, error) {
+	if qs, ok := s.(MergeQueueServer); ok {
+		return qs.EnqueuePR(from, to)
+	}
+	return nil, errors.New("git server does not support merge queues")
+}
+
+// Deployment is the deployment of a release train recorded by the git server, e.g. for deployment dashboards
+type Deployment struct {
+	// Ref is the branch or commit deploying the release train
+	Ref string
+	// Environment is the environment the release train deploys to
+	Environment string
+	// Description is a short human readable description
+	Description string
+	// Payload is extra information of the deployment, encoded as JSON
+	Payload interface{}
+}
+
+// DeploymentServer is a Server able to record deployments of release trains
+type DeploymentServer interface {
+	Server
+	// CreateDeployment records the deployment and returns its URL
+	CreateDeployment(d Deployment) (string, error)
+}
+
+// CreateDeployment records the deployment with the server.
+// It fails if the server does not support deployments.
+func CreateDeployment(s Server, d Deployment) (string, error) {
+	if ds, ok := s.(DeploymentServer); ok {
+		return ds.CreateDeployment(d)
+	}
+	return "", errors.New("git server does not support deployments")
+}
+
+// Provider is a PruneServer, CommentServer, DefaultBranchServer, MergeQueueServer and DeploymentServer implemented by the functions
+// of a git server provider package. Comment, Enqueue and Deploy are nil for providers without PR comments, merge queues and deployments.
+type Provider struct {
+	Create  func(from, to, title, body string, policy ReviewPolicy) error
+	Find    func(from, to string) (*PR, error)
+	Update  func(pr *PR, title, body string, policy ReviewPolicy) error
+	List    func(prefix, to string) ([]*PR, error)
+	Close   func(pr *PR, comment string) error
+	Comment func(pr *PR, comment string) error
+	Default func() (string, error)
+	Enqueue func(from, to string) (*QueueEntry, error)
+	Deploy  func(d Deployment) (string, error)
+}
+
+func (p Provider) CreatePR(from, to, title, body string) error {
+	return p.CreatePRWithPolicy(from, to, title, body, ReviewPolicy{})
+}
+
+func (p Provider) CreatePRWithPolicy(from, to, title, body string, policy ReviewPolicy) error {
+	if body == "" {
+		body = title
+	}
+	return p.Create(from, to, title, body, policy)
+}
+
+func (p Provider) FindOpenPR(from, to string) (*PR, error) {
+	return p.Find(from, to)
+}
+
+func (p Provider) UpdatePR(pr *PR, title, body string, policy ReviewPolicy) error {
+	return p.Update(pr, title, body, policy)
+}
+
+func (p Provider) ListOpenPRs(prefix, to string) ([]*PR, error) {
+	return p.List(prefix, to)
+}
+
+func (p Provider) ClosePR(pr *PR, comment string) error {
+	return p.Close(pr, comment)
+}
+
+func (p Provider) CommentPR(pr *PR, comment string) error {
+	if p.Comment == nil {
+		return errors.New("git server does not support PR comments")
+	}
+	return p.Comment(pr, comment)
+}
+
+func (p Provider) DefaultBranch() (string, error) {
+	return p.Default()
+}
+
+func (p Provider) EnqueuePR(from, to string) (*QueueEntry, error) {
+	if p.Enqueue == nil {
+		return nil, errors.New("git server does not support merge queues")
+	}
+	return p.Enqueue(from, to)
+}
+
+func (p Provider) CreateDeployment(d Deployment) (string, error) {
+	if p.Deploy == nil {
+		return "", errors.New("git server does not support deployments")
+	}
+	return p.Deploy(d)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package git
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLS is the custom CA bundle and client certificate of enterprise git servers
+type TLS struct {
+	// CABundle is a PEM file of CA certificates trusted in addition to the system roots
+	CABundle string
+	// ClientCert and ClientKey are the PEM files of the client certificate of mutual TLS
+	ClientCert string
+	ClientKey  string
+}
+
+// tlsConfig is the TLS client configuration applied by TLS.Apply
+var tlsConfig *tls.Config
+
+// Config returns the TLS client configuration, nil if no option is set
+func (t TLS) Config() (*tls.Config, error) {
+	if t.CABundle == "" && t.ClientCert == "" && t.ClientKey == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{}
+	if t.CABundle != "" {
+		pem, err := os.ReadFile(t.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in CA bundle %s", t.CABundle)
+		}
+		cfg.RootCAs = pool
+	}
+	if t.ClientCert != "" || t.ClientKey != "" {
+		if t.ClientCert == "" || t.ClientKey == "" {
+			return nil, errors.New("client certificate and key must be set together")
+		}
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// Apply sets the TLS configuration of http.DefaultTransport, used by the API clients of the git
+// servers, and points git commands to the same files with the GIT_SSL_* environment variables
+func (t TLS) Apply() error {
+	cfg, err := t.Config()
+	if err != nil || cfg == nil {
+		return err
+	}
+	tlsConfig = cfg
+	http.DefaultTransport.(*http.Transport).TLSClientConfig = cfg
+	env := map[string]string{
+		"GIT_SSL_CAINFO": t.CABundle,
+		"GIT_SSL_CERT":   t.ClientCert,
+		"GIT_SSL_KEY":    t.ClientKey,
+	}
+	for name, value := range env {
+		if value == "" {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HTTPClient returns the HTTP client with the applied TLS configuration for API clients
+// not using http.DefaultTransport, nil if no configuration was applied
+func HTTPClient() *http.Client {
+	if tlsConfig == nil {
+		return nil
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	return &http.Client{Transport: tr}
+}
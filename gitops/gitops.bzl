@@ -1,22 +1,45 @@
+load("@bazel_skylib//lib:shell.bzl", "shell")
 load("@rules_gitops//gitops:provider.bzl", "GitopsArtifactsInfo")
 
 def __create_gitops_prs_impl(ctx):
     src_by_train = {}
+    pr_titles = {}
+    pr_bodies = {}
     for src in ctx.attr.srcs:
         gai = src[GitopsArtifactsInfo]
         if not gai.deployment_branch in src_by_train:
             src_by_train[gai.deployment_branch] = []
         src_by_train[gai.deployment_branch].append(src.files_to_run.executable)
+        if getattr(gai, "pr_title", None):
+            pr_titles[gai.deployment_branch] = gai.pr_title
+        if getattr(gai, "pr_body", None):
+            pr_bodies[gai.deployment_branch] = gai.pr_body
 
     # print("src_by_train:", src_by_train)
     trans_img_pushes = depset(transitive = [obj[GitopsArtifactsInfo].image_pushes for obj in ctx.attr.srcs if obj.files_to_run.executable]).to_list()
-    params = ""
+    # resolved binaries and pushes are passed in params files, large repositories exceed the argv limits
+    resolved_binaries = []
     for deployment_branch in src_by_train.keys():
         executables = src_by_train[deployment_branch]
         for exe in executables:
-            params += "--resolved_binary {}:{} ".format(deployment_branch, exe.short_path)
-    for exe in trans_img_pushes:
-        params += "--resolved_push {} ".format(exe.files_to_run.executable.short_path)
+            resolved_binaries.append("{}:{}".format(deployment_branch, exe.short_path))
+    resolved_pushes = [exe.files_to_run.executable.short_path for exe in trans_img_pushes]
+    binaries_file = ctx.actions.declare_file(ctx.label.name + ".resolved_binaries")
+    ctx.actions.write(binaries_file, "".join([rb + "\n" for rb in resolved_binaries]))
+    pushes_file = ctx.actions.declare_file(ctx.label.name + ".resolved_pushes")
+    ctx.actions.write(pushes_file, "".join([rp + "\n" for rp in resolved_pushes]))
+    params = "--resolved_binaries_file {} ".format(binaries_file.short_path)
+    params += "--resolved_pushes_file {} ".format(pushes_file.short_path)
+    for deployment_branch, title in pr_titles.items():
+        params += "--train_pr_title {} ".format(shell.quote("{}={}".format(deployment_branch, title)))
+    for deployment_branch, body in pr_bodies.items():
+        params += "--train_pr_body {} ".format(shell.quote("{}={}".format(deployment_branch, body)))
+    for target, path in ctx.attr.stdout_targets.items():
+        params += "--stdout_target {} ".format(shell.quote("{}={}".format(target.files_to_run.executable.short_path, path)))
+    for arg in ctx.attr.gitops_binary_args:
+        params += "--gitops_binary_arg {} ".format(shell.quote(arg))
+    for name, values in ctx.attr.branch_parameters.items():
+        params += "--branch_parameter {}={} ".format(name, ",".join(values))
     if ctx.attr.release_branch:
         params += "--release_branch {} ".format(ctx.attr.release_branch)
     if ctx.attr.git_repo:
@@ -26,14 +49,35 @@ def __create_gitops_prs_impl(ctx):
     if ctx.attr.gitopsdir:
         params += "--gitopsdir {} ".format(ctx.attr.gitopsdir)
     params += "--push_parallelism {} ".format(ctx.attr.push_parallelism)
+    params += "--render_parallelism {} ".format(ctx.attr.render_parallelism)
     if ctx.attr.gitops_pr_into:
         params += "--gitops_pr_into {} ".format(ctx.attr.gitops_pr_into)
     if ctx.attr.deploy_branch_prefix:
         params += "--deploy_branch_prefix {} ".format(ctx.attr.deploy_branch_prefix)
+    if ctx.attr.deployment_layout:
+        params += "--deployment_layout {} ".format(shell.quote(ctx.attr.deployment_layout))
     if ctx.attr.deployment_branch_suffix:
         params += "--deployment_branch_suffix {} ".format(ctx.attr.deployment_branch_suffix)
     if ctx.attr.git_server:
         params += "--git_server {} ".format(ctx.attr.git_server)
+    if ctx.attr.offline:
+        params += "--offline "
+    if ctx.attr.pr_manifest:
+        params += "--pr_manifest {} ".format(shell.quote(ctx.attr.pr_manifest))
+    if ctx.attr.bundle_dir:
+        params += "--bundle_dir {} ".format(shell.quote(ctx.attr.bundle_dir))
+    if ctx.attr.git_push_repo:
+        params += "--git_push_repo {} ".format(shell.quote(ctx.attr.git_push_repo))
+    if ctx.attr.git_push_owner:
+        params += "--git_push_owner {} ".format(ctx.attr.git_push_owner)
+    if ctx.attr.vault_addr:
+        params += "--vault_addr {} ".format(ctx.attr.vault_addr)
+    if ctx.attr.vault_auth_method:
+        params += "--vault_auth_method {} ".format(ctx.attr.vault_auth_method)
+    if ctx.attr.vault_role:
+        params += "--vault_role {} ".format(ctx.attr.vault_role)
+    for name, ref in ctx.attr.vault_secrets.items():
+        params += "--vault_secret {} ".format(shell.quote("{}={}".format(name, ref)))
     if ctx.attr.dry_run:
         params += "--dry_run "
     if ctx.attr.github_repo_owner:
@@ -60,7 +104,7 @@ def __create_gitops_prs_impl(ctx):
         },
         output = ctx.outputs.executable,
     )
-    runfiles = ctx.runfiles(files = ctx.files.srcs)
+    runfiles = ctx.runfiles(files = ctx.files.srcs + [binaries_file, pushes_file])
     transitive_runfiles = []
     for target in ctx.attr.srcs:
         transitive_runfiles.append(target[DefaultInfo].default_runfiles)
@@ -101,23 +145,66 @@ create_gitops_prs = rule(
             doc = "number of parallel pushes to registry",
             default = 4,
         ),
+        "render_parallelism": attr.int(
+            doc = "number of gitops binaries of a release train running in parallel",
+            default = 1,
+        ),
         "gitops_pr_into": attr.string(
-            doc = "use this branch as the source branch and target for deployment PR",
-            default = "main",
+            doc = "use this branch as the source branch and target for deployment PR. Defaults to the default branch of the deployment repository",
         ),
         "release_branch": attr.string(
             doc = "release branch to create PRs in.",
         ),
+        "gitops_binary_args": attr.string_list(
+            doc = "extra arguments of every gitops binary, e.g. [\"--variable=REGION=us\"]",
+        ),
+        "stdout_targets": attr.label_keyed_string_dict(
+            doc = "gitops targets of srcs printing manifests to stdout, with the path to write them to under the deployment root, e.g. {\":rules\": \"{gitops_path}/monitoring/rules.yaml\"}",
+        ),
         "deploy_branch_prefix": attr.string(
-            doc = "prefix for deployment branches",
+            doc = "namespace of deployment branches, e.g. the application name: deploy/<prefix>/<train>",
+        ),
+        "deployment_layout": attr.string(
+            doc = "directory the manifests of every gitops target are moved to, e.g. {gitops_path}/{train}/{package}",
         ),
         "deployment_branch_suffix": attr.string(
             doc = "suffix for deployment branches",
         ),
+        "branch_parameters": attr.string_list_dict(
+            doc = "values of {name} placeholders of deployment_branch attributes. A release train is created per value, e.g. {\"region\": [\"us\", \"eu\"]}",
+        ),
         "git_server": attr.string(
             doc = "git server to create PRs in.",
             default = "github",
         ),
+        "vault_addr": attr.string(
+            doc = "Vault server to read vault_secrets from",
+        ),
+        "vault_auth_method": attr.string(
+            doc = "Vault auth method: token, approle, jwt or kubernetes",
+        ),
+        "vault_role": attr.string(
+            doc = "Vault role of the jwt and kubernetes auth methods, the role ID of approle",
+        ),
+        "vault_secrets": attr.string_dict(
+            doc = "credentials read from Vault, flag name to path#field, e.g. {\"github_access_token\": \"secret/data/gitops#token\"}",
+        ),
+        "offline": attr.bool(
+            default = False,
+            doc = "clone from and push to git_mirror and record PRs in pr_manifest instead of calling the git server API",
+        ),
+        "pr_manifest": attr.string(
+            doc = "JSON file of the PRs to create of offline runs",
+        ),
+        "bundle_dir": attr.string(
+            doc = "directory of the git bundles and PR metadata of offline runs, written instead of pushing to the git mirror",
+        ),
+        "git_push_repo": attr.string(
+            doc = "fork of the gitops repository to push deployment branches to",
+        ),
+        "git_push_owner": attr.string(
+            doc = "owner of git_push_repo, derived from its URL by default",
+        ),
         "dry_run": attr.bool(
             doc = "dry run mode",
             default = False,
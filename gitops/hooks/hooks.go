@@ -0,0 +1,120 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package hooks runs user provided commands at well defined stages of a gitops run.
+package hooks
+
+import (
+	"fmt"
+	"log"
+	"os"
+	oe "os/exec"
+	"runtime"
+	"strings"
+)
+
+// Stage of a gitops run
+type Stage string
+
+// Stages at which hooks are executed
+const (
+	// PreRender runs for every release train before its gitops binaries are executed
+	PreRender Stage = "pre-render"
+	// PostRender runs for every release train after its gitops binaries are executed
+	PostRender Stage = "post-render"
+	// PreCommit runs for every release train with changes before the deployment branch commit
+	PreCommit Stage = "pre-commit"
+	// PrePush runs once before deployment branches are pushed
+	PrePush Stage = "pre-push"
+	// PostPR runs for every deployment branch after its PR is created
+	PostPR Stage = "post-pr"
+)
+
+// Env describes the context passed to hooks as environment variables
+type Env struct {
+	Train    string
+	Branch   string
+	Workdir  string
+	Commit   string
+	Files    []string
+	Branches []string
+}
+
+func (e Env) environ(stage Stage) []string {
+	return append(os.Environ(),
+		"GITOPS_HOOK="+string(stage),
+		"GITOPS_TRAIN="+e.Train,
+		"GITOPS_BRANCH="+e.Branch,
+		"GITOPS_WORKDIR="+e.Workdir,
+		"GITOPS_GIT_COMMIT="+e.Commit,
+		"GITOPS_CHANGED_FILES="+strings.Join(e.Files, "\n"),
+		"GITOPS_BRANCHES="+strings.Join(e.Branches, "\n"),
+	)
+}
+
+// Runner executes the hooks of a stage. A non-nil error vetoes the stage.
+type Runner interface {
+	Run(stage Stage, env Env) error
+}
+
+// RunnerFunc is a Runner implemented in Go, e.g. by programs driving gitops runs
+type RunnerFunc func(stage Stage, env Env) error
+
+func (f RunnerFunc) Run(stage Stage, env Env) error {
+	return f(stage, env)
+}
+
+// Chain is a Runner executing runners in order until one of them fails
+type Chain []Runner
+
+func (c Chain) Run(stage Stage, env Env) error {
+	for _, r := range c {
+		if err := r.Run(stage, env); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hooks maps stages to commands. A command is a shell command line, executed with sh -c,
+// or cmd /C on Windows, so arguments may be quoted.
+type Hooks map[Stage][]string
+
+// Run executes all hooks registered for the stage in order.
+// A hook exiting with non-zero status vetoes the stage and stops the execution of remaining hooks.
+func (h Hooks) Run(stage Stage, env Env) error {
+	for _, command := range h[stage] {
+		if strings.TrimSpace(command) == "" {
+			continue
+		}
+		log.Printf("running %s hook: %s", stage, command)
+		cmd := shell(command)
+		cmd.Dir = env.Workdir
+		cmd.Env = env.environ(stage)
+		b, err := cmd.CombinedOutput()
+		if len(b) > 0 {
+			log.Printf("%s", b)
+		}
+		if err != nil {
+			return fmt.Errorf("%s hook %q failed: %w", stage, command, err)
+		}
+	}
+	return nil
+}
+
+// shell returns the command executing the command line with the shell of the platform
+func shell(command string) *oe.Cmd {
+	if runtime.GOOS == "windows" {
+		return oe.Command("cmd", "/C", command)
+	}
+	return oe.Command("sh", "-c", command)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package hooks
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeScript(t *testing.T, dir, name, body string) string {
+	t.Helper()
+	p := filepath.Join(dir, name)
+	if err := os.WriteFile(p, []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	record := writeScript(t, dir, "record.sh", `echo "$GITOPS_HOOK $GITOPS_TRAIN $1 $GITOPS_CHANGED_FILES" >> `+out+"\n")
+	veto := writeScript(t, dir, "veto.sh", "exit 3\n")
+
+	h := Hooks{
+		PreRender: {record + ` "quoted arg"`, "  "},
+		PreCommit: {veto, record},
+	}
+	env := Env{Train: "prod", Workdir: dir, Files: []string{"cloud/a.yaml"}}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	if err := h.Run(PreRender, env); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := bytes.Count(logs.Bytes(), []byte("\n")); n != 1 {
+		t.Errorf("silent hook logged %d lines: %q", n, logs.String())
+	}
+	if err := h.Run(PreCommit, env); err == nil {
+		t.Fatal("expected veto")
+	}
+	if err := h.Run(PostPR, env); err != nil {
+		t.Fatalf("unexpected error for stage without hooks: %v", err)
+	}
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "pre-render prod quoted arg cloud/a.yaml\n"; string(b) != want {
+		t.Errorf("unexpected hook output %q, want %q", b, want)
+	}
+}
+
+func TestChain(t *testing.T) {
+	var calls []string
+	record := func(name string, err error) Runner {
+		return RunnerFunc(func(stage Stage, env Env) error {
+			calls = append(calls, name+" "+string(stage)+" "+env.Train)
+			return err
+		})
+	}
+	c := Chain{record("a", nil), record("b", errors.New("veto")), record("c", nil)}
+	if err := c.Run(PrePush, Env{Train: "prod"}); err == nil || err.Error() != "veto" {
+		t.Fatalf("expected veto, got %v", err)
+	}
+	if want := []string{"a pre-push prod", "b pre-push prod"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("unexpected calls %v, want %v", calls, want)
+	}
+}
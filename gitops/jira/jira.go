@@ -0,0 +1,154 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package jira links deployment PRs to Jira tickets.
+package jira
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var keyRe = regexp.MustCompile(`\b[A-Z][A-Z0-9]+-[0-9]+\b`)
+
+// Keys extracts unique Jira ticket keys from texts in order of appearance.
+// If projects is not empty only keys of the listed projects are returned.
+func Keys(projects []string, texts ...string) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, text := range texts {
+		for _, key := range keyRe.FindAllString(text, -1) {
+			if seen[key] || !inProjects(key, projects) {
+				continue
+			}
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func inProjects(key string, projects []string) bool {
+	if len(projects) == 0 {
+		return true
+	}
+	project := key[:strings.LastIndex(key, "-")]
+	for _, p := range projects {
+		if p == project {
+			return true
+		}
+	}
+	return false
+}
+
+// Decorate prefixes the PR title with the ticket keys and appends ticket links to the PR body
+func Decorate(title, body, baseURL string, keys []string) (string, string) {
+	if len(keys) == 0 {
+		return title, body
+	}
+	title = fmt.Sprintf("[%s] %s", strings.Join(keys, ", "), title)
+	links := make([]string, len(keys))
+	for i, key := range keys {
+		links[i] = fmt.Sprintf("[%s](%s/browse/%s)", key, strings.TrimSuffix(baseURL, "/"), key)
+	}
+	body = fmt.Sprintf("%s\n\nJira: %s", body, strings.Join(links, ", "))
+	return title, body
+}
+
+// Client calls the Jira REST API
+type Client struct {
+	// URL of the Jira server, e.g. https://example.atlassian.net
+	URL   string
+	User  string
+	Token string
+	HTTP  *http.Client
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.URL, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if c.User != "" {
+		req.SetBasicAuth(c.User, c.Token)
+	} else if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Transition moves the ticket to the named status. Tickets already in the target status are left unchanged.
+func (c *Client) Transition(key, name string) error {
+	var issue struct {
+		Fields struct {
+			Status struct {
+				Name string `json:"name"`
+			} `json:"status"`
+		} `json:"fields"`
+	}
+	if err := c.do(http.MethodGet, "/rest/api/2/issue/"+key+"?fields=status", nil, &issue); err != nil {
+		return err
+	}
+	if strings.EqualFold(issue.Fields.Status.Name, name) {
+		return nil
+	}
+	var transitions struct {
+		Transitions []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+			To   struct {
+				Name string `json:"name"`
+			} `json:"to"`
+		} `json:"transitions"`
+	}
+	if err := c.do(http.MethodGet, "/rest/api/2/issue/"+key+"/transitions", nil, &transitions); err != nil {
+		return err
+	}
+	for _, t := range transitions.Transitions {
+		if strings.EqualFold(t.Name, name) || strings.EqualFold(t.To.Name, name) {
+			req := map[string]interface{}{"transition": map[string]string{"id": t.ID}}
+			return c.do(http.MethodPost, "/rest/api/2/issue/"+key+"/transitions", req, nil)
+		}
+	}
+	return fmt.Errorf("%s: no transition to %q available", key, name)
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package jira
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestKeys(t *testing.T) {
+	for _, tt := range []struct {
+		projects []string
+		texts    []string
+		want     []string
+	}{
+		{nil, []string{"feature/OPS-12-fix", "OPS-12: fix deploy\n\nalso DEV-7"}, []string{"OPS-12", "DEV-7"}},
+		{[]string{"DEV"}, []string{"OPS-12 DEV-7 DEV-7"}, []string{"DEV-7"}},
+		{nil, []string{"master", "no tickets here, ops-1 is lowercase"}, nil},
+	} {
+		if got := Keys(tt.projects, tt.texts...); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Keys(%v, %q) = %v, want %v", tt.projects, tt.texts, got, tt.want)
+		}
+	}
+}
+
+func TestDecorate(t *testing.T) {
+	title, body := Decorate("GitOps deployment prod", "prod", "https://jira.example.com/", []string{"OPS-1", "OPS-2"})
+	if title != "[OPS-1, OPS-2] GitOps deployment prod" {
+		t.Errorf("unexpected title %q", title)
+	}
+	if body != "prod\n\nJira: [OPS-1](https://jira.example.com/browse/OPS-1), [OPS-2](https://jira.example.com/browse/OPS-2)" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if title, body := Decorate("t", "b", "", nil); title != "t" || body != "b" {
+		t.Errorf("unexpected decoration without keys: %q %q", title, body)
+	}
+}
+
+func TestTransition(t *testing.T) {
+	var transitioned string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "bot" || p != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "GET /rest/api/2/issue/OPS-1", "GET /rest/api/2/issue/OPS-2":
+			fmt.Fprint(w, `{"fields":{"status":{"name":"In Review"}}}`)
+		case "GET /rest/api/2/issue/OPS-3":
+			fmt.Fprint(w, `{"fields":{"status":{"name":"Deploying"}}}`)
+		case "GET /rest/api/2/issue/OPS-1/transitions":
+			fmt.Fprint(w, `{"transitions":[{"id":"11","name":"Done","to":{"name":"Done"}},{"id":"21","name":"Deploy","to":{"name":"Deploying"}}]}`)
+		case "GET /rest/api/2/issue/OPS-2/transitions":
+			fmt.Fprint(w, `{"transitions":[]}`)
+		case "POST /rest/api/2/issue/OPS-1/transitions":
+			var req struct {
+				Transition struct{ ID string } `json:"transition"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			transitioned = req.Transition.ID
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	c := &Client{URL: ts.URL, User: "bot", Token: "token"}
+	if err := c.Transition("OPS-1", "Deploying"); err != nil || transitioned != "21" {
+		t.Errorf("OPS-1: err %v, transition %q", err, transitioned)
+	}
+	if err := c.Transition("OPS-2", "Deploying"); err == nil {
+		t.Error("OPS-2: expected missing transition error")
+	}
+	if err := c.Transition("OPS-3", "Deploying"); err != nil {
+		t.Errorf("OPS-3: %v", err)
+	}
+	if err := (&Client{URL: ts.URL}).Transition("OPS-1", "Deploying"); err == nil {
+		t.Error("expected unauthorized error")
+	}
+}
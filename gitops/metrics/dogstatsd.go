@@ -0,0 +1,68 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Sink receives every counter increment and histogram observation of a registry
+type Sink interface {
+	Count(name string, v float64, labels []string)
+	Histogram(name string, v float64, labels []string)
+}
+
+// DogStatsD sends metrics to a Datadog agent over UDP. Labels are sent as tags.
+type DogStatsD struct {
+	conn net.Conn
+	tags []string
+}
+
+// NewDogStatsD connects to the DogStatsD agent at host:port. tags, e.g. team:sre, are added to every metric.
+func NewDogStatsD(host string, port int, tags []string) (*DogStatsD, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to dogstatsd: %w", err)
+	}
+	return &DogStatsD{conn: conn, tags: tags}, nil
+}
+
+// Count implements Sink
+func (d *DogStatsD) Count(name string, v float64, labels []string) {
+	d.send(name, v, "c", labels)
+}
+
+// Histogram implements Sink
+func (d *DogStatsD) Histogram(name string, v float64, labels []string) {
+	d.send(name, v, "h", labels)
+}
+
+// Close closes the connection to the agent
+func (d *DogStatsD) Close() error {
+	return d.conn.Close()
+}
+
+// send writes the datagram name:v|type|#tags. Metrics are best effort, write errors are ignored.
+func (d *DogStatsD) send(name string, v float64, typ string, labels []string) {
+	tags := append([]string{}, d.tags...)
+	for i := 0; i+1 < len(labels); i += 2 {
+		tags = append(tags, labels[i]+":"+labels[i+1])
+	}
+	msg := name + ":" + formatFloat(v) + "|" + typ
+	if len(tags) > 0 {
+		msg += "|#" + strings.Join(tags, ",")
+	}
+	d.conn.Write([]byte(msg))
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDogStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agent.Close()
+	d, err := NewDogStatsD("127.0.0.1", agent.LocalAddr().(*net.UDPAddr).Port, []string{"team:sre"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	r := New()
+	r.AddSink(d)
+	r.Add("prer_pushes_total", 2, "kind", "branch")
+	r.Observe("prer_phase_duration_seconds", 1.5, "phase", "render")
+
+	agent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for _, want := range []string{
+		"prer_pushes_total:2|c|#team:sre,kind:branch",
+		"prer_phase_duration_seconds:1.5|h|#team:sre,phase:render",
+	} {
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != want {
+			t.Errorf("datagram %q, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package metrics records counters and histograms of a run without external dependencies.
+// Metrics are exposed in the Prometheus text format and can be saved to a file so a
+// parent process, e.g. the serve command, can merge the metrics of the runs it starts.
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// APIRetries counts retried git server API requests by server
+const APIRetries = "prer_api_retries_total"
+
+// Buckets are the upper bounds of histogram buckets, in seconds for durations
+var Buckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900}
+
+// Default is the registry of the process
+var Default = New()
+
+func init() {
+	Default.Describe(APIRetries, "Retried git server API requests")
+}
+
+// Registry holds counters and histograms by metric name and label values
+type Registry struct {
+	mu         sync.Mutex
+	Help       map[string]string     `json:"help"`
+	Counters   map[string]float64    `json:"counters"`
+	Histograms map[string]*Histogram `json:"histograms"`
+	sinks      []Sink
+}
+
+// Histogram counts observations in Buckets
+type Histogram struct {
+	Counts []uint64 `json:"counts"`
+	Sum    float64  `json:"sum"`
+	Count  uint64   `json:"count"`
+}
+
+// New returns an empty registry
+func New() *Registry {
+	return &Registry{
+		Help:       make(map[string]string),
+		Counters:   make(map[string]float64),
+		Histograms: make(map[string]*Histogram),
+	}
+}
+
+// Describe sets the help text of the metric
+func (r *Registry) Describe(name, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Help[name] = help
+}
+
+// AddSink forwards counter increments and observations recorded from now on to s.
+// Merged registries are not forwarded.
+func (r *Registry) AddSink(s Sink) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sinks = append(r.sinks, s)
+}
+
+// Add increments the counter. labels are name, value pairs.
+func (r *Registry) Add(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Counters[series(name, labels)] += v
+	for _, s := range r.sinks {
+		s.Count(name, v, labels)
+	}
+}
+
+// Observe adds v to the histogram. labels are name, value pairs.
+func (r *Registry) Observe(name string, v float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.histogram(series(name, labels)).observe(v)
+	for _, s := range r.sinks {
+		s.Histogram(name, v, labels)
+	}
+}
+
+// Counter returns the value of the counter, 0 if it was never incremented
+func (r *Registry) Counter(name string, labels ...string) float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.Counters[series(name, labels)]
+}
+
+// Sum returns the sum and the count of observations of the histogram
+func (r *Registry) Sum(name string, labels ...string) (float64, uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h, ok := r.Histograms[series(name, labels)]
+	if !ok {
+		return 0, 0
+	}
+	return h.Sum, h.Count
+}
+
+// Labels returns the values of label of every series of the metric, sorted
+func (r *Registry) Labels(name, label string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[string]bool)
+	collect := func(key string) {
+		n, labels := parseSeries(key)
+		if n != name {
+			return
+		}
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i] == label {
+				seen[labels[i+1]] = true
+			}
+		}
+	}
+	for key := range r.Counters {
+		collect(key)
+	}
+	for key := range r.Histograms {
+		collect(key)
+	}
+	values := make([]string, 0, len(seen))
+	for v := range seen {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	return values
+}
+
+// Merge adds the counters and histograms of other to r
+func (r *Registry) Merge(other *Registry) {
+	other.mu.Lock()
+	defer other.mu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for name, help := range other.Help {
+		if _, ok := r.Help[name]; !ok {
+			r.Help[name] = help
+		}
+	}
+	for key, v := range other.Counters {
+		r.Counters[key] += v
+	}
+	for key, oh := range other.Histograms {
+		h := r.histogram(key)
+		for i := range h.Counts {
+			if i < len(oh.Counts) {
+				h.Counts[i] += oh.Counts[i]
+			}
+		}
+		h.Sum += oh.Sum
+		h.Count += oh.Count
+	}
+}
+
+// Save writes the registry to the JSON file read by Load
+func (r *Registry) Save(path string) error {
+	r.mu.Lock()
+	b, err := json.Marshal(r)
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0644)
+}
+
+// Load reads the registry saved by Save
+func Load(path string) (*Registry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := New()
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("unable to parse metrics %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// WritePrometheus writes the metrics in the Prometheus text exposition format
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	type line struct{ key, text string }
+	byName := make(map[string][]line)
+	kinds := make(map[string]string)
+	for key, v := range r.Counters {
+		name, labels := parseSeries(key)
+		kinds[name] = "counter"
+		byName[name] = append(byName[name], line{key, fmt.Sprintf("%s%s %s\n", name, formatLabels(labels), formatFloat(v))})
+	}
+	for key, h := range r.Histograms {
+		name, labels := parseSeries(key)
+		kinds[name] = "histogram"
+		var b strings.Builder
+		for i, le := range Buckets {
+			fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(append(labels, "le", formatFloat(le))), h.Counts[i])
+		}
+		fmt.Fprintf(&b, "%s_bucket%s %d\n", name, formatLabels(append(labels, "le", "+Inf")), h.Count)
+		fmt.Fprintf(&b, "%s_sum%s %s\n", name, formatLabels(labels), formatFloat(h.Sum))
+		fmt.Fprintf(&b, "%s_count%s %d\n", name, formatLabels(labels), h.Count)
+		byName[name] = append(byName[name], line{key, b.String()})
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if help, ok := r.Help[name]; ok {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n", name, help); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n", name, kinds[name]); err != nil {
+			return err
+		}
+		lines := byName[name]
+		sort.Slice(lines, func(i, j int) bool { return lines[i].key < lines[j].key })
+		for _, l := range lines {
+			if _, err := io.WriteString(w, l.text); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Handler serves the metrics in the Prometheus text exposition format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+}
+
+// Describe sets the help text of the metric of the Default registry
+func Describe(name, help string) { Default.Describe(name, help) }
+
+// Add increments the counter of the Default registry
+func Add(name string, v float64, labels ...string) { Default.Add(name, v, labels...) }
+
+// Observe adds v to the histogram of the Default registry
+func Observe(name string, v float64, labels ...string) { Default.Observe(name, v, labels...) }
+
+func (r *Registry) histogram(key string) *Histogram {
+	h, ok := r.Histograms[key]
+	if !ok || len(h.Counts) != len(Buckets) {
+		h = &Histogram{Counts: make([]uint64, len(Buckets))}
+		r.Histograms[key] = h
+	}
+	return h
+}
+
+func (h *Histogram) observe(v float64) {
+	for i, le := range Buckets {
+		if v <= le {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += v
+	h.Count++
+}
+
+// series returns the key of the metric with labels, e.g. name{a="1",b="2"}. Labels are sorted by name.
+func series(name string, labels []string) string {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: odd number of label values for %s", name))
+	}
+	pairs := make([][2]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, [2]string{labels[i], labels[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })
+	flat := make([]string, 0, len(labels))
+	for _, p := range pairs {
+		flat = append(flat, p[0], p[1])
+	}
+	return name + formatLabels(flat)
+}
+
+// parseSeries is the inverse of series
+func parseSeries(key string) (string, []string) {
+	name, rest, ok := strings.Cut(key, "{")
+	if !ok {
+		return key, nil
+	}
+	rest = strings.TrimSuffix(rest, "}")
+	var labels []string
+	for rest != "" {
+		label, value, _ := strings.Cut(rest, "=")
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			break
+		}
+		v, _ := strconv.Unquote(quoted)
+		labels = append(labels, label, v)
+		rest = strings.TrimPrefix(value[len(quoted):], ",")
+	}
+	return name, labels
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package metrics
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := New()
+	r.Describe("prer_pushes_total", "Pushes")
+	r.Add("prer_pushes_total", 1, "kind", "branch")
+	r.Add("prer_pushes_total", 2, "kind", "branch")
+	r.Observe("prer_phase_duration_seconds", 0.3, "phase", "render")
+	r.Observe("prer_phase_duration_seconds", 20, "phase", "render")
+	var b strings.Builder
+	if err := r.WritePrometheus(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE prer_phase_duration_seconds histogram\n",
+		`prer_phase_duration_seconds_bucket{phase="render",le="0.1"} 0` + "\n",
+		`prer_phase_duration_seconds_bucket{phase="render",le="0.5"} 1` + "\n",
+		`prer_phase_duration_seconds_bucket{phase="render",le="+Inf"} 2` + "\n",
+		`prer_phase_duration_seconds_sum{phase="render"} 20.3` + "\n",
+		`prer_phase_duration_seconds_count{phase="render"} 2` + "\n",
+		"# HELP prer_pushes_total Pushes\n# TYPE prer_pushes_total counter\n" + `prer_pushes_total{kind="branch"} 3` + "\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("WritePrometheus() = %q, missing %q", b.String(), want)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	r := New()
+	r.Add("prer_changed_files_total", 3, "train", "prod", "repo", "a")
+	r.Add("prer_changed_files_total", 1, "train", `qa "1"`)
+	r.Add("prer_pushes_total", 1, "train", "other")
+	if got, want := r.Labels("prer_changed_files_total", "train"), []string{"prod", `qa "1"`}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Labels() = %v, want %v", got, want)
+	}
+	if got := r.Counter("prer_changed_files_total", "repo", "a", "train", "prod"); got != 3 {
+		t.Errorf("Counter() = %v, want 3", got)
+	}
+}
+
+func TestSaveMerge(t *testing.T) {
+	r := New()
+	r.Add("prer_pushes_total", 2)
+	r.Observe("prer_phase_duration_seconds", 1, "phase", "push")
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	if err := r.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := New()
+	total.Merge(loaded)
+	total.Merge(loaded)
+	if got := total.Counter("prer_pushes_total"); got != 4 {
+		t.Errorf("Counter() = %v, want 4", got)
+	}
+	if sum, count := total.Sum("prer_phase_duration_seconds", "phase", "push"); sum != 2 || count != 2 {
+		t.Errorf("Sum() = %v, %v, want 2, 2", sum, count)
+	}
+}
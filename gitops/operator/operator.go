@@ -0,0 +1,269 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package operator executes GitOpsRun custom resources in a kubernetes cluster.
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Store reads and updates runs
+type Store interface {
+	List(ctx context.Context) ([]GitOpsRun, error)
+	UpdateStatus(ctx context.Context, run *GitOpsRun) error
+	// Env returns the environment variables of the run credentials
+	Env(ctx context.Context, run *GitOpsRun) ([]string, error)
+}
+
+// Runner executes a run with the additional environment
+type Runner func(ctx context.Context, run *GitOpsRun, env []string) error
+
+// Controller polls runs and executes pending ones one at a time
+type Controller struct {
+	Store    Store
+	Run      Runner
+	Interval time.Duration
+
+	mu         sync.Mutex
+	reconciled bool
+	listErr    error
+	history    []Record
+}
+
+// Record is a run executed by the controller, reported by Recent
+type Record struct {
+	Namespace     string
+	Name          string
+	Revision      string
+	ReleaseBranch string
+	Phase         string
+	Message       string
+	Started       time.Time
+	Finished      *time.Time
+}
+
+// maxRecords is the number of executed runs kept in memory
+const maxRecords = 200
+
+// Ready returns nil once runs were listed successfully, or the error of the last attempt
+func (c *Controller) Ready() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listErr != nil {
+		return c.listErr
+	}
+	if !c.reconciled {
+		return errors.New("runs are not listed yet")
+	}
+	return nil
+}
+
+// Recent returns at most n runs executed by the controller, newest first
+func (c *Controller) Recent(n int) []Record {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []Record
+	for i := len(c.history) - 1; i >= 0 && len(records) < n; i-- {
+		records = append(records, c.history[i])
+	}
+	return records
+}
+
+// track records the run phase in the history
+func (c *Controller) track(run *GitOpsRun) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rec := Record{
+		Namespace:     run.Namespace,
+		Name:          run.Name,
+		Revision:      run.Spec.Revision,
+		ReleaseBranch: run.Spec.ReleaseBranch,
+		Phase:         run.Status.Phase,
+		Message:       run.Status.Message,
+	}
+	if run.Status.StartTime != nil {
+		rec.Started = run.Status.StartTime.Time
+	}
+	if run.Status.CompletionTime != nil {
+		finished := run.Status.CompletionTime.Time
+		rec.Finished = &finished
+	}
+	if last := len(c.history) - 1; last >= 0 && c.history[last].Namespace == rec.Namespace && c.history[last].Name == rec.Name && c.history[last].Phase == PhaseRunning {
+		c.history[last] = rec
+		return
+	}
+	c.history = append(c.history, rec)
+	if len(c.history) > maxRecords {
+		c.history = c.history[len(c.history)-maxRecords:]
+	}
+}
+
+// Start reconciles runs until ctx is done
+func (c *Controller) Start(ctx context.Context) {
+	t := time.NewTicker(c.Interval)
+	defer t.Stop()
+	for {
+		if err := c.Reconcile(ctx); err != nil {
+			log.Printf("reconcile failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Reconcile executes all runs which have not been started yet
+func (c *Controller) Reconcile(ctx context.Context) error {
+	runs, err := c.Store.List(ctx)
+	c.mu.Lock()
+	c.reconciled = c.reconciled || err == nil
+	c.listErr = err
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	for i := range runs {
+		run := &runs[i]
+		switch run.Status.Phase {
+		case "", PhasePending:
+			c.execute(ctx, run)
+		case PhaseRunning:
+			// the controller executes runs synchronously, a run in this state was interrupted by a restart
+			c.finish(ctx, run, fmt.Errorf("run was interrupted"))
+		}
+	}
+	return nil
+}
+
+func (c *Controller) execute(ctx context.Context, run *GitOpsRun) {
+	now := metav1.Now()
+	run.Status.Phase = PhaseRunning
+	run.Status.StartTime = &now
+	run.Status.Message = ""
+	meta.SetStatusCondition(&run.Status.Conditions, metav1.Condition{
+		Type:               ConditionSucceeded,
+		Status:             metav1.ConditionUnknown,
+		Reason:             PhaseRunning,
+		ObservedGeneration: run.Generation,
+	})
+	if err := c.Store.UpdateStatus(ctx, run); err != nil {
+		// most likely the run was modified or deleted, it is picked up by the next reconcile
+		log.Printf("unable to start run %s/%s: %v", run.Namespace, run.Name, err)
+		return
+	}
+	log.Printf("starting run %s/%s", run.Namespace, run.Name)
+	c.track(run)
+	env, err := c.Store.Env(ctx, run)
+	if err == nil {
+		err = c.Run(ctx, run, env)
+	}
+	c.finish(ctx, run, err)
+}
+
+func (c *Controller) finish(ctx context.Context, run *GitOpsRun, err error) {
+	now := metav1.Now()
+	run.Status.CompletionTime = &now
+	cond := metav1.Condition{Type: ConditionSucceeded, ObservedGeneration: run.Generation}
+	if err != nil {
+		run.Status.Phase = PhaseFailed
+		run.Status.Message = err.Error()
+		cond.Status, cond.Reason, cond.Message = metav1.ConditionFalse, PhaseFailed, err.Error()
+	} else {
+		run.Status.Phase = PhaseSucceeded
+		cond.Status, cond.Reason = metav1.ConditionTrue, PhaseSucceeded
+	}
+	meta.SetStatusCondition(&run.Status.Conditions, cond)
+	log.Printf("run %s/%s: %s %s", run.Namespace, run.Name, run.Status.Phase, run.Status.Message)
+	c.track(run)
+	if err := c.Store.UpdateStatus(ctx, run); err != nil {
+		log.Printf("unable to update status of run %s/%s: %v", run.Namespace, run.Name, err)
+	}
+}
+
+// KubeStore is a Store backed by the kubernetes API
+type KubeStore struct {
+	Clientset kubernetes.Interface
+	// Namespace to watch. All namespaces if empty.
+	Namespace string
+}
+
+func (s *KubeStore) path(namespace, name string) string {
+	p := "/apis/" + Group + "/" + Version
+	if namespace != "" {
+		p += "/namespaces/" + namespace
+	}
+	p += "/" + Resource
+	if name != "" {
+		p += "/" + name
+	}
+	return p
+}
+
+// List returns runs of the watched namespace
+func (s *KubeStore) List(ctx context.Context) ([]GitOpsRun, error) {
+	b, err := s.Clientset.CoreV1().RESTClient().Get().AbsPath(s.path(s.Namespace, "")).DoRaw(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s: %w", Resource, err)
+	}
+	var list GitOpsRunList
+	if err := json.Unmarshal(b, &list); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", Resource, err)
+	}
+	return list.Items, nil
+}
+
+// UpdateStatus writes the run status
+func (s *KubeStore) UpdateStatus(ctx context.Context, run *GitOpsRun) error {
+	b, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+	res, err := s.Clientset.CoreV1().RESTClient().Put().AbsPath(s.path(run.Namespace, run.Name), "status").Body(b).DoRaw(ctx)
+	if err != nil {
+		return err
+	}
+	// keep resourceVersion for subsequent updates
+	var updated GitOpsRun
+	if err := json.Unmarshal(res, &updated); err == nil {
+		run.ResourceVersion = updated.ResourceVersion
+	}
+	return nil
+}
+
+// Env reads the credentials secret of the run
+func (s *KubeStore) Env(ctx context.Context, run *GitOpsRun) ([]string, error) {
+	if run.Spec.CredentialsSecret == "" {
+		return nil, nil
+	}
+	secret, err := s.Clientset.CoreV1().Secrets(run.Namespace).Get(ctx, run.Spec.CredentialsSecret, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credentials: %w", err)
+	}
+	var env []string
+	for k, v := range secret.Data {
+		env = append(env, k+"="+string(v))
+	}
+	return env, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package operator
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type fakeStore struct {
+	runs    []GitOpsRun
+	updates []string
+}
+
+func (s *fakeStore) List(ctx context.Context) ([]GitOpsRun, error) {
+	return append([]GitOpsRun{}, s.runs...), nil
+}
+
+func (s *fakeStore) UpdateStatus(ctx context.Context, run *GitOpsRun) error {
+	s.updates = append(s.updates, run.Name+":"+run.Status.Phase)
+	for i := range s.runs {
+		if s.runs[i].Name == run.Name {
+			s.runs[i] = *run
+		}
+	}
+	return nil
+}
+
+func (s *fakeStore) Env(ctx context.Context, run *GitOpsRun) ([]string, error) {
+	return []string{"GITHUB_TOKEN=token"}, nil
+}
+
+func TestReconcile(t *testing.T) {
+	store := &fakeStore{runs: []GitOpsRun{
+		{ObjectMeta: metav1.ObjectMeta{Name: "ok"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "bad"}, Status: RunStatus{Phase: PhasePending}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "done"}, Status: RunStatus{Phase: PhaseSucceeded}},
+	}}
+	var executed []string
+	c := &Controller{Store: store, Run: func(ctx context.Context, run *GitOpsRun, env []string) error {
+		executed = append(executed, run.Name)
+		if len(env) != 1 || env[0] != "GITHUB_TOKEN=token" {
+			t.Errorf("unexpected env %v", env)
+		}
+		if run.Name == "bad" {
+			return errors.New("render failed")
+		}
+		return nil
+	}}
+	if c.Ready() == nil {
+		t.Error("expected controller not ready before reconcile")
+	}
+	if err := c.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Ready(); err != nil {
+		t.Errorf("unexpected readiness error %v", err)
+	}
+	if recent := c.Recent(1); len(recent) != 1 || recent[0].Name != "bad" || recent[0].Phase != PhaseFailed || recent[0].Finished == nil {
+		t.Errorf("unexpected recent runs %+v", recent)
+	}
+	if recent := c.Recent(10); len(recent) != 2 {
+		t.Errorf("expected 2 recent runs, got %+v", recent)
+	}
+	if len(executed) != 2 {
+		t.Errorf("expected 2 runs, got %v", executed)
+	}
+	want := []string{"ok:Running", "ok:Succeeded", "bad:Running", "bad:Failed"}
+	if len(store.updates) != len(want) {
+		t.Fatalf("status updates %v, want %v", store.updates, want)
+	}
+	for i := range want {
+		if store.updates[i] != want[i] {
+			t.Errorf("status updates %v, want %v", store.updates, want)
+		}
+	}
+	bad := store.runs[1]
+	cond := meta.FindStatusCondition(bad.Status.Conditions, ConditionSucceeded)
+	if cond == nil || cond.Status != metav1.ConditionFalse || cond.Message != "render failed" {
+		t.Errorf("unexpected condition %+v", cond)
+	}
+}
+
+func TestKubeStorePath(t *testing.T) {
+	s := &KubeStore{}
+	if got, want := s.path("ci", "run1"), "/apis/gitops.fasterci.com/v1alpha1/namespaces/ci/gitopsruns/run1"; got != want {
+		t.Errorf("path() = %s, want %s", got, want)
+	}
+	if got, want := s.path("", ""), "/apis/gitops.fasterci.com/v1alpha1/gitopsruns"; got != want {
+		t.Errorf("path() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package operator
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// API group, version and resource of the GitOpsRun custom resource. See crd.yaml.
+const (
+	Group    = "gitops.fasterci.com"
+	Version  = "v1alpha1"
+	Resource = "gitopsruns"
+)
+
+// Run phases
+const (
+	PhasePending   = "Pending"
+	PhaseRunning   = "Running"
+	PhaseSucceeded = "Succeeded"
+	PhaseFailed    = "Failed"
+)
+
+// ConditionSucceeded is the condition type reporting the outcome of a run
+const ConditionSucceeded = "Succeeded"
+
+// GitOpsRun requests a single create_gitops_prs run
+type GitOpsRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   RunSpec   `json:"spec"`
+	Status RunStatus `json:"status,omitempty"`
+}
+
+// RunSpec describes the source repository and configuration of a run
+type RunSpec struct {
+	// Repo is the source repository URL
+	Repo string `json:"repo"`
+	// Revision is the commit or branch of Repo to render
+	Revision string `json:"revision"`
+	// ReleaseBranch selects gitops targets by release_branch_prefix
+	ReleaseBranch string `json:"releaseBranch,omitempty"`
+	// Targets to scan for gitops targets
+	Targets string `json:"targets,omitempty"`
+	// Args are additional create_gitops_prs flags, e.g. the deployment repository and git server
+	Args []string `json:"args,omitempty"`
+	// CredentialsSecret is the name of a secret in the run namespace.
+	// Every key of the secret is exposed to the run as an environment variable, e.g. GITHUB_TOKEN.
+	CredentialsSecret string `json:"credentialsSecret,omitempty"`
+}
+
+// RunStatus is the observed state of a run
+type RunStatus struct {
+	Phase          string             `json:"phase,omitempty"`
+	Message        string             `json:"message,omitempty"`
+	StartTime      *metav1.Time       `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time       `json:"completionTime,omitempty"`
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// GitOpsRunList is a list of runs
+type GitOpsRunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []GitOpsRun `json:"items"`
+}
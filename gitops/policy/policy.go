@@ -0,0 +1,88 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package policy evaluates rego policies against rendered manifests using conftest.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	oe "os/exec"
+	"path/filepath"
+)
+
+// Violation is a failed policy rule
+type Violation struct {
+	File    string
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.File, v.Message)
+}
+
+// Conftest runs conftest policies
+type Conftest struct {
+	// Binary is the conftest executable
+	Binary string
+	// Policy is the directory or bundle with rego policies
+	Policy string
+}
+
+// Check evaluates policies against files and directories relative to root and returns violations.
+// Paths that do not exist (deleted files) are skipped.
+func (c *Conftest) Check(root string, paths []string) ([]Violation, error) {
+	args := []string{"test", "--no-color", "--output", "json", "--policy", c.Policy}
+	n := 0
+	for _, p := range paths {
+		if _, err := os.Stat(filepath.Join(root, p)); err == nil {
+			args = append(args, p)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	cmd := oe.Command(c.Binary, args...)
+	cmd.Dir = root
+	out, err := cmd.Output()
+	if err != nil {
+		// conftest exits with 1 when policies fail. Other errors don't produce a report.
+		if ee, ok := err.(*oe.ExitError); !ok || ee.ExitCode() != 1 {
+			return nil, fmt.Errorf("conftest failed: %w", err)
+		}
+	}
+	return parseResults(out)
+}
+
+type checkResult struct {
+	Filename string `json:"filename"`
+	Failures []struct {
+		Msg string `json:"msg"`
+	} `json:"failures"`
+}
+
+// parseResults parses conftest json output
+func parseResults(out []byte) ([]Violation, error) {
+	var results []checkResult
+	if err := json.Unmarshal(out, &results); err != nil {
+		return nil, fmt.Errorf("unable to parse conftest output: %w", err)
+	}
+	var violations []Violation
+	for _, r := range results {
+		for _, f := range r.Failures {
+			violations = append(violations, Violation{File: r.Filename, Message: f.Msg})
+		}
+	}
+	return violations, nil
+}
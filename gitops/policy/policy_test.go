@@ -0,0 +1,44 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseResults(t *testing.T) {
+	out := `[
+		{"filename": "cloud/ok.yaml", "namespace": "main", "successes": 2},
+		{"filename": "cloud/app.yaml", "namespace": "main", "successes": 1, "failures": [
+			{"msg": "Containers must not run as root"},
+			{"msg": "Deployment app must set resource limits"}
+		]}
+	]`
+	got, err := parseResults([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Violation{
+		{File: "cloud/app.yaml", Message: "Containers must not run as root"},
+		{File: "cloud/app.yaml", Message: "Deployment app must set resource limits"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResults() = %v, want %v", got, want)
+	}
+}
+
+func TestParseResultsInvalid(t *testing.T) {
+	if _, err := parseResults([]byte("Error: no policies found")); err == nil {
+		t.Error("expected error for non json output")
+	}
+}
@@ -0,0 +1,203 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/yaml"
+)
+
+// workloadKinds are the kinds of objects listed as affected workloads
+var workloadKinds = map[string]bool{
+	"Deployment":  true,
+	"StatefulSet": true,
+	"DaemonSet":   true,
+	"Job":         true,
+	"CronJob":     true,
+	"Rollout":     true, // Argo Rollouts
+}
+
+// workload is a workload object of a manifest
+type workload struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// affected are the namespaces and workloads of the manifests changed by release trains
+type affected struct {
+	Namespaces []string
+	Workloads  []workload
+}
+
+// affectedResources returns the namespaces and workloads of the changed files of the deployment repository.
+// Deleted manifests are read from HEAD. Files that are not Kubernetes manifests are ignored.
+func affectedResources(workdir *git.Repo, files []string) (affected, error) {
+	namespaces := make(map[string]bool)
+	workloads := make(map[workload]bool)
+	scan := func(name string, content []byte) {
+		decoder := yaml.NewYAMLOrJSONDecoder(bytes.NewReader(content), 1024)
+		for {
+			var obj unstructured.Unstructured
+			if err := decoder.Decode(&obj.Object); err != nil {
+				if err != io.EOF {
+					log.Printf("WARNING: unable to parse %s: %v", name, err)
+				}
+				return
+			}
+			if obj.Object == nil {
+				continue
+			}
+			ns := obj.GetNamespace()
+			if obj.GetKind() == "Namespace" {
+				ns = obj.GetName()
+			}
+			if ns != "" {
+				namespaces[ns] = true
+			}
+			if workloadKinds[obj.GetKind()] {
+				workloads[workload{Kind: obj.GetKind(), Name: obj.GetName(), Namespace: ns}] = true
+			}
+		}
+	}
+	for _, f := range files {
+		path := filepath.Join(workdir.Dir, f)
+		fi, err := os.Stat(path)
+		switch {
+		case os.IsNotExist(err):
+			if !isManifest(f) {
+				continue
+			}
+			deleted, err := workdir.ReadTree("HEAD", f)
+			if err != nil {
+				return affected{}, err
+			}
+			for name, content := range deleted {
+				scan(name, content)
+			}
+		case err != nil:
+			return affected{}, err
+		case fi.IsDir():
+			// new directories are reported by git as a whole
+			err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+				if err != nil || d.IsDir() || !isManifest(p) {
+					return err
+				}
+				content, err := os.ReadFile(p)
+				if err == nil {
+					scan(p, content)
+				}
+				return err
+			})
+			if err != nil {
+				return affected{}, err
+			}
+		case isManifest(f):
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return affected{}, err
+			}
+			scan(f, content)
+		}
+	}
+	var a affected
+	for ns := range namespaces {
+		a.Namespaces = append(a.Namespaces, ns)
+	}
+	sort.Strings(a.Namespaces)
+	for w := range workloads {
+		a.Workloads = append(a.Workloads, w)
+	}
+	sort.Slice(a.Workloads, func(i, j int) bool {
+		wi, wj := a.Workloads[i], a.Workloads[j]
+		if wi.Namespace != wj.Namespace {
+			return wi.Namespace < wj.Namespace
+		}
+		if wi.Name != wj.Name {
+			return wi.Name < wj.Name
+		}
+		return wi.Kind < wj.Kind
+	})
+	return a, nil
+}
+
+// merge returns the namespaces and workloads of both
+func (a affected) merge(b affected) affected {
+	merged := affected{Namespaces: appendUnique(append([]string{}, a.Namespaces...), b.Namespaces...)}
+	sort.Strings(merged.Namespaces)
+	merged.Workloads = append(merged.Workloads, a.Workloads...)
+	for _, w := range b.Workloads {
+		found := false
+		for _, m := range merged.Workloads {
+			found = found || m == w
+		}
+		if !found {
+			merged.Workloads = append(merged.Workloads, w)
+		}
+	}
+	return merged
+}
+
+// section returns the Markdown PR body section listing the namespaces and workloads, empty if there are none
+func (a affected) section() string {
+	if len(a.Namespaces) == 0 && len(a.Workloads) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("### Affected resources\n")
+	if len(a.Namespaces) > 0 {
+		b.WriteString("\n**Namespaces:** `" + strings.Join(a.Namespaces, "`, `") + "`\n")
+	}
+	if len(a.Workloads) > 0 {
+		b.WriteString("\n**Workloads:**\n")
+		for _, w := range a.Workloads {
+			if w.Namespace != "" {
+				fmt.Fprintf(&b, "- `%s/%s` in `%s`\n", w.Kind, w.Name, w.Namespace)
+			} else {
+				fmt.Fprintf(&b, "- `%s/%s`\n", w.Kind, w.Name)
+			}
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// maxLabelLength is the longest label name accepted by GitHub
+const maxLabelLength = 50
+
+// labels returns the PR labels namespace:<namespace> and service:<workload name>
+func (a affected) labels() []string {
+	var labels []string
+	add := func(label string) {
+		if len(label) > maxLabelLength {
+			label = label[:maxLabelLength]
+		}
+		labels = appendUnique(labels, label)
+	}
+	for _, ns := range a.Namespaces {
+		add("namespace:" + ns)
+	}
+	for _, w := range a.Workloads {
+		add("service:" + w.Name)
+	}
+	return labels
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/alert"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+// progress is the release train and phase the run is currently in, reported with failures
+var progress struct {
+	train   string
+	phase   string
+	started time.Time
+}
+
+// notifiers receive failure events, configured by SetupAlerts
+var notifiers alert.Notifiers
+
+var alertSource, alertLink string
+
+func setPhase(train, phase string) {
+	endPhase()
+	progress.train = train
+	progress.phase = phase
+	progress.started = time.Now()
+}
+
+// SetupAlerts configures failure notifiers. Dry runs are never reported.
+func SetupAlerts(cfg *Config) {
+	if cfg.DryRun {
+		return
+	}
+	if cfg.DatadogAPIKey != "" {
+		notifiers = append(notifiers, &alert.Datadog{APIKey: cfg.DatadogAPIKey, Site: cfg.DatadogSite, Tags: cfg.DatadogTags})
+	}
+	if cfg.PagerDutyRoutingKey != "" {
+		notifiers = append(notifiers, &alert.PagerDuty{RoutingKey: cfg.PagerDutyRoutingKey})
+	}
+	alertSource = cfg.AlertSource
+	alertLink = os.Getenv("BUILDKITE_BUILD_URL")
+}
+
+// notifyFailure sends the failure event. Delivery errors are logged and otherwise ignored.
+func notifyFailure(train, phase, msg string) {
+	if len(notifiers) == 0 {
+		return
+	}
+	e := alert.Event{Train: train, Phase: phase, Error: redact.String(msg), Source: alertSource, Link: alertLink}
+	if err := notifiers.Notify(e); err != nil {
+		log.Printf("WARNING: unable to send failure alert: %v", err)
+	}
+}
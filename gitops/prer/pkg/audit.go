@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/audit"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// auditActor returns the user who triggered the run
+func auditActor() string {
+	for _, name := range []string{"BUILDKITE_BUILD_CREATOR", "GITHUB_ACTOR", "GITLAB_USER_LOGIN", "USER"} {
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// changedImages returns the images referenced by the changed files of the deployment repository
+func changedImages(workdir *git.Repo, files []string) ([]audit.Image, error) {
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, filepath.Join(workdir.Dir, f))
+	}
+	return audit.Images(paths...)
+}
+
+// appendAuditRecord appends the deployment record of the release train to its audit log and stages it.
+// files are the changed manifests of the train. It returns the audit log path relative to the repository root.
+func appendAuditRecord(workdir *git.Repo, train string, files []string, cfg *Config) (string, error) {
+	logPath := strings.NewReplacer("{gitops_path}", cfg.GitOpsPath, "{train}", train).Replace(cfg.AuditPath)
+	images, err := changedImages(workdir, files)
+	if err != nil {
+		return "", err
+	}
+	rec := audit.Record{
+		Time:     time.Now().UTC(),
+		Actor:    cfg.AuditActor,
+		Train:    train,
+		Branch:   cfg.BranchName,
+		Commit:   cfg.GitCommit,
+		BuildURL: os.Getenv("BUILDKITE_BUILD_URL"),
+		Images:   images,
+	}
+	if err := audit.Append(filepath.Join(workdir.Dir, logPath), rec); err != nil {
+		return "", err
+	}
+	return logPath, workdir.Add(logPath)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// spawnExec is the part of a bazel --execution_log_json_file entry with file digests
+type spawnExec struct {
+	Inputs        []loggedFile `json:"inputs"`
+	ActualOutputs []loggedFile `json:"actualOutputs"`
+}
+
+type loggedFile struct {
+	Path   string `json:"path"`
+	Digest struct {
+		Hash string `json:"hash"`
+	} `json:"digest"`
+}
+
+// readExecutionLog returns the digests of all files of a bazel JSON execution log by their exec root relative path
+func readExecutionLog(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	digests := make(map[string]string)
+	// the log is a stream of JSON objects, one per spawn
+	dec := json.NewDecoder(f)
+	for {
+		var spawn spawnExec
+		if err := dec.Decode(&spawn); errors.Is(err, io.EOF) {
+			return digests, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, files := range [][]loggedFile{spawn.Inputs, spawn.ActualOutputs} {
+			for _, lf := range files {
+				if lf.Digest.Hash != "" {
+					digests[lf.Path] = lf.Digest.Hash
+				}
+			}
+		}
+	}
+}
+
+// bazelDigest returns the digest bazel recorded for the resolved file path: bazel-out/... for
+// generated files and the workspace relative path for source files
+func (c *renderCache) bazelDigest(path string) (string, bool) {
+	if len(c.bazelDigests) == 0 {
+		return "", false
+	}
+	execPath := ""
+	if i := strings.Index(path, "/bazel-out/"); i >= 0 {
+		execPath = path[i+1:]
+	} else if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, path); err == nil && !strings.HasPrefix(rel, "..") {
+			execPath = filepath.ToSlash(rel)
+		}
+	}
+	d, ok := c.bazelDigests[execPath]
+	return d, ok
+}
@@ -0,0 +1,150 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// branchNamespace returns the prefix of deployment, promotion or rollback branches of the kind,
+// e.g. deploy/ or deploy/<prefix>/ with --deploy_branch_prefix
+func branchNamespace(kind string, cfg *Config) string {
+	if prefix := strings.Trim(cfg.DeployBranchPrefix, "/"); prefix != "" {
+		return kind + "/" + prefix + "/"
+	}
+	return kind + "/"
+}
+
+// branchVariable matches {name} placeholders of deployment_branch attributes
+var branchVariable = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// branchVariables are the gitops rule attributes available in deployment_branch placeholders
+var branchVariables = []string{"cluster", "namespace", "app_name"}
+
+// expandBranch replaces {cluster}, {namespace} and {app_name} placeholders of the deployment_branch
+// attribute value with the attributes of the gitops target, e.g. {cluster}/{namespace}/myteam.
+// Placeholders of --branch_parameter names are left for expandParameters.
+// Unknown placeholders and placeholders of empty attributes are errors.
+func expandBranch(value string, attrs map[string]string, params map[string][]string) (string, error) {
+	var err error
+	expanded := branchVariable.ReplaceAllStringFunc(value, func(m string) string {
+		name := m[1 : len(m)-1]
+		if _, ok := params[name]; ok {
+			return m
+		}
+		v, ok := attrs[name]
+		switch {
+		case !ok:
+			err = fmt.Errorf("unknown variable %s in deployment_branch %q, expected one of %v or a --branch_parameter", m, value, branchVariables)
+		case v == "":
+			err = fmt.Errorf("variable %s of deployment_branch %q is empty", m, value)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// parseBranchParameters parses --branch_parameter values in the name=value1,value2 format
+func parseBranchParameters(values []string) (map[string][]string, error) {
+	params := make(map[string][]string)
+	for _, v := range values {
+		name, list, found := strings.Cut(v, "=")
+		if !found || !branchVariable.MatchString("{"+name+"}") || list == "" {
+			return nil, fmt.Errorf("invalid branch_parameter %q, expected name=value1,value2 with a lower case name", v)
+		}
+		params[name] = append(params[name], strings.Split(list, ",")...)
+	}
+	return params, nil
+}
+
+// trainVariant is a release train expanded from a parameterized one
+type trainVariant struct {
+	name string
+	// vars are the NAME=value template variables of the expansion
+	vars []string
+}
+
+// expandParameters replaces every release train with {name} placeholders of --branch_parameter
+// names with a train per combination of the parameter values, e.g. myapp-{region} with
+// myapp-us and myapp-eu. The expanded trains render their targets with the NAME=value
+// template variables and inherit the PR title and body of the parameterized train.
+func expandParameters(trains map[string][]string, cfg *Config) (map[string][]string, error) {
+	expanded := make(map[string][]string)
+	for train, targets := range trains {
+		variants := []trainVariant{{name: train}}
+		for _, m := range branchVariable.FindAllStringSubmatch(train, -1) {
+			values, ok := cfg.BranchParameters[m[1]]
+			if !ok {
+				return nil, errorf("unknown variable %s in deployment_branch %q", m[0], train)
+			}
+			var next []trainVariant
+			for _, v := range variants {
+				if !strings.Contains(v.name, m[0]) {
+					// repeated placeholder, already replaced
+					next = append(next, v)
+					continue
+				}
+				for _, value := range values {
+					vars := append(append([]string{}, v.vars...), strings.ToUpper(m[1])+"="+value)
+					next = append(next, trainVariant{name: strings.ReplaceAll(v.name, m[0], value), vars: vars})
+				}
+			}
+			variants = next
+		}
+		for _, v := range variants {
+			expanded[v.name] = append(expanded[v.name], targets...)
+			if len(v.vars) == 0 {
+				continue
+			}
+			if cfg.TrainParameters == nil {
+				cfg.TrainParameters = make(map[string][]string)
+			}
+			sort.Strings(v.vars)
+			cfg.TrainParameters[v.name] = v.vars
+			if title, ok := cfg.TrainPRTitles[train]; ok {
+				setTrainValue(&cfg.TrainPRTitles, v.name, title)
+			}
+			if body, ok := cfg.TrainPRBodies[train]; ok {
+				setTrainValue(&cfg.TrainPRBodies, v.name, body)
+			}
+		}
+	}
+	return expanded, nil
+}
+
+// parameterArgs returns the template variable arguments of the fanned out release train
+func parameterArgs(train string, cfg *Config) []string {
+	vars, _ := trainValue(cfg.TrainParameters, train)
+	var args []string
+	for _, v := range vars {
+		args = append(args, "--variable", v)
+	}
+	return args
+}
+
+// pushOwner returns the owner of --git_push_repo, empty if branches are pushed to --git_repo
+func pushOwner(cfg *Config) string {
+	if cfg.GitPushRepo == "" || cfg.GitPushOwner != "" {
+		return cfg.GitPushOwner
+	}
+	return git.RepoOwner(cfg.GitPushRepo)
+}
+
+// prHead returns the head of the PR of the pushed branch, owner:branch for branches of --git_push_repo
+func prHead(branch string, cfg *Config) string {
+	return git.Head(pushOwner(cfg), branch)
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// version and commit of the prer are set at link time, e.g. by the x_defs of the create_gitops_prs binary
+var (
+	version = ""
+	commit  = ""
+)
+
+// buildVersion returns the version and commit of the prer. Values not set at link time
+// are taken from the build information recorded by the go tool.
+func buildVersion() (string, string) {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && c == "" {
+				c = s.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "dev"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	return v, c
+}
+
+// buildInfo describes the prer build, e.g. "rules_gitops prer v0.50.0 (commit 1a2b3c4)"
+func buildInfo() string {
+	v, c := buildVersion()
+	return fmt.Sprintf("rules_gitops prer %s (commit %s)", v, c)
+}
+
+// withBuildFooter appends the prer build info to a commit message or PR body
+func withBuildFooter(msg string) string {
+	return msg + "\n\nGenerated by " + buildInfo()
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// bundleFile returns the path of the bundle (.bundle) or the PR metadata (.json) of the branch in the bundle directory
+func bundleFile(dir, branch, ext string) (string, error) {
+	return filepath.Abs(filepath.Join(dir, url.PathEscape(branch)+ext))
+}
+
+// writeBundles writes a git bundle of every updated deployment branch to --bundle_dir instead of pushing it.
+// A bundle contains the commits of the branch missing on --gitops_pr_into, which the repository it is applied to has.
+func writeBundles(workdir *git.Repo, branches []string, cfg *Config) error {
+	if err := os.MkdirAll(cfg.BundleDir, 0755); err != nil {
+		return errorf("failed to create bundle directory: %w", err)
+	}
+	for _, branch := range branches {
+		path, err := bundleFile(cfg.BundleDir, branch, ".bundle")
+		if err != nil {
+			return errorf("%w", err)
+		}
+		if _, err := exec.Ex(workdir.Dir, "git", "bundle", "create", path, "refs/heads/"+branch, "^origin/"+cfg.PRTargetBranch); err != nil {
+			return errorf("failed to bundle branch %s: %w", branch, err)
+		}
+		log.Printf("Bundled branch %s in %s", branch, path)
+	}
+	return nil
+}
+
+// readBundlePRs reads the PRs of the PR metadata files in --bundle_dir
+func readBundlePRs(cfg *Config) ([]ManifestPR, error) {
+	files, err := filepath.Glob(filepath.Join(cfg.BundleDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var prs []ManifestPR
+	for _, f := range files {
+		m, err := readPRManifest(f, cfg.GitRepo)
+		if err != nil {
+			return nil, err
+		}
+		if m.GitRepo != cfg.GitRepo {
+			return nil, fmt.Errorf("PR metadata %s is for %s, not git_repo %s", f, m.GitRepo, cfg.GitRepo)
+		}
+		prs = append(prs, m.PRs...)
+	}
+	return prs, nil
+}
+
+// pushBundles pushes the deployment branches of the bundles in --bundle_dir to --git_repo.
+// The bundles are fetched into a scratch repository after the PR target branches they are based on.
+func pushBundles(prs []ManifestPR, cfg *Config) error {
+	dir, err := os.MkdirTemp(cfg.GitOpsTmpDir, "bundles")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if _, err := exec.Ex(dir, "git", "init", "-q", "--bare"); err != nil {
+		return err
+	}
+	fetch := []string{"fetch", "-q", cfg.GitRepo}
+	var into []string
+	for _, pr := range prs {
+		into = appendUnique(into, pr.Into)
+	}
+	for _, branch := range into {
+		fetch = append(fetch, "+refs/heads/"+branch+":refs/remotes/origin/"+branch)
+	}
+	if _, err := exec.Ex(dir, "git", fetch...); err != nil {
+		return fmt.Errorf("failed to fetch the PR target branches: %w", err)
+	}
+	push := []string{"push", "-f", cfg.GitRepo}
+	for _, pr := range prs {
+		bundle, err := bundleFile(cfg.BundleDir, pr.Branch, ".bundle")
+		if err != nil {
+			return err
+		}
+		ref := "refs/heads/" + pr.Branch
+		if _, err := exec.Ex(dir, "git", "fetch", "-q", bundle, "+"+ref+":"+ref); err != nil {
+			return fmt.Errorf("failed to apply bundle %s: %w", bundle, err)
+		}
+		push = append(push, ref+":"+ref)
+	}
+	if _, err := exec.Ex(dir, "git", push...); err != nil {
+		return fmt.Errorf("failed to push deployment branches: %w", err)
+	}
+	return nil
+}
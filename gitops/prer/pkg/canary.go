@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/canary"
+)
+
+// expandCanaries adds a {train}-canary release train for every release train
+func expandCanaries(trains map[string][]string, cfg *Config) map[string][]string {
+	if cfg.Canary == nil {
+		return trains
+	}
+	expanded := make(map[string][]string)
+	cfg.CanaryTrains = make(map[string]string)
+	for train, targets := range trains {
+		expanded[train] = targets
+		expanded[train+"-canary"] = targets
+		cfg.CanaryTrains[train+"-canary"] = train
+	}
+	return expanded
+}
+
+// renderCanary renders the base release train into a scratch root and writes
+// the canary variant of every rendered manifest to --canary_path under deploymentRoot
+func renderCanary(train, base string, targets []string, deploymentRoot string, cfg *Config) (targetFiles, error) {
+	scratch, err := os.MkdirTemp(cfg.GitOpsTmpDir, "canary")
+	if err != nil {
+		return nil, errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	rendered, err := renderTrain(base, targets, scratch, cfg)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[string]string)
+	for target, files := range rendered {
+		for _, f := range files {
+			owners[f] = target
+		}
+	}
+	written := make(targetFiles)
+	for _, target := range targets {
+		written[target] = nil
+	}
+	src := filepath.Join(scratch, cfg.GitOpsPath)
+	destRel := strings.NewReplacer("{gitops_path}", cfg.GitOpsPath, "{train}", base).Replace(cfg.CanaryPath)
+	dest := filepath.Join(deploymentRoot, destRel)
+	log.Printf("Writing canary variant of release train %s to %s", base, dest)
+	err = filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !isManifest(path) {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var out bytes.Buffer
+		n, err := canary.Transform(f, &out, cfg.Canary)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if n == 0 {
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if owner, ok := owners[filepath.Join(cfg.GitOpsPath, rel)]; ok {
+			written.add(owner, filepath.Join(destRel, rel))
+		}
+		return os.WriteFile(target, out.Bytes(), 0644)
+	})
+	if err != nil {
+		return nil, errorf("failed to write canary variant of %s: %w", base, err)
+	}
+	return written, nil
+}
+
+func isManifest(path string) bool {
+	ext := filepath.Ext(path)
+	return ext == ".yaml" || ext == ".yml" || ext == ".json"
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/changelog"
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// maxChangelogEntries limits the changelog size in PR bodies
+const maxChangelogEntries = 50
+
+// buildkiteRepoURL returns the web URL of the Buildkite source repository
+func buildkiteRepoURL() string {
+	repo := os.Getenv("BUILDKITE_REPO")
+	repo = strings.Replace(repo, ":", "/", 1)
+	repo = strings.Replace(repo, "git@", "https://", 1)
+	repo = strings.Replace(repo, ".git", "", 1)
+	return repo
+}
+
+// trainChangelog describes the source repository commits since the release train was last deployed to --gitops_pr_into
+func trainChangelog(workdir *git.Repo, targets []string, cfg *Config) string {
+	if len(targets) == 0 || cfg.GitCommit == "unknown" {
+		return ""
+	}
+	prev := commitmsg.ExtractSourceCommit(workdir.FindCommitMessage(cfg.PRTargetBranch, targets[0]))
+	if prev == "" {
+		log.Printf("No previous deployment of %s found, skipping changelog", targets[0])
+		return ""
+	}
+	entries, err := changelog.Generate("", prev, cfg.GitCommit)
+	if err != nil {
+		log.Printf("WARNING: unable to generate changelog: %v", err)
+		return ""
+	}
+	if len(entries) == 0 {
+		return ""
+	}
+	repoURL := cfg.SourceRepoURL
+	if repoURL == "" && os.Getenv("BUILDKITE_REPO") != "" {
+		repoURL = buildkiteRepoURL()
+	}
+	short := prev
+	if len(short) > 7 {
+		short = short[:7]
+	}
+	return fmt.Sprintf("### Changes since %s\n\n%s", short, changelog.Markdown(entries, repoURL, maxChangelogEntries))
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// parseTrainClusters parses --train_clusters values in the train=cluster1,cluster2 format
+func parseTrainClusters(values []string) (map[string][]string, error) {
+	clusters := make(map[string][]string)
+	for _, v := range values {
+		train, list, found := strings.Cut(v, "=")
+		if !found || train == "" || list == "" {
+			return nil, fmt.Errorf("invalid train_clusters %q, expected train=cluster1,cluster2", v)
+		}
+		clusters[train] = append(clusters[train], strings.Split(list, ",")...)
+	}
+	return clusters, nil
+}
+
+// parseClusterVariables parses --cluster_variable values in the cluster:NAME=VALUE format
+func parseClusterVariables(values []string) (map[string][]string, error) {
+	vars := make(map[string][]string)
+	for _, v := range values {
+		cluster, variable, found := strings.Cut(v, ":")
+		if !found || cluster == "" || !strings.Contains(variable, "=") {
+			return nil, fmt.Errorf("invalid cluster_variable %q, expected cluster:NAME=VALUE", v)
+		}
+		vars[cluster] = append(vars[cluster], variable)
+	}
+	return vars, nil
+}
+
+// renderTrain renders the release train into deploymentRoot, once per environment or cluster if configured.
+// Trains expanded from --branch_parameter are rendered with their template variables.
+// It returns the files written by every target.
+func renderTrain(train string, targets []string, deploymentRoot string, cfg *Config) (targetFiles, error) {
+	if base, ok := cfg.CanaryTrains[train]; ok {
+		return renderCanary(train, base, targets, deploymentRoot, cfg)
+	}
+	env, hasEnv := cfg.TrainEnvironments[train]
+	clusters := cfg.TrainClusters[train]
+	args := append(parameterArgs(train, cfg), binaryArgs(train, cfg)...)
+	if !hasEnv && len(clusters) == 0 {
+		if cfg.DeploymentLayout != "" {
+			return renderVariant(train, targets, deploymentRoot, cfg.GitOpsPath, args, cfg)
+		}
+		return renderTargets(targets, deploymentRoot, cfg, args...)
+	}
+	if hasEnv {
+		args = append(args, "--variable", "ENVIRONMENT="+env.Name)
+		for _, v := range env.Variables {
+			args = append(args, "--variable", v)
+		}
+	}
+	if len(clusters) == 0 {
+		dest := strings.NewReplacer("{gitops_path}", cfg.GitOpsPath, "{env}", env.Name).Replace(cfg.EnvironmentPath)
+		log.Printf("Rendering release train %s for environment %s", train, env.Name)
+		return renderVariant(train, targets, deploymentRoot, dest, args, cfg)
+	}
+	written := make(targetFiles)
+	for _, cluster := range clusters {
+		clusterArgs := append(append([]string{}, args...), "--variable", "CLUSTER="+cluster)
+		for _, v := range cfg.ClusterVariables[cluster] {
+			clusterArgs = append(clusterArgs, "--variable", v)
+		}
+		dest := strings.NewReplacer("{gitops_path}", cfg.GitOpsPath, "{cluster}", cluster, "{train}", train).Replace(cfg.ClusterPath)
+		log.Printf("Rendering release train %s for cluster %s", train, cluster)
+		rendered, err := renderVariant(train, targets, deploymentRoot, dest, clusterArgs, cfg)
+		if err != nil {
+			return nil, err
+		}
+		written.merge(rendered)
+	}
+	return written, nil
+}
+
+// renderVariant renders targets with args into a scratch root and moves the rendered
+// --gitops_path tree to dest under deploymentRoot, or to the --deployment_layout directory of
+// every target within dest. It returns the files written by every target under dest.
+func renderVariant(train string, targets []string, deploymentRoot, dest string, args []string, cfg *Config) (targetFiles, error) {
+	scratch, err := os.MkdirTemp(cfg.GitOpsTmpDir, "variant")
+	if err != nil {
+		return nil, errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(scratch)
+
+	if cfg.DeploymentLayout != "" {
+		return renderLayout(train, targets, scratch, deploymentRoot, dest, args, cfg)
+	}
+	rendered, err := renderTargets(targets, scratch, cfg, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := moveTree(filepath.Join(scratch, cfg.GitOpsPath), filepath.Join(deploymentRoot, dest)); err != nil {
+		return nil, errorf("failed to write manifests to %s: %w", dest, err)
+	}
+	written := make(targetFiles)
+	for target, files := range rendered {
+		written[target] = nil
+		for _, f := range files {
+			if rel, err := filepath.Rel(cfg.GitOpsPath, f); err == nil && !strings.HasPrefix(rel, "..") {
+				written.add(target, filepath.Join(dest, rel))
+			}
+		}
+	}
+	return written, nil
+}
+
+// moveTree moves all files of src into dst replacing existing files.
+// Files are renamed if possible and streamed otherwise, so large manifests are never held in memory.
+func moveTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if err := os.Rename(path, target); err == nil {
+			return nil
+		}
+		return copyFile(path, target)
+	})
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+)
+
+const (
+	commitStyleDefault      = "default"
+	commitStyleConventional = "conventional"
+)
+
+// commitMessage formats the commit message in the configured --commit_style.
+// Conventional commits get the "<type>(<scope>): <description>" subject with msg as the body.
+// Messages end with the prer build info footer.
+func commitMessage(scope, description, msg string, cfg *Config) string {
+	if cfg.CommitStyle == commitStyleConventional {
+		msg = commitmsg.Conventional(cfg.CommitType, scope, description, msg)
+	}
+	return withBuildFooter(msg)
+}
+
+// servicesDescription describes a deployment of n targets
+func servicesDescription(n int) string {
+	if n == 1 {
+		return "update 1 service"
+	}
+	return fmt.Sprintf("update %d services", n)
+}
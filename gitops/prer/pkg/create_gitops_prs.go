@@ -0,0 +1,1871 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/analysis"
+	"github.com/fasterci/rules_gitops/gitops/audit"
+	"github.com/fasterci/rules_gitops/gitops/bazel"
+	"github.com/fasterci/rules_gitops/gitops/canary"
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/git/azuredevops"
+	"github.com/fasterci/rules_gitops/gitops/git/bitbucket"
+	"github.com/fasterci/rules_gitops/gitops/git/codecommit"
+	"github.com/fasterci/rules_gitops/gitops/git/external"
+	"github.com/fasterci/rules_gitops/gitops/git/gitea"
+	"github.com/fasterci/rules_gitops/gitops/git/github"
+	"github.com/fasterci/rules_gitops/gitops/git/github_app"
+	"github.com/fasterci/rules_gitops/gitops/git/gitlab"
+	"github.com/fasterci/rules_gitops/gitops/git/local"
+	"github.com/fasterci/rules_gitops/gitops/hooks"
+	"github.com/fasterci/rules_gitops/gitops/jira"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+	"github.com/fasterci/rules_gitops/gitops/publish"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+	"github.com/fasterci/rules_gitops/gitops/secrets"
+	proto "github.com/golang/protobuf/proto"
+)
+
+// Config holds all command line configuration
+type Config struct {
+	// Git related configs
+	GitRepo        string
+	GitMirror      string
+	GitPushRepo    string // fork of GitRepo deployment branches are pushed to
+	GitPushOwner   string
+	Offline        bool   // clone from and push to GitMirror, record PRs in PRManifest
+	PRManifest     string // PRs to create of offline runs, published by publish-prs
+	BundleDir      string // git bundles and PR metadata of offline runs, instead of pushing to GitMirror
+	CABundle       string
+	ClientCert     string
+	ClientKey      string
+	GitHost        string
+	BranchName     string
+	GitCommit      string
+	ReleaseBranch  string
+	PRTargetBranch string
+
+	// Bazel related configs
+	BazelCmd  string
+	Workspace string
+	Targets   string
+
+	// GitOps related configs
+	GitOpsPath        string
+	GitOpsTmpDir      string
+	RunID             string // names the workspace of the run in GitOpsTmpDir
+	PushParallelism   int
+	RenderParallelism int
+	StdoutTargets     map[string]string   // deployment root paths of targets printing manifests to stdout
+	BinaryArgs        []string            // extra arguments of all gitops binaries
+	TrainBinaryArgs   map[string][]string // extra arguments of the gitops binaries of a release train
+	DryRun            bool
+	Interactive       bool
+	MaxDiffFiles      int
+	MaxDiffLines      int
+	Force             bool
+	DetailedExitCodes bool
+	RequireClean      bool
+
+	// Secret scanning configs
+	ScanSecrets        bool
+	ScanSecretsEntropy bool
+	SecretsAllowlist   string
+
+	// Policy gate configs
+	PolicyPath string
+	Conftest   string
+
+	// Schema validation configs
+	ValidateSchemas   bool
+	Kubeconform       string
+	CRDSchemas        string
+	KubernetesVersion string
+
+	// Placeholder check configs
+	CheckPlaceholders   bool
+	AllowedPlaceholders []string
+
+	// PR related configs
+	PRTitle                string
+	PRBody                 string
+	TrainPRTitles          map[string]string // per release train PR titles, overriding PRTitle
+	TrainPRBodies          map[string]string // per release train PR bodies, overriding PRBody
+	BranchParameters       map[string][]string
+	TrainParameters        map[string][]string // template variables of trains expanded from BranchParameters
+	DeploymentBranchSuffix string
+	DeployBranchPrefix     string // namespace of branches of the pipeline, e.g. the application name
+	Changelog              bool
+	AffectedSection        bool // list the namespaces and workloads changed by the train in the PR body
+	AffectedLabels         bool // label PRs with the namespaces and workloads changed by the train
+	ImageTable             bool // add a table of the previous and new image references to the PR body
+	DiffSummary            bool // summarize the files and images changed by the PR in its body
+	PrunePRs               bool // close the PRs of retired release trains after creating PRs
+	SourceRepoURL          string
+	GitHubDeployments      bool   // create a GitHub deployment of every release train with a PR
+	DeploymentEnvironment  string // environment of the deployments, {train} is replaced
+	PRReviewers            []trainPattern
+	PRTeamReviewers        []trainPattern
+	PRDefaultReviewers     []string // users requested to review the PRs of all trains
+	PRDefaultTeamReviewers []string // teams requested to review the PRs of all trains
+	PRLabels               []string // labels of the PRs of all trains
+	PRAssignees            []string // users assigned to the PRs of all trains
+	AutoMergeTrains        []string
+	PRAutoMerge            bool           // merge the PRs of all trains automatically once their checks pass
+	MergeQueueTrains       []string       // patterns of trains whose PRs are added to the merge queue instead of enabling auto-merge
+	TrainDependencies      []trainPattern // release trains whose PRs must merge before PRs of matching trains
+
+	// Multi-cluster configs
+	TrainClusters    map[string][]string
+	ClusterVariables map[string][]string
+	ClusterPath      string
+
+	// DeploymentLayout is the directory of the manifests of every target within --gitops_path
+	DeploymentLayout string
+
+	// Environment configs
+	Environments    []environment
+	EnvironmentPath string
+	// TrainEnvironments maps release trains created by expandEnvironments to their environment
+	TrainEnvironments map[string]environment
+
+	// Canary configs
+	Canary     *canary.Config
+	CanaryPath string
+	// CanaryTrains maps canary release trains created by expandCanaries to their base train
+	CanaryTrains map[string]string
+
+	// Jira related configs
+	JiraURL        string
+	JiraUser       string
+	JiraToken      string
+	JiraProjects   []string
+	JiraTransition string
+
+	// Vault related configs
+	VaultAddr       string
+	VaultNamespace  string
+	VaultToken      string
+	VaultAuthMethod string
+	VaultAuthMount  string
+	VaultRole       string
+	VaultSecretID   string
+	VaultJWT        string
+	VaultSecrets    map[string]string // vault secret references path#field by flag name
+
+	// ServiceNow related configs
+	ServiceNowURL             string
+	ServiceNowUser            string
+	ServiceNowPassword        string
+	ServiceNowTrains          []string
+	ServiceNowTemplate        string
+	ServiceNowAssignmentGroup string
+
+	// Failure alerting configs
+	AlertSource         string
+	DatadogAPIKey       string
+	DatadogSite         string
+	DatadogTags         []string
+	PagerDutyRoutingKey string
+
+	// Metrics configs
+	StatsDHost string
+	StatsDPort int
+	StatsDTags []string
+
+	// Flux related configs
+	FluxPath      string
+	FluxTrainPath string
+	FluxNamespace string
+	FluxSource    string
+	FluxInterval  string
+
+	// Object storage publishing configs
+	PublishURL string
+
+	// Commit message configs
+	CommitStyle string
+	CommitType  string
+
+	// Audit log configs
+	AuditPath string
+	// OwnershipIndex is the file of deployment branches mapping gitops targets of a release train to the files they own.
+	// It contains the {train} placeholder.
+	OwnershipIndex string
+	AuditActor     string
+
+	// Deployment freeze configs
+	FreezeWindows  []string
+	FreezeTimezone string
+	IgnoreFreeze   bool
+
+	// Hooks are executed at stages of the run, user commands of the hook flags by default
+	Hooks hooks.Runner
+	// GitServer creates PRs instead of the --git_server provider if set
+	GitServer git.Server
+	// MetricsFile is written with the metrics of the run
+	MetricsFile string
+	// JUnitReport is written with a JUnit XML test case per release train of the run
+	JUnitReport string
+	// renders caches manifests of targets shared by release trains during a run
+	renders *renderCache
+
+	// Serve command configs
+	ServeConfig      string
+	Listen           string
+	WebhookSecret    string
+	InsecureWebhooks bool
+	APIToken         string
+	Debounce         time.Duration
+	ServeMetrics     bool
+	StatusRuns       int
+
+	// Operator command configs
+	Kubeconfig        string
+	OperatorNamespace string
+	OperatorInterval  time.Duration
+
+	// Drift command configs
+	DriftReport string
+
+	// Render configs
+	RenderState  string
+	ExecutionLog string
+	RenderDir    string
+
+	// List-trains command configs
+	ListFormat string
+
+	// Promote command configs
+	PromoteFrom       string
+	PromoteTo         string
+	PromoteFromBranch string
+
+	// Rollback command configs
+	RollbackTrain string
+	RollbackTo    string
+	RollbackPath  string
+
+	// create_gitops_prs rule
+	ResolvedBinaries     SliceFlags
+	ResolvedPushes       SliceFlags
+	ResolvedBinariesFile string // newline-delimited --resolved_binary values
+	ResolvedPushesFile   string // newline-delimited --resolved_push values
+
+	// Dependencies
+	DependencyKinds []string
+	DependencyNames []string
+	DependencyAttrs []string
+}
+
+// RegisterFlags defines the command line flags of the Config on fs.
+// The returned function builds the Config once fs is parsed.
+func RegisterFlags(fs *flag.FlagSet) func() (*Config, error) {
+	cfg := &Config{}
+
+	// Git flags
+	fs.StringVar(&cfg.GitRepo, "git_repo", "", "Git repository location")
+	fs.StringVar(&cfg.GitMirror, "git_mirror", "", "Git mirror location (e.g., /mnt/mirror/repo.git)")
+	fs.StringVar(&cfg.GitPushRepo, "git_push_repo", "", "Fork of --git_repo to push deployment branches to. PRs are opened from the fork into --git_repo")
+	fs.StringVar(&cfg.GitPushOwner, "git_push_owner", "", "Owner of --git_push_repo in PR heads (owner:branch). Derived from the --git_push_repo URL if empty")
+	fs.BoolVar(&cfg.Offline, "offline", false, "Mirror-only mode for air-gapped builds: clone from and push deployment branches to --git_mirror and record the PRs to create in --pr_manifest instead of calling the --git_server API")
+	fs.StringVar(&cfg.PRManifest, "pr_manifest", "", "JSON file of the PRs to create written by --offline runs and read by the publish-prs command")
+	fs.StringVar(&cfg.BundleDir, "bundle_dir", "", "Directory of build artifacts for air-gapped builds: --offline runs write a git bundle and a PR metadata JSON file per updated deployment branch instead of pushing to --git_mirror, and the publish-prs command pushes them to --git_repo and creates their PRs")
+	fs.StringVar(&cfg.CABundle, "ca_bundle", "", "PEM file of CA certificates trusted by git and the git server, Vault and integration API clients in addition to the system roots")
+	fs.StringVar(&cfg.ClientCert, "client_cert", "", "PEM file of the TLS client certificate of git and the API clients, for servers requiring mutual TLS")
+	fs.StringVar(&cfg.ClientKey, "client_key", "", "PEM file of the private key of --client_cert")
+	fs.StringVar(&cfg.GitHost, "git_server", "bitbucket", "Git server API to use: 'bitbucket', 'azuredevops', 'codecommit', 'gitea', 'github', 'gitlab', 'github_app', 'gerrit' to push changes for review, 'exec' or 'webhook' to pass PRs to exec_pr_command or webhook_pr_url, or 'local' to record PRs as files in local_pr_dir")
+	fs.StringVar(&cfg.BranchName, "branch_name", "unknown", "Branch name for commit message")
+	gitCommit := os.Getenv("BUILDKITE_COMMIT")
+	if gitCommit == "" {
+		gitCommit = "unknown"
+	}
+	fs.StringVar(&cfg.GitCommit, "git_commit", gitCommit, "Git commit for commit message and PR title. Defaults to BUILDKITE_COMMIT. Required by runs pushing deployment branches")
+	fs.StringVar(&cfg.ReleaseBranch, "release_branch", "master", "Filter GitOps targets by release branch")
+	fs.StringVar(&cfg.PRTargetBranch, "gitops_pr_into", "", "Target branch for deployment PR. Defaults to the default branch of the deployment repository reported by --git_server")
+
+	// Bazel flags
+	fs.StringVar(&cfg.BazelCmd, "bazel_cmd", "tools/bazel", "Bazel binary path")
+	fs.StringVar(&cfg.Workspace, "workspace", "", "Workspace root path")
+	fs.StringVar(&cfg.Targets, "targets", "//... except //experimental/...", "Targets to scan (separate multiple with +)")
+
+	// GitOps flags
+	fs.StringVar(&cfg.GitOpsPath, "gitops_path", "cloud", "File storage location in repo")
+	fs.StringVar(&cfg.GitOpsTmpDir, "gitops_tmpdir", os.TempDir(), "Git tree checkout location")
+	fs.StringVar(&cfg.RunID, "run_id", defaultRunID(), "Identifier of the run naming its temporary directory gitops-<run_id> in --gitops_tmpdir. Defaults to the pipeline, build and job id of Buildkite, GitHub Actions, GitLab CI or Jenkins")
+	fs.IntVar(&cfg.PushParallelism, "push_parallelism", 1, "Concurrent image push count")
+	fs.StringVar(&cfg.MetricsFile, "metrics_file", "", "JSON file to write phase durations, changed file and push counts and API retries of the run to")
+	fs.StringVar(&cfg.JUnitReport, "junit_report", "", "JUnit XML file to write the result of every release train to, for CI test report views")
+	fs.IntVar(&cfg.RenderParallelism, "render_parallelism", 1, "Concurrent gitops binary count of a release train. Every binary writes into its own deployment root, merged in target order")
+	var stdoutTargets SliceFlags
+	fs.Var(&stdoutTargets, "stdout_target", "Gitops target printing its manifests to stdout in the target=path format. Stdout is written to path under the deployment root, {gitops_path} is replaced. Can be specified multiple times")
+	var binaryArgs, trainBinaryArgs SliceFlags
+	fs.Var(&binaryArgs, "gitops_binary_arg", "Extra argument of every gitops binary, e.g. --gitops_binary_arg=--cluster=us-east1. Can be specified multiple times")
+	fs.Var(&trainBinaryArgs, "train_binary_arg", "Extra argument of the gitops binaries of a release train in the train=arg format, passed after --gitops_binary_arg. Can be specified multiple times")
+	fs.BoolVar(&cfg.DryRun, "dry_run", false, "Print actions without creating PRs")
+	fs.BoolVar(&cfg.RequireClean, "require_clean_workspace", false, "Abort if the workspace has uncommitted changes or its HEAD is not --git_commit")
+	fs.BoolVar(&cfg.DetailedExitCodes, "detailed_exit_codes", false, "Exit with code 2 if there were no changes to commit and with code 10 if a deployment freeze stopped the run")
+	fs.BoolVar(&cfg.Interactive, "interactive", false, "Print the changes of every release train and ask for confirmation before committing it for push and PR creation")
+	fs.IntVar(&cfg.MaxDiffFiles, "max_diff_files", 0, "Refuse to commit a release train changing more files than this. 0 disables the check")
+	fs.IntVar(&cfg.MaxDiffLines, "max_diff_lines", 0, "Refuse to commit a release train changing more lines than this. 0 disables the check")
+	fs.BoolVar(&cfg.Force, "force", false, "Commit even if the diff size limits are exceeded")
+
+	// Secret scanning flags
+	fs.BoolVar(&cfg.ScanSecrets, "scan_secrets", false, "Scan changed files for credentials and stop before commit if any are found")
+	fs.BoolVar(&cfg.ScanSecretsEntropy, "scan_secrets_entropy", false, "Also report high entropy strings when scanning for credentials")
+	fs.StringVar(&cfg.SecretsAllowlist, "secrets_allowlist", "", "File with regular expressions (one per line) matching file paths or values to ignore when scanning for credentials")
+
+	// PR flags
+	fs.StringVar(&cfg.PRTitle, "gitops_pr_title", "", "PR title")
+	fs.StringVar(&cfg.PRBody, "gitops_pr_body", "", "PR body message")
+	var trainPRTitles, trainPRBodies, branchParameters SliceFlags
+	fs.Var(&branchParameters, "branch_parameter", "Parameter of deployment_branch values in the name=value1,value2 format, e.g. region=us,eu. A deployment_branch myapp-{region} creates a myapp-us and a myapp-eu release train rendered with the REGION template variable. Can be specified multiple times")
+	fs.Var(&trainPRTitles, "train_pr_title", "PR title of a release train in the train=title format, overriding --gitops_pr_title. {train} and {branch} are replaced. Can be specified multiple times")
+	fs.Var(&trainPRBodies, "train_pr_body", "PR body of a release train in the train=body format, overriding --gitops_pr_body. {train} and {branch} are replaced. Can be specified multiple times")
+	var prReviewers, prTeamReviewers, autoMergeTrains, mergeQueueTrains, trainDependencies SliceFlags
+	var defaultReviewers, defaultTeamReviewers, prLabels, prAssignees SliceFlags
+	fs.Var(&defaultReviewers, "gitops_pr_reviewers", "Comma-separated users requested to review the PRs of all release trains, in addition to --pr_reviewers. Can be specified multiple times")
+	fs.Var(&defaultTeamReviewers, "gitops_pr_team_reviewers", "Comma-separated teams requested to review the PRs of all release trains, in addition to --pr_team_reviewers. Can be specified multiple times")
+	fs.Var(&prLabels, "gitops_pr_labels", "Comma-separated labels added to the PRs of all release trains. Can be specified multiple times")
+	fs.Var(&prAssignees, "gitops_pr_assignees", "Comma-separated users assigned to the PRs of all release trains. Requires the github or github_app git_server. Can be specified multiple times")
+	fs.Var(&prReviewers, "pr_reviewers", "Users requested to review PRs of matching release trains, in the train_pattern=user1,user2 format, e.g. prod*=alice,bob. Can be specified multiple times")
+	fs.Var(&prTeamReviewers, "pr_team_reviewers", "Teams requested to review PRs of matching release trains, in the train_pattern=team1,team2 format. Can be specified multiple times")
+	fs.Var(&autoMergeTrains, "auto_merge", "Release train pattern, e.g. dev*, whose PRs are merged automatically once their requirements are met. Can be specified multiple times. Auto-merge is never enabled for other trains")
+	fs.BoolVar(&cfg.PRAutoMerge, "gitops_pr_automerge", false, "Merge the PRs of all release trains automatically once their checks pass: auto-merge on github, merge when pipeline succeeds on gitlab and merge on build success on bitbucket. Trains matching --merge_queue are queued instead")
+	fs.Var(&mergeQueueTrains, "merge_queue", "Release train pattern whose PRs are added to the merge queue of --gitops_pr_into when they are created or updated, instead of enabling auto-merge. Requires the github or github_app git_server. Can be specified multiple times")
+	fs.Var(&trainDependencies, "train_depends_on", "Release trains that deploy before matching release trains, in the train_pattern=train1,train2 format, e.g. app*=infra. PRs of matching trains reference the open PRs of these trains and are not merged automatically until they merge. Can be specified multiple times")
+	fs.BoolVar(&cfg.Changelog, "changelog", false, "Add source repository commits since the previous deployment of the release train to the PR body")
+	fs.BoolVar(&cfg.AffectedSection, "pr_affected_section", false, "Add a section listing the namespaces and workloads changed by the release train to the PR body")
+	fs.BoolVar(&cfg.ImageTable, "pr_image_table", false, "Add a table of the image references on the PR target branch and the references deployed by the PR to the PR body")
+	fs.BoolVar(&cfg.DiffSummary, "pr_diff_summary", false, "Add a summary of the files under --gitops_path changed by the PR, with their added and removed lines and changed images, to the PR body")
+	fs.BoolVar(&cfg.PrunePRs, "prune_prs", false, "After creating PRs, close the PRs and delete the deployment branches of release trains that are no longer discovered, like the prune-prs command")
+	fs.BoolVar(&cfg.GitHubDeployments, "github_deployments", false, "Create a GitHub deployment of the deployment branch of every release train once its PR is created or updated, with the source commit and images in its payload. Requires the github or github_app git_server")
+	fs.StringVar(&cfg.DeploymentEnvironment, "github_deployment_environment", "{train}", "Environment of the GitHub deployments of release trains, {train} is replaced with the release train")
+	fs.BoolVar(&cfg.AffectedLabels, "pr_affected_labels", false, "Label PRs with namespace:<namespace> and service:<workload> of the namespaces and workloads changed by the release train")
+	fs.StringVar(&cfg.SourceRepoURL, "source_repo_url", "", "Web URL of the source repository used to link changelog commits and PRs, e.g. https://github.com/org/app. Derived from BUILDKITE_REPO if empty")
+	fs.StringVar(&cfg.DeploymentBranchSuffix, "deployment_branch_suffix", "", "Suffix for deployment branch names")
+	fs.StringVar(&cfg.DeployBranchPrefix, "deploy_branch_prefix", "", "Namespace of deployment, promotion and rollback branches, e.g. the application name: deploy/<prefix>/<train>. Keeps pipelines deploying into the same gitops repository with identical release train names apart")
+
+	// Policy flags
+	fs.StringVar(&cfg.PolicyPath, "policy", "", "Conftest policy directory or bundle to evaluate against changed manifests of every release train before commit")
+	fs.StringVar(&cfg.Conftest, "conftest", "conftest", "Conftest binary used to evaluate --policy")
+
+	// Schema validation flags
+	fs.BoolVar(&cfg.ValidateSchemas, "validate_schemas", false, "Validate changed manifests of every release train against kubernetes schemas with kubeconform before commit")
+	fs.StringVar(&cfg.Kubeconform, "kubeconform", "kubeconform", "Kubeconform binary used by --validate_schemas")
+	fs.StringVar(&cfg.CRDSchemas, "crd_schemas", "", "Directory with CRD json schemas named {kind}_{version}.json. Resources without schema are skipped if not set")
+	fs.StringVar(&cfg.KubernetesVersion, "kubernetes_version", "", "Kubernetes version to validate schemas against. Default is the latest")
+
+	// Placeholder check flags
+	var allowedPlaceholders SliceFlags
+	fs.BoolVar(&cfg.CheckPlaceholders, "check_placeholders", false, "Fail release trains whose changed manifests contain unexpanded stamp or template placeholders")
+	fs.Var(&allowedPlaceholders, "allow_placeholder", "Regular expression of placeholders allowed in rendered manifests, e.g. '\\.Labels'. Can be specified multiple times")
+
+	// Multi-cluster flags
+	var trainClusters, clusterVariables SliceFlags
+	fs.Var(&trainClusters, "train_clusters", "Clusters to render the release train for, in the train=cluster1,cluster2 format. Can be specified multiple times")
+	fs.Var(&clusterVariables, "cluster_variable", "Template variable passed to gitops binaries rendering the cluster, in the cluster:NAME=VALUE format. Can be specified multiple times")
+	fs.StringVar(&cfg.ClusterPath, "cluster_path", "{gitops_path}/{cluster}/{train}", "Directory the --gitops_path manifests rendered for a cluster are written to. {gitops_path}, {cluster} and {train} are replaced")
+
+	// Layout flags
+	fs.StringVar(&cfg.DeploymentLayout, "deployment_layout", "", "Directory the --gitops_path manifests of every target are moved to, e.g. {gitops_path}/{train}/{package}. {gitops_path} (the cluster or environment directory of variants), {train}, {package} and {name} of the target are replaced. Disabled if empty")
+
+	// Environment flags
+	var environments SliceFlags
+	fs.Var(&environments, "environment", "Environment to render every release train for, in the name or name=variables_file format. Creates a {train}-{name} release train per environment. Can be specified multiple times")
+	fs.StringVar(&cfg.EnvironmentPath, "environment_path", "{gitops_path}/{env}", "Directory the --gitops_path manifests rendered for an environment are written to. {gitops_path} and {env} are replaced")
+
+	// Canary flags
+	var canaryConfig string
+	fs.StringVar(&canaryConfig, "canary_config", "", "JSON file configuring canary variants. Enables a {train}-canary release train with canary variants of the manifests of every release train")
+	fs.StringVar(&cfg.CanaryPath, "canary_path", "{gitops_path}/canary/{train}", "Directory canary variants are written to. {gitops_path} and {train} are replaced")
+
+	// Jira flags
+	var jiraProjects SliceFlags
+	fs.StringVar(&cfg.JiraURL, "jira_url", "", "Jira server URL, e.g. https://example.atlassian.net. Enables linking of Jira tickets referenced by the source branch and commit message in deployment PRs")
+	fs.StringVar(&cfg.JiraUser, "jira_user", os.Getenv("JIRA_USER"), "Jira user for basic authentication. Bearer token authentication is used if empty")
+	fs.StringVar(&cfg.JiraToken, "jira_token", os.Getenv("JIRA_TOKEN"), "Jira API token")
+	fs.Var(&jiraProjects, "jira_project", "Jira project key to link tickets of. Can be specified multiple times. Default is all projects")
+	fs.StringVar(&cfg.JiraTransition, "jira_transition", "", "Status or transition name to move linked Jira tickets to after the PR is created, e.g. Deploying. Requires --jira_project")
+
+	// Vault flags
+	var vaultSecrets SliceFlags
+	fs.StringVar(&cfg.VaultAddr, "vault_addr", os.Getenv("VAULT_ADDR"), "Vault server address to read --vault_secret credentials from, e.g. https://vault.example.com:8200")
+	fs.StringVar(&cfg.VaultNamespace, "vault_namespace", os.Getenv("VAULT_NAMESPACE"), "Vault Enterprise namespace")
+	fs.StringVar(&cfg.VaultToken, "vault_token", os.Getenv("VAULT_TOKEN"), "Vault token of the 'token' auth method")
+	fs.StringVar(&cfg.VaultAuthMethod, "vault_auth_method", "token", "Vault auth method: 'token', 'approle', 'jwt' or 'kubernetes'")
+	fs.StringVar(&cfg.VaultAuthMount, "vault_auth_mount", "", "Mount path of the Vault auth method. Default is the method name")
+	fs.StringVar(&cfg.VaultRole, "vault_role", "", "Vault role of the 'jwt' and 'kubernetes' auth methods, the role ID of 'approle'")
+	fs.StringVar(&cfg.VaultSecretID, "vault_secret_id", os.Getenv("VAULT_SECRET_ID"), "Secret ID of the 'approle' auth method")
+	fs.StringVar(&cfg.VaultJWT, "vault_jwt", os.Getenv("VAULT_JWT"), "JWT of the 'jwt' auth method, e.g. the OIDC token of the CI job. The 'kubernetes' method defaults to the pod service account token")
+	fs.Var(&vaultSecrets, "vault_secret", "Credential to read from Vault in the form flag=path#field, e.g. github_access_token=secret/data/gitops#token. private_key sets the GitHub App key and docker_config the registry credentials. Can be specified multiple times")
+
+	// ServiceNow flags
+	var serviceNowTrains SliceFlags
+	fs.StringVar(&cfg.ServiceNowURL, "servicenow_url", "", "ServiceNow instance URL, e.g. https://example.service-now.com. Enables change requests for --servicenow_train deployments")
+	fs.StringVar(&cfg.ServiceNowUser, "servicenow_user", os.Getenv("SERVICENOW_USER"), "ServiceNow user")
+	fs.StringVar(&cfg.ServiceNowPassword, "servicenow_password", os.Getenv("SERVICENOW_PASSWORD"), "ServiceNow password")
+	fs.Var(&serviceNowTrains, "servicenow_train", "Release train name pattern requiring a change request, e.g. prod*. Can be specified multiple times")
+	fs.StringVar(&cfg.ServiceNowTemplate, "servicenow_template", "", "JSON file with change request fields. Values may reference {train}, {branch}, {commit}, {title} and {body}")
+	fs.StringVar(&cfg.ServiceNowAssignmentGroup, "servicenow_assignment_group", "", "Assignment group of created change requests")
+
+	// Failure alerting flags
+	var datadogTags SliceFlags
+	fs.StringVar(&cfg.AlertSource, "alert_source", os.Getenv("BUILDKITE_PIPELINE_SLUG"), "Name of the pipeline reported with failure alerts")
+	fs.StringVar(&cfg.DatadogAPIKey, "datadog_api_key", os.Getenv("DD_API_KEY"), "Datadog API key. Enables Datadog error events for failed runs")
+	fs.StringVar(&cfg.DatadogSite, "datadog_site", "datadoghq.com", "Datadog site")
+	fs.Var(&datadogTags, "datadog_tag", "Tag added to Datadog error events, e.g. team:sre. Can be specified multiple times")
+	fs.StringVar(&cfg.PagerDutyRoutingKey, "pagerduty_routing_key", os.Getenv("PAGERDUTY_ROUTING_KEY"), "PagerDuty Events API v2 routing key. Enables PagerDuty alerts for failed runs")
+
+	// Metrics flags
+	var statsdTags SliceFlags
+	statsdPort := 8125
+	if port, err := strconv.Atoi(os.Getenv("DD_DOGSTATSD_PORT")); err == nil {
+		statsdPort = port
+	}
+	fs.StringVar(&cfg.StatsDHost, "statsd_host", os.Getenv("DD_AGENT_HOST"), "DogStatsD agent host to send run metrics to. Disabled if empty")
+	fs.IntVar(&cfg.StatsDPort, "statsd_port", statsdPort, "DogStatsD agent port")
+	fs.Var(&statsdTags, "statsd_tag", "Tag added to DogStatsD metrics, e.g. team:sre. Can be specified multiple times")
+
+	// Flux flags
+	fs.StringVar(&cfg.FluxPath, "flux_path", "", "Directory under gitops_path to write a Flux Kustomization per release train into. Empty disables generation")
+	fs.StringVar(&cfg.FluxTrainPath, "flux_train_path", "./{gitops_path}/{train}", "Path of the release train manifests used in generated Flux Kustomizations. {gitops_path} and {train} are replaced")
+	fs.StringVar(&cfg.FluxNamespace, "flux_namespace", "flux-system", "Namespace of generated Flux Kustomizations")
+	fs.StringVar(&cfg.FluxSource, "flux_source", "flux-system", "Name of the Flux GitRepository source referenced by generated Kustomizations")
+	fs.StringVar(&cfg.FluxInterval, "flux_interval", "5m", "Reconciliation interval of generated Flux Kustomizations")
+
+	// Publishing flags
+	fs.StringVar(&cfg.PublishURL, "publish_url", "", "Object storage prefix (s3://bucket/prefix or gs://bucket/prefix) to upload the manifests of updated release trains to after their deployment branches are pushed")
+
+	// Commit message flags
+	fs.StringVar(&cfg.CommitStyle, "commit_style", commitStyleDefault, "Deployment commit message style: default or conventional. Conventional commits have the '<type>(<train>): update N services' subject")
+	fs.StringVar(&cfg.CommitType, "commit_type", "deploy", "Conventional commit type of deployment commits")
+
+	// Audit log flags
+	fs.StringVar(&cfg.OwnershipIndex, "ownership_index", "", "File committed with every deployment of a release train mapping its gitops targets to the files they own, relative to the repository root, e.g. .gitops/index/{train}.yaml. Must contain {train}. Disabled if empty")
+	fs.StringVar(&cfg.AuditPath, "audit_path", "", "Audit log file committed with every deployment of a release train, e.g. audit/{train}.jsonl. Disabled if empty")
+	fs.StringVar(&cfg.AuditActor, "audit_actor", auditActor(), "User recorded in the audit log")
+
+	// Deployment freeze flags
+	var freezeWindows SliceFlags
+	fs.Var(&freezeWindows, "freeze_window", "Deployment freeze window, either RFC 3339 '<start>/<end>' or weekly '<weekday> <HH:MM>/<weekday> <HH:MM>'. Can be specified multiple times")
+	fs.StringVar(&cfg.FreezeTimezone, "freeze_timezone", "UTC", "Time zone of weekly deployment freeze windows")
+	fs.BoolVar(&cfg.IgnoreFreeze, "ignore_freeze", false, "Push and create PRs even during a deployment freeze. Use for emergencies only")
+
+	// Hook flags
+	var preRender, postRender, preCommit, prePush, postPR SliceFlags
+	fs.Var(&preRender, "hook_pre_render", "Shell command to run for every release train before rendering. Can be specified multiple times. Non-zero exit fails the release train")
+	fs.Var(&postRender, "hook_post_render", "Shell command to run for every release train after rendering. Can be specified multiple times. Non-zero exit fails the release train")
+	fs.Var(&preCommit, "hook_pre_commit", "Shell command to run for every changed release train before commit. Can be specified multiple times. Non-zero exit fails the release train")
+	fs.Var(&prePush, "hook_pre_push", "Shell command to run before pushing deployment branches. Can be specified multiple times. Non-zero exit aborts the run")
+	fs.Var(&postPR, "hook_post_pr", "Shell command to run for every deployment branch after the PR is created. Can be specified multiple times. Non-zero exit fails the run")
+
+	// Serve command flags
+	fs.StringVar(&cfg.ServeConfig, "serve_config", "", "JSON file with pipelines served by the serve command")
+	fs.StringVar(&cfg.Listen, "listen", ":8080", "Address the serve command listens on. The operator command serves /healthz, /readyz and /status on it")
+	fs.StringVar(&cfg.WebhookSecret, "webhook_secret", os.Getenv("GITOPS_WEBHOOK_SECRET"), "Secret used to verify GitHub webhook signatures and GitLab webhook tokens. Required unless --insecure_webhooks is set")
+	fs.BoolVar(&cfg.InsecureWebhooks, "insecure_webhooks", false, "Accept webhooks without verification if --webhook_secret is not set")
+	fs.StringVar(&cfg.APIToken, "api_token", os.Getenv("GITOPS_API_TOKEN"), "Bearer token of the serve command runs API. The API is disabled if empty")
+	fs.DurationVar(&cfg.Debounce, "debounce", 30*time.Second, "Time to wait for more pushes to the same branch before running a pipeline")
+	fs.BoolVar(&cfg.ServeMetrics, "serve_metrics", false, "Expose metrics of the serve command and of the runs it starts at /metrics in the Prometheus text format")
+	fs.IntVar(&cfg.StatusRuns, "status_runs", 10, "Number of recent runs listed by /status of the serve and operator commands")
+
+	// Operator command flags
+	fs.StringVar(&cfg.Kubeconfig, "kubeconfig", "", "Kubeconfig used by the operator command. In-cluster configuration is used if empty")
+	fs.StringVar(&cfg.OperatorNamespace, "operator_namespace", "", "Namespace the operator command watches for GitOpsRun resources. All namespaces if empty")
+	fs.DurationVar(&cfg.OperatorInterval, "operator_interval", 10*time.Second, "Interval the operator command polls GitOpsRun resources at")
+
+	// Drift command flags
+	fs.StringVar(&cfg.DriftReport, "drift_report", "", "File to write the JSON drift report to. Default is stdout")
+
+	// List-trains command flags
+	fs.StringVar(&cfg.ListFormat, "list_format", "json", "Output format of the list-trains and diff-stats commands: json or table")
+
+	// Render command flags
+	fs.StringVar(&cfg.RenderState, "render_state", "", "File recording digests of gitops binaries and their rendered manifests between runs. Targets whose binary, runfiles and manifests have not changed since the last run are not executed. Disabled if empty")
+	fs.StringVar(&cfg.ExecutionLog, "execution_log", "", "Bazel JSON execution log (--execution_log_json_file) of the build of the gitops targets. --render_state uses the file digests recorded by bazel instead of hashing runfiles")
+	fs.StringVar(&cfg.RenderDir, "render_dir", "", "Directory the render command writes manifests of every release train to, one <train> subdirectory per train")
+
+	// Promote command flags
+	fs.StringVar(&cfg.PromoteFrom, "promote_from", "", "Environment directory to promote manifests from, e.g. cloud/staging")
+	fs.StringVar(&cfg.PromoteTo, "promote_to", "", "Environment directory to promote manifests to, e.g. cloud/prod")
+	fs.StringVar(&cfg.PromoteFromBranch, "promote_from_branch", "", "Branch to read --promote_from manifests from. Default is --gitops_pr_into")
+
+	// Rollback command flags
+	fs.StringVar(&cfg.RollbackTrain, "rollback_train", "", "Release train to roll back")
+	fs.StringVar(&cfg.RollbackTo, "rollback_to", "", "Deployment repository commit or tag to restore manifests from")
+	fs.StringVar(&cfg.RollbackPath, "rollback_path", "", "Directory of manifests to restore. Default is the files of --rollback_train according to its ownership index or gitops commits at --rollback_to")
+
+	// create_gitops_prs rule sets these when used with `bazel run`
+	fs.Var(&cfg.ResolvedBinaries, "resolved_binary", "list of resolved gitops binaries to run. Can be specified multiple times. format is releasetrain:cmd/binary/to/run/command. Default is empty")
+	fs.Var(&cfg.ResolvedPushes, "resolved_push", "list of resolved push binaries to run. Can be specified multiple times. format is cmd/binary/to/run/command. Default is empty")
+	fs.StringVar(&cfg.ResolvedBinariesFile, "resolved_binaries_file", "", "params file with a --resolved_binary value per line, added to --resolved_binary. Avoids command line length limits of large repositories")
+	fs.StringVar(&cfg.ResolvedPushesFile, "resolved_pushes_file", "", "params file with a --resolved_push value per line, added to --resolved_push")
+
+	// Dependencies
+	var kinds, names, attrs SliceFlags
+	fs.Var(&kinds, "gitops_dependencies_kind", "Dependency kinds for GitOps phase")
+	fs.Var(&names, "gitops_dependencies_name", "Dependency names for GitOps phase")
+	fs.Var(&attrs, "gitops_dependencies_attr", "Dependency attributes (format: attr=value)")
+
+	return func() (*Config, error) {
+		cfg.DependencyKinds = kinds
+		if len(cfg.DependencyKinds) == 0 {
+			cfg.DependencyKinds = []string{"k8s_container_push", "push_oci"}
+		}
+		cfg.DependencyNames = names
+		cfg.DependencyAttrs = attrs
+
+		cfg.FreezeWindows = freezeWindows
+		cfg.AllowedPlaceholders = allowedPlaceholders
+		var err error
+		if cfg.TrainClusters, err = parseTrainClusters(trainClusters); err != nil {
+			return nil, err
+		}
+		if cfg.ClusterVariables, err = parseClusterVariables(clusterVariables); err != nil {
+			return nil, err
+		}
+		if cfg.BranchParameters, err = parseBranchParameters(branchParameters); err != nil {
+			return nil, err
+		}
+		if cfg.VaultSecrets, err = parseVaultSecrets(vaultSecrets); err != nil {
+			return nil, err
+		}
+		if cfg.StdoutTargets, err = parseStdoutTargets(stdoutTargets, cfg.GitOpsPath); err != nil {
+			return nil, err
+		}
+		cfg.BinaryArgs = binaryArgs
+		if cfg.TrainBinaryArgs, err = parseTrainArgs("train_binary_arg", trainBinaryArgs); err != nil {
+			return nil, err
+		}
+		if cfg.TrainPRTitles, err = parseTrainValues("train_pr_title", trainPRTitles); err != nil {
+			return nil, err
+		}
+		if cfg.TrainPRBodies, err = parseTrainValues("train_pr_body", trainPRBodies); err != nil {
+			return nil, err
+		}
+		if cfg.PRReviewers, err = parseTrainPatterns("pr_reviewers", prReviewers); err != nil {
+			return nil, err
+		}
+		if cfg.PRTeamReviewers, err = parseTrainPatterns("pr_team_reviewers", prTeamReviewers); err != nil {
+			return nil, err
+		}
+		cfg.PRDefaultReviewers = splitValues(defaultReviewers)
+		cfg.PRDefaultTeamReviewers = splitValues(defaultTeamReviewers)
+		cfg.PRLabels = splitValues(prLabels)
+		cfg.PRAssignees = splitValues(prAssignees)
+		cfg.AutoMergeTrains = autoMergeTrains
+		cfg.MergeQueueTrains = mergeQueueTrains
+		if cfg.TrainDependencies, err = parseTrainPatterns("train_depends_on", trainDependencies); err != nil {
+			return nil, err
+		}
+		if err := readParamsFile(cfg.ResolvedBinariesFile, &cfg.ResolvedBinaries); err != nil {
+			return nil, err
+		}
+		if err := readParamsFile(cfg.ResolvedPushesFile, &cfg.ResolvedPushes); err != nil {
+			return nil, err
+		}
+		redact.Add(cfg.JiraToken, cfg.ServiceNowPassword, cfg.DatadogAPIKey, cfg.PagerDutyRoutingKey, cfg.WebhookSecret, cfg.APIToken, cfg.VaultToken, cfg.VaultSecretID, cfg.VaultJWT)
+		if cfg.Environments, err = parseEnvironments(environments); err != nil {
+			return nil, err
+		}
+		if canaryConfig != "" {
+			if cfg.Canary, err = canary.LoadConfig(canaryConfig); err != nil {
+				return nil, fmt.Errorf("failed to load canary config: %w", err)
+			}
+		}
+		cfg.JiraProjects = jiraProjects
+		cfg.ServiceNowTrains = serviceNowTrains
+		cfg.DatadogTags = datadogTags
+		cfg.StatsDTags = statsdTags
+
+		cfg.Hooks = hooks.Hooks{
+			hooks.PreRender:  preRender,
+			hooks.PostRender: postRender,
+			hooks.PreCommit:  preCommit,
+			hooks.PrePush:    prePush,
+			hooks.PostPR:     postPR,
+		}
+
+		return cfg, nil
+	}
+}
+
+// DefaultConfig returns the Config with the default values of all command line flags
+func DefaultConfig() *Config {
+	cfg, err := RegisterFlags(flag.NewFlagSet("prer", flag.ContinueOnError))()
+	if err != nil {
+		// flag defaults are always valid
+		panic(err)
+	}
+	return cfg
+}
+
+// InitConfig parses the command line flags into the Config and masks credentials in the log output.
+// It exits after printing --version or if flags are invalid.
+func InitConfig() *Config {
+	log.SetOutput(redact.NewWriter(os.Stderr))
+	config := RegisterFlags(flag.CommandLine)
+	showVersion := flag.Bool("version", false, "Print the prer version and exit")
+
+	flag.Usage = usage
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(buildInfo())
+		os.Exit(0)
+	}
+	cfg, err := config()
+	if err != nil {
+		log.Print(err)
+		os.Exit(ExitConfig)
+	}
+	return cfg
+}
+
+const commandsHelp = `Commands:
+  (none)	render release trains, push images and create deployment PRs
+  drift		report release trains whose rendered manifests differ from --gitops_pr_into
+  diff-stats	print the files every target would add, change and remove in --gitops_pr_into in --list_format
+  render	render release trains into --render_dir without any git or PR work
+  doctor	check that bazel, the git repository and the git server credentials are usable
+  list-trains	print release trains, their deployment branches and targets in --list_format
+  promote	copy manifests from --promote_from into --promote_to and create a PR
+  rollback	restore manifests of --rollback_train to --rollback_to and create a PR
+  publish-prs	push the branches of --pr_manifest from --git_mirror to --git_repo and create their PRs
+  prune-prs	close the PRs and delete the deployment branches of release trains that no longer exist
+  serve		run pipelines from --serve_config on git push webhooks
+  operator	execute GitOpsRun custom resources of a kubernetes cluster
+`
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\n%s\nFlags:\n", os.Args[0], commandsHelp)
+	flag.PrintDefaults()
+}
+
+// gitServer returns the GitServer of the Config or the --git_server provider
+func gitServer(cfg *Config) (git.Server, error) {
+	if cfg.GitServer != nil {
+		return cfg.GitServer, nil
+	}
+	if cfg.Offline {
+		return &offlineServer{path: cfg.PRManifest, bundleDir: cfg.BundleDir, gitRepo: cfg.GitRepo}, nil
+	}
+	servers := map[string]git.Server{
+		"github":      git.Provider{Create: github.CreatePRWithPolicy, Find: github.FindOpenPR, Update: github.UpdateOpenPR, List: github.ListOpenPRs, Close: github.CloseOpenPR, Comment: github.CommentOpenPR, Default: github.DefaultBranch, Enqueue: github.EnqueueOpenPR, Deploy: github.CreateDeployment},
+		"gitlab":      git.Provider{Create: gitlab.CreatePRWithPolicy, Find: gitlab.FindOpenPR, Update: gitlab.UpdateOpenPR, List: gitlab.ListOpenPRs, Close: gitlab.CloseOpenPR, Comment: gitlab.CommentOpenPR, Default: gitlab.DefaultBranch},
+		"bitbucket":   git.Provider{Create: bitbucket.CreatePRWithPolicy, Find: bitbucket.FindOpenPR, Update: bitbucket.UpdateOpenPR, List: bitbucket.ListOpenPRs, Close: bitbucket.CloseOpenPR, Comment: bitbucket.CommentOpenPR, Default: bitbucket.DefaultBranch},
+		"azuredevops": git.Provider{Create: azuredevops.CreatePRWithPolicy, Find: azuredevops.FindOpenPR, Update: azuredevops.UpdateOpenPR, List: azuredevops.ListOpenPRs, Close: azuredevops.CloseOpenPR, Comment: azuredevops.CommentOpenPR, Default: azuredevops.DefaultBranch},
+		"codecommit":  git.Provider{Create: codecommit.CreatePRWithPolicy, Find: codecommit.FindOpenPR, Update: codecommit.UpdateOpenPR, List: codecommit.ListOpenPRs, Close: codecommit.CloseOpenPR, Comment: codecommit.CommentOpenPR, Default: codecommit.DefaultBranch},
+		"gitea":       git.Provider{Create: gitea.CreatePRWithPolicy, Find: gitea.FindOpenPR, Update: gitea.UpdateOpenPR, List: gitea.ListOpenPRs, Close: gitea.CloseOpenPR, Comment: gitea.CommentOpenPR, Default: gitea.DefaultBranch},
+		"github_app":  git.Provider{Create: github_app.CreatePRWithPolicy, Find: github_app.FindOpenPR, Update: github_app.UpdateOpenPR, List: github_app.ListOpenPRs, Close: github_app.CloseOpenPR, Comment: github_app.CommentOpenPR, Default: github_app.DefaultBranch, Enqueue: github_app.EnqueueOpenPR, Deploy: github_app.CreateDeployment},
+		"local":       git.PolicyServerFunc(local.CreatePRWithPolicy),
+		"exec":        git.PolicyServerFunc(external.CreatePRWithExec),
+		"webhook":     git.PolicyServerFunc(external.CreatePRWithWebhook),
+	}
+
+	server, exists := servers[cfg.GitHost]
+	if !exists {
+		return nil, errorf("unsupported git host: %s", cfg.GitHost)
+	}
+	return server, nil
+}
+
+// resolvePRTargetBranch sets an empty --gitops_pr_into to the default branch of the deployment repository
+// reported by the git server, or to the branch HEAD of --git_repo (--git_mirror offline) points to
+func resolvePRTargetBranch(cfg *Config) error {
+	if cfg.PRTargetBranch != "" {
+		return nil
+	}
+	server, err := gitServer(cfg)
+	if err != nil {
+		return err
+	}
+	repo := cfg.GitRepo
+	if cfg.Offline {
+		repo = cfg.GitMirror
+	}
+	branch, err := git.DefaultBranch(server, repo)
+	if err != nil {
+		return errorf("unable to find the default branch of the deployment repository, set --gitops_pr_into: %w", err)
+	}
+	log.Printf("Using the default branch %s of the deployment repository as --gitops_pr_into", branch)
+	cfg.PRTargetBranch = branch
+	return nil
+}
+
+func executeBazelQuery(query string) (*analysis.CqueryResult, error) {
+	log.Printf("Running Bazel Query: %s", query)
+	cmd := osexec.Command("bazel", "cquery",
+		"--output=proto",
+		"--noimplicit_deps",
+		query)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, errorf("no protobuf data found in output: %w", err)
+	}
+
+	result := &analysis.CqueryResult{}
+	if err := proto.Unmarshal(output, result); err != nil {
+		return nil, errorf("failed to unmarshal protobuf: %w", err)
+	}
+
+	return result, nil
+}
+
+// runParallel calls fn for items with at most parallelism concurrent calls.
+// No more items are started after a call fails; the first error is returned.
+func runParallel(items []string, parallelism int, fn func(string) error) error {
+	itemChan := make(chan string)
+	failed := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			defer wg.Done()
+			for item := range itemChan {
+				if err := fn(item); err != nil {
+					once.Do(func() {
+						firstErr = err
+						close(failed)
+					})
+				}
+			}
+		}()
+	}
+
+send:
+	for _, item := range items {
+		select {
+		case itemChan <- item:
+		case <-failed:
+			break send
+		}
+	}
+	close(itemChan)
+	wg.Wait()
+	return firstErr
+}
+
+func processResolvedImages(cfg *Config) error {
+	return runParallel(cfg.ResolvedPushes, cfg.PushParallelism, func(cmd string) error {
+		if _, err := exec.Ex("", cmd); err != nil {
+			return errorf("failed to push %s: %w", cmd, err)
+		}
+		metrics.Add(metricPushes, 1, "kind", "image")
+		return nil
+	})
+}
+
+func processImages(targets []string, cfg *Config) error {
+	deps := fmt.Sprintf("set('%s')", strings.Join(targets, "' '"))
+	queries := []string{}
+
+	// Build queries
+	for _, kind := range cfg.DependencyKinds {
+		queries = append(queries, fmt.Sprintf("kind(%s, deps(%s))", kind, deps))
+	}
+	for _, name := range cfg.DependencyNames {
+		queries = append(queries, fmt.Sprintf("filter(%s, deps(%s))", name, deps))
+	}
+	for _, attr := range cfg.DependencyAttrs {
+		name, value, _ := strings.Cut(attr, "=")
+		if value == "" {
+			value = ".*"
+		}
+		queries = append(queries, fmt.Sprintf("attr(%s, %s, deps(%s))", name, value, deps))
+	}
+
+	query := strings.Join(queries, " union ")
+	result, err := executeBazelQuery(query)
+	if err != nil {
+		return err
+	}
+
+	// Process targets in parallel
+	var pushTargets []string
+	for _, t := range result.Results {
+		pushTargets = append(pushTargets, t.Target.Rule.GetName())
+	}
+	return runParallel(pushTargets, cfg.PushParallelism, func(target string) error {
+		if err := processTarget(target, cfg.BazelCmd); err != nil {
+			return err
+		}
+		metrics.Add(metricPushes, 1, "kind", "image")
+		return nil
+	})
+}
+
+// targetExecutable returns the executable file of the target in bazel-bin, the target if it has none
+func targetExecutable(target string) (string, bool) {
+	bin := bazel.TargetToExecutable(target)
+	if file, ok := exec.Find(bin); ok {
+		return file, true
+	}
+	return bin, false
+}
+
+func processTarget(target, bazelCmd string) error {
+	if executable, ok := targetExecutable(target); ok {
+		if _, err := exec.Ex("", executable); err != nil {
+			return errorf("failed to push %s: %w", target, err)
+		}
+		return nil
+	}
+	log.Printf("target %s is not a file, running as command", target)
+	if _, err := exec.Ex("", bazelCmd, "run", target); err != nil {
+		return errorf("failed to push %s: %w", target, err)
+	}
+	return nil
+}
+
+// createPullRequests creates a PR for every branch. changelogs are appended to PR bodies of their branches,
+// the resources, images and files changed by the branches are listed in their bodies and labels if enabled.
+func createPullRequests(branches []string, changelogs map[string]string, resources map[string]affected, images map[string][]imageChange, diffs map[string][]manifestChange, deployed map[string][]audit.Image, cfg *Config) error {
+	if cfg.DryRun {
+		log.Printf("Dry run: would create PRs for branches: %v", branches)
+		return nil
+	}
+
+	server, err := gitServer(cfg)
+	if err != nil {
+		return err
+	}
+	keys := jiraKeys(cfg)
+	pushed := branches
+	if branches, err = orderBranches(branches, cfg); err != nil {
+		return err
+	}
+	for _, branch := range branches {
+		pending, err := pendingPrerequisites(server, trainOfBranch(branch, cfg), pushed, cfg)
+		if err != nil {
+			return err
+		}
+		title, body := prText(trainOfBranch(branch, cfg), branch, fmt.Sprintf("GitOps deployment %s", branch), branch, cfg)
+		if cl := changelogs[branch]; cl != "" {
+			body += "\n\n" + cl
+		}
+		if s := imageTable(images[branch]); s != "" {
+			body += "\n\n" + s
+		}
+		if s := diffSummary(diffs[branch]); s != "" {
+			body += "\n\n" + s
+		}
+		if s := resources[branch].section(); s != "" && cfg.AffectedSection {
+			body += "\n\n" + s
+		}
+		if s := dependsOnSection(pending); s != "" {
+			body += "\n\n" + s
+		}
+		title, body = jira.Decorate(title, body, cfg.JiraURL, keys)
+		production := changeTrains([]string{trainOfBranch(branch, cfg)}, cfg)
+		changeRequest := ""
+		if len(production) > 0 {
+			if changeRequest, err = findChangeRequest(server, prHead(branch, cfg), cfg); err != nil {
+				return err
+			}
+		}
+		prBody := body
+		if changeRequest != "" {
+			prBody += "\n\n" + changeRequest
+		}
+
+		policy := reviewPolicy(trainOfBranch(branch, cfg), cfg)
+		if cfg.AffectedLabels {
+			policy.Labels = appendUnique(policy.Labels, resources[branch].labels()...)
+		}
+		// the train deploys once its prerequisites have merged
+		policy.AutoMerge = policy.AutoMerge && len(pending) == 0
+		if err := git.CreatePRIdempotent(server, prHead(branch, cfg), cfg.PRTargetBranch, title, withBuildFooter(prBody), policy, idempotencyKey(branch, cfg)); err != nil {
+			return errorf("failed to create PR: %w", err)
+		}
+		if len(production) > 0 && changeRequest == "" {
+			if err := attachChangeRequest(server, production, prHead(branch, cfg), branch, title, body, policy, idempotencyKey(branch, cfg), cfg); err != nil {
+				return err
+			}
+		}
+		if len(cfg.TrainDependencies) > 0 {
+			orderedPRs = append(orderedPRs, orderedPR{Train: trainOfBranch(branch, cfg), Pending: pending})
+		}
+		if mergeQueue(trainOfBranch(branch, cfg), cfg) && len(pending) == 0 {
+			if err := enqueuePR(server, trainOfBranch(branch, cfg), prHead(branch, cfg), cfg); err != nil {
+				return err
+			}
+		}
+		if cfg.GitHubDeployments {
+			if err := createDeployment(server, trainOfBranch(branch, cfg), branch, deployed[branch], cfg); err != nil {
+				return err
+			}
+		}
+		if err := cfg.runHooks(hooks.PostPR, hooks.Env{Branch: branch, Commit: cfg.GitCommit}); err != nil {
+			return phaseError(err)
+		}
+	}
+	transitionJira(keys, cfg)
+	return nil
+}
+
+// idempotencyKey returns the key of the PR and commits of the branch deploying the source commit.
+// A retried run of the same commit uses the same key. Branches include --deploy_branch_prefix,
+// so pipelines deploying the same release train of a source repository use different keys.
+func idempotencyKey(branch string, cfg *Config) string {
+	sum := sha256.Sum256([]byte(cfg.GitCommit + "\x00" + branch))
+	return hex.EncodeToString(sum[:8])
+}
+
+// RunCommand validates the Config and runs the command cmd, the PR creation pipeline if cmd is empty
+func RunCommand(cmd string, cfg *Config) error {
+	setPhase("", cmd)
+	defer saveMetrics(cfg)
+	defer setupStatsD(cfg)()
+
+	if cfg.Workspace != "" {
+		if err := os.Chdir(cfg.Workspace); err != nil {
+			return errorf("failed to change directory: %w", err)
+		}
+	}
+	tlsOpts := git.TLS{CABundle: cfg.CABundle, ClientCert: cfg.ClientCert, ClientKey: cfg.ClientKey}
+	if err := tlsOpts.Apply(); err != nil {
+		return errorf("invalid TLS configuration: %w", err)
+	}
+	// credentials must be set before validation of the git server flags
+	cleanup, err := loadVaultSecrets(flag.CommandLine, cfg)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	// doctor reports configuration problems as one of its checks
+	if cmd != "doctor" {
+		if err := cfg.Validate(cmd); err != nil {
+			return err
+		}
+	}
+	// commands reading or targeting the PR target branch
+	if cmd != "render" && cmd != "list-trains" && cmd != "publish-prs" {
+		if err := resolvePRTargetBranch(cfg); err != nil {
+			if cmd != "doctor" {
+				return err
+			}
+			log.Printf("WARNING: %v", err)
+		}
+	}
+	rd, err := openRunDir(cfg.GitOpsTmpDir, cfg.RunID)
+	if err != nil {
+		return errorf("failed to create run directory: %w", err)
+	}
+	defer rd.close()
+	cfg.GitOpsTmpDir = rd.dir
+
+	// commands rendering manifests from the workspace
+	if cfg.RequireClean && (cmd == "" || cmd == "drift" || cmd == "diff-stats" || cmd == "render") {
+		setPhase("", PhaseDiscovery)
+		if err := checkWorkspace("", cfg); err != nil {
+			return phaseError(err)
+		}
+	}
+
+	switch cmd {
+	case "":
+		return Run(cfg)
+	case "drift":
+		return detectDrift(cfg)
+	case "diff-stats":
+		return diffStats(cfg)
+	case "render":
+		return renderAll(cfg)
+	case "list-trains":
+		return listTrains(cfg)
+	case "doctor":
+		return doctor(cfg)
+	case "promote":
+		return promote(cfg)
+	case "rollback":
+		return rollback(cfg)
+	case "publish-prs":
+		return publishPRs(cfg)
+	case "prune-prs":
+		return prunePRs(cfg)
+	case "serve":
+		return serveWebhooks(cfg)
+	case "operator":
+		return runOperator(cfg)
+	}
+	return errorf("unknown command: %s", cmd)
+}
+
+// readParamsFile appends the non-empty lines of the params file to values.
+// The create_gitops_prs rule passes resolved binaries and pushes in params files.
+func readParamsFile(path string, values *SliceFlags) error {
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read params file: %w", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			*values = append(*values, line)
+		}
+	}
+	return nil
+}
+
+// findTrains returns gitops targets of --release_branch grouped by release train (deployment branch).
+// Trains are expanded per --branch_parameter, --environment and --canary_config.
+func findTrains(cfg *Config) (map[string][]string, error) {
+	return queryTrains(cfg, false)
+}
+
+// allTrains returns the release trains of --targets of every release branch.
+// Pruning keeps them: the trains of other release branches are still deployed by their own pipelines.
+func allTrains(cfg *Config) (map[string][]string, error) {
+	return queryTrains(cfg, true)
+}
+
+// trainsQuery returns the bazel query of gitops targets with a deployment branch,
+// limited to --release_branch unless allReleases is set
+func trainsQuery(cfg *Config, allReleases bool) string {
+	if allReleases {
+		return fmt.Sprintf("attr(deployment_branch, \".+\", kind(gitops, %s))", cfg.Targets)
+	}
+	return fmt.Sprintf("attr(deployment_branch, \".+\", attr(release_branch_prefix, \"%s\", kind(gitops, %s)))",
+		cfg.ReleaseBranch, cfg.Targets)
+}
+
+func queryTrains(cfg *Config, allReleases bool) (map[string][]string, error) {
+	trains := make(map[string][]string)
+	if len(cfg.ResolvedBinaries) > 0 {
+		// This condition is used when calling the script from create_gitops_pr rules
+		// When you call `bazel run <create_gitops_pr target>`, you can't call another bazel query within a bazel run command
+		// So we have to rely on resolved binaries that were passed in
+		for _, rb := range cfg.ResolvedBinaries {
+			releaseTrain, bin, found := strings.Cut(rb, ":")
+			if !found {
+				return nil, errorf("resolved_binaries: invalid resolved_binary format: %s", rb)
+			}
+			trains[releaseTrain] = append(trains[releaseTrain], bin)
+		}
+		return expandTrains(trains, cfg)
+	}
+
+	// Find release trains
+	result, err := executeBazelQuery(trainsQuery(cfg, allReleases))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range result.Results {
+		var branch, title, body string
+		vars := make(map[string]string)
+		for _, attr := range t.Target.GetRule().GetAttribute() {
+			switch attr.GetName() {
+			case "deployment_branch":
+				branch = attr.GetStringValue()
+			case "pr_title":
+				title = attr.GetStringValue()
+			case "pr_body":
+				body = attr.GetStringValue()
+			}
+			if slices.Contains(branchVariables, attr.GetName()) {
+				vars[attr.GetName()] = attr.GetStringValue()
+			}
+		}
+		train, err := expandBranch(branch, vars, cfg.BranchParameters)
+		if err != nil {
+			return nil, errorf("%s: %w", t.Target.Rule.GetName(), err)
+		}
+		trains[train] = append(trains[train], t.Target.Rule.GetName())
+		if allReleases {
+			continue
+		}
+		// --train_pr_title and --train_pr_body take precedence over the rule attributes
+		setTrainValue(&cfg.TrainPRTitles, train, title)
+		setTrainValue(&cfg.TrainPRBodies, train, body)
+	}
+	return expandTrains(trains, cfg)
+}
+
+// expandTrains expands release trains per --branch_parameter, --environment and --canary_config
+func expandTrains(trains map[string][]string, cfg *Config) (map[string][]string, error) {
+	trains, err := expandParameters(trains, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return expandCanaries(expandEnvironments(trains, cfg), cfg), nil
+}
+
+// cloneRepo clones the deployment repository into a new temporary directory.
+// The caller is responsible for removing the returned directory.
+func cloneRepo(cfg *Config) (string, *git.Repo, error) {
+	gitopsDir, err := os.MkdirTemp(cfg.GitOpsTmpDir, "gitops")
+	if err != nil {
+		return "", nil, errorf("failed to create temp directory: %w", err)
+	}
+
+	repo, mirror := cfg.GitRepo, cfg.GitMirror
+	if cfg.Offline {
+		// the mirror is origin, deployment branches are pushed into it
+		repo, mirror = cfg.GitMirror, ""
+	}
+	unlock, err := lockMirror(cfg.GitMirror, false)
+	if err != nil {
+		os.RemoveAll(gitopsDir)
+		return "", nil, errorf("%w", err)
+	}
+	workdir, err := git.Clone(repo, gitopsDir, mirror, cfg.PRTargetBranch, cfg.GitOpsPath)
+	unlock()
+	if err != nil {
+		os.RemoveAll(gitopsDir)
+		return "", nil, errorf("failed to clone repository: %w", err)
+	}
+	if cfg.GitPushRepo != "" {
+		if err := workdir.AddPushRemote(cfg.GitPushRepo); err != nil {
+			os.RemoveAll(gitopsDir)
+			return "", nil, errorf("failed to add push repository: %w", err)
+		}
+	}
+	return gitopsDir, workdir, nil
+}
+
+// targetFiles maps gitops targets to the files they have written, relative to the deployment root
+type targetFiles map[string][]string
+
+// add records files written by the target, skipping duplicates
+func (tf targetFiles) add(target string, files ...string) {
+	for _, f := range files {
+		if !slices.Contains(tf[target], f) {
+			tf[target] = append(tf[target], f)
+		}
+	}
+}
+
+// merge adds all files of other
+func (tf targetFiles) merge(other targetFiles) {
+	for target, files := range other {
+		tf.add(target, files...)
+	}
+}
+
+// outputOwners maps files written under the deployment root to the gitops target that has written them
+type outputOwners map[string]string
+
+// claim records the files written by the targets of a release train. It fails with both target labels
+// if a file is also written by another target of this or a previously rendered release train,
+// as the last writer would silently overwrite the manifests of the other one.
+func (o outputOwners) claim(rendered targetFiles) error {
+	targets := make([]string, 0, len(rendered))
+	for target := range rendered {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	for _, target := range targets {
+		for _, f := range rendered[target] {
+			if owner, ok := o[f]; ok && owner != target {
+				first, second := owner, target
+				if second < first {
+					first, second = second, first
+				}
+				return errorf("output path collision: %s is written by both %s and %s", f, first, second)
+			}
+			o[f] = target
+		}
+	}
+	return nil
+}
+
+// renderTargets runs gitops binaries of targets writing manifests into deploymentRoot.
+// It returns the files written by every target, which gitops binaries print as they write them.
+// Targets already rendered with the same args during the run are written from the render cache.
+// With --render_parallelism every target renders into its own scratch root, merged into
+// deploymentRoot in the order of targets once all of them are done.
+func renderTargets(targets []string, deploymentRoot string, cfg *Config, args ...string) (targetFiles, error) {
+	written := make(targetFiles)
+	if cfg.RenderParallelism <= 1 || len(targets) < 2 {
+		for _, target := range targets {
+			files, err := renderTarget(target, deploymentRoot, deploymentRoot, cfg, args)
+			if err != nil {
+				return nil, err
+			}
+			written[target] = nil
+			written.add(target, files...)
+		}
+		return written, nil
+	}
+
+	var mu sync.Mutex
+	scratches := make(map[string]string)
+	defer func() {
+		for _, scratch := range scratches {
+			os.RemoveAll(scratch)
+		}
+	}()
+	err := runParallel(targets, cfg.RenderParallelism, func(target string) error {
+		scratch, err := os.MkdirTemp(cfg.GitOpsTmpDir, "target")
+		if err != nil {
+			return errorf("failed to create temp directory: %w", err)
+		}
+		mu.Lock()
+		scratches[target] = scratch
+		mu.Unlock()
+		files, err := renderTarget(target, deploymentRoot, scratch, cfg, args)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		written[target] = nil
+		written.add(target, files...)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		if err := moveTree(scratches[target], deploymentRoot); err != nil {
+			return nil, errorf("failed to write manifests of %s: %w", target, err)
+		}
+	}
+	return written, nil
+}
+
+// renderTarget renders the target into outRoot and returns the files it has written relative to outRoot.
+// The binary is not executed if deploymentRoot already contains its unchanged manifests, see --render_state.
+func renderTarget(target, deploymentRoot, outRoot string, cfg *Config, args []string) ([]string, error) {
+	files, cached, err := cfg.renders.replay(target, args, outRoot)
+	if err != nil {
+		return nil, errorf("failed to write cached manifests of %s: %w", target, err)
+	}
+	if cached {
+		return files, nil
+	}
+	bin, _ := targetExecutable(target)
+	inputs := cfg.renders.inputDigest(bin, args)
+	if files, ok := cfg.renders.unchanged(target, args, inputs, deploymentRoot); ok {
+		log.Printf("Skipping %s, its inputs and manifests have not changed since the last run", target)
+		if err := cfg.renders.record(target, args, deploymentRoot, files); err != nil {
+			return nil, errorf("failed to cache manifests of %s: %w", target, err)
+		}
+		return files, nil
+	}
+	binArgs := append([]string{"--nopush", "--deployment_root", outRoot}, args...)
+	written := make(targetFiles)
+	if path, ok := cfg.StdoutTargets[target]; ok {
+		if err := renderStdout(bin, binArgs, filepath.Join(outRoot, path)); err != nil {
+			return nil, errorf("failed to render %s: %w", target, err)
+		}
+		written.add(target, path)
+	} else {
+		out, err := exec.Ex("", bin, binArgs...)
+		if err != nil {
+			return nil, errorf("failed to render %s: %w", target, err)
+		}
+		prefix := filepath.Clean(outRoot) + string(filepath.Separator)
+		for _, line := range strings.Split(out, "\n") {
+			if line = strings.TrimSpace(line); strings.HasPrefix(line, prefix) {
+				written.add(target, filepath.Clean(strings.TrimPrefix(line, prefix)))
+			}
+		}
+	}
+	if err := cfg.renders.record(target, args, outRoot, written[target]); err != nil {
+		return nil, errorf("failed to cache manifests of %s: %w", target, err)
+	}
+	if err := cfg.renders.recordState(target, args, inputs, outRoot, written[target]); err != nil {
+		return nil, errorf("failed to record render state of %s: %w", target, err)
+	}
+	return written[target], nil
+}
+
+// runHooks runs the hooks of the stage, if any
+func (cfg *Config) runHooks(stage hooks.Stage, env hooks.Env) error {
+	if cfg.Hooks == nil {
+		return nil
+	}
+	return cfg.Hooks.Run(stage, env)
+}
+
+// trainBranch returns the deployment branch of the release train
+func trainBranch(train string, cfg *Config) string {
+	return branchNamespace("deploy", cfg) + train + cfg.DeploymentBranchSuffix
+}
+
+// Run renders all release trains, commits changes into deployment branches and creates PRs.
+// Errors are *PhaseError for failures stopping the run and TrainErrors for release trains
+// that failed while the others were committed.
+func Run(cfg *Config) (err error) {
+	start := time.Now()
+	if !cfg.DryRun {
+		if err := checkCommit(cfg); err != nil {
+			return phaseError(err)
+		}
+	}
+	if err := startRenders(cfg); err != nil {
+		return err
+	}
+	defer cfg.renders.finish()
+	setPhase("", PhaseDiscovery)
+	trains, err := findTrains(cfg)
+	if err != nil {
+		return err
+	}
+	if len(trains) == 0 {
+		log.Println("No matching targets found")
+		return noChanges(cfg)
+	}
+
+	var failures TrainErrors
+	defer func() {
+		// runs with failed trains leave retired PRs in place until the next successful run
+		if cfg.PrunePRs && (err == nil || errors.Is(err, errNoChanges)) {
+			if perr := pruneRetired(cfg); perr != nil {
+				err = perr
+			}
+		}
+	}()
+	names := make([]string, 0, len(trains))
+	for train := range trains {
+		names = append(names, train)
+	}
+	defer func() {
+		saveJUnitReport(names, failures, err, start, cfg)
+	}()
+	defer func() {
+		if (err == nil || errors.Is(err, errNoChanges) || errors.Is(err, errFrozen)) && len(failures) > 0 {
+			err = failures
+		}
+	}()
+	defer logRunSummary(len(trains), start)
+
+	setPhase("", PhaseClone)
+	gitopsDir, workdir, err := cloneRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gitopsDir)
+
+	scanner, err := newSecretScanner(cfg)
+	if err != nil {
+		return err
+	}
+	gates := newGates(cfg)
+	failTrain := func(train string, err error) {
+		log.Printf("Release train %s failed: %v", train, err)
+		failures = append(failures, phaseError(err))
+		workdir.Discard(cfg.GitOpsPath)
+	}
+
+	var updatedTargets []string
+	var updatedBranches []string
+	var modifiedFiles []string
+	changelogs := make(map[string]string)
+	resources := make(map[string]affected)
+	owners := make(outputOwners)
+	images := make(map[string][]imageChange)
+	diffs := make(map[string][]manifestChange)
+	deployed := make(map[string][]audit.Image)
+	var published []publication
+
+	// Process each release train
+	for train, targets := range trains {
+		branch := trainBranch(train, cfg)
+		setPhase(train, PhaseRender)
+
+		if !workdir.SwitchToBranch(branch, cfg.PRTargetBranch) {
+			// Check if branch needs recreation due to deleted targets
+			msg := workdir.GetLastCommitMessage()
+			currentTargets := make(map[string]bool)
+			for _, t := range targets {
+				currentTargets[t] = true
+			}
+
+			for _, t := range commitmsg.ExtractTargets(msg) {
+				if !currentTargets[t] {
+					workdir.RecreateBranch(branch, cfg.PRTargetBranch)
+					break
+				}
+			}
+		}
+
+		if cfg.Changelog {
+			changelogs[branch] = trainChangelog(workdir, targets, cfg)
+		}
+
+		env := hooks.Env{Train: train, Branch: branch, Workdir: gitopsDir, Commit: cfg.GitCommit}
+		if err := cfg.runHooks(hooks.PreRender, env); err != nil {
+			failTrain(train, err)
+			continue
+		}
+		rendered, err := renderTrain(train, targets, gitopsDir, cfg)
+		if err != nil {
+			return err
+		}
+		if err := owners.claim(rendered); err != nil {
+			return err
+		}
+		if cfg.FluxPath != "" {
+			if err := writeFluxKustomization(gitopsDir, train, cfg); err != nil {
+				return err
+			}
+		}
+		if err := cfg.runHooks(hooks.PostRender, env); err != nil {
+			failTrain(train, err)
+			continue
+		}
+
+		files, err := workdir.GetModifiedFiles()
+
+		if err != nil {
+			return errorf("failed to get modified files: %w", err)
+		}
+		metrics.Add(metricChangedFiles, float64(len(files)), "train", train)
+		if cfg.AffectedSection || cfg.AffectedLabels {
+			if resources[branch], err = affectedResources(workdir, files); err != nil {
+				failTrain(train, err)
+				continue
+			}
+		}
+		if cfg.ImageTable {
+			if images[branch], err = imageChanges(workdir, files, "origin/"+cfg.PRTargetBranch); err != nil {
+				failTrain(train, err)
+				continue
+			}
+		}
+
+		metadata, err := commitMetadata(workdir, train, targets, files, rendered, cfg)
+		if err != nil {
+			failTrain(train, err)
+			continue
+		}
+		commitMsg := fmt.Sprintf("GitOps for release branch %s from %s commit %s\n%s%s",
+			cfg.ReleaseBranch, cfg.BranchName, cfg.GitCommit, commitmsg.Generate(targets), metadata)
+
+		modifiedFiles = append(modifiedFiles, files...)
+		log.Printf("Modified files: %v", modifiedFiles)
+		setPhase(train, PhaseValidate)
+		if err := checkDiffSize(workdir, branch, cfg); err != nil {
+			return err
+		}
+		if scanner != nil {
+			if err := scanSecrets(scanner, workdir, branch, files); err != nil {
+				return err
+			}
+		}
+		if err := gates.validate(workdir, files); err != nil {
+			failTrain(train, err)
+			commentViolations(branch, err, cfg)
+			continue
+		}
+		if cfg.Interactive && len(files) > 0 {
+			confirmed, err := confirmTrain(workdir, train, branch, stdin, os.Stdout, cfg)
+			if err != nil {
+				return err
+			}
+			if !confirmed {
+				log.Printf("Release train %s skipped", train)
+				modifiedFiles = modifiedFiles[:len(modifiedFiles)-len(files)]
+				workdir.Discard(cfg.GitOpsPath)
+				continue
+			}
+		}
+		if len(files) > 0 && cfg.AuditPath != "" {
+			auditFile, err := appendAuditRecord(workdir, train, files, cfg)
+			if err != nil {
+				failTrain(train, err)
+				continue
+			}
+			modifiedFiles = append(modifiedFiles, auditFile)
+		}
+		if len(files) > 0 && cfg.OwnershipIndex != "" {
+			if _, err := writeOwnershipIndex(workdir, train, targets, rendered, cfg); err != nil {
+				failTrain(train, err)
+				continue
+			}
+		}
+		if len(files) > 0 {
+			env.Files = files
+			if err := cfg.runHooks(hooks.PreCommit, env); err != nil {
+				failTrain(train, err)
+				continue
+			}
+		}
+		setPhase(train, PhaseCommit)
+		commitMsg = commitMessage(train, servicesDescription(len(targets)), commitMsg, cfg)
+		if workdir.Commit(commitMsg, cfg.GitOpsPath) {
+			log.Printf("Branch %s has changes, push required", branch)
+			for _, t := range targets {
+				// targets shared by trains are queried for images once
+				if !slices.Contains(updatedTargets, t) {
+					updatedTargets = append(updatedTargets, t)
+				}
+			}
+			updatedBranches = append(updatedBranches, branch)
+			if cfg.DiffSummary {
+				if diffs[branch], err = manifestChanges(workdir, "origin/"+cfg.PRTargetBranch, cfg); err != nil {
+					return errorf("failed to summarize changes of %s: %w", branch, err)
+				}
+			}
+			if cfg.GitHubDeployments {
+				if deployed[branch], err = changedImages(workdir, files); err != nil {
+					return errorf("failed to read images of %s: %w", branch, err)
+				}
+			}
+			if cfg.PublishURL != "" {
+				pub, err := newPublication(workdir, train, rendered)
+				if err != nil {
+					return err
+				}
+				published = append(published, pub)
+			}
+		}
+	}
+
+	if len(updatedTargets) == 0 {
+		log.Println("No GitOps changes to push")
+		return noChanges(cfg)
+	}
+
+	setPhase("", PhaseFreeze)
+	isFrozen, reason, err := checkFreeze(workdir, cfg)
+	if err != nil {
+		return err
+	}
+	if isFrozen {
+		if !cfg.IgnoreFreeze {
+			log.Printf("Deployment freeze in effect (%s), not pushing branches %v", reason, updatedBranches)
+			return frozen(reason, cfg)
+		}
+		log.Printf("WARNING: deployment freeze in effect (%s), continuing because of --ignore_freeze", reason)
+	}
+
+	setPhase("", PhasePush)
+	if len(cfg.ResolvedPushes) > 0 {
+		err = processResolvedImages(cfg)
+	} else {
+		err = processImages(updatedTargets, cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	if cfg.DryRun {
+		return nil
+	}
+	slug := os.Getenv("BUILDKITE_PIPELINE_SLUG")
+	url := os.Getenv("BUILDKITE_BUILD_URL")
+	commit := fmt.Sprintf("%s/commit/%s", buildkiteRepoURL(), cfg.GitCommit)
+	shortSha := cfg.GitCommit[:7]
+
+	prTitle := fmt.Sprintf("Gitops Deploy: %s - %s", slug, shortSha)
+	prDescription := fmt.Sprintf("Automated PR for [%s](%s) via [Buildkite Pipeline](%s)", slug, commit, url)
+
+	if err := cfg.runHooks(hooks.PrePush, hooks.Env{Workdir: gitopsDir, Commit: cfg.GitCommit, Files: modifiedFiles, Branches: updatedBranches}); err != nil {
+		return errorf("push aborted: %w", err)
+	}
+
+	setPhase("", PhasePR)
+	switch {
+	case cfg.GitServer == nil && !cfg.Offline && cfg.GitHost == "github_app":
+		keys := jiraKeys(cfg)
+		prTitle, prDescription = jira.Decorate(prTitle, prDescription, cfg.JiraURL, keys)
+		var trains []string
+		for _, branch := range updatedBranches {
+			trains = append(trains, trainOfBranch(branch, cfg))
+		}
+		for _, branch := range updatedBranches {
+			if cl := changelogs[branch]; cl != "" {
+				prDescription += fmt.Sprintf("\n\n**%s**\n\n%s", trainOfBranch(branch, cfg), cl)
+			}
+		}
+		var changed affected
+		var imageDiff []imageChange
+		var fileDiff []manifestChange
+		for _, branch := range updatedBranches {
+			changed = changed.merge(resources[branch])
+			imageDiff = mergeImageChanges(imageDiff, images[branch])
+			fileDiff = mergeManifestChanges(fileDiff, diffs[branch])
+		}
+		if s := imageTable(imageDiff); s != "" {
+			prDescription += "\n\n" + s
+		}
+		if s := diffSummary(fileDiff); s != "" {
+			prDescription += "\n\n" + s
+		}
+		if s := changed.section(); s != "" && cfg.AffectedSection {
+			prDescription += "\n\n" + s
+		}
+		policy := combinedReviewPolicy(trains, cfg)
+		if cfg.AffectedLabels {
+			policy.Labels = appendUnique(policy.Labels, changed.labels()...)
+		}
+		production := changeTrains(trains, cfg)
+		var crServer git.Server
+		changeRequest := ""
+		if len(production) > 0 {
+			if crServer, err = gitServer(cfg); err != nil {
+				return err
+			}
+			if changeRequest, err = findChangeRequest(crServer, cfg.BranchName, cfg); err != nil {
+				return err
+			}
+		}
+		prBody := prDescription
+		if changeRequest != "" {
+			prBody += "\n\n" + changeRequest
+		}
+		commit := github_app.CreateCommit(cfg.PRTargetBranch, cfg.BranchName, gitopsDir, modifiedFiles, prTitle, withBuildFooter(prBody), policy, idempotencyKey(cfg.BranchName, cfg))
+		metrics.Add(metricPushes, 1, "kind", "branch")
+		// the API commit combines all trains and is the only one that exists in the deployment repository
+		for i := range published {
+			published[i].version = commit
+		}
+		if len(production) > 0 && changeRequest == "" {
+			if err := attachChangeRequest(crServer, production, cfg.BranchName, cfg.BranchName, prTitle, prDescription, policy, idempotencyKey(cfg.BranchName, cfg), cfg); err != nil {
+				return err
+			}
+		}
+		if err := publishTrains(workdir, published, cfg); err != nil {
+			return err
+		}
+		if combinedMergeQueue(trains, cfg) {
+			server, err := gitServer(cfg)
+			if err != nil {
+				return err
+			}
+			if err := enqueuePR(server, strings.Join(trains, ","), cfg.BranchName, cfg); err != nil {
+				return err
+			}
+		}
+		if cfg.GitHubDeployments {
+			server, err := gitServer(cfg)
+			if err != nil {
+				return err
+			}
+			// every train of the combined PR is deployed by its branch
+			for _, branch := range updatedBranches {
+				if err := createDeployment(server, trainOfBranch(branch, cfg), cfg.BranchName, deployed[branch], cfg); err != nil {
+					return err
+				}
+			}
+		}
+		if err := cfg.runHooks(hooks.PostPR, hooks.Env{Branch: cfg.BranchName, Workdir: gitopsDir, Commit: cfg.GitCommit, Files: modifiedFiles}); err != nil {
+			return phaseError(err)
+		}
+		transitionJira(keys, cfg)
+		return nil
+	case cfg.GitServer == nil && !cfg.Offline && cfg.GitHost == "gerrit":
+		if err := pushChanges(workdir, updatedBranches, resources, cfg); err != nil {
+			return err
+		}
+		return publishTrains(workdir, published, cfg)
+	case cfg.Offline && cfg.BundleDir != "":
+		if err := writeBundles(workdir, updatedBranches, cfg); err != nil {
+			return err
+		}
+		return createPullRequests(updatedBranches, changelogs, resources, images, diffs, deployed, cfg)
+	default:
+		if cfg.Offline {
+			unlock, err := lockMirror(cfg.GitMirror, true)
+			if err != nil {
+				return errorf("%w", err)
+			}
+			defer unlock()
+		}
+		workdir.Push(updatedBranches)
+		metrics.Add(metricPushes, float64(len(updatedBranches)), "kind", "branch")
+		if err := publishTrains(workdir, published, cfg); err != nil {
+			return err
+		}
+		return createPullRequests(updatedBranches, changelogs, resources, images, diffs, deployed, cfg)
+	}
+}
+
+// commitMetadata returns the structured commit message metadata of the release train deployment.
+// files are the changed files and rendered are the files written by every target.
+func commitMetadata(workdir *git.Repo, train string, targets, files []string, rendered targetFiles, cfg *Config) (string, error) {
+	m := commitmsg.Metadata{
+		Train:        train,
+		SourceBranch: cfg.BranchName,
+		SourceCommit: cfg.GitCommit,
+		Files:        files,
+	}
+	for _, t := range targets {
+		target := commitmsg.Target{Label: t, Files: rendered[t]}
+		sort.Strings(target.Files)
+		images, err := changedImages(workdir, target.Files)
+		if err != nil {
+			return "", err
+		}
+		target.Images = commitImages(images)
+		m.Targets = append(m.Targets, target)
+	}
+	images, err := changedImages(workdir, files)
+	if err != nil {
+		return "", err
+	}
+	m.Images = commitImages(images)
+	return commitmsg.GenerateMetadata(m)
+}
+
+func commitImages(images []audit.Image) []commitmsg.Image {
+	var result []commitmsg.Image
+	for _, img := range images {
+		result = append(result, commitmsg.Image{Name: img.Name, Digest: img.Digest})
+	}
+	return result
+}
+
+// checkDiffSize returns an error stopping the run if the staged change for the branch exceeds the configured limits
+func checkDiffSize(workdir *git.Repo, branch string, cfg *Config) error {
+	ds, err := workdir.StagedDiffStat(cfg.GitOpsPath)
+	if err != nil {
+		return errorf("failed to compute diff size: %w", err)
+	}
+	log.Printf("Branch %s diff: %d files, %d lines", branch, ds.Files, ds.Lines)
+	exceeded := (cfg.MaxDiffFiles > 0 && ds.Files > cfg.MaxDiffFiles) || (cfg.MaxDiffLines > 0 && ds.Lines > cfg.MaxDiffLines)
+	if !exceeded {
+		return nil
+	}
+	if cfg.Force {
+		log.Printf("WARNING: branch %s diff exceeds limits (max_diff_files=%d, max_diff_lines=%d), continuing because of --force", branch, cfg.MaxDiffFiles, cfg.MaxDiffLines)
+		return nil
+	}
+	return errorf("branch %s diff of %d files, %d lines exceeds limits (max_diff_files=%d, max_diff_lines=%d), use --force to override", branch, ds.Files, ds.Lines, cfg.MaxDiffFiles, cfg.MaxDiffLines)
+}
+
+// publication is a release train deployment commit uploaded to --publish_url once its branch is pushed
+type publication struct {
+	train string
+	// commit is the local deployment commit the files are read from
+	commit string
+	// version is the commit of the deployment repository naming the upload, commit unless the
+	// git server creates its own commit, e.g. github_app
+	version string
+	// files are all files rendered for the train, changed or not
+	files []string
+}
+
+// newPublication records the deployment commit of the release train checked out in workdir
+func newPublication(workdir *git.Repo, train string, rendered targetFiles) (publication, error) {
+	commit, err := workdir.Head()
+	if err != nil {
+		return publication{}, errorf("failed to publish %s: %w", train, err)
+	}
+	pub := publication{train: train, commit: commit, version: commit}
+	for _, files := range rendered {
+		pub.files = appendUnique(pub.files, files...)
+	}
+	sort.Strings(pub.files)
+	return pub, nil
+}
+
+// publishTrains uploads the manifests of every deployment commit to <publish_url>/<train>/<version>.
+// The files are read from the commits, the workdir has the last deployment branch checked out.
+func publishTrains(workdir *git.Repo, published []publication, cfg *Config) error {
+	for _, pub := range published {
+		if err := publishTrain(workdir, pub, cfg); err != nil {
+			return errorf("failed to publish %s: %w", pub.train, err)
+		}
+	}
+	return nil
+}
+
+func publishTrain(workdir *git.Repo, pub publication, cfg *Config) error {
+	tree, err := workdir.ReadTree(pub.commit, cfg.GitOpsPath)
+	if err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp(cfg.GitOpsTmpDir, "publish")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for _, f := range pub.files {
+		b, ok := tree[filepath.ToSlash(f)]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(staging, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, b, 0644); err != nil {
+			return err
+		}
+	}
+	dest := fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(cfg.PublishURL, "/"), pub.train, pub.version)
+	log.Printf("Publishing %d files of release train %s to %s", len(pub.files), pub.train, dest)
+	return publish.Upload(staging, pub.files, dest)
+}
+
+// newSecretScanner returns the configured secret scanner or nil if scanning is disabled
+func newSecretScanner(cfg *Config) (*secrets.Scanner, error) {
+	if !cfg.ScanSecrets {
+		return nil, nil
+	}
+	scanner := &secrets.Scanner{Entropy: cfg.ScanSecretsEntropy}
+	if cfg.SecretsAllowlist != "" {
+		allow, err := secrets.LoadAllowlist(cfg.SecretsAllowlist)
+		if err != nil {
+			return nil, errorf("failed to load secrets allowlist: %w", err)
+		}
+		scanner.Allow = allow
+	}
+	return scanner, nil
+}
+
+// scanSecrets returns an error stopping the run if any of the changed files contains credentials
+func scanSecrets(scanner *secrets.Scanner, workdir *git.Repo, branch string, files []string) error {
+	findings, err := scanner.ScanPaths(workdir.Dir, files)
+	if err != nil {
+		return errorf("failed to scan for secrets: %w", err)
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	for _, f := range findings {
+		log.Printf("possible secret: %s", f)
+	}
+	return errorf("branch %s: %d possible secrets detected, refusing to commit. Add exceptions to --secrets_allowlist if these are false positives", branch, len(findings))
+}
+
+// SliceFlags implements flag.Value for string slice flags
+type SliceFlags []string
+
+func (sf *SliceFlags) String() string {
+	return fmt.Sprintf("[%s]", strings.Join(*sf, ","))
+}
+
+func (sf *SliceFlags) Set(value string) error {
+	*sf = append(*sf, value)
+	return nil
+}
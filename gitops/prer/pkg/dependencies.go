@@ -0,0 +1,119 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// prerequisites returns the release trains that must deploy before the train
+func prerequisites(train string, cfg *Config) []string {
+	var trains []string
+	for _, t := range matchTrain(train, cfg.TrainDependencies) {
+		if t != train {
+			trains = appendUnique(trains, t)
+		}
+	}
+	return trains
+}
+
+// orderBranches orders the deployment branches so the PRs of prerequisite release trains are
+// created before the PRs of the trains depending on them. It fails on circular dependencies.
+func orderBranches(branches []string, cfg *Config) ([]string, error) {
+	byTrain := make(map[string]string)
+	for _, branch := range branches {
+		byTrain[trainOfBranch(branch, cfg)] = branch
+	}
+	const visiting, visited = 1, 2
+	state := make(map[string]int)
+	var ordered []string
+	var visit func(train string, chain []string) error
+	visit = func(train string, chain []string) error {
+		chain = append(chain, train)
+		switch state[train] {
+		case visited:
+			return nil
+		case visiting:
+			return errorf("circular release train dependency %s", strings.Join(chain, " -> "))
+		}
+		state[train] = visiting
+		for _, p := range prerequisites(train, cfg) {
+			if _, ok := byTrain[p]; !ok {
+				continue
+			}
+			if err := visit(p, chain); err != nil {
+				return err
+			}
+		}
+		state[train] = visited
+		ordered = append(ordered, byTrain[train])
+		return nil
+	}
+	for _, branch := range branches {
+		if err := visit(trainOfBranch(branch, cfg), nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// pendingPrerequisite is a prerequisite release train whose PR has not merged yet
+type pendingPrerequisite struct {
+	Train string
+	// URL is the open PR of the train, empty if the git server is unable to find PRs
+	URL string
+}
+
+// pendingPrerequisites returns the prerequisites of the train with an open PR into --gitops_pr_into.
+// Git servers unable to find PRs report the prerequisites whose branches were pushed by the run.
+func pendingPrerequisites(server git.Server, train string, pushed []string, cfg *Config) ([]pendingPrerequisite, error) {
+	var pending []pendingPrerequisite
+	for _, p := range prerequisites(train, cfg) {
+		branch := trainBranch(p, cfg)
+		ds, ok := server.(git.DedupServer)
+		if !ok {
+			if slices.Contains(pushed, branch) {
+				pending = append(pending, pendingPrerequisite{Train: p})
+			}
+			continue
+		}
+		pr, err := ds.FindOpenPR(prHead(branch, cfg), cfg.PRTargetBranch)
+		if err != nil {
+			return nil, errorf("failed to find the PR of %s, a prerequisite of %s: %w", p, train, err)
+		}
+		if pr != nil {
+			pending = append(pending, pendingPrerequisite{Train: p, URL: pr.URL})
+		}
+	}
+	return pending, nil
+}
+
+// dependsOnSection returns the PR description section referencing the PRs of pending prerequisites
+func dependsOnSection(pending []pendingPrerequisite) string {
+	if len(pending) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("### Depends on\n")
+	for _, p := range pending {
+		if p.URL == "" {
+			fmt.Fprintf(&b, "\n- %s", p.Train)
+		} else {
+			fmt.Fprintf(&b, "\n- %s: depends-on %s", p.Train, p.URL)
+		}
+	}
+	return b.String()
+}
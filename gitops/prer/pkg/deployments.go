@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/audit"
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// deploymentPayload is the payload of the deployment of a release train
+type deploymentPayload struct {
+	Train        string            `json:"train"`
+	SourceBranch string            `json:"source_branch"`
+	SourceCommit string            `json:"source_commit"`
+	Images       []commitmsg.Image `json:"images,omitempty"`
+}
+
+// deploymentEnvironment returns the environment of the release train deployments, --github_deployment_environment with {train} replaced
+func deploymentEnvironment(train string, cfg *Config) string {
+	return strings.ReplaceAll(cfg.DeploymentEnvironment, "{train}", train)
+}
+
+// createDeployment records the deployment of the release train by ref, the deployment branch, with the git server.
+// images are the images referenced by the files changed by the train.
+func createDeployment(server git.Server, train, ref string, images []audit.Image, cfg *Config) error {
+	d := git.Deployment{
+		Ref:         ref,
+		Environment: deploymentEnvironment(train, cfg),
+		Description: fmt.Sprintf("GitOps deployment of %s from %s commit %s", train, cfg.BranchName, cfg.GitCommit),
+		Payload: deploymentPayload{
+			Train:        train,
+			SourceBranch: cfg.BranchName,
+			SourceCommit: cfg.GitCommit,
+			Images:       commitImages(images),
+		},
+	}
+	u, err := git.CreateDeployment(server, d)
+	if err != nil {
+		return errorf("failed to create deployment of %s: %w", train, err)
+	}
+	log.Printf("Release train %s deployment to %s: %s", train, d.Environment, u)
+	return nil
+}
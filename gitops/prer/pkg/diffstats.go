@@ -0,0 +1,168 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// targetDiffStats counts the files a gitops target would add, change and remove in the deployment repository
+type targetDiffStats struct {
+	Train   string `json:"train"`
+	Target  string `json:"target"`
+	Added   int    `json:"added"`
+	Changed int    `json:"changed"`
+	Removed int    `json:"removed"`
+}
+
+// diffStats renders every release train on top of the PR target branch in the run directory and
+// reports the files every target would add, change and remove, without committing anything.
+// Removed files are the files the target has written according to the gitops commits of the branch
+// that are deleted by the render.
+func diffStats(cfg *Config) error {
+	if err := startRenders(cfg); err != nil {
+		return err
+	}
+	defer cfg.renders.finish()
+	setPhase("", PhaseDiscovery)
+	trains, err := findTrains(cfg)
+	if err != nil {
+		return err
+	}
+	gitopsDir, workdir, err := cloneRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gitopsDir)
+
+	names := make([]string, 0, len(trains))
+	for train := range trains {
+		names = append(names, train)
+	}
+	sort.Strings(names)
+
+	stats := []targetDiffStats{}
+	owners := make(outputOwners)
+	for _, train := range names {
+		setPhase(train, PhaseRender)
+		rendered, err := renderTrain(train, trains[train], gitopsDir, cfg)
+		if err != nil {
+			return err
+		}
+		if err := owners.claim(rendered); err != nil {
+			return err
+		}
+		targets := append([]string{}, trains[train]...)
+		sort.Strings(targets)
+		for _, target := range targets {
+			s, err := countTargetChanges(workdir, train, target, rendered[target], cfg)
+			if err != nil {
+				return errorf("failed to compare manifests of %s: %w", target, err)
+			}
+			s.Train = train
+			log.Printf("%s: %d added, %d changed, %d removed", target, s.Added, s.Changed, s.Removed)
+			stats = append(stats, s)
+		}
+		workdir.Discard(cfg.GitOpsPath)
+	}
+
+	if cfg.ListFormat == "table" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TRAIN\tTARGET\tADDED\tCHANGED\tREMOVED")
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", s.Train, s.Target, s.Added, s.Changed, s.Removed)
+		}
+		if err := w.Flush(); err != nil {
+			return errorf("failed to write diff statistics: %w", err)
+		}
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stats); err != nil {
+		return errorf("failed to write diff statistics: %w", err)
+	}
+	return nil
+}
+
+// countTargetChanges compares the files written by the target into the working tree with HEAD.
+// Files owned by the target at HEAD that are missing in the working tree are removed.
+func countTargetChanges(workdir *git.Repo, train, target string, files []string, cfg *Config) (targetDiffStats, error) {
+	s := targetDiffStats{Target: target}
+	written := make(map[string]bool)
+	for _, f := range files {
+		written[f] = true
+		content, err := os.ReadFile(filepath.Join(workdir.Dir, f))
+		if err != nil {
+			return s, err
+		}
+		committed, err := workdir.ReadTree("HEAD", f)
+		if err != nil {
+			return s, err
+		}
+		prev, ok := committed[filepath.ToSlash(f)]
+		switch {
+		case !ok:
+			s.Added++
+		case !bytes.Equal(prev, content):
+			s.Changed++
+		}
+	}
+	prevFiles, err := previousTargetFiles(workdir, train, target, cfg)
+	if err != nil {
+		return s, err
+	}
+	for _, f := range prevFiles {
+		if written[f] {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(workdir.Dir, f)); !os.IsNotExist(err) {
+			continue
+		}
+		committed, err := workdir.ReadTree("HEAD", f)
+		if err != nil {
+			return s, err
+		}
+		if len(committed) > 0 {
+			s.Removed++
+		}
+	}
+	return s, nil
+}
+
+// previousTargetFiles returns the files owned by the target of the train at HEAD: the files of the ownership
+// index of the train, or of the most recent gitops commit describing the target for branches without an index
+func previousTargetFiles(workdir *git.Repo, train, target string, cfg *Config) ([]string, error) {
+	index, err := readOwnershipIndex(workdir, "HEAD", train, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if index != nil {
+		return index.Targets[target], nil
+	}
+	messages, err := workdir.CommitMessages("HEAD", target, 0)
+	if err != nil {
+		return nil, err
+	}
+	files, _ := commitmsg.FindTargetFiles(messages, target)
+	return files, nil
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/audit"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// maxDiffSummaryFiles limits the number of files listed in the manifest diff summary of PR bodies
+const maxDiffSummaryFiles = 100
+
+// manifestChange is a file of the deployment repository changed by the PR of a release train
+type manifestChange struct {
+	git.FileChange
+	// Images are the image repositories whose references are changed in the file
+	Images []string
+}
+
+// manifestChanges returns the files under --gitops_path changed by the current branch of workdir since it diverged
+// from base, the target branch of the PR, with the image repositories whose references each file changes
+func manifestChanges(workdir *git.Repo, base string, cfg *Config) ([]manifestChange, error) {
+	mergeBase, files, err := workdir.ChangedFiles(base, "HEAD", cfg.GitOpsPath)
+	if err != nil {
+		return nil, err
+	}
+	images := func(ref, name string) ([]audit.Image, error) {
+		if !isManifest(name) {
+			return nil, nil
+		}
+		contents, err := workdir.ReadTree(ref, name)
+		if err != nil {
+			return nil, err
+		}
+		return audit.ParseImages(contents[name]), nil
+	}
+	var changes []manifestChange
+	for _, f := range files {
+		c := manifestChange{FileChange: f}
+		var old, new []audit.Image
+		if f.Status != "A" {
+			if old, err = images(mergeBase, f.Path); err != nil {
+				return nil, err
+			}
+		}
+		if f.Status != "D" {
+			if new, err = images("HEAD", f.Path); err != nil {
+				return nil, err
+			}
+		}
+		for _, ic := range diffImages(old, new) {
+			c.Images = append(c.Images, ic.Repository)
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// mergeManifestChanges returns the changes of both sorted by path, b replaces changes of the same file in a
+func mergeManifestChanges(a, b []manifestChange) []manifestChange {
+	byPath := make(map[string]manifestChange)
+	for _, c := range append(append([]manifestChange{}, a...), b...) {
+		byPath[c.Path] = c
+	}
+	merged := make([]manifestChange, 0, len(byPath))
+	for _, c := range byPath {
+		merged = append(merged, c)
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Path < merged[j].Path })
+	return merged
+}
+
+// diffSummary returns the Markdown PR body section summarizing the manifest changes, empty if there are none
+func diffSummary(changes []manifestChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	counts := make(map[string]int)
+	for _, c := range changes {
+		counts[c.Status]++
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "### Manifest changes\n\n%d files changed: %d added, %d modified, %d removed\n\n", len(changes), counts["A"], counts["M"], counts["D"])
+	b.WriteString("| File | Change | Lines | Images |\n| --- | --- | --- | --- |\n")
+	for i, c := range changes {
+		if i == maxDiffSummaryFiles {
+			fmt.Fprintf(&b, "\n_and %d more files_\n", len(changes)-maxDiffSummaryFiles)
+			break
+		}
+		status := map[string]string{"A": "added", "M": "modified", "D": "removed"}[c.Status]
+		if status == "" {
+			status = c.Status
+		}
+		images := ""
+		if len(c.Images) > 0 {
+			images = "`" + strings.Join(c.Images, "`<br>`") + "`"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | +%d -%d | %s |\n", c.Path, status, c.Added, c.Removed, images)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
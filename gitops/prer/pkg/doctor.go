@@ -0,0 +1,142 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	osexec "os/exec"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/git/azuredevops"
+	"github.com/fasterci/rules_gitops/gitops/git/bitbucket"
+	"github.com/fasterci/rules_gitops/gitops/git/codecommit"
+	"github.com/fasterci/rules_gitops/gitops/git/external"
+	"github.com/fasterci/rules_gitops/gitops/git/gerrit"
+	"github.com/fasterci/rules_gitops/gitops/git/gitea"
+	"github.com/fasterci/rules_gitops/gitops/git/github"
+	"github.com/fasterci/rules_gitops/gitops/git/github_app"
+	"github.com/fasterci/rules_gitops/gitops/git/gitlab"
+	"github.com/fasterci/rules_gitops/gitops/git/local"
+)
+
+// doctorTimeout limits the time of each preflight check
+const doctorTimeout = time.Minute
+
+// errSkipped marks checks not applicable to the configuration
+var errSkipped = errors.New("skipped")
+
+// doctorCheck is a preflight check of the configuration
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// serverChecks verify credentials of the git servers
+var serverChecks = map[string]func(context.Context) error{
+	"github":      github.Check,
+	"gitlab":      gitlab.Check,
+	"bitbucket":   bitbucket.Check,
+	"azuredevops": azuredevops.Check,
+	"codecommit":  codecommit.Check,
+	"gerrit":      gerrit.Check,
+	"gitea":       gitea.Check,
+	"github_app":  github_app.Check,
+	"local":       local.Check,
+	"exec":        external.CheckExec,
+	"webhook":     external.CheckWebhook,
+}
+
+// doctor runs preflight checks of the configuration and reports the result of each check.
+// It exits with a non-zero status if any check fails.
+func doctor(cfg *Config) error {
+	checks := []doctorCheck{
+		{"configuration", func(ctx context.Context) error {
+			return cfg.Validate("")
+		}},
+		{"bazel", func(ctx context.Context) error {
+			if len(cfg.ResolvedBinaries) > 0 {
+				return errSkipped
+			}
+			if out, err := osexec.CommandContext(ctx, "bazel", "info", "workspace").CombinedOutput(); err != nil {
+				return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+			}
+			return nil
+		}},
+		{"clean workspace", func(ctx context.Context) error {
+			if !cfg.RequireClean {
+				return errSkipped
+			}
+			return checkWorkspace("", cfg)
+		}},
+		{"git mirror " + cfg.GitMirror, func(ctx context.Context) error {
+			if cfg.GitMirror == "" {
+				return errSkipped
+			}
+			_, err := exec.Ex(cfg.GitMirror, "git", "rev-parse", "--git-dir")
+			return err
+		}},
+		{"git repository " + cfg.GitRepo + " branch " + cfg.PRTargetBranch, func(ctx context.Context) error {
+			if cfg.GitRepo == "" {
+				return errors.New("--git_repo must be set")
+			}
+			if cfg.PRTargetBranch == "" {
+				return errors.New("unable to find the default branch of the repository, set --gitops_pr_into")
+			}
+			repo := cfg.GitRepo
+			if cfg.Offline {
+				repo = cfg.GitMirror
+			}
+			exists, err := git.RemoteBranchExists(repo, cfg.PRTargetBranch)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				return fmt.Errorf("branch %s does not exist", cfg.PRTargetBranch)
+			}
+			return nil
+		}},
+		{"git server " + cfg.GitHost + " credentials", func(ctx context.Context) error {
+			if cfg.Offline {
+				return errSkipped
+			}
+			check, ok := serverChecks[cfg.GitHost]
+			if !ok {
+				return fmt.Errorf("unsupported git host: %s", cfg.GitHost)
+			}
+			return check(ctx)
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+		err := c.run(ctx)
+		cancel()
+		switch {
+		case err == nil:
+			fmt.Printf("OK    %s\n", c.name)
+		case errors.Is(err, errSkipped):
+			fmt.Printf("SKIP  %s\n", c.name)
+		default:
+			failed++
+			fmt.Printf("FAIL  %s: %v\n", c.name, err)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
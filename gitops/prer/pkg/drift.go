@@ -0,0 +1,114 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// errDrift is returned by the drift command if rendered manifests differ from the deployment repository
+var errDrift = errors.New("drift detected")
+
+// trainDrift lists files of a release train that differ from the deployment repository
+type trainDrift struct {
+	Train   string   `json:"train"`
+	Targets []string `json:"targets"`
+	Files   []string `json:"files"`
+}
+
+// driftReport is the machine readable result of the drift command
+type driftReport struct {
+	Branch  string       `json:"branch"`
+	Commit  string       `json:"commit"`
+	Drifted []trainDrift `json:"drifted"`
+}
+
+// detectDrift renders every release train on top of the PR target branch and reports
+// trains whose rendered manifests differ from the committed ones. Nothing is pushed.
+// The returned error wraps errDrift if any release train has drifted.
+func detectDrift(cfg *Config) error {
+	if err := startRenders(cfg); err != nil {
+		return err
+	}
+	defer cfg.renders.finish()
+	trains, err := findTrains(cfg)
+	if err != nil {
+		return err
+	}
+	if len(trains) == 0 {
+		log.Println("No matching targets found")
+		return nil
+	}
+
+	gitopsDir, workdir, err := cloneRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gitopsDir)
+
+	names := make([]string, 0, len(trains))
+	for train := range trains {
+		names = append(names, train)
+	}
+	sort.Strings(names)
+
+	report := driftReport{
+		Branch:  cfg.PRTargetBranch,
+		Commit:  cfg.GitCommit,
+		Drifted: []trainDrift{},
+	}
+	owners := make(outputOwners)
+	for _, train := range names {
+		rendered, err := renderTrain(train, trains[train], gitopsDir, cfg)
+		if err != nil {
+			return err
+		}
+		if err := owners.claim(rendered); err != nil {
+			return err
+		}
+		files, err := workdir.GetModifiedFiles()
+		if err != nil {
+			return errorf("failed to get modified files: %w", err)
+		}
+		if len(files) > 0 {
+			log.Printf("DRIFT: release train %s differs from %s in %d files: %v", train, cfg.PRTargetBranch, len(files), files)
+			report.Drifted = append(report.Drifted, trainDrift{Train: train, Targets: trains[train], Files: files})
+		} else {
+			log.Printf("release train %s is up to date", train)
+		}
+		workdir.Discard(cfg.GitOpsPath)
+	}
+
+	out := os.Stdout
+	if cfg.DriftReport != "" {
+		f, err := os.Create(cfg.DriftReport)
+		if err != nil {
+			return errorf("failed to create drift report: %w", err)
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return errorf("failed to write drift report: %w", err)
+	}
+
+	if len(report.Drifted) > 0 {
+		return fmt.Errorf("%w in %d of %d release trains", errDrift, len(report.Drifted), len(names))
+	}
+	return nil
+}
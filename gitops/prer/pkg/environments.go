@@ -0,0 +1,86 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// environment is a variant every release train is rendered for
+type environment struct {
+	Name string
+	// Variables are NAME=VALUE template variables of the environment
+	Variables []string
+}
+
+// parseEnvironments parses --environment values in the name or name=variables_file format
+func parseEnvironments(values []string) ([]environment, error) {
+	var envs []environment
+	for _, v := range values {
+		name, file, _ := strings.Cut(v, "=")
+		if name == "" {
+			return nil, fmt.Errorf("invalid environment %q, expected name or name=variables_file", v)
+		}
+		env := environment{Name: name}
+		if file != "" {
+			vars, err := readVariables(file)
+			if err != nil {
+				return nil, fmt.Errorf("environment %s: %w", name, err)
+			}
+			env.Variables = vars
+		}
+		envs = append(envs, env)
+	}
+	return envs, nil
+}
+
+// readVariables reads NAME=VALUE lines of the file. Empty lines and lines starting with # are ignored.
+func readVariables(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var vars []string
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("%s:%d: expected NAME=VALUE", path, n)
+		}
+		vars = append(vars, line)
+	}
+	return vars, s.Err()
+}
+
+// expandEnvironments replaces every release train with a {train}-{env} train per configured environment
+func expandEnvironments(trains map[string][]string, cfg *Config) map[string][]string {
+	if len(cfg.Environments) == 0 {
+		return trains
+	}
+	expanded := make(map[string][]string)
+	cfg.TrainEnvironments = make(map[string]environment)
+	for train, targets := range trains {
+		for _, env := range cfg.Environments {
+			name := train + "-" + env.Name
+			expanded[name] = targets
+			cfg.TrainEnvironments[name] = env
+		}
+	}
+	return expanded
+}
@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// Phases of a run reported by PhaseError
+const (
+	PhaseDiscovery = "discovery"
+	PhaseClone     = "clone"
+	PhaseRender    = "render"
+	PhaseValidate  = "validate"
+	PhaseCommit    = "commit"
+	PhaseFreeze    = "freeze"
+	PhasePush      = "push"
+	PhasePR        = "pr"
+)
+
+// Exit codes of create_gitops_prs by outcome of the run
+const (
+	ExitSuccess = 0
+	// ExitFailure is the exit code of failures of no other class
+	ExitFailure = 1
+	// ExitNoChanges is returned with --detailed_exit_codes if the run had nothing to commit
+	ExitNoChanges = 2
+	ExitDiscovery = 3
+	ExitRender    = 4
+	// ExitPush is the exit code of git and image push failures
+	ExitPush = 5
+	// ExitProvider is the exit code of git server (PR creation) failures
+	ExitProvider = 6
+	ExitConfig   = 7
+	ExitDrift    = 8
+	// ExitTrains is the exit code of runs where some release trains failed while the others were committed
+	ExitTrains = 9
+	// ExitFrozen is returned with --detailed_exit_codes if a deployment freeze stopped the run before the push
+	ExitFrozen = 10
+)
+
+// errNoChanges is returned with --detailed_exit_codes if the run had nothing to commit
+var errNoChanges = errors.New("no gitops changes")
+
+// errFrozen is returned with --detailed_exit_codes if a deployment freeze stopped the run before the push
+var errFrozen = errors.New("deployment freeze in effect")
+
+// phaseExitCodes are the exit codes of failed phases
+var phaseExitCodes = map[string]int{
+	PhaseDiscovery: ExitDiscovery,
+	PhaseClone:     ExitPush,
+	PhaseRender:    ExitRender,
+	PhaseValidate:  ExitRender,
+	PhaseCommit:    ExitPush,
+	PhaseFreeze:    ExitPush,
+	PhasePush:      ExitPush,
+	PhasePR:        ExitProvider,
+}
+
+// PhaseError is the failure of a phase of the run. Train is empty for phases covering all release trains.
+type PhaseError struct {
+	Train string
+	Phase string
+	Err   error
+}
+
+func (e *PhaseError) Error() string {
+	if e.Train == "" {
+		return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", e.Train, e.Phase, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+// TrainErrors are failures of release trains that did not stop the run of other release trains
+type TrainErrors []*PhaseError
+
+func (e TrainErrors) Error() string {
+	return fmt.Sprintf("%d release trains failed", len(e))
+}
+
+// errorf returns the error of the current phase
+func errorf(format string, args ...interface{}) error {
+	return &PhaseError{Train: progress.train, Phase: progress.phase, Err: fmt.Errorf(format, args...)}
+}
+
+// phaseError returns err as the error of the current phase unless it already is a PhaseError
+func phaseError(err error) *PhaseError {
+	var pe *PhaseError
+	if errors.As(err, &pe) {
+		return pe
+	}
+	return &PhaseError{Train: progress.train, Phase: progress.phase, Err: err}
+}
+
+// noChanges is the result of a run without changes to commit
+func noChanges(cfg *Config) error {
+	if cfg.DetailedExitCodes {
+		return errNoChanges
+	}
+	return nil
+}
+
+// frozen is the result of a run stopped by a deployment freeze
+func frozen(reason string, cfg *Config) error {
+	frozenReason = reason
+	if cfg.DetailedExitCodes {
+		return fmt.Errorf("%w: %s", errFrozen, reason)
+	}
+	return nil
+}
+
+// ExitCode returns the exit code of the run failing with err
+func ExitCode(err error) int {
+	var config ConfigError
+	var trainErrs TrainErrors
+	var pe *PhaseError
+	switch {
+	case err == nil:
+		return ExitSuccess
+	case errors.Is(err, errNoChanges):
+		return ExitNoChanges
+	case errors.Is(err, errFrozen):
+		return ExitFrozen
+	case errors.As(err, &config):
+		return ExitConfig
+	case errors.Is(err, errDrift):
+		return ExitDrift
+	case errors.As(err, &trainErrs):
+		return ExitTrains
+	case errors.As(err, &pe):
+		if code, ok := phaseExitCodes[pe.Phase]; ok {
+			return code
+		}
+	}
+	return ExitFailure
+}
+
+// ReportError logs the error of the run and sends failure alerts for failed phases
+func ReportError(err error) {
+	if errors.Is(err, errNoChanges) || errors.Is(err, errFrozen) {
+		log.Print(err)
+		return
+	}
+	var trainErrs TrainErrors
+	if errors.As(err, &trainErrs) {
+		log.Printf("%d release trains failed:", len(trainErrs))
+		for _, e := range trainErrs {
+			log.Printf("  %s: %v", e.Train, e.Err)
+			notifyFailure(e.Train, e.Phase, e.Err.Error())
+		}
+		return
+	}
+	log.Print(err)
+	var pe *PhaseError
+	if errors.As(err, &pe) {
+		notifyFailure(pe.Train, pe.Phase, pe.Err.Error())
+	}
+}
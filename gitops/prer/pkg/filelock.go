@@ -0,0 +1,84 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// errLocked is returned by tryLockFile if another process holds the lock
+var errLocked = errors.New("locked by another process")
+
+// fileLock is an advisory lock of a lock file shared by concurrent runs on one agent, e.g. of a cache.
+// The operating system releases the lock when the process exits, so a crashed run never leaves a lock behind.
+type fileLock struct {
+	path string
+	f    *os.File
+}
+
+// lockFile waits for the shared or exclusive lock of the file at path, creating the file if it does not exist
+func lockFile(path string, exclusive bool) (*fileLock, error) {
+	return acquire(path, exclusive, true)
+}
+
+// tryLockFile returns the exclusive lock of the file at path, errLocked if another process holds a lock
+func tryLockFile(path string) (*fileLock, error) {
+	return acquire(path, true, false)
+}
+
+func acquire(path string, exclusive, block bool) (*fileLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil && !exclusive {
+			// a shared lock of a read-only location, e.g. of a git mirror mounted read-only
+			f, err = os.Open(path)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to open lock file: %w", err)
+		}
+		if err := flock(f, exclusive, block); err != nil {
+			f.Close()
+			if errors.Is(err, errLocked) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("unable to lock %s: %w", path, err)
+		}
+		// the holder of the lock may have removed the file before it was locked, see release
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if current, err := os.Stat(path); err == nil && os.SameFile(locked, current) {
+			return &fileLock{path: path, f: f}, nil
+		}
+		f.Close()
+	}
+}
+
+// unlock releases the lock and keeps the lock file
+func (l *fileLock) unlock() {
+	l.f.Close()
+}
+
+// release removes the lock file and releases the lock. Waiting processes lock the removed file and retry.
+func (l *fileLock) release() {
+	if err := os.Remove(l.path); err != nil {
+		// Windows does not remove open files, other processes can not open the file while it is removed
+		l.f.Close()
+		os.Remove(l.path)
+		return
+	}
+	l.f.Close()
+}
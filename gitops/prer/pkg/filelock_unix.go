@@ -0,0 +1,44 @@
+//go:build unix
+
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package prer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fileLocking reports whether the platform supports file locks
+const fileLocking = true
+
+// flock locks the file, returning errLocked if block is false and another process holds a lock
+func flock(f *os.File, exclusive, block bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	for {
+		err := syscall.Flock(int(f.Fd()), how)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return errLocked
+		}
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/flux"
+)
+
+// writeFluxKustomization writes the Flux Kustomization syncing the release train into the deployment root
+func writeFluxKustomization(deploymentRoot, train string, cfg *Config) error {
+	name := flux.ObjectName(train)
+	path := strings.NewReplacer("{gitops_path}", cfg.GitOpsPath, "{train}", train).Replace(cfg.FluxTrainPath)
+	k := flux.Kustomization{
+		Name:      name,
+		Namespace: cfg.FluxNamespace,
+		Path:      path,
+		Source:    cfg.FluxSource,
+		Interval:  cfg.FluxInterval,
+		Prune:     true,
+	}
+	b, err := k.Generate()
+	if err != nil {
+		return errorf("failed to generate flux kustomization for %s: %w", train, err)
+	}
+	file := filepath.Join(deploymentRoot, cfg.GitOpsPath, cfg.FluxPath, name+".yaml")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return errorf("failed to create flux path: %w", err)
+	}
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		return errorf("failed to write flux kustomization: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/freeze"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// checkFreeze reports whether a deployment freeze declared by flags or by the freeze file
+// of the PR target branch is in effect
+func checkFreeze(workdir *git.Repo, cfg *Config) (bool, string, error) {
+	loc, err := time.LoadLocation(cfg.FreezeTimezone)
+	if err != nil {
+		return false, "", errorf("invalid freeze_timezone: %w", err)
+	}
+	var windows []freeze.Window
+	for _, fw := range cfg.FreezeWindows {
+		w, err := freeze.ParseWindow(fw, loc)
+		if err != nil {
+			return false, "", errorf("invalid freeze_window: %w", err)
+		}
+		windows = append(windows, w)
+	}
+
+	files, err := workdir.ReadTree("origin/"+cfg.PRTargetBranch, git.FreezeFile)
+	if err != nil {
+		return false, "", errorf("failed to read %s: %w", git.FreezeFile, err)
+	}
+	if content, ok := files[git.FreezeFile]; ok {
+		fileWindows, indefinite, err := freeze.ParseFile(string(content), loc)
+		if err != nil {
+			return false, "", errorf("invalid %s: %w", git.FreezeFile, err)
+		}
+		if indefinite {
+			return true, fmt.Sprintf("%s present in %s", git.FreezeFile, cfg.PRTargetBranch), nil
+		}
+		windows = append(windows, fileWindows...)
+	}
+
+	if w, ok := freeze.Active(windows, time.Now()); ok {
+		return true, "freeze window " + w.String(), nil
+	}
+	return false, "", nil
+}
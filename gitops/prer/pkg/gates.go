@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/policy"
+	"github.com/fasterci/rules_gitops/gitops/schema"
+)
+
+// gates are the validations changed files of a release train have to pass before commit
+type gates struct {
+	conftest    *policy.Conftest
+	kubeconform *schema.Kubeconform
+	// placeholders are the allowed placeholders, nil if placeholders are not checked
+	placeholders []*regexp.Regexp
+}
+
+func newGates(cfg *Config) *gates {
+	g := &gates{}
+	if cfg.PolicyPath != "" {
+		g.conftest = &policy.Conftest{Binary: cfg.Conftest, Policy: cfg.PolicyPath}
+	}
+	if cfg.CheckPlaceholders {
+		// the expressions are validated with the Config
+		g.placeholders, _ = compilePlaceholderAllowlist(cfg.AllowedPlaceholders)
+	}
+	if cfg.ValidateSchemas {
+		g.kubeconform = &schema.Kubeconform{Binary: cfg.Kubeconform, CRDSchemas: cfg.CRDSchemas, KubernetesVersion: cfg.KubernetesVersion}
+	}
+	return g
+}
+
+// validate returns an error describing the first failed validation
+func (g *gates) validate(workdir *git.Repo, files []string) error {
+	if g.placeholders != nil {
+		if err := checkPlaceholders(workdir.Dir, files, g.placeholders); err != nil {
+			return err
+		}
+	}
+	if g.kubeconform != nil {
+		if err := checkSchemas(g.kubeconform, workdir, files); err != nil {
+			return err
+		}
+	}
+	if g.conftest != nil {
+		if err := checkPolicies(g.conftest, workdir, files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSchemas validates the changed files against kubernetes and CRD schemas
+func checkSchemas(kubeconform *schema.Kubeconform, workdir *git.Repo, files []string) error {
+	errs, err := kubeconform.Validate(workdir.Dir, files)
+	if err != nil {
+		return err
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.String()
+	}
+	return fmt.Errorf("%d schema validation errors:\n\t%s", len(errs), strings.Join(msgs, "\n\t"))
+}
+
+// checkPolicies evaluates the conftest policies against the changed files
+func checkPolicies(conftest *policy.Conftest, workdir *git.Repo, files []string) error {
+	violations, err := conftest.Check(workdir.Dir, files)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	return &policyError{violations: violations}
+}
+
+// policyError is the error of a release train violating conftest policies
+type policyError struct {
+	violations []policy.Violation
+}
+
+func (e *policyError) Error() string {
+	msgs := make([]string, len(e.violations))
+	for i, v := range e.violations {
+		msgs[i] = v.String()
+	}
+	return fmt.Sprintf("%d policy violations:\n\t%s", len(e.violations), strings.Join(msgs, "\n\t"))
+}
+
+// commentViolations comments the policy violations of err on the open PR of the release train branch,
+// so its reviewers see why the PR is not updated. Failures to comment are logged, the train fails anyway.
+func commentViolations(branch string, err error, cfg *Config) {
+	var pe *policyError
+	if !errors.As(err, &pe) || cfg.DryRun {
+		return
+	}
+	server, err := gitServer(cfg)
+	if err != nil {
+		log.Printf("WARNING: unable to comment the policy violations of %s: %v", branch, err)
+		return
+	}
+	cs, ok := server.(git.CommentServer)
+	if !ok {
+		return
+	}
+	pr, err := cs.FindOpenPR(prHead(branch, cfg), cfg.PRTargetBranch)
+	if err != nil || pr == nil {
+		if err != nil {
+			log.Printf("WARNING: unable to comment the policy violations of %s: %v", branch, err)
+		}
+		return
+	}
+	comment := fmt.Sprintf("Commit %s of %s violates %d policies, this PR was not updated:\n", cfg.GitCommit, cfg.BranchName, len(pe.violations))
+	for _, v := range pe.violations {
+		comment += fmt.Sprintf("\n- `%s`: %s", v.File, v.Message)
+	}
+	if err := cs.CommentPR(pr, comment); err != nil {
+		log.Printf("WARNING: unable to comment the policy violations of %s on %s: %v", branch, pr.URL, err)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"log"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/git/gerrit"
+	"github.com/fasterci/rules_gitops/gitops/hooks"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+)
+
+// pushChanges submits every updated deployment branch as a Gerrit change into --gitops_pr_into instead of
+// pushing the branch and opening a PR. The Change-Id derives from the idempotency key of the branch.
+func pushChanges(workdir *git.Repo, branches []string, resources map[string]affected, cfg *Config) error {
+	branches, err := orderBranches(branches, cfg)
+	if err != nil {
+		return err
+	}
+	remote := workdir.PushRemote
+	if remote == "" {
+		remote = "origin"
+	}
+	keys := jiraKeys(cfg)
+	for _, branch := range branches {
+		policy := reviewPolicy(trainOfBranch(branch, cfg), cfg)
+		if cfg.AffectedLabels {
+			policy.Labels = appendUnique(policy.Labels, resources[branch].labels()...)
+		}
+		changeID := gerrit.ChangeID(idempotencyKey(branch, cfg))
+		if err := gerrit.PushChange(workdir.Dir, remote, branch, cfg.PRTargetBranch, changeID, policy); err != nil {
+			return errorf("failed to push change: %w", err)
+		}
+		metrics.Add(metricPushes, 1, "kind", "branch")
+		log.Printf("Release train %s submitted as change %s", trainOfBranch(branch, cfg), changeID)
+		if err := cfg.runHooks(hooks.PostPR, hooks.Env{Branch: branch, Commit: cfg.GitCommit}); err != nil {
+			return phaseError(err)
+		}
+	}
+	transitionJira(keys, cfg)
+	return nil
+}
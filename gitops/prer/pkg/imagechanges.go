@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/audit"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// imageChange is an image repository whose references are changed by a release train.
+// Old and New are the tags and digests of the repository before and after the change, empty if the image is added or removed.
+type imageChange struct {
+	Repository string
+	Old        []string
+	New        []string
+}
+
+// imageChanges compares the images of the changed files of the deployment repository with the images
+// of the same files at base, the target branch of the PR. Repositories with unchanged references are omitted.
+func imageChanges(workdir *git.Repo, files []string, base string) ([]imageChange, error) {
+	current, err := changedImages(workdir, files)
+	if err != nil {
+		return nil, err
+	}
+	var previous []audit.Image
+	for _, f := range files {
+		// added files and directories are missing at base and have no previous images
+		contents, err := workdir.ReadTree(base, f)
+		if err != nil {
+			return nil, err
+		}
+		for name, content := range contents {
+			if isManifest(name) {
+				previous = append(previous, audit.ParseImages(content)...)
+			}
+		}
+	}
+	return diffImages(previous, current), nil
+}
+
+// diffImages returns the repositories whose references differ between old and new, sorted by repository
+func diffImages(old, new []audit.Image) []imageChange {
+	refs := func(images []audit.Image) map[string][]string {
+		m := make(map[string][]string)
+		for _, img := range images {
+			repo, ref := splitImage(img)
+			m[repo] = appendUnique(m[repo], ref)
+		}
+		for _, r := range m {
+			sort.Strings(r)
+		}
+		return m
+	}
+	oldRefs, newRefs := refs(old), refs(new)
+	var repos []string
+	for repo := range oldRefs {
+		repos = append(repos, repo)
+	}
+	for repo := range newRefs {
+		if _, ok := oldRefs[repo]; !ok {
+			repos = append(repos, repo)
+		}
+	}
+	sort.Strings(repos)
+	var changes []imageChange
+	for _, repo := range repos {
+		if strings.Join(oldRefs[repo], " ") == strings.Join(newRefs[repo], " ") {
+			continue
+		}
+		changes = append(changes, imageChange{Repository: repo, Old: oldRefs[repo], New: newRefs[repo]})
+	}
+	return changes
+}
+
+// splitImage splits the image into the repository and the reference, the tag and digest, e.g. v1@sha256:...
+// Images without tag and digest reference the latest tag.
+func splitImage(img audit.Image) (string, string) {
+	repo, tag := img.Name, ""
+	if i := strings.LastIndexByte(repo, ':'); i > strings.LastIndexByte(repo, '/') {
+		repo, tag = repo[:i], repo[i+1:]
+	}
+	switch {
+	case img.Digest == "" && tag == "":
+		return repo, "latest"
+	case img.Digest == "":
+		return repo, tag
+	case tag == "":
+		return repo, img.Digest
+	default:
+		return repo, tag + "@" + img.Digest
+	}
+}
+
+// mergeImageChanges returns the changes of both, changes of the same repository are merged
+func mergeImageChanges(a, b []imageChange) []imageChange {
+	merged := append([]imageChange{}, a...)
+	for _, c := range b {
+		found := false
+		for i := range merged {
+			if merged[i].Repository == c.Repository {
+				merged[i].Old = appendUnique(append([]string{}, merged[i].Old...), c.Old...)
+				merged[i].New = appendUnique(append([]string{}, merged[i].New...), c.New...)
+				found = true
+			}
+		}
+		if !found {
+			merged = append(merged, c)
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Repository < merged[j].Repository })
+	return merged
+}
+
+// imageTable returns the Markdown PR body section with a table of the image changes, empty if there are none
+func imageTable(changes []imageChange) string {
+	if len(changes) == 0 {
+		return ""
+	}
+	cell := func(refs []string) string {
+		if len(refs) == 0 {
+			return "_none_"
+		}
+		return "`" + strings.Join(refs, "`<br>`") + "`"
+	}
+	var b strings.Builder
+	b.WriteString("### Image changes\n\n| Image | Current | New |\n| --- | --- | --- |\n")
+	for _, c := range changes {
+		fmt.Fprintf(&b, "| `%s` | %s | %s |\n", c.Repository, cell(c.Old), cell(c.New))
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
@@ -0,0 +1,280 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// renderState is the --render_state file. It records the inputs and outputs of rendered
+// targets, so later runs skip gitops binaries whose inputs and outputs have not changed.
+type renderState struct {
+	// Targets are keyed by the target and its render arguments
+	Targets map[string]targetState `json:"targets"`
+	// Files memoizes content hashes of runfiles by their size and modification time
+	Files map[string]fileDigest `json:"files"`
+}
+
+// targetState is the content digest of the gitops binary with its runfiles and the hashes of the files it wrote
+type targetState struct {
+	Inputs  string            `json:"inputs"`
+	Outputs map[string]string `json:"outputs"`
+}
+
+type fileDigest struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+}
+
+func newRenderState() *renderState {
+	return &renderState{Targets: make(map[string]targetState), Files: make(map[string]fileDigest)}
+}
+
+// readRenderState reads the render state file, an empty state if it does not exist
+func readRenderState(path string) (*renderState, error) {
+	state := newRenderState()
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, state); err != nil {
+			// a corrupt state only costs a full render
+			log.Printf("WARNING: ignoring invalid render state %s: %v", path, err)
+			return newRenderState(), nil
+		}
+	}
+	return state, nil
+}
+
+// startRenders resets the render cache of the run and loads --render_state, if set
+func startRenders(cfg *Config) error {
+	cfg.renders = newRenderCache(cfg.GitOpsTmpDir)
+	if cfg.RenderState == "" {
+		return nil
+	}
+	// concurrent runs on the agent may share the state, it is locked while it is read or written
+	if err := os.MkdirAll(filepath.Dir(cfg.RenderState), 0755); err != nil {
+		return errorf("failed to create render state directory: %w", err)
+	}
+	lock, err := lockFile(cfg.RenderState+".lock", false)
+	if err != nil {
+		return errorf("failed to lock render state: %w", err)
+	}
+	state, err := readRenderState(cfg.RenderState)
+	lock.unlock()
+	if err != nil {
+		return errorf("failed to read render state: %w", err)
+	}
+	cfg.renders.state = state
+	cfg.renders.recorded = newRenderState()
+	cfg.renders.statePath = cfg.RenderState
+	if cfg.ExecutionLog != "" {
+		if cfg.renders.bazelDigests, err = readExecutionLog(cfg.ExecutionLog); err != nil {
+			return errorf("failed to read execution log: %w", err)
+		}
+	}
+	return nil
+}
+
+// saveState merges the targets and files recorded by the run into --render_state, keeping the entries
+// saved by concurrent runs since the state was loaded. A failure is logged as it only costs a full render next time.
+func (c *renderCache) saveState() {
+	if c == nil || c.state == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lock, err := lockFile(c.statePath+".lock", true)
+	if err != nil {
+		log.Printf("WARNING: unable to save render state %s: %v", c.statePath, err)
+		return
+	}
+	defer lock.unlock()
+	state, err := readRenderState(c.statePath)
+	if err != nil {
+		state = c.state
+	}
+	for k, v := range c.recorded.Targets {
+		state.Targets[k] = v
+	}
+	for k, v := range c.recorded.Files {
+		state.Files[k] = v
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		// the state is replaced atomically, runs loading it without the lock never read a partial state
+		tmp := c.statePath + ".tmp"
+		if err = os.WriteFile(tmp, b, 0644); err == nil {
+			err = os.Rename(tmp, c.statePath)
+		}
+	}
+	if err != nil {
+		log.Printf("WARNING: unable to save render state %s: %v", c.statePath, err)
+	}
+}
+
+// inputDigest returns the content digest of the gitops binary bin, its runfiles and args.
+// It returns an empty digest if --render_state is not set or the binary has no runfiles tree.
+func (c *renderCache) inputDigest(bin string, args []string) string {
+	if c == nil || c.state == nil {
+		return ""
+	}
+	runfiles := bin + ".runfiles"
+	if fi, err := os.Stat(runfiles); err != nil || !fi.IsDir() {
+		return ""
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%q\n", args)
+	files := map[string]string{".": bin}
+	if err := collectFiles(runfiles, ".runfiles", files); err != nil {
+		log.Printf("WARNING: unable to read runfiles of %s: %v", bin, err)
+		return ""
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum, err := c.fileHash(files[name])
+		if err != nil {
+			log.Printf("WARNING: unable to hash %s: %v", files[name], err)
+			return ""
+		}
+		fmt.Fprintf(h, "%s %s\n", name, sum)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// collectFiles maps names of regular files under dir, following symlinks, to their resolved paths
+func collectFiles(dir, name string, files map[string]string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		path, err := filepath.EvalSymlinks(filepath.Join(dir, e.Name()))
+		if err != nil {
+			// dangling runfiles symlinks are not inputs
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			if err := collectFiles(path, name+"/"+e.Name(), files); err != nil {
+				return err
+			}
+		} else if fi.Mode().IsRegular() {
+			files[name+"/"+e.Name()] = path
+		}
+	}
+	return nil
+}
+
+// fileHash returns the digest of the file recorded by bazel or its sha256, reusing
+// the memoized hash if its size and modification time have not changed
+func (c *renderCache) fileHash(path string) (string, error) {
+	if d, ok := c.bazelDigest(path); ok {
+		return "bazel:" + d, nil
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	d, ok := c.state.Files[path]
+	c.mu.Unlock()
+	if ok && d.Size == fi.Size() && d.ModTime.Equal(fi.ModTime()) {
+		return d.SHA256, nil
+	}
+	sum, err := sha256File(path)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	c.state.Files[path] = fileDigest{Size: fi.Size(), ModTime: fi.ModTime(), SHA256: sum}
+	c.recorded.Files[path] = c.state.Files[path]
+	c.mu.Unlock()
+	return sum, nil
+}
+
+func sha256File(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// unchanged reports whether the target rendered with args was rendered from the same inputs
+// in a previous run and deploymentRoot already contains identical outputs. It returns the output files.
+func (c *renderCache) unchanged(target string, args []string, inputs, deploymentRoot string) ([]string, bool) {
+	if inputs == "" {
+		return nil, false
+	}
+	c.mu.Lock()
+	prev, ok := c.state.Targets[renderKey(target, args)]
+	c.mu.Unlock()
+	if !ok || prev.Inputs != inputs {
+		return nil, false
+	}
+	var files []string
+	for f, sum := range prev.Outputs {
+		if current, err := sha256File(filepath.Join(deploymentRoot, f)); err != nil || current != sum {
+			return nil, false
+		}
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files, true
+}
+
+// recordState records the inputs and the output hashes of the target rendered with args
+func (c *renderCache) recordState(target string, args []string, inputs, deploymentRoot string, files []string) error {
+	if inputs == "" {
+		return nil
+	}
+	outputs := make(map[string]string)
+	for _, f := range files {
+		sum, err := sha256File(filepath.Join(deploymentRoot, f))
+		if err != nil {
+			return err
+		}
+		outputs[f] = sum
+	}
+	c.mu.Lock()
+	c.state.Targets[renderKey(target, args)] = targetState{Inputs: inputs, Outputs: outputs}
+	c.recorded.Targets[renderKey(target, args)] = c.state.Targets[renderKey(target, args)]
+	c.mu.Unlock()
+	return nil
+}
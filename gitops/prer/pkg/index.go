@@ -0,0 +1,82 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/ghodss/yaml"
+)
+
+// ownershipIndex maps the gitops targets of a deployment branch to the files they own.
+// It is committed with every deployment of the release train to the --ownership_index of the train.
+type ownershipIndex struct {
+	Train        string              `json:"train"`
+	SourceCommit string              `json:"source_commit,omitempty"`
+	Targets      map[string][]string `json:"targets"`
+}
+
+// writeOwnershipIndex replaces the ownership index of the deployment branch with the files written
+// by the targets of the train and stages it. It returns the index path relative to the repository root.
+func writeOwnershipIndex(workdir *git.Repo, train string, targets []string, rendered targetFiles, cfg *Config) (string, error) {
+	index := ownershipIndex{Train: train, SourceCommit: cfg.GitCommit, Targets: make(map[string][]string)}
+	for _, t := range targets {
+		files := append([]string{}, rendered[t]...)
+		sort.Strings(files)
+		index.Targets[t] = files
+	}
+	b, err := yaml.Marshal(index)
+	if err != nil {
+		return "", err
+	}
+	indexPath := ownershipIndexPath(train, cfg)
+	path := filepath.Join(workdir.Dir, indexPath)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return "", err
+	}
+	return indexPath, workdir.Add(indexPath)
+}
+
+// ownershipIndexPath returns the ownership index file of the release train relative to the repository root.
+// Every train has its own file, so PRs of different trains never conflict on it.
+func ownershipIndexPath(train string, cfg *Config) string {
+	return strings.NewReplacer("{gitops_path}", cfg.GitOpsPath, "{train}", train).Replace(cfg.OwnershipIndex)
+}
+
+// readOwnershipIndex returns the ownership index of the release train at ref, nil if there is none
+func readOwnershipIndex(workdir *git.Repo, ref, train string, cfg *Config) (*ownershipIndex, error) {
+	if cfg.OwnershipIndex == "" {
+		return nil, nil
+	}
+	indexPath := ownershipIndexPath(train, cfg)
+	files, err := workdir.ReadTree(ref, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := files[filepath.ToSlash(indexPath)]
+	if !ok {
+		return nil, nil
+	}
+	var index ownershipIndex
+	if err := yaml.Unmarshal(b, &index); err != nil {
+		return nil, fmt.Errorf("invalid ownership index %s at %s: %w", indexPath, ref, err)
+	}
+	return &index, nil
+}
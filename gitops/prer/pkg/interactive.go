@@ -0,0 +1,53 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// stdin is shared by all prompts, so buffered answers are not lost between them
+var stdin = bufio.NewReader(os.Stdin)
+
+// confirmTrain prints the changes of the release train and asks to confirm deploying them.
+// Answering d prints the full diff before asking again. Only confirmed trains are committed,
+// pushed and get PRs.
+func confirmTrain(workdir *git.Repo, train, branch string, in *bufio.Reader, out io.Writer, cfg *Config) (bool, error) {
+	stat, err := workdir.StagedDiff(cfg.GitOpsPath, true)
+	if err != nil {
+		return false, errorf("failed to get changes of %s: %w", train, err)
+	}
+	fmt.Fprintf(out, "\nRelease train %s, branch %s:\n%s", train, branch, stat)
+	for {
+		fmt.Fprintf(out, "Deploy release train %s? [y/N/d] ", train)
+		answer, err := in.ReadString('\n')
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y", "yes":
+			return true, nil
+		case "d", "diff":
+			diff, derr := workdir.StagedDiff(cfg.GitOpsPath, false)
+			if derr != nil {
+				return false, errorf("failed to get changes of %s: %w", train, derr)
+			}
+			fmt.Fprint(out, diff)
+			if err == nil {
+				continue
+			}
+		}
+		return false, nil
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"log"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/jira"
+)
+
+// jiraKeys returns Jira tickets referenced by the source branch name and commit message
+func jiraKeys(cfg *Config) []string {
+	if cfg.JiraURL == "" {
+		return nil
+	}
+	var msg string
+	if cfg.GitCommit != "unknown" {
+		var err error
+		if msg, err = exec.Ex("", "git", "log", "-1", "--format=%B", cfg.GitCommit); err != nil {
+			log.Printf("WARNING: unable to read message of commit %s: %v", cfg.GitCommit, err)
+		}
+	}
+	keys := jira.Keys(cfg.JiraProjects, cfg.BranchName, msg)
+	log.Printf("Jira tickets: %v", keys)
+	return keys
+}
+
+// transitionJira moves the tickets to --jira_transition. Failures are reported but do not fail the run.
+func transitionJira(keys []string, cfg *Config) {
+	if cfg.JiraTransition == "" || cfg.DryRun {
+		return
+	}
+	c := &jira.Client{URL: cfg.JiraURL, User: cfg.JiraUser, Token: cfg.JiraToken}
+	for _, key := range keys {
+		if err := c.Transition(key, cfg.JiraTransition); err != nil {
+			log.Printf("WARNING: unable to transition %s to %s: %v", key, cfg.JiraTransition, err)
+			continue
+		}
+		log.Printf("Transitioned %s to %s", key, cfg.JiraTransition)
+	}
+}
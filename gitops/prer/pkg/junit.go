@@ -0,0 +1,103 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+// junitSuites is the JUnit XML report of a run, with a test case per release train
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name      string      `xml:"name,attr"`
+	Tests     int         `xml:"tests,attr"`
+	Failures  int         `xml:"failures,attr"`
+	Time      string      `xml:"time,attr"`
+	Timestamp string      `xml:"timestamp,attr"`
+	Cases     []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitReport returns the report of the release trains of a run that ended with err.
+// failures are the trains that failed on their own, a failure stopping the run fails all other
+// trains as none of them is deployed.
+func junitReport(trains []string, failures TrainErrors, err error, start time.Time) junitSuites {
+	failed := make(map[string]*PhaseError)
+	for _, f := range failures {
+		failed[f.Train] = f
+	}
+	var stopped *PhaseError
+	var trainErrs TrainErrors
+	if err != nil && !errors.Is(err, errNoChanges) && !errors.Is(err, errFrozen) && !errors.As(err, &trainErrs) {
+		stopped = phaseError(err)
+	}
+
+	names := append([]string{}, trains...)
+	sort.Strings(names)
+	suite := junitSuite{
+		Name:      "create_gitops_prs",
+		Tests:     len(names),
+		Time:      fmt.Sprintf("%.3f", time.Since(start).Seconds()),
+		Timestamp: start.UTC().Format(time.RFC3339),
+	}
+	for _, train := range names {
+		c := junitCase{Name: train, Classname: "gitops"}
+		pe := failed[train]
+		if pe == nil {
+			pe = stopped
+		}
+		if pe != nil {
+			msg := redact.String(pe.Err.Error())
+			c.Failure = &junitFailure{Message: msg, Type: pe.Phase, Text: redact.String(pe.Error())}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, c)
+	}
+	return junitSuites{Suites: []junitSuite{suite}}
+}
+
+// saveJUnitReport writes the JUnit XML report of the run to --junit_report
+func saveJUnitReport(trains []string, failures TrainErrors, err error, start time.Time, cfg *Config) {
+	if cfg.JUnitReport == "" {
+		return
+	}
+	b, xmlErr := xml.MarshalIndent(junitReport(trains, failures, err, start), "", "  ")
+	if xmlErr == nil {
+		xmlErr = os.WriteFile(cfg.JUnitReport, append([]byte(xml.Header), append(b, '\n')...), 0644)
+	}
+	if xmlErr != nil {
+		log.Printf("WARNING: unable to save the JUnit report: %v", xmlErr)
+	}
+}
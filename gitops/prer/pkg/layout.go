@@ -0,0 +1,96 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// targetPackage returns the package and the name of a gitops target label, or of the
+// executable path of a --resolved_binary
+func targetPackage(target string) (pkg, name string) {
+	if label, ok := strings.CutPrefix(target, "//"); ok {
+		pkg, name, _ = strings.Cut(label, ":")
+		return pkg, name
+	}
+	return filepath.Dir(target), filepath.Base(target)
+}
+
+// layoutPath returns the --deployment_layout directory of the target of the release train.
+// dest is the --gitops_path directory of the train or of its cluster or environment variant.
+func layoutPath(train, target, dest string, cfg *Config) string {
+	pkg, name := targetPackage(target)
+	return filepath.Clean(strings.NewReplacer("{gitops_path}", dest, "{train}", train, "{package}", pkg, "{name}", name).Replace(cfg.DeploymentLayout))
+}
+
+// moveFile moves the file src to dst, creating the directory of dst
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// renderLayout renders every target with args into its own root under scratch, as targets commonly
+// write the same file names, and moves the --gitops_path manifests of the target to its
+// --deployment_layout directory within dest under deploymentRoot. It returns the moved files of every target.
+func renderLayout(train string, targets []string, scratch, deploymentRoot, dest string, args []string, cfg *Config) (targetFiles, error) {
+	roots := make(map[string]string, len(targets))
+	for i, target := range targets {
+		roots[target] = filepath.Join(scratch, strconv.Itoa(i))
+		if err := os.MkdirAll(roots[target], 0755); err != nil {
+			return nil, errorf("failed to create temp directory: %w", err)
+		}
+	}
+	var mu sync.Mutex
+	rendered := make(targetFiles)
+	err := runParallel(targets, cfg.RenderParallelism, func(target string) error {
+		files, err := renderTargets([]string{target}, roots[target], cfg, args...)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		rendered.merge(files)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	written := make(targetFiles)
+	for _, target := range targets {
+		targetDest := layoutPath(train, target, dest, cfg)
+		written[target] = nil
+		for _, f := range rendered[target] {
+			rel, err := filepath.Rel(cfg.GitOpsPath, f)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if err := moveFile(filepath.Join(roots[target], f), filepath.Join(deploymentRoot, targetDest, rel)); err != nil {
+				return nil, errorf("failed to write manifests of %s to %s: %w", target, targetDest, err)
+			}
+			written.add(target, filepath.Join(targetDest, rel))
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,62 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// trainInfo describes a release train found by the discovery query
+type trainInfo struct {
+	Train   string   `json:"train"`
+	Branch  string   `json:"branch"`
+	Targets []string `json:"targets"`
+}
+
+// listTrains prints release trains, their deployment branches and targets in --list_format
+func listTrains(cfg *Config) error {
+	trains, err := findTrains(cfg)
+	if err != nil {
+		return err
+	}
+	list := []trainInfo{}
+	for train, targets := range trains {
+		targets = append([]string{}, targets...)
+		sort.Strings(targets)
+		list = append(list, trainInfo{Train: train, Branch: trainBranch(train, cfg), Targets: targets})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Train < list[j].Train
+	})
+
+	if cfg.ListFormat == "table" {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TRAIN\tBRANCH\tTARGETS")
+		for _, t := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", t.Train, t.Branch, strings.Join(t.Targets, ","))
+		}
+		if err := w.Flush(); err != nil {
+			return errorf("failed to write trains: %w", err)
+		}
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(list); err != nil {
+		return errorf("failed to write trains: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+)
+
+const (
+	metricPhaseDuration = "prer_phase_duration_seconds"
+	metricChangedFiles  = "prer_changed_files_total"
+	metricPushes        = "prer_pushes_total"
+	metricRuns          = "prer_runs_total"
+	metricRunDuration   = "prer_run_duration_seconds"
+)
+
+// phaseOrder is the order phases are listed in the run summary
+var phaseOrder = []string{PhaseDiscovery, PhaseClone, PhaseRender, PhaseValidate, PhaseCommit, PhaseFreeze, PhasePush, PhasePR}
+
+func init() {
+	metrics.Describe(metricPhaseDuration, "Duration of run phases")
+	metrics.Describe(metricChangedFiles, "Files changed by release trains")
+	metrics.Describe(metricPushes, "Pushed deployment branches and images")
+	metrics.Describe(metricRuns, "Pipeline runs of the serve command by result")
+	metrics.Describe(metricRunDuration, "Duration of pipeline runs of the serve command")
+}
+
+// endPhase records the duration of the current phase once
+func endPhase() {
+	if progress.phase != "" && !progress.started.IsZero() {
+		metrics.Observe(metricPhaseDuration, time.Since(progress.started).Seconds(), "phase", progress.phase)
+	}
+	progress.started = time.Time{}
+}
+
+// metricsSummary returns phase durations, changed files, pushes and API retries of the run
+func metricsSummary() string {
+	var phases []string
+	for _, phase := range phaseOrder {
+		if sum, count := metrics.Default.Sum(metricPhaseDuration, "phase", phase); count > 0 {
+			phases = append(phases, fmt.Sprintf("%s %s", phase, time.Duration(sum*float64(time.Second)).Round(time.Millisecond)))
+		}
+	}
+	var changed []string
+	for _, train := range metrics.Default.Labels(metricChangedFiles, "train") {
+		changed = append(changed, fmt.Sprintf("%s %.0f", train, metrics.Default.Counter(metricChangedFiles, "train", train)))
+	}
+	var retries float64
+	for _, server := range metrics.Default.Labels(metrics.APIRetries, "server") {
+		retries += metrics.Default.Counter(metrics.APIRetries, "server", server)
+	}
+	return fmt.Sprintf("phases: %s; changed files: %s; pushed %.0f branches and %.0f images; %.0f API retries",
+		orNone(phases), orNone(changed),
+		metrics.Default.Counter(metricPushes, "kind", "branch"), metrics.Default.Counter(metricPushes, "kind", "image"), retries)
+}
+
+// setupStatsD sends metrics to the DogStatsD agent if --statsd_host is set and returns the
+// function closing the connection. Metrics are best effort and never fail the run.
+func setupStatsD(cfg *Config) func() {
+	if cfg.StatsDHost == "" {
+		return func() {}
+	}
+	d, err := metrics.NewDogStatsD(cfg.StatsDHost, cfg.StatsDPort, cfg.StatsDTags)
+	if err != nil {
+		log.Printf("WARNING: %v", err)
+		return func() {}
+	}
+	metrics.Default.AddSink(d)
+	return func() {
+		endPhase()
+		d.Close()
+	}
+}
+
+// statsdArgs returns the DogStatsD flags of cfg passed to runs started by the serve command
+func statsdArgs(cfg *Config) []string {
+	if cfg.StatsDHost == "" {
+		return nil
+	}
+	args := []string{"--statsd_host", cfg.StatsDHost, "--statsd_port", strconv.Itoa(cfg.StatsDPort)}
+	for _, tag := range cfg.StatsDTags {
+		args = append(args, "--statsd_tag", tag)
+	}
+	return args
+}
+
+// saveMetrics writes the metrics of the run to --metrics_file
+func saveMetrics(cfg *Config) {
+	if cfg.MetricsFile == "" {
+		return
+	}
+	endPhase()
+	if err := metrics.Default.Save(cfg.MetricsFile); err != nil {
+		log.Printf("WARNING: unable to save metrics: %v", err)
+	}
+}
+
+func orNone(values []string) string {
+	if len(values) == 0 {
+		return "none"
+	}
+	return strings.Join(values, ", ")
+}
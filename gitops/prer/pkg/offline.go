@@ -0,0 +1,226 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+)
+
+// PRManifest lists the PRs to create, written by offline runs and published by the publish-prs command
+type PRManifest struct {
+	// GitRepo is the repository the PRs are created in
+	GitRepo string       `json:"git_repo"`
+	PRs     []ManifestPR `json:"prs"`
+}
+
+// ManifestPR is a PR to create from a deployment branch pushed to the git mirror
+type ManifestPR struct {
+	Branch         string   `json:"branch"`
+	Into           string   `json:"into"`
+	Title          string   `json:"title"`
+	Body           string   `json:"body"`
+	Reviewers      []string `json:"reviewers,omitempty"`
+	TeamReviewers  []string `json:"team_reviewers,omitempty"`
+	AutoMerge      bool     `json:"auto_merge,omitempty"`
+	Labels         []string `json:"labels,omitempty"`
+	Assignees      []string `json:"assignees,omitempty"`
+	IdempotencyKey string   `json:"idempotency_key"`
+}
+
+// readPRManifest reads the manifest, an empty manifest of gitRepo if the file does not exist
+func readPRManifest(path, gitRepo string) (*PRManifest, error) {
+	m := &PRManifest{GitRepo: gitRepo}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("invalid PR manifest %s: %w", path, err)
+	}
+	return m, nil
+}
+
+// write replaces the manifest file atomically, so a consumer never reads a partial manifest
+func (m *PRManifest) write(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lockPRManifest locks the lock file of the manifest, shared while it is read and exclusive while it is updated
+func lockPRManifest(path string, exclusive bool) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return lockFile(path+".lock", exclusive)
+}
+
+// offlineServer records PRs in the manifest instead of calling the git server API.
+// PRs of a branch already in the manifest replace the recorded one. With a bundle directory
+// every branch has its own manifest next to its bundle.
+type offlineServer struct {
+	path      string
+	bundleDir string
+	gitRepo   string
+}
+
+// manifest returns the path of the manifest recording the PR of the branch
+func (s *offlineServer) manifest(branch string) (string, error) {
+	if s.bundleDir != "" {
+		return bundleFile(s.bundleDir, branch, ".json")
+	}
+	return s.path, nil
+}
+
+func (s *offlineServer) CreatePR(from, to, title, body string) error {
+	return s.CreatePRWithPolicy(from, to, title, body, git.ReviewPolicy{})
+}
+
+func (s *offlineServer) CreatePRWithPolicy(from, to, title, body string, policy git.ReviewPolicy) error {
+	path, err := s.manifest(from)
+	if err != nil {
+		return err
+	}
+	// concurrent offline runs record their PRs in the same manifest
+	lock, err := lockPRManifest(path, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	m, err := readPRManifest(path, s.gitRepo)
+	if err != nil {
+		return err
+	}
+	// the key is recorded separately, publish-prs adds the marker again
+	key := git.MarkerKey(body)
+	pr := ManifestPR{
+		Branch:         from,
+		Into:           to,
+		Title:          title,
+		Body:           strings.TrimSuffix(body, "\n\n"+git.Marker(key)),
+		Reviewers:      policy.Reviewers,
+		TeamReviewers:  policy.TeamReviewers,
+		AutoMerge:      policy.AutoMerge,
+		Labels:         policy.Labels,
+		Assignees:      policy.Assignees,
+		IdempotencyKey: key,
+	}
+	replaced := false
+	for i := range m.PRs {
+		if m.PRs[i].Branch == from && m.PRs[i].Into == to {
+			m.PRs[i], replaced = pr, true
+		}
+	}
+	if !replaced {
+		m.PRs = append(m.PRs, pr)
+	}
+	if err := m.write(path); err != nil {
+		return err
+	}
+	log.Printf("Recorded PR from %s into %s in %s", from, to, path)
+	return nil
+}
+
+// publishPRs pushes the deployment branches of the PR manifest from the git mirror, or of the
+// bundles in --bundle_dir, to --git_repo and creates their PRs. It is the network connected
+// counterpart of offline runs.
+func publishPRs(cfg *Config) error {
+	var prs []ManifestPR
+	source := cfg.PRManifest
+	if cfg.BundleDir != "" {
+		var err error
+		if prs, err = readBundlePRs(cfg); err != nil {
+			return errorf("%w", err)
+		}
+		source = cfg.BundleDir
+	} else {
+		lock, err := lockPRManifest(cfg.PRManifest, false)
+		if err != nil {
+			return errorf("%w", err)
+		}
+		m, err := readPRManifest(cfg.PRManifest, cfg.GitRepo)
+		lock.unlock()
+		if err != nil {
+			return errorf("%w", err)
+		}
+		if m.GitRepo != cfg.GitRepo {
+			return errorf("PR manifest %s is for %s, not git_repo %s", cfg.PRManifest, m.GitRepo, cfg.GitRepo)
+		}
+		prs = m.PRs
+	}
+	if len(prs) == 0 {
+		log.Printf("No PRs to publish in %s", source)
+		return noChanges(cfg)
+	}
+	if cfg.DryRun {
+		for _, pr := range prs {
+			log.Printf("Dry run: would push %s and create a PR into %s", pr.Branch, pr.Into)
+		}
+		return nil
+	}
+
+	setPhase("", PhasePush)
+	if cfg.BundleDir != "" {
+		if err := pushBundles(prs, cfg); err != nil {
+			return errorf("%w", err)
+		}
+	} else {
+		args := []string{"push", "-f", cfg.GitRepo}
+		for _, pr := range prs {
+			args = append(args, "refs/heads/"+pr.Branch+":refs/heads/"+pr.Branch)
+		}
+		unlock, err := lockMirror(cfg.GitMirror, false)
+		if err != nil {
+			return errorf("%w", err)
+		}
+		_, err = exec.Ex(cfg.GitMirror, "git", args...)
+		unlock()
+		if err != nil {
+			return errorf("failed to push deployment branches from %s: %w", cfg.GitMirror, err)
+		}
+	}
+	metrics.Add(metricPushes, float64(len(prs)), "kind", "branch")
+
+	setPhase("", PhasePR)
+	server, err := gitServer(cfg)
+	if err != nil {
+		return err
+	}
+	for _, pr := range prs {
+		policy := git.ReviewPolicy{Reviewers: pr.Reviewers, TeamReviewers: pr.TeamReviewers, AutoMerge: pr.AutoMerge, Labels: pr.Labels, Assignees: pr.Assignees}
+		if err := git.CreatePRIdempotent(server, pr.Branch, pr.Into, pr.Title, pr.Body, policy, pr.IdempotencyKey); err != nil {
+			return errorf("failed to create PR for branch %s: %w", pr.Branch, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+	"github.com/fasterci/rules_gitops/gitops/operator"
+	"github.com/fasterci/rules_gitops/gitops/serve"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// executeRun clones the run source repository and runs create_gitops_prs for it in a separate process
+func executeRun(cfg *Config) operator.Runner {
+	return func(ctx context.Context, run *operator.GitOpsRun, env []string) error {
+		dir, err := os.MkdirTemp(cfg.GitOpsTmpDir, "gitopsrun")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		workspace := filepath.Join(dir, "src")
+		if _, err := exec.Ex("", "git", "clone", run.Spec.Repo, workspace); err != nil {
+			return fmt.Errorf("unable to clone %s: %w", run.Spec.Repo, err)
+		}
+		if _, err := exec.Ex(workspace, "git", "checkout", "-f", run.Spec.Revision); err != nil {
+			return fmt.Errorf("unable to checkout %s: %w", run.Spec.Revision, err)
+		}
+		commit, err := exec.Ex(workspace, "git", "rev-parse", "HEAD")
+		if err != nil {
+			return err
+		}
+		args := append([]string{}, run.Spec.Args...)
+		if run.Spec.ReleaseBranch != "" {
+			args = append(args, "--release_branch", run.Spec.ReleaseBranch)
+		}
+		if run.Spec.Targets != "" {
+			args = append(args, "--targets", run.Spec.Targets)
+		}
+		args = append(args, "--workspace", workspace, "--branch_name", run.Spec.Revision, "--git_commit", strings.TrimSpace(commit))
+		cmd := osexec.CommandContext(ctx, os.Args[0], args...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Stdout = os.Stderr
+		cmd.Stderr = os.Stderr
+		return childError(cmd.Run())
+	}
+}
+
+// operatorStatus reports runs executed by the controller in the format of the serve command.
+// The operator is ready once it listed GitOpsRun resources.
+func operatorStatus(c *operator.Controller) serve.StatusFunc {
+	return func(n int) serve.Status {
+		st := serve.Status{Ready: true, Counts: make(map[string]int), Runs: []serve.Run{}}
+		if err := c.Ready(); err != nil {
+			st.Ready, st.Reason = false, err.Error()
+		}
+		for i, r := range c.Recent(math.MaxInt) {
+			run := serve.Run{
+				Trigger: serve.Trigger{
+					ID:       r.Namespace + "/" + r.Name,
+					Pipeline: r.Name,
+					Branch:   r.ReleaseBranch,
+					Commit:   r.Revision,
+					Source:   "operator",
+				},
+				State:    strings.ToLower(r.Phase),
+				Error:    r.Message,
+				Queued:   r.Started,
+				Finished: r.Finished,
+			}
+			if !r.Started.IsZero() {
+				started := r.Started
+				run.Started = &started
+			}
+			st.Counts[run.State]++
+			if i < n {
+				st.Runs = append(st.Runs, run)
+			}
+		}
+		return st
+	}
+}
+
+// runOperator executes GitOpsRun custom resources of the cluster
+func runOperator(cfg *Config) error {
+	config, err := clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
+	if err != nil {
+		return errorf("unable to load kubernetes config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return phaseError(err)
+	}
+	c := &operator.Controller{
+		Store:    &operator.KubeStore{Clientset: clientset, Namespace: cfg.OperatorNamespace},
+		Run:      executeRun(cfg),
+		Interval: cfg.OperatorInterval,
+	}
+	mux := http.NewServeMux()
+	serve.HandleHealth(mux, operatorStatus(c), cfg.StatusRuns)
+	if cfg.ServeMetrics {
+		mux.Handle("/metrics", metrics.Default.Handler())
+	}
+	go func() {
+		log.Printf("ERROR: health endpoints stopped: %v", http.ListenAndServe(cfg.Listen, mux))
+	}()
+	log.Printf("Watching %s in namespace %q", operator.Resource, cfg.OperatorNamespace)
+	c.Start(context.Background())
+	return nil
+}
@@ -0,0 +1,36 @@
+//go:build unix
+
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package prer
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// peakMemory returns the maximum resident set size of the prer and of its largest child process, e.g. a gitops binary, in bytes
+func peakMemory() (self, children uint64) {
+	maxRSS := func(who int) uint64 {
+		var ru syscall.Rusage
+		if err := syscall.Getrusage(who, &ru); err != nil {
+			return 0
+		}
+		// darwin reports bytes, other systems kilobytes
+		if runtime.GOOS == "darwin" {
+			return uint64(ru.Maxrss)
+		}
+		return uint64(ru.Maxrss) * 1024
+	}
+	return maxRSS(syscall.RUSAGE_SELF), maxRSS(syscall.RUSAGE_CHILDREN)
+}
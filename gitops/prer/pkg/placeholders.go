@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// placeholderRe matches template placeholders left in rendered manifests: stamp variables
+// ({BUILD_EMBED_LABEL}, {STABLE_VERSION}), k8s_deploy substitutions ({{variables.ENV}},
+// {{imports.config}}, {{//app:image}}), go template fields ({{.Var}}) and bare STABLE_* stamp keys
+var placeholderRe = regexp.MustCompile(`\{(BUILD|STABLE)_[A-Z0-9_]+\}|\{\{-?\s*(variables\.|imports\.|//|\.)[^{}]*\}\}|\bSTABLE_[A-Z0-9_]+\b`)
+
+// placeholderFinding is an unexpanded placeholder of a rendered file
+type placeholderFinding struct {
+	Path        string
+	Line        int
+	Placeholder string
+}
+
+func (f placeholderFinding) String() string {
+	return fmt.Sprintf("%s:%d: %s", f.Path, f.Line, f.Placeholder)
+}
+
+// findPlaceholders returns unexpanded placeholders of the files in dir not matching any of the allow expressions.
+// Deleted files are skipped.
+func findPlaceholders(dir string, files []string, allow []*regexp.Regexp) ([]placeholderFinding, error) {
+	var findings []placeholderFinding
+	for _, name := range files {
+		f, err := os.Open(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			for _, p := range placeholderRe.FindAllString(scanner.Text(), -1) {
+				if !allowedPlaceholder(p, allow) {
+					findings = append(findings, placeholderFinding{Path: name, Line: line, Placeholder: p})
+				}
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", name, err)
+		}
+	}
+	return findings, nil
+}
+
+func allowedPlaceholder(p string, allow []*regexp.Regexp) bool {
+	for _, re := range allow {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPlaceholders fails if any of the changed files contains an unexpanded placeholder
+func checkPlaceholders(dir string, files []string, allow []*regexp.Regexp) error {
+	findings, err := findPlaceholders(dir, files, allow)
+	if err != nil {
+		return err
+	}
+	if len(findings) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(findings))
+	for i, f := range findings {
+		msgs[i] = f.String()
+	}
+	return fmt.Errorf("%d unexpanded placeholders:\n\t%s", len(findings), strings.Join(msgs, "\n\t"))
+}
+
+// compilePlaceholderAllowlist compiles the --allow_placeholder expressions
+func compilePlaceholderAllowlist(exprs []string) ([]*regexp.Regexp, error) {
+	allow := make([]*regexp.Regexp, len(exprs))
+	for i, expr := range exprs {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allow_placeholder %q: %w", expr, err)
+		}
+		allow[i] = re
+	}
+	return allow, nil
+}
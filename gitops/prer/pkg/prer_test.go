@@ -0,0 +1,1923 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/audit"
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/git/gerrit"
+	"github.com/fasterci/rules_gitops/gitops/hooks"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+	"github.com/fasterci/rules_gitops/gitops/operator"
+	"github.com/fasterci/rules_gitops/gitops/policy"
+	"github.com/fasterci/rules_gitops/gitops/serve"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	if cfg.GitOpsPath != "cloud" || cfg.PushParallelism != 1 || cfg.PRTargetBranch != "" {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+	if want := []string{"k8s_container_push", "push_oci"}; !reflect.DeepEqual(cfg.DependencyKinds, want) {
+		t.Errorf("unexpected dependency kinds %v, want %v", cfg.DependencyKinds, want)
+	}
+	if cfg.Hooks == nil {
+		t.Error("hooks are not set")
+	}
+	if cfg.CheckPlaceholders {
+		t.Error("placeholder check is enabled by default")
+	}
+	if cfg.MaxDiffFiles != 0 || cfg.MaxDiffLines != 0 {
+		t.Errorf("diff limits are enabled by default: %d files, %d lines", cfg.MaxDiffFiles, cfg.MaxDiffLines)
+	}
+}
+
+func TestRegisterFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := RegisterFlags(fs)
+	err := fs.Parse([]string{"--gitops_path=deploy", "--train_clusters=prod=us,eu", "--hook_pre_push=check.sh"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.GitOpsPath != "deploy" {
+		t.Errorf("unexpected gitops path %s", cfg.GitOpsPath)
+	}
+	if want := map[string][]string{"prod": {"us", "eu"}}; !reflect.DeepEqual(cfg.TrainClusters, want) {
+		t.Errorf("unexpected train clusters %v, want %v", cfg.TrainClusters, want)
+	}
+	if h, ok := cfg.Hooks.(hooks.Hooks); !ok || !reflect.DeepEqual(h[hooks.PrePush], []string{"check.sh"}) {
+		t.Errorf("unexpected hooks %v", cfg.Hooks)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	config = RegisterFlags(fs)
+	if err := fs.Parse([]string{"--train_clusters=prod"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config(); err == nil {
+		t.Error("expected invalid train_clusters error")
+	}
+}
+
+func TestResolvedParamsFiles(t *testing.T) {
+	dir := t.TempDir()
+	binaries := filepath.Join(dir, "binaries.params")
+	os.WriteFile(binaries, []byte("prod:app/prod.gitops\n\nprod:web/prod.gitops\n"), 0644)
+	pushes := filepath.Join(dir, "pushes.params")
+	os.WriteFile(pushes, []byte("app/image.push\n"), 0644)
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := RegisterFlags(fs)
+	if err := fs.Parse([]string{"--resolved_binary=dev:app/dev.gitops", "--resolved_binaries_file=" + binaries, "--resolved_pushes_file=" + pushes}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (SliceFlags{"dev:app/dev.gitops", "prod:app/prod.gitops", "prod:web/prod.gitops"}); !reflect.DeepEqual(cfg.ResolvedBinaries, want) {
+		t.Errorf("unexpected resolved binaries %v, want %v", cfg.ResolvedBinaries, want)
+	}
+	if want := (SliceFlags{"app/image.push"}); !reflect.DeepEqual(cfg.ResolvedPushes, want) {
+		t.Errorf("unexpected resolved pushes %v, want %v", cfg.ResolvedPushes, want)
+	}
+
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	config = RegisterFlags(fs)
+	if err := fs.Parse([]string{"--resolved_binaries_file=" + filepath.Join(dir, "missing")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config(); err == nil || !strings.Contains(err.Error(), "failed to read params file") {
+		t.Errorf("config() with a missing params file = %v", err)
+	}
+}
+
+func TestPhaseError(t *testing.T) {
+	setPhase("prod", PhaseRender)
+	defer setPhase("", "")
+	err := fmt.Errorf("run failed: %w", errorf("failed to render %s: %w", "//app:prod", errors.New("exit status 1")))
+	var pe *PhaseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected PhaseError, got %v", err)
+	}
+	if pe.Train != "prod" || pe.Phase != PhaseRender {
+		t.Errorf("unexpected phase error %+v", pe)
+	}
+	if want := "prod render: failed to render //app:prod: exit status 1"; pe.Error() != want {
+		t.Errorf("unexpected message %q, want %q", pe.Error(), want)
+	}
+	if phaseError(err) != pe {
+		t.Error("phaseError wrapped an existing PhaseError")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, ExitSuccess},
+		{errNoChanges, ExitNoChanges},
+		{fmt.Errorf("%w: freeze window Fri 18:00/Mon 08:00", errFrozen), ExitFrozen},
+		{errors.New("unknown"), ExitFailure},
+		{ConfigError{"git_repo must be set"}, ExitConfig},
+		{fmt.Errorf("%w in 1 of 2 release trains", errDrift), ExitDrift},
+		{TrainErrors{{Train: "prod", Phase: PhaseValidate, Err: errors.New("gate failed")}}, ExitTrains},
+		{&PhaseError{Phase: PhaseDiscovery, Err: errors.New("bazel failed")}, ExitDiscovery},
+		{&PhaseError{Train: "prod", Phase: PhaseRender, Err: errors.New("exit status 1")}, ExitRender},
+		{&PhaseError{Phase: PhasePush, Err: errors.New("denied")}, ExitPush},
+		{fmt.Errorf("run: %w", &PhaseError{Phase: PhasePR, Err: errors.New("forbidden")}), ExitProvider},
+		{&PhaseError{Phase: "doctor", Err: errors.New("2 checks failed")}, ExitFailure},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%v) = %d, want %d", tt.err, got, tt.want)
+		}
+	}
+	if noChanges(&Config{}) != nil || noChanges(&Config{DetailedExitCodes: true}) != errNoChanges {
+		t.Error("unexpected noChanges result")
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	var calls int32
+	items := []string{"a", "b", "c", "d"}
+	err := runParallel(items, 2, func(string) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	if err != nil || calls != 4 {
+		t.Errorf("unexpected result %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = runParallel(items, 1, func(item string) error {
+		atomic.AddInt32(&calls, 1)
+		if item == "b" {
+			return errors.New("push failed")
+		}
+		return nil
+	})
+	if err == nil || err.Error() != "push failed" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if calls == 4 {
+		t.Error("items were started after the failure")
+	}
+}
+
+func TestGitServer(t *testing.T) {
+	custom := git.ServerFunc(func(from, to, title, body string) error { return nil })
+	cfg := &Config{GitHost: "unknown", GitServer: custom}
+	if s, err := gitServer(cfg); err != nil || s == nil {
+		t.Errorf("custom server not used: %v", err)
+	}
+	cfg.GitServer = nil
+	if _, err := gitServer(cfg); err == nil {
+		t.Error("expected unsupported git host error")
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	cfg := &Config{}
+	if err := cfg.runHooks(hooks.PrePush, hooks.Env{}); err != nil {
+		t.Errorf("unexpected error without hooks: %v", err)
+	}
+	var stages []hooks.Stage
+	cfg.Hooks = hooks.RunnerFunc(func(stage hooks.Stage, env hooks.Env) error {
+		stages = append(stages, stage)
+		return nil
+	})
+	if err := cfg.runHooks(hooks.PostPR, hooks.Env{}); err != nil || !reflect.DeepEqual(stages, []hooks.Stage{hooks.PostPR}) {
+		t.Errorf("unexpected hook calls %v: %v", stages, err)
+	}
+}
+
+func TestPRText(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PRBody = "pipeline body"
+	cfg.TrainPRTitles = map[string]string{"prod": "Deploy {train} from {branch}"}
+	title, body := prText("prod-us", "deploy/prod-us", "default title", "default body", cfg)
+	if title != "Deploy prod-us from deploy/prod-us" || body != "pipeline body" {
+		t.Errorf("unexpected PR text %q %q", title, body)
+	}
+	title, _ = prText("dev", "deploy/dev", "default title", "default body", cfg)
+	if title != "default title" {
+		t.Errorf("unexpected PR title %q", title)
+	}
+	if _, err := parseTrainValues("train_pr_title", []string{"no-value"}); err == nil {
+		t.Error("expected invalid train_pr_title error")
+	}
+}
+
+func TestExpandBranch(t *testing.T) {
+	attrs := map[string]string{"cluster": "us-east", "namespace": "", "app_name": "grafana"}
+	if got, err := expandBranch("{cluster}/{app_name}", attrs, nil); err != nil || got != "us-east/grafana" {
+		t.Errorf("unexpected %q %v", got, err)
+	}
+	if _, err := expandBranch("{cluster}/{namespace}", attrs, nil); err == nil {
+		t.Error("expected empty namespace error")
+	}
+	if _, err := expandBranch("{region}", attrs, nil); err == nil {
+		t.Error("expected unknown variable error")
+	}
+}
+
+func TestExpandParameters(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.BranchParameters = map[string][]string{"region": {"us", "eu"}}
+	cfg.TrainPRTitles = map[string]string{"myapp-{region}": "Deploy {train}"}
+	train, err := expandBranch("{app_name}-{region}", map[string]string{"app_name": "myapp"}, cfg.BranchParameters)
+	if err != nil || train != "myapp-{region}" {
+		t.Fatalf("unexpected %q %v", train, err)
+	}
+	trains, err := expandParameters(map[string][]string{train: {"//app:gitops"}, "dev": {"//dev:gitops"}}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trains) != 3 || len(trains["myapp-eu"]) != 1 || len(trains["dev"]) != 1 {
+		t.Errorf("unexpected trains %v", trains)
+	}
+	if args := parameterArgs("myapp-us-staging", cfg); !reflect.DeepEqual(args, []string{"--variable", "REGION=us"}) {
+		t.Errorf("unexpected args %v", args)
+	}
+	if title, _ := prText("myapp-us", "deploy/myapp-us", "", "", cfg); title != "Deploy myapp-us" {
+		t.Errorf("unexpected title %q", title)
+	}
+	if _, err := expandParameters(map[string][]string{"myapp-{zone}": nil}, cfg); err == nil {
+		t.Error("expected unknown variable error")
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	var nilCache *renderCache
+	if _, ok, err := nilCache.replay("//app:gitops", nil, t.TempDir()); ok || err != nil {
+		t.Errorf("unexpected nil cache hit %v %v", ok, err)
+	}
+
+	c := newRenderCache(t.TempDir())
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "cloud/app"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "cloud/app/deployment.yaml"), []byte("kind: Deployment\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"--variable", "REGION=us"}
+	if err := c.record("//app:gitops", args, src, []string{"cloud/app/deployment.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := c.replay("//app:gitops", nil, t.TempDir()); ok {
+		t.Error("unexpected cache hit for different args")
+	}
+	dst := t.TempDir()
+	files, ok, err := c.replay("//app:gitops", args, dst)
+	if err != nil || !ok || !reflect.DeepEqual(files, []string{"cloud/app/deployment.yaml"}) {
+		t.Fatalf("unexpected replay %v %v %v", files, ok, err)
+	}
+	if b, err := os.ReadFile(filepath.Join(dst, "cloud/app/deployment.yaml")); err != nil || string(b) != "kind: Deployment\n" {
+		t.Errorf("unexpected replayed content %q %v", b, err)
+	}
+}
+
+func TestRenderState(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "app.gitops")
+	for path, content := range map[string]string{
+		bin: "#!/bin/sh\n",
+		bin + ".runfiles/main/app/deployment.yaml": "kind: Deployment\n",
+		filepath.Join(dir, "out/cloud/app.yaml"):   "rendered\n",
+	} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := DefaultConfig()
+	cfg.RenderState = filepath.Join(dir, "state.json")
+	if err := startRenders(cfg); err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "out")
+	inputs := cfg.renders.inputDigest(bin, nil)
+	if inputs == "" {
+		t.Fatal("expected input digest")
+	}
+	if _, ok := cfg.renders.unchanged("//app:gitops", nil, inputs, root); ok {
+		t.Error("unexpected unchanged target before the first render")
+	}
+	if err := cfg.renders.recordState("//app:gitops", nil, inputs, root, []string{"cloud/app.yaml"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg.renders.saveState()
+
+	// next run
+	if err := startRenders(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if files, ok := cfg.renders.unchanged("//app:gitops", nil, cfg.renders.inputDigest(bin, nil), root); !ok || !reflect.DeepEqual(files, []string{"cloud/app.yaml"}) {
+		t.Errorf("expected unchanged target, got %v %v", files, ok)
+	}
+	if err := os.WriteFile(bin+".runfiles/main/app/deployment.yaml", []byte("kind: StatefulSet\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cfg.renders.unchanged("//app:gitops", nil, cfg.renders.inputDigest(bin, nil), root); ok {
+		t.Error("unexpected unchanged target after its runfiles changed")
+	}
+}
+
+func TestRenderStateConcurrentRuns(t *testing.T) {
+	dir := t.TempDir()
+	first, second := DefaultConfig(), DefaultConfig()
+	first.RenderState = filepath.Join(dir, "state", "state.json")
+	second.RenderState = first.RenderState
+	for _, cfg := range []*Config{first, second} {
+		if err := startRenders(cfg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := first.renders.recordState("//app:gitops", nil, "a", dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.renders.recordState("//db:gitops", nil, "b", dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	first.renders.saveState()
+	second.renders.saveState()
+
+	state, err := readRenderState(first.RenderState)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Targets) != 2 || state.Targets["//app:gitops"].Inputs != "a" || state.Targets["//db:gitops"].Inputs != "b" {
+		t.Errorf("the second run lost the targets of the first run: %v", state.Targets)
+	}
+}
+
+func TestRunDir(t *testing.T) {
+	tmp := t.TempDir()
+	// a run killed before removing its directory
+	stale := filepath.Join(tmp, "gitops-pipeline-7")
+	if err := os.MkdirAll(filepath.Join(stale, "gitops"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale+".lock", nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := openRunDir(tmp, "pipeline/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(tmp, "gitops-pipeline_42"); first.dir != want {
+		t.Errorf("run directory %s, want %s", first.dir, want)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale run directory was not removed: %v", err)
+	}
+	// a concurrent run with the same id
+	second, err := openRunDir(tmp, "pipeline/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(tmp, "gitops-pipeline_42-2"); second.dir != want {
+		t.Errorf("concurrent run directory %s, want %s", second.dir, want)
+	}
+	if _, err := os.Stat(first.dir); err != nil {
+		t.Errorf("the directory of the running run was removed: %v", err)
+	}
+	first.close()
+	second.close()
+	if entries, _ := os.ReadDir(tmp); len(entries) != 0 {
+		t.Errorf("unexpected files left in %s: %v", tmp, entries)
+	}
+}
+
+func TestExecutionLogDigests(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bazel-out/k8-fastbuild/bin/app/app.gitops")
+	if err := os.MkdirAll(bin+".runfiles", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "exec.json")
+	entries := `{"inputs": [{"path": "app/deployment.yaml", "digest": {"hash": "aaa"}}], "actualOutputs": []}
+{"inputs": [], "actualOutputs": [{"path": "bazel-out/k8-fastbuild/bin/app/app.gitops", "digest": {"hash": "bbb"}}]}
+`
+	if err := os.WriteFile(log, []byte(entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.RenderState = filepath.Join(dir, "state.json")
+	cfg.ExecutionLog = log
+	if err := startRenders(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if d, ok := cfg.renders.bazelDigest(bin); !ok || d != "bbb" {
+		t.Errorf("unexpected digest %q %v", d, ok)
+	}
+	inputs := cfg.renders.inputDigest(bin, nil)
+	// the content is not read if bazel recorded the digest
+	if err := os.WriteFile(bin, []byte("#!/bin/bash\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if inputs == "" || cfg.renders.inputDigest(bin, nil) != inputs {
+		t.Error("expected input digest from the execution log")
+	}
+}
+
+func TestRenderTargetsParallel(t *testing.T) {
+	dir := t.TempDir()
+	var targets []string
+	for _, name := range []string{"a", "b", "c"} {
+		bin := filepath.Join(dir, name+".gitops")
+		script := fmt.Sprintf("#!/bin/sh\nmkdir -p $3/cloud\necho %s > $3/cloud/%s.yaml\necho $3/cloud/%s.yaml\n", name, name, name)
+		if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, bin)
+	}
+	cfg := DefaultConfig()
+	cfg.GitOpsTmpDir = t.TempDir()
+	cfg.RenderParallelism = 2
+	root := t.TempDir()
+	written, err := renderTargets(targets, root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"a", "b", "c"} {
+		f := "cloud/" + name + ".yaml"
+		if !reflect.DeepEqual(written[targets[i]], []string{f}) {
+			t.Errorf("unexpected files of %s: %v", name, written[targets[i]])
+		}
+		if b, err := os.ReadFile(filepath.Join(root, f)); err != nil || string(b) != name+"\n" {
+			t.Errorf("unexpected %s content %q %v", f, b, err)
+		}
+	}
+}
+
+func TestOutputPathCollision(t *testing.T) {
+	dir := t.TempDir()
+	var targets []string
+	for _, name := range []string{"a", "b"} {
+		bin := filepath.Join(dir, name+".gitops")
+		script := fmt.Sprintf("#!/bin/sh\nmkdir -p $3/cloud\necho %s > $3/cloud/%s.yaml\necho %s > $3/cloud/shared.yaml\necho $3/cloud/%s.yaml\necho $3/cloud/shared.yaml\n", name, name, name, name)
+		if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, bin)
+	}
+	cfg := DefaultConfig()
+	cfg.GitOpsTmpDir = t.TempDir()
+	written, err := renderTargets(targets, t.TempDir(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := make(outputOwners)
+	err = owners.claim(written)
+	if err == nil || !strings.Contains(err.Error(), "cloud/shared.yaml is written by both "+targets[0]+" and "+targets[1]) {
+		t.Errorf("claim() = %v", err)
+	}
+
+	// trains are claimed one after another
+	owners = make(outputOwners)
+	if err := owners.claim(targetFiles{"//app:prod": {"cloud/prod/app.yaml"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := owners.claim(targetFiles{"//app:prod": {"cloud/prod/app.yaml"}, "//db:prod": {"cloud/prod/db.yaml"}}); err != nil {
+		t.Errorf("unexpected collision of the same target: %v", err)
+	}
+	if err := owners.claim(targetFiles{"//web:qa": {"cloud/prod/db.yaml"}}); err == nil || !strings.Contains(err.Error(), "//db:prod and //web:qa") {
+		t.Errorf("claim() of another train = %v", err)
+	}
+}
+
+func TestRenderStdoutTarget(t *testing.T) {
+	dir := t.TempDir()
+	files := filepath.Join(dir, "files.gitops")
+	if err := os.WriteFile(files, []byte("#!/bin/sh\nmkdir -p $3/cloud\necho a > $3/cloud/a.yaml\necho $3/cloud/a.yaml\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	stdout := filepath.Join(dir, "stdout.gitops")
+	if err := os.WriteFile(stdout, []byte("#!/bin/sh\necho generating >&2\necho 'kind: PrometheusRule'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.GitOpsTmpDir = t.TempDir()
+	var err error
+	if cfg.StdoutTargets, err = parseStdoutTargets([]string{stdout + "={gitops_path}/prom/rules.yaml"}, cfg.GitOpsPath); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	written, err := renderTargets([]string{files, stdout}, root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(written[stdout], []string{"cloud/prom/rules.yaml"}) || !reflect.DeepEqual(written[files], []string{"cloud/a.yaml"}) {
+		t.Errorf("unexpected files %v", written)
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "cloud/prom/rules.yaml")); err != nil || string(b) != "kind: PrometheusRule\n" {
+		t.Errorf("unexpected stdout manifest %q %v", b, err)
+	}
+
+	for _, v := range []string{"//app:rules", "//app:rules=", "//app:rules=/etc/rules.yaml", "//app:rules=../rules.yaml"} {
+		if _, err := parseStdoutTargets([]string{v}, "cloud"); err == nil {
+			t.Errorf("expected error for %q", v)
+		}
+	}
+}
+
+func TestBinaryArgs(t *testing.T) {
+	trainArgs, err := parseTrainArgs("train_binary_arg", []string{"myapp=--cluster=us-east1", "myapp=--debug", "other=--x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{BinaryArgs: []string{"--region=us"}, TrainBinaryArgs: trainArgs}
+	if got, want := binaryArgs("myapp-prod", cfg), []string{"--region=us", "--cluster=us-east1", "--debug"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("binaryArgs(myapp-prod) = %q, want %q", got, want)
+	}
+	if got := binaryArgs("web", cfg); !reflect.DeepEqual(got, []string{"--region=us"}) {
+		t.Errorf("binaryArgs(web) = %q", got)
+	}
+	if _, err := parseTrainArgs("train_binary_arg", []string{"--debug"}); err == nil {
+		t.Error("expected invalid train_binary_arg error")
+	}
+	for arg, want := range map[string]bool{"--deployment_root=/tmp": true, "-nopush": true, "--cluster=us": false, "nopush": false} {
+		if got := reservedBinaryArg(arg); got != want {
+			t.Errorf("reservedBinaryArg(%q) = %v", arg, got)
+		}
+	}
+}
+
+func TestDeploymentLayout(t *testing.T) {
+	cfg := &Config{DeploymentLayout: "{gitops_path}/{train}/{package}/{name}"}
+	if got := layoutPath("prod", "//services/web:prod.gitops", "cloud", cfg); got != "cloud/prod/services/web/prod.gitops" {
+		t.Errorf("layoutPath(label) = %q", got)
+	}
+	if got := layoutPath("prod", "services/api/prod.gitops", "cloud/us-east1/prod", cfg); got != "cloud/us-east1/prod/prod/services/api/prod.gitops" {
+		t.Errorf("layoutPath(resolved binary) = %q", got)
+	}
+
+	dir := t.TempDir()
+	var targets []string
+	for _, name := range []string{"web", "api"} {
+		bin := filepath.Join(dir, name)
+		script := "#!/bin/sh\nmkdir -p $3/cloud\necho " + name + " > $3/cloud/deployment.yaml\necho $3/cloud/deployment.yaml\n"
+		if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		targets = append(targets, bin)
+	}
+	cfg = DefaultConfig()
+	cfg.GitOpsTmpDir = t.TempDir()
+	cfg.DeploymentLayout = "{gitops_path}/{train}/{name}"
+	root := t.TempDir()
+	written, err := renderTrain("prod", targets, root, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"web", "api"} {
+		f := "cloud/prod/" + name + "/deployment.yaml"
+		if !reflect.DeepEqual(written[targets[i]], []string{f}) {
+			t.Errorf("unexpected files of %s: %v", name, written[targets[i]])
+		}
+		if b, err := os.ReadFile(filepath.Join(root, f)); err != nil || string(b) != name+"\n" {
+			t.Errorf("unexpected %s content %q %v", f, b, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "cloud/deployment.yaml")); !os.IsNotExist(err) {
+		t.Errorf("expected no manifests outside the layout, got %v", err)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[uint64]string{0: "0 B", 1023: "1023 B", 1536: "1.5 KiB", 3 << 30: "3.0 GiB"} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %q, want %q", n, got, want)
+		}
+	}
+	if self, _ := peakMemory(); self == 0 {
+		t.Error("expected peak memory")
+	}
+}
+
+func TestMetricsSummary(t *testing.T) {
+	defer func(r *metrics.Registry) { metrics.Default = r }(metrics.Default)
+	metrics.Default = metrics.New()
+	setPhase("", PhaseRender)
+	setPhase("", PhasePush)
+	endPhase()
+	endPhase()
+	metrics.Add(metricChangedFiles, 3, "train", "prod")
+	metrics.Add(metricChangedFiles, 0, "train", "qa")
+	metrics.Add(metricPushes, 2, "kind", "branch")
+	metrics.Add(metrics.APIRetries, 1, "server", "gitlab")
+	want := "phases: render 0s, push 0s; changed files: prod 3, qa 0; pushed 2 branches and 0 images; 1 API retries"
+	if got := metricsSummary(); got != want {
+		t.Errorf("metricsSummary() = %q, want %q", got, want)
+	}
+	if _, count := metrics.Default.Sum(metricPhaseDuration, "phase", PhasePush); count != 1 {
+		t.Errorf("push phase recorded %d times, want 1", count)
+	}
+}
+
+func TestStatsDArgs(t *testing.T) {
+	cfg := DefaultConfig()
+	if args := statsdArgs(cfg); args != nil {
+		t.Errorf("statsdArgs() = %v, want none", args)
+	}
+	cfg.StatsDHost, cfg.StatsDPort, cfg.StatsDTags = "datadog-agent", 8125, []string{"team:sre"}
+	want := []string{"--statsd_host", "datadog-agent", "--statsd_port", "8125", "--statsd_tag", "team:sre"}
+	if got := statsdArgs(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("statsdArgs() = %v, want %v", got, want)
+	}
+}
+
+type fakeRunStore struct {
+	runs []operator.GitOpsRun
+}
+
+func (s *fakeRunStore) List(ctx context.Context) ([]operator.GitOpsRun, error) {
+	return append([]operator.GitOpsRun{}, s.runs...), nil
+}
+
+func (s *fakeRunStore) UpdateStatus(ctx context.Context, run *operator.GitOpsRun) error {
+	return nil
+}
+
+func (s *fakeRunStore) Env(ctx context.Context, run *operator.GitOpsRun) ([]string, error) {
+	return nil, nil
+}
+
+func TestOperatorStatus(t *testing.T) {
+	store := &fakeRunStore{runs: []operator.GitOpsRun{
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "first"}, Spec: operator.RunSpec{Revision: "aaa"}},
+		{ObjectMeta: metav1.ObjectMeta{Namespace: "ci", Name: "second"}, Spec: operator.RunSpec{Revision: "bbb", ReleaseBranch: "main"}},
+	}}
+	c := &operator.Controller{Store: store, Run: func(ctx context.Context, run *operator.GitOpsRun, env []string) error {
+		if run.Name == "second" {
+			return errors.New("render failed")
+		}
+		return nil
+	}}
+	status := operatorStatus(c)
+	if st := status(10); st.Ready || st.Reason == "" {
+		t.Errorf("expected not ready before reconcile, got %+v", st)
+	}
+	if err := c.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	st := status(1)
+	if !st.Ready || st.Counts["succeeded"] != 1 || st.Counts["failed"] != 1 || len(st.Runs) != 1 {
+		t.Fatalf("unexpected status %+v", st)
+	}
+	if r := st.Runs[0]; r.ID != "ci/second" || r.Commit != "bbb" || r.Branch != "main" || r.State != "failed" || r.Error != "render failed" || r.Started == nil {
+		t.Errorf("unexpected run %+v", r)
+	}
+}
+
+// fakeChild replaces the create_gitops_prs binary started for serve and operator runs with a script
+// recording its arguments. It returns the Config parsed from the arguments of the last run.
+func fakeChild(t *testing.T) func() *Config {
+	t.Helper()
+	t.Setenv("BUILDKITE_COMMIT", "")
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	child := filepath.Join(dir, "create_gitops_prs")
+	script := fmt.Sprintf("#!/bin/sh\nfor a in \"$@\"; do echo \"$a\"; done > %s\n", argsFile)
+	if err := os.WriteFile(child, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	arg0 := os.Args[0]
+	os.Args[0] = child
+	t.Cleanup(func() { os.Args[0] = arg0 })
+	return func() *Config {
+		b, err := os.ReadFile(argsFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs := flag.NewFlagSet("child", flag.ContinueOnError)
+		config := RegisterFlags(fs)
+		if err := fs.Parse(strings.Split(strings.TrimSpace(string(b)), "\n")); err != nil {
+			t.Fatal(err)
+		}
+		cfg, err := config()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+}
+
+// sourceRepo returns a repository with a commit on branch main and the commit
+func sourceRepo(t *testing.T) (string, string) {
+	t.Helper()
+	origin := filepath.Join(t.TempDir(), "app.git")
+	work := filepath.Join(t.TempDir(), "app")
+	exec.Mustex("", "git", "init", "-q", "--bare", origin)
+	exec.Mustex("", "git", "clone", "-q", origin, work)
+	exec.Mustex(work, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "app")
+	exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/main")
+	return origin, strings.TrimSpace(exec.Mustex(work, "git", "rev-parse", "HEAD"))
+}
+
+func TestPipelineRunCommit(t *testing.T) {
+	origin, commit := sourceRepo(t)
+	child := fakeChild(t)
+
+	workspace := filepath.Join(t.TempDir(), "workspace")
+	exec.Mustex("", "git", "clone", "-q", origin, workspace)
+	p := serve.Pipeline{Name: "app", Workspace: workspace}
+	if err := runPipeline(context.Background(), p, serve.Trigger{Branch: "main"}, DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := child(); cfg.GitCommit != commit || checkCommit(cfg) != nil {
+		t.Errorf("serve run commit %q, want %s", cfg.GitCommit, commit)
+	}
+}
+
+func TestOperatorRunCommit(t *testing.T) {
+	origin, commit := sourceRepo(t)
+	child := fakeChild(t)
+	run := &operator.GitOpsRun{Spec: operator.RunSpec{Repo: origin, Revision: "main"}}
+	if err := executeRun(DefaultConfig())(context.Background(), run, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := child(); cfg.GitCommit != commit || checkCommit(cfg) != nil {
+		t.Errorf("operator run commit %q, want %s", cfg.GitCommit, commit)
+	}
+}
+
+func TestIdempotencyKey(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GitCommit = "1a2b3c4"
+	key := idempotencyKey("prod", cfg)
+	if len(key) != 16 || key != idempotencyKey("prod", cfg) {
+		t.Errorf("idempotencyKey() = %q, want a stable 16 character key", key)
+	}
+	if key == idempotencyKey("qa", cfg) {
+		t.Error("expected different keys of release trains")
+	}
+	cfg.GitCommit = "5d6e7f8"
+	if key == idempotencyKey("prod", cfg) {
+		t.Error("expected different keys of commits")
+	}
+}
+
+func TestBranchNamespace(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DeploymentBranchSuffix = "-team"
+	if got := trainBranch("prod", cfg); got != "deploy/prod-team" {
+		t.Errorf("trainBranch() = %q, want deploy/prod-team", got)
+	}
+	cfg.DeployBranchPrefix = "helloworld/"
+	branch := trainBranch("prod", cfg)
+	if branch != "deploy/helloworld/prod-team" {
+		t.Errorf("trainBranch() = %q, want deploy/helloworld/prod-team", branch)
+	}
+	if got := trainOfBranch(branch, cfg); got != "prod" {
+		t.Errorf("trainOfBranch(%q) = %q, want prod", branch, got)
+	}
+	if got := branchNamespace("rollback", cfg); got != "rollback/helloworld/" {
+		t.Errorf("branchNamespace() = %q, want rollback/helloworld/", got)
+	}
+}
+
+func TestCheckWorkspace(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "BUILD"), []byte("# app\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	exec.Mustex(dir, "git", "init", "-q")
+	exec.Mustex(dir, "git", "add", "BUILD")
+	exec.Mustex(dir, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "init")
+	head := strings.TrimSpace(exec.Mustex(dir, "git", "rev-parse", "HEAD"))
+
+	for _, commit := range []string{"unknown", head, head[:7]} {
+		if err := checkWorkspace(dir, &Config{GitCommit: commit}); err != nil {
+			t.Errorf("git_commit %s: %v", commit, err)
+		}
+	}
+	if err := checkWorkspace(dir, &Config{GitCommit: "1a2b3c4"}); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("expected HEAD mismatch error, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "BUILD"), []byte("# changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkWorkspace(dir, &Config{GitCommit: head}); err == nil || !strings.Contains(err.Error(), "M BUILD") {
+		t.Errorf("expected uncommitted changes error, got %v", err)
+	}
+}
+
+func TestCheckPlaceholders(t *testing.T) {
+	dir := t.TempDir()
+	manifest := `metadata:
+  labels:
+    version: "{BUILD_EMBED_LABEL}"
+    env: "{{variables.ENVIRONMENT}}"
+spec:
+  image: registry/app@sha256:1
+  args: ["--build", "STABLE_GIT_COMMIT", "${HOME}", "{name}"]
+  template: "{{ .Labels.alertname }}"
+`
+	if err := os.WriteFile(filepath.Join(dir, "app.yaml"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	findings, err := findPlaceholders(dir, []string{"app.yaml", "deleted.yaml"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range findings {
+		got = append(got, f.String())
+	}
+	want := []string{
+		"app.yaml:3: {BUILD_EMBED_LABEL}",
+		"app.yaml:4: {{variables.ENVIRONMENT}}",
+		"app.yaml:7: STABLE_GIT_COMMIT",
+		"app.yaml:8: {{ .Labels.alertname }}",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("findPlaceholders() = %q, want %q", got, want)
+	}
+
+	allow, err := compilePlaceholderAllowlist([]string{`\.Labels`, "^STABLE_GIT_COMMIT$"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkPlaceholders(dir, []string{"app.yaml"}, allow)
+	if err == nil || !strings.HasPrefix(err.Error(), "2 unexpanded placeholders") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, err := compilePlaceholderAllowlist([]string{"("}); err == nil {
+		t.Error("expected invalid expression error")
+	}
+}
+
+func TestPRHead(t *testing.T) {
+	cfg := &Config{}
+	if got := prHead("deploy/prod", cfg); got != "deploy/prod" {
+		t.Errorf("prHead() without fork = %q", got)
+	}
+	cfg.GitPushRepo = "git@github.com:deploybot/deploy.git"
+	if got := prHead("deploy/prod", cfg); got != "deploybot:deploy/prod" {
+		t.Errorf("prHead() of fork = %q", got)
+	}
+	cfg.GitPushOwner = "other"
+	if got := prHead("deploy/prod", cfg); got != "other:deploy/prod" {
+		t.Errorf("prHead() with git_push_owner = %q", got)
+	}
+}
+
+func TestLoadVaultSecrets(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/approle/login":
+			w.Write([]byte(`{"auth": {"client_token": "s.vaulttoken"}}`))
+		case "/v1/secret/data/gitops":
+			if r.Header.Get("X-Vault-Token") != "s.vaulttoken" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"data": {"data": {"token": "glpat-secret", "docker": "{\"auths\": {}}"}, "metadata": {}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	t.Setenv("DOCKER_CONFIG", "")
+
+	secrets, err := parseVaultSecrets([]string{"gitlab_access_token=secret/data/gitops#token", "docker_config=secret/data/gitops#docker"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{VaultAddr: ts.URL, VaultAuthMethod: "approle", VaultRole: "role", VaultSecretID: "secret", VaultSecrets: secrets}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	token := fs.String("gitlab_access_token", "", "")
+	cleanup, err := loadVaultSecrets(fs, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *token != "glpat-secret" {
+		t.Errorf("gitlab_access_token = %q", *token)
+	}
+	config := filepath.Join(os.Getenv("DOCKER_CONFIG"), "config.json")
+	if b, err := os.ReadFile(config); err != nil || string(b) != `{"auths": {}}` {
+		t.Errorf("docker config %q, %v", b, err)
+	}
+	cleanup()
+	if _, err := os.Stat(config); !os.IsNotExist(err) {
+		t.Errorf("docker config not removed: %v", err)
+	}
+
+	if _, err := parseVaultSecrets([]string{"gitlab_access_token=secret/data/gitops"}); err == nil {
+		t.Error("expected error of vault_secret without field")
+	}
+}
+
+func TestOfflinePRManifest(t *testing.T) {
+	dir := t.TempDir()
+	mirror, remote, work := filepath.Join(dir, "mirror.git"), filepath.Join(dir, "remote.git"), filepath.Join(dir, "work")
+	exec.Mustex("", "git", "init", "-q", "--bare", mirror)
+	exec.Mustex("", "git", "init", "-q", "--bare", remote)
+	exec.Mustex("", "git", "clone", "-q", mirror, work)
+	exec.Mustex(work, "git", "checkout", "-q", "-b", "deploy/prod")
+	exec.Mustex(work, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "deploy")
+	exec.Mustex(work, "git", "push", "-q", "origin", "deploy/prod")
+
+	cfg := &Config{Offline: true, GitRepo: remote, GitMirror: mirror, PRManifest: filepath.Join(dir, "prs.json")}
+	server, err := gitServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy := git.ReviewPolicy{Reviewers: []string{"alice"}}
+	for _, title := range []string{"first", "second"} {
+		if err := git.CreatePRIdempotent(server, "deploy/prod", "master", title, "body", policy, "1a2b"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := readPRManifest(cfg.PRManifest, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ManifestPR{{Branch: "deploy/prod", Into: "master", Title: "second", Body: "body", Reviewers: []string{"alice"}, IdempotencyKey: "1a2b"}}
+	if m.GitRepo != remote || !reflect.DeepEqual(m.PRs, want) {
+		t.Errorf("unexpected manifest %+v", m)
+	}
+
+	var created []string
+	cfg.Offline = false
+	cfg.GitServer = git.PolicyServerFunc(func(from, to, title, body string, p git.ReviewPolicy) error {
+		created = append(created, fmt.Sprintf("%s %s %s %q %v", from, to, title, body, p.Reviewers))
+		return nil
+	})
+	if err := publishPRs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := git.RemoteBranchExists(remote, "deploy/prod"); err != nil || !exists {
+		t.Errorf("branch not pushed to git_repo: %v", err)
+	}
+	if len(created) != 1 || created[0] != `deploy/prod master second "body\n\n<!-- gitops-idempotency-key: 1a2b -->" [alice]` {
+		t.Errorf("unexpected PRs %v", created)
+	}
+}
+
+func TestOfflineBundles(t *testing.T) {
+	dir := t.TempDir()
+	remote, work := filepath.Join(dir, "remote.git"), filepath.Join(dir, "work")
+	exec.Mustex("", "git", "init", "-q", "--bare", remote)
+	exec.Mustex("", "git", "clone", "-q", remote, work)
+	commit := []string{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m"}
+	exec.Mustex(work, "git", append(commit, "init")...)
+	exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/master")
+	exec.Mustex(work, "git", "fetch", "-q", "origin")
+	exec.Mustex(work, "git", "checkout", "-q", "-b", "deploy/prod")
+	exec.Mustex(work, "git", append(commit, "deploy")...)
+
+	cfg := &Config{Offline: true, GitRepo: remote, BundleDir: filepath.Join(dir, "bundles"), PRTargetBranch: "master", GitOpsTmpDir: t.TempDir()}
+	if err := writeBundles(&git.Repo{Dir: work}, []string{"deploy/prod"}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	server, err := gitServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := git.CreatePRIdempotent(server, "deploy/prod", "master", "title", "body", git.ReviewPolicy{}, "1a2b"); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"deploy%2Fprod.bundle", "deploy%2Fprod.json"} {
+		if _, err := os.Stat(filepath.Join(cfg.BundleDir, f)); err != nil {
+			t.Errorf("missing bundle artifact: %v", err)
+		}
+	}
+	if exists, _ := git.RemoteBranchExists(remote, "deploy/prod"); exists {
+		t.Fatal("offline run pushed the branch")
+	}
+
+	var created []string
+	cfg.Offline = false
+	cfg.GitServer = git.PolicyServerFunc(func(from, to, title, body string, p git.ReviewPolicy) error {
+		created = append(created, from+" "+to+" "+title)
+		return nil
+	})
+	if err := publishPRs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	head := exec.Mustex(work, "git", "rev-parse", "deploy/prod")
+	if out := exec.Mustex("", "git", "ls-remote", remote, "refs/heads/deploy/prod"); !strings.HasPrefix(out, strings.TrimSpace(head)) {
+		t.Errorf("bundled branch not pushed to git_repo: %q", out)
+	}
+	if !reflect.DeepEqual(created, []string{"deploy/prod master title"}) {
+		t.Errorf("unexpected PRs %v", created)
+	}
+}
+
+func TestGerritChanges(t *testing.T) {
+	for _, who := range []string{"AUTHOR", "COMMITTER"} {
+		t.Setenv("GIT_"+who+"_NAME", "test")
+		t.Setenv("GIT_"+who+"_EMAIL", "test@example.com")
+	}
+	dir := t.TempDir()
+	remote, work := filepath.Join(dir, "remote.git"), filepath.Join(dir, "work")
+	exec.Mustex("", "git", "init", "-q", "--bare", remote)
+	exec.Mustex("", "git", "clone", "-q", remote, work)
+	commit := []string{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m"}
+	exec.Mustex(work, "git", append(commit, "init")...)
+	exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/master")
+	exec.Mustex(work, "git", "checkout", "-q", "-b", "deploy/prod")
+	exec.Mustex(work, "git", append(commit, "GitOps for release branch prod")...)
+
+	cfg := DefaultConfig()
+	cfg.GitHost = "gerrit"
+	cfg.GitCommit = "abc123"
+	cfg.PRTargetBranch = "master"
+	if err := pushChanges(&git.Repo{Dir: work}, []string{"deploy/prod"}, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	msg := exec.Mustex(remote, "git", "log", "-1", "--format=%B", "refs/for/master")
+	if want := "Change-Id: " + gerrit.ChangeID(idempotencyKey("deploy/prod", cfg)); !strings.Contains(msg, want) {
+		t.Errorf("change message %q lacks %s", msg, want)
+	}
+	if exists, _ := git.RemoteBranchExists(remote, "deploy/prod"); exists {
+		t.Error("gerrit run pushed the deployment branch")
+	}
+}
+
+func TestPrunePRs(t *testing.T) {
+	origin := filepath.Join(t.TempDir(), "deploy.git")
+	exec.Mustex("", "git", "init", "-q", "--bare", origin)
+	work := filepath.Join(t.TempDir(), "work")
+	exec.Mustex("", "git", "clone", "-q", origin, work)
+	exec.Mustex(work, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", "deploy")
+	for _, b := range []string{"deploy/app/prod", "deploy/app/legacy", "deploy/other/prod", "feature/x"} {
+		exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/"+b)
+	}
+
+	cfg := DefaultConfig()
+	cfg.GitRepo = origin
+	cfg.PRTargetBranch = "master"
+	cfg.GitOpsTmpDir = t.TempDir()
+	cfg.DeployBranchPrefix = "app"
+	cfg.ResolvedBinaries = []string{"prod:bazel-bin/app/prod.gitops"}
+	var closed []string
+	cfg.GitServer = git.Provider{
+		List: func(prefix, to string) ([]*git.PR, error) {
+			if prefix != "deploy/app/" || to != "master" {
+				t.Errorf("unexpected list of PRs from %s into %s", prefix, to)
+			}
+			return []*git.PR{{Number: 1, Branch: "deploy/app/prod"}, {Number: 2, Branch: "deploy/app/legacy"}}, nil
+		},
+		Close: func(pr *git.PR, comment string) error {
+			if !strings.Contains(comment, "`legacy`") {
+				t.Errorf("unexpected comment %q", comment)
+			}
+			closed = append(closed, pr.Branch)
+			return nil
+		},
+	}
+
+	cfg.DryRun = true
+	if err := prunePRs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := git.RemoteBranchExists(origin, "deploy/app/legacy"); len(closed) != 0 || !exists {
+		t.Fatalf("dry run closed %v or deleted the branch", closed)
+	}
+	cfg.DryRun = false
+	if err := prunePRs(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(closed, []string{"deploy/app/legacy"}) {
+		t.Errorf("closed PRs of %v", closed)
+	}
+	branches, err := git.RemoteBranches(origin, "")
+	if want := []string{"deploy/app/prod", "deploy/other/prod", "feature/x"}; err != nil || !reflect.DeepEqual(branches, want) {
+		t.Errorf("branches after pruning %v, %v, want %v", branches, err, want)
+	}
+}
+
+func TestTrainsQuery(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Targets = "//services/..."
+	cfg.ReleaseBranch = "release"
+	if got, want := trainsQuery(cfg, false), `attr(deployment_branch, ".+", attr(release_branch_prefix, "release", kind(gitops, //services/...)))`; got != want {
+		t.Errorf("release query %s, want %s", got, want)
+	}
+	// pruning keeps the trains of every release branch
+	if got, want := trainsQuery(cfg, true), `attr(deployment_branch, ".+", kind(gitops, //services/...))`; got != want {
+		t.Errorf("prune query %s, want %s", got, want)
+	}
+}
+
+func TestAffectedResources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec.Mustex(dir, "git", "init", "-q")
+	write("cloud/old.yaml", "apiVersion: batch/v1\nkind: CronJob\nmetadata:\n  name: cleanup\n  namespace: shop\n")
+	exec.Mustex(dir, "git", "add", ".")
+	exec.Mustex(dir, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial")
+
+	os.Remove(filepath.Join(dir, "cloud/old.yaml"))
+	write("cloud/web.yaml", "apiVersion: v1\nkind: Namespace\nmetadata:\n  name: shop\n---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: web\n  namespace: shop\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: web\n  namespace: shop\n")
+	write("cloud/new/db.yaml", "apiVersion: apps/v1\nkind: StatefulSet\nmetadata:\n  name: db\n  namespace: data\n")
+	write("cloud/README.md", "not a manifest\n")
+	workdir := &git.Repo{Dir: dir}
+	files, err := workdir.GetModifiedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := affectedResources(workdir, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := affected{
+		Namespaces: []string{"data", "shop"},
+		Workloads: []workload{
+			{Kind: "StatefulSet", Name: "db", Namespace: "data"},
+			{Kind: "CronJob", Name: "cleanup", Namespace: "shop"},
+			{Kind: "Deployment", Name: "web", Namespace: "shop"},
+		},
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Fatalf("affectedResources() = %+v, want %+v", a, want)
+	}
+	if labels := a.labels(); !reflect.DeepEqual(labels, []string{"namespace:data", "namespace:shop", "service:db", "service:cleanup", "service:web"}) {
+		t.Errorf("unexpected labels %v", labels)
+	}
+	section := a.section()
+	if !strings.Contains(section, "**Namespaces:** `data`, `shop`") || !strings.Contains(section, "- `Deployment/web` in `shop`") {
+		t.Errorf("unexpected section %q", section)
+	}
+	if s := (affected{}).section(); s != "" {
+		t.Errorf("unexpected section of no resources %q", s)
+	}
+}
+
+func TestImageChanges(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec.Mustex(dir, "git", "init", "-q")
+	write("cloud/web.yaml", "containers:\n- image: gcr.io/shop/web:v1@sha256:1111\n- image: gcr.io/shop/proxy:1.25\n")
+	write("cloud/old.yaml", "containers:\n- image: gcr.io/shop/cleanup@sha256:3333\n")
+	exec.Mustex(dir, "git", "add", ".")
+	exec.Mustex(dir, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "initial")
+
+	write("cloud/web.yaml", "containers:\n- image: gcr.io/shop/web:v2@sha256:2222\n- image: gcr.io/shop/proxy:1.25\n")
+	os.Remove(filepath.Join(dir, "cloud/old.yaml"))
+	write("cloud/new/db.yaml", "containers:\n- image: localhost:5000/db\n")
+	workdir := &git.Repo{Dir: dir}
+	files, err := workdir.GetModifiedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := imageChanges(workdir, files, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []imageChange{
+		{Repository: "gcr.io/shop/cleanup", Old: []string{"sha256:3333"}},
+		{Repository: "gcr.io/shop/web", Old: []string{"v1@sha256:1111"}, New: []string{"v2@sha256:2222"}},
+		{Repository: "localhost:5000/db", New: []string{"latest"}},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("imageChanges() = %+v, want %+v", changes, want)
+	}
+	table := imageTable(changes[:2])
+	wantTable := "### Image changes\n\n| Image | Current | New |\n| --- | --- | --- |\n" +
+		"| `gcr.io/shop/cleanup` | `sha256:3333` | _none_ |\n" +
+		"| `gcr.io/shop/web` | `v1@sha256:1111` | `v2@sha256:2222` |"
+	if table != wantTable {
+		t.Errorf("imageTable() = %q, want %q", table, wantTable)
+	}
+	merged := mergeImageChanges(changes[1:2], []imageChange{{Repository: "gcr.io/shop/web", Old: []string{"v1@sha256:1111"}, New: []string{"v3"}}})
+	if len(merged) != 1 || !reflect.DeepEqual(merged[0].New, []string{"v2@sha256:2222", "v3"}) {
+		t.Errorf("unexpected merged changes %+v", merged)
+	}
+	if s := imageTable(nil); s != "" {
+		t.Errorf("unexpected table of no changes %q", s)
+	}
+}
+
+func TestManifestChanges(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commit := func() {
+		exec.Mustex(dir, "git", "add", ".")
+		exec.Mustex(dir, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "change")
+	}
+	exec.Mustex(dir, "git", "init", "-q", "-b", "master")
+	write("cloud/web.yaml", "containers:\n- image: gcr.io/shop/web:v1\n- image: gcr.io/shop/proxy:1.25\n")
+	write("cloud/old.yaml", "containers:\n- image: gcr.io/shop/cleanup:v1\n")
+	commit()
+	exec.Mustex(dir, "git", "checkout", "-q", "-b", "deploy/prod")
+	write("cloud/web.yaml", "containers:\n- image: gcr.io/shop/web:v2\n- image: gcr.io/shop/proxy:1.25\n")
+	os.Remove(filepath.Join(dir, "cloud/old.yaml"))
+	write("cloud/config.txt", "a\n")
+	commit()
+	// changes of the target branch after the deployment branch diverged are not part of the PR
+	exec.Mustex(dir, "git", "checkout", "-q", "master")
+	write("cloud/other.yaml", "b\n")
+	commit()
+	exec.Mustex(dir, "git", "checkout", "-q", "deploy/prod")
+
+	cfg := DefaultConfig()
+	cfg.GitOpsPath = "cloud"
+	changes, err := manifestChanges(&git.Repo{Dir: dir}, "master", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []manifestChange{
+		{FileChange: git.FileChange{Path: "cloud/config.txt", Status: "A", Added: 1}},
+		{FileChange: git.FileChange{Path: "cloud/old.yaml", Status: "D", Removed: 2}, Images: []string{"gcr.io/shop/cleanup"}},
+		{FileChange: git.FileChange{Path: "cloud/web.yaml", Status: "M", Added: 1, Removed: 1}, Images: []string{"gcr.io/shop/web"}},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Fatalf("manifestChanges() = %+v, want %+v", changes, want)
+	}
+	summary := diffSummary(mergeManifestChanges(changes[2:], changes[:2]))
+	wantSummary := "### Manifest changes\n\n3 files changed: 1 added, 1 modified, 1 removed\n\n" +
+		"| File | Change | Lines | Images |\n| --- | --- | --- | --- |\n" +
+		"| `cloud/config.txt` | added | +1 -0 |  |\n" +
+		"| `cloud/old.yaml` | removed | +0 -2 | `gcr.io/shop/cleanup` |\n" +
+		"| `cloud/web.yaml` | modified | +1 -1 | `gcr.io/shop/web` |"
+	if summary != wantSummary {
+		t.Errorf("diffSummary() = %q, want %q", summary, wantSummary)
+	}
+	if s := diffSummary(nil); s != "" {
+		t.Errorf("unexpected summary of no changes %q", s)
+	}
+}
+
+func TestResolvePRTargetBranch(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GitServer = git.Provider{Default: func() (string, error) { return "main", nil }}
+	if err := resolvePRTargetBranch(cfg); err != nil || cfg.PRTargetBranch != "main" {
+		t.Errorf("resolvePRTargetBranch() = %v, branch %q", err, cfg.PRTargetBranch)
+	}
+	cfg.PRTargetBranch = "release"
+	if err := resolvePRTargetBranch(cfg); err != nil || cfg.PRTargetBranch != "release" {
+		t.Errorf("resolvePRTargetBranch() overrode --gitops_pr_into: %v, branch %q", err, cfg.PRTargetBranch)
+	}
+	cfg = DefaultConfig()
+	cfg.GitServer = git.Provider{Default: func() (string, error) { return "", errors.New("forbidden") }}
+	if err := resolvePRTargetBranch(cfg); err == nil || !strings.Contains(err.Error(), "set --gitops_pr_into") {
+		t.Errorf("resolvePRTargetBranch() = %v", err)
+	}
+}
+
+func TestDiffStats(t *testing.T) {
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "app.gitops")
+	script := "#!/bin/sh\nmkdir -p $3/cloud\necho new > $3/cloud/a.yaml\necho same > $3/cloud/same.yaml\necho b > $3/cloud/b.yaml\nrm -f $3/cloud/gone.yaml\n" +
+		"echo $3/cloud/a.yaml\necho $3/cloud/same.yaml\necho $3/cloud/b.yaml\n"
+	if err := os.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	origin := filepath.Join(t.TempDir(), "deploy.git")
+	exec.Mustex("", "git", "init", "-q", "--bare", origin)
+	work := filepath.Join(t.TempDir(), "work")
+	exec.Mustex("", "git", "clone", "-q", origin, work)
+	for name, content := range map[string]string{"a.yaml": "old\n", "same.yaml": "same\n", "gone.yaml": "gone\n", "other.yaml": "other\n"} {
+		os.MkdirAll(filepath.Join(work, "cloud"), 0755)
+		if err := os.WriteFile(filepath.Join(work, "cloud", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err := commitmsg.GenerateMetadata(commitmsg.Metadata{Train: "prod", Targets: []commitmsg.Target{{Label: bin, Files: []string{"cloud/a.yaml", "cloud/same.yaml", "cloud/gone.yaml"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec.Mustex(work, "git", "add", ".")
+	exec.Mustex(work, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "deploy "+bin+"\n\n"+metadata)
+	exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/master")
+
+	cfg := DefaultConfig()
+	cfg.GitRepo = origin
+	cfg.PRTargetBranch = "master"
+	cfg.GitOpsTmpDir = t.TempDir()
+	cfg.ResolvedBinaries = []string{"prod:" + bin}
+	cfg.ListFormat = "table"
+	stdout := os.Stdout
+	r, w, _ := os.Pipe()
+	os.Stdout = w
+	err = diffStats(cfg)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "TRAIN") || strings.Join(strings.Fields(lines[1]), " ") != "prod "+bin+" 1 1 1" {
+		t.Errorf("unexpected diff statistics %q", out)
+	}
+}
+
+func TestOwnershipIndex(t *testing.T) {
+	work := t.TempDir()
+	exec.Mustex(work, "git", "init", "-q")
+	cfg := DefaultConfig()
+	cfg.GitCommit = "1a2b3c"
+	cfg.OwnershipIndex = ".gitops/index/{train}.yaml"
+	workdir := &git.Repo{Dir: work}
+	rendered := targetFiles{"//app:prod": {"cloud/web.yaml", "cloud/app.yaml"}}
+	path, err := writeOwnershipIndex(workdir, "prod", []string{"//app:prod", "//db:prod"}, rendered, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(filepath.Join(work, path))
+	want := "source_commit: 1a2b3c\ntargets:\n  //app:prod:\n  - cloud/app.yaml\n  - cloud/web.yaml\n  //db:prod: []\ntrain: prod\n"
+	if path != ".gitops/index/prod.yaml" || string(b) != want {
+		t.Errorf("unexpected ownership index %s:\n%s", path, b)
+	}
+	exec.Mustex(work, "git", "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "-m", "deploy")
+
+	files, err := previousTargetFiles(workdir, "prod", "//app:prod", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(files, []string{"cloud/app.yaml", "cloud/web.yaml"}) {
+		t.Errorf("unexpected files owned at HEAD %v", files)
+	}
+	if index, err := readOwnershipIndex(workdir, "HEAD", "dev", cfg); index != nil || err != nil {
+		t.Errorf("readOwnershipIndex() of another train = %v, %v", index, err)
+	}
+	cfg.OwnershipIndex = ""
+	if index, err := readOwnershipIndex(workdir, "HEAD", "prod", cfg); index != nil || err != nil {
+		t.Errorf("readOwnershipIndex() without index = %v, %v", index, err)
+	}
+}
+
+func TestDefaultReviewPolicy(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := RegisterFlags(fs)
+	err := fs.Parse([]string{"--gitops_pr_reviewers=alice, bob", "--gitops_pr_reviewers=carol", "--gitops_pr_team_reviewers=sre",
+		"--gitops_pr_labels=gitops", "--gitops_pr_assignees=oncall", "--pr_reviewers=prod*=dave,alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := git.ReviewPolicy{
+		Reviewers:     []string{"alice", "bob", "carol", "dave"},
+		TeamReviewers: []string{"sre"},
+		Labels:        []string{"gitops"},
+		Assignees:     []string{"oncall"},
+	}
+	if got := reviewPolicy("prod-eu", cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("reviewPolicy() = %+v, want %+v", got, want)
+	}
+	if got := combinedReviewPolicy([]string{"dev", "prod"}, cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("combinedReviewPolicy() = %+v, want %+v", got, want)
+	}
+	cfg.GitHost = "gitlab"
+	if err := cfg.Validate(""); err == nil || !strings.Contains(err.Error(), "gitops_pr_assignees requires the github") {
+		t.Errorf("expected gitops_pr_assignees problem, got %v", err)
+	}
+}
+
+func TestPRAutoMerge(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	config := RegisterFlags(fs)
+	if err := fs.Parse([]string{"--gitops_pr_automerge", "--merge_queue=prod*"}); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reviewPolicy("dev", cfg).AutoMerge {
+		t.Error("expected auto-merge of dev")
+	}
+	if reviewPolicy("prod-eu", cfg).AutoMerge {
+		t.Error("expected prod-eu to use the merge queue instead of auto-merge")
+	}
+	if !combinedReviewPolicy([]string{"dev", "qa"}, cfg).AutoMerge || combinedReviewPolicy([]string{"dev", "prod"}, cfg).AutoMerge {
+		t.Error("unexpected auto-merge of combined PRs")
+	}
+}
+
+func TestMergeQueue(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PRTargetBranch = "master"
+	cfg.AutoMergeTrains = []string{"*"}
+	cfg.MergeQueueTrains = []string{"prod*"}
+	autoMerge := make(map[string]bool)
+	var enqueued []string
+	cfg.GitServer = git.Provider{
+		Create: func(from, to, title, body string, policy git.ReviewPolicy) error {
+			autoMerge[from] = policy.AutoMerge
+			return nil
+		},
+		Find: func(from, to string) (*git.PR, error) { return nil, nil },
+		Enqueue: func(from, to string) (*git.QueueEntry, error) {
+			enqueued = append(enqueued, from+" "+to)
+			return &git.QueueEntry{Position: 2, State: "QUEUED"}, nil
+		},
+	}
+	queuedPRs = nil
+	if err := createPullRequests([]string{"deploy/prod", "deploy/dev"}, nil, nil, nil, nil, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(autoMerge, map[string]bool{"deploy/prod": false, "deploy/dev": true}) {
+		t.Errorf("unexpected auto-merge %v", autoMerge)
+	}
+	if !reflect.DeepEqual(enqueued, []string{"deploy/prod master"}) {
+		t.Errorf("unexpected enqueued PRs %v", enqueued)
+	}
+	if s := mergeQueueSummary(queuedPRs); s != "prod #2 (QUEUED)" {
+		t.Errorf("unexpected merge queue summary %q", s)
+	}
+	if combinedMergeQueue([]string{"prod", "dev"}, cfg) || !combinedMergeQueue([]string{"prod", "prod-eu"}, cfg) {
+		t.Error("unexpected merge queue of a combined PR")
+	}
+	queuedPRs = nil
+
+	cfg.GitServer = git.PolicyServerFunc(func(from, to, title, body string, policy git.ReviewPolicy) error { return nil })
+	if err := createPullRequests([]string{"deploy/prod"}, nil, nil, nil, nil, nil, cfg); err == nil || !strings.Contains(err.Error(), "does not support merge queues") {
+		t.Errorf("createPullRequests() without merge queue support = %v", err)
+	}
+}
+
+func TestGitHubDeployments(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PRTargetBranch = "master"
+	cfg.GitHubDeployments = true
+	cfg.DeploymentEnvironment = "k8s-{train}"
+	cfg.BranchName = "main"
+	cfg.GitCommit = "abc123"
+	var deployments []git.Deployment
+	cfg.GitServer = git.Provider{
+		Create: func(from, to, title, body string, policy git.ReviewPolicy) error { return nil },
+		Find:   func(from, to string) (*git.PR, error) { return nil, nil },
+		Deploy: func(d git.Deployment) (string, error) {
+			deployments = append(deployments, d)
+			return "https://github.example.com/deployments/1", nil
+		},
+	}
+	deployed := map[string][]audit.Image{"deploy/prod": {{Name: "gcr.io/shop/web:v2", Digest: "sha256:2222"}}}
+	if err := createPullRequests([]string{"deploy/prod", "deploy/dev"}, nil, nil, nil, nil, deployed, cfg); err != nil {
+		t.Fatal(err)
+	}
+	want := []git.Deployment{
+		{Ref: "deploy/prod", Environment: "k8s-prod", Description: "GitOps deployment of prod from main commit abc123", Payload: deploymentPayload{
+			Train: "prod", SourceBranch: "main", SourceCommit: "abc123", Images: []commitmsg.Image{{Name: "gcr.io/shop/web:v2", Digest: "sha256:2222"}}}},
+		{Ref: "deploy/dev", Environment: "k8s-dev", Description: "GitOps deployment of dev from main commit abc123", Payload: deploymentPayload{
+			Train: "dev", SourceBranch: "main", SourceCommit: "abc123"}},
+	}
+	if !reflect.DeepEqual(deployments, want) {
+		t.Errorf("deployments = %+v, want %+v", deployments, want)
+	}
+
+	cfg.GitServer = git.PolicyServerFunc(func(from, to, title, body string, policy git.ReviewPolicy) error { return nil })
+	if err := createPullRequests([]string{"deploy/prod"}, nil, nil, nil, nil, nil, cfg); err == nil || !strings.Contains(err.Error(), "does not support deployments") {
+		t.Errorf("createPullRequests() without deployment support = %v", err)
+	}
+
+	cfg.GitServer = nil
+	cfg.GitHost = "gitlab"
+	if err := cfg.Validate(""); err == nil || !strings.Contains(err.Error(), "github_deployments requires the github") {
+		t.Errorf("expected github_deployments problem, got %v", err)
+	}
+}
+
+func TestCommentViolations(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PRTargetBranch, cfg.BranchName, cfg.GitCommit = "master", "main", "0123456789abcdef0123456789abcdef01234567"
+	var comments []string
+	cfg.GitServer = git.Provider{
+		Find: func(from, to string) (*git.PR, error) {
+			if from != "deploy/prod" {
+				return nil, nil
+			}
+			return &git.PR{Number: 7, URL: "https://git.example.com/pr/7"}, nil
+		},
+		Comment: func(pr *git.PR, comment string) error {
+			comments = append(comments, fmt.Sprintf("#%d %s", pr.Number, comment))
+			return nil
+		},
+	}
+	violations := &policyError{violations: []policy.Violation{{File: "cloud/prod/app.yaml", Message: "containers must not run as root"}}}
+	commentViolations("deploy/prod", fmt.Errorf("validate: %w", violations), cfg)
+	commentViolations("deploy/dev", violations, cfg)
+	commentViolations("deploy/prod", errors.New("3 schema validation errors"), cfg)
+	want := "#7 Commit 0123456789abcdef0123456789abcdef01234567 of main violates 1 policies, this PR was not updated:\n\n- `cloud/prod/app.yaml`: containers must not run as root"
+	if len(comments) != 1 || comments[0] != want {
+		t.Errorf("comments = %q, want %q", comments, want)
+	}
+	if !strings.Contains(violations.Error(), "1 policy violations:\n\tcloud/prod/app.yaml: containers must not run as root") {
+		t.Errorf("unexpected error %q", violations.Error())
+	}
+}
+
+func TestChangeRequestReuse(t *testing.T) {
+	var created int32
+	snow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&created, 1)
+		fmt.Fprint(w, `{"result": {"number": "CHG0001", "sys_id": "abc"}}`)
+	}))
+	defer snow.Close()
+	cfg := DefaultConfig()
+	cfg.PRTargetBranch = "master"
+	cfg.ServiceNowURL = snow.URL
+	cfg.ServiceNowTrains = []string{"prod"}
+	prs := map[string]*git.PR{}
+	createErr := errors.New("forbidden")
+	cfg.GitServer = git.Provider{
+		Create: func(from, to, title, body string, policy git.ReviewPolicy) error {
+			if createErr != nil {
+				return createErr
+			}
+			prs[from] = &git.PR{URL: "https://git.example.com/pr/" + from, Body: body}
+			return nil
+		},
+		Find: func(from, to string) (*git.PR, error) { return prs[from], nil },
+		Update: func(p *git.PR, title, body string, policy git.ReviewPolicy) error {
+			p.Body = body
+			return nil
+		},
+	}
+
+	if err := createPullRequests([]string{"deploy/prod"}, nil, nil, nil, nil, nil, cfg); err == nil || created != 0 {
+		t.Errorf("change request created for a failed PR: %v", err)
+	}
+	createErr = nil
+	for run := 0; run < 2; run++ {
+		if err := createPullRequests([]string{"deploy/prod", "deploy/dev"}, nil, nil, nil, nil, nil, cfg); err != nil {
+			t.Fatal(err)
+		}
+		pr := prs[prHead("deploy/prod", cfg)]
+		if created != 1 || pr == nil || !strings.Contains(pr.Body, "Change request: [CHG0001]("+snow.URL) || git.MarkerKey(pr.Body) == "" {
+			t.Errorf("run %d: %d change requests, PR %+v", run, created, pr)
+		}
+		if dev := prs[prHead("deploy/dev", cfg)]; dev == nil || strings.Contains(dev.Body, "Change request") {
+			t.Errorf("run %d: dev PR %+v", run, dev)
+		}
+	}
+}
+
+func TestTrainDependencies(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PRTargetBranch = "master"
+	cfg.AutoMergeTrains = []string{"*"}
+	var err error
+	if cfg.TrainDependencies, err = parseTrainPatterns("train_depends_on", []string{"app*=infra", "infra=network"}); err != nil {
+		t.Fatal(err)
+	}
+	open := map[string]bool{"deploy/network": false}
+	var created []string
+	autoMerge := make(map[string]bool)
+	bodies := make(map[string]string)
+	cfg.GitServer = git.Provider{
+		Create: func(from, to, title, body string, policy git.ReviewPolicy) error {
+			created = append(created, from)
+			autoMerge[from] = policy.AutoMerge
+			bodies[from] = body
+			open[from] = true
+			return nil
+		},
+		Find: func(from, to string) (*git.PR, error) {
+			if !open[from] {
+				return nil, nil
+			}
+			return &git.PR{URL: "https://git.example.com/pr/" + from}, nil
+		},
+	}
+	orderedPRs = nil
+	if err := createPullRequests([]string{"deploy/app-web", "deploy/infra", "deploy/dev"}, nil, nil, nil, nil, nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(created, []string{"deploy/infra", "deploy/app-web", "deploy/dev"}) {
+		t.Errorf("unexpected PR order %v", created)
+	}
+	if !reflect.DeepEqual(autoMerge, map[string]bool{"deploy/infra": true, "deploy/app-web": false, "deploy/dev": true}) {
+		t.Errorf("unexpected auto-merge %v", autoMerge)
+	}
+	if !strings.Contains(bodies["deploy/app-web"], "- infra: depends-on https://git.example.com/pr/deploy/infra") {
+		t.Errorf("missing depends-on reference in %q", bodies["deploy/app-web"])
+	}
+	if s := prOrderSummary(orderedPRs); s != "infra, app-web (waits for infra), dev" {
+		t.Errorf("unexpected PR order summary %q", s)
+	}
+	orderedPRs = nil
+
+	cfg.TrainDependencies = append(cfg.TrainDependencies, trainPattern{Pattern: "infra", Values: []string{"app-web"}})
+	if _, err := orderBranches([]string{"deploy/app-web", "deploy/infra"}, cfg); err == nil || !strings.Contains(err.Error(), "circular release train dependency app-web -> infra -> app-web") {
+		t.Errorf("orderBranches() with a cycle = %v", err)
+	}
+}
+
+func TestJUnitReport(t *testing.T) {
+	start := time.Now()
+	failures := TrainErrors{{Train: "stage", Phase: PhaseRender, Err: errors.New("exit status 1")}}
+	report := junitReport([]string{"prod", "stage", "dev"}, failures, failures, start)
+	suite := report.Suites[0]
+	if suite.Tests != 3 || suite.Failures != 1 {
+		t.Errorf("unexpected suite %+v", suite)
+	}
+	if c := suite.Cases[2]; c.Name != "stage" || c.Failure == nil || c.Failure.Type != PhaseRender || c.Failure.Message != "exit status 1" {
+		t.Errorf("unexpected test case %+v", c)
+	}
+
+	// a failure stopping the run fails the trains that did not fail before
+	stopped := &PhaseError{Phase: PhasePR, Err: errors.New("PR creation failed")}
+	report = junitReport([]string{"prod", "stage"}, failures, stopped, start)
+	if c := report.Suites[0].Cases; c[0].Failure == nil || c[0].Failure.Type != PhasePR || c[1].Failure.Type != PhaseRender {
+		t.Errorf("unexpected test cases %+v", c)
+	}
+	if report := junitReport([]string{"prod"}, nil, errNoChanges, start); report.Suites[0].Failures != 0 {
+		t.Errorf("unexpected failures of a run without changes %+v", report)
+	}
+
+	cfg := DefaultConfig()
+	cfg.JUnitReport = filepath.Join(t.TempDir(), "junit.xml")
+	saveJUnitReport([]string{"prod", "stage"}, failures, failures, start, cfg)
+	b, err := os.ReadFile(cfg.JUnitReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`<testsuite name="create_gitops_prs" tests="2" failures="1"`, `<testcase name="prod" classname="gitops"></testcase>`, `<failure message="exit status 1" type="render">stage render: exit status 1</failure>`} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("JUnit report does not contain %s:\n%s", want, b)
+		}
+	}
+}
+
+// runFixture returns the Config of a run rendering release train prod with a script into a new bare
+// deployment repository, without Buildkite environment variables. PRs are recorded in prs.
+func runFixture(t *testing.T, prs *[]string) (*Config, string) {
+	t.Helper()
+	for _, name := range []string{"BUILDKITE_COMMIT", "BUILDKITE_PIPELINE_SLUG", "BUILDKITE_BUILD_URL", "BUILDKITE_REPO"} {
+		t.Setenv(name, "")
+	}
+	for _, name := range []string{"GIT_AUTHOR_NAME", "GIT_COMMITTER_NAME"} {
+		t.Setenv(name, "test")
+	}
+	for _, name := range []string{"GIT_AUTHOR_EMAIL", "GIT_COMMITTER_EMAIL"} {
+		t.Setenv(name, "test@example.com")
+	}
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "deploy.git")
+	work := filepath.Join(dir, "work")
+	exec.Mustex("", "git", "init", "-q", "--bare", remote)
+	exec.Mustex("", "git", "clone", "-q", remote, work)
+	if err := os.MkdirAll(filepath.Join(work, "cloud/prod"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"cloud/prod/app.yaml": "kind: Secret\n", "cloud/prod/svc.yaml": "kind: Service\n"} {
+		if err := os.WriteFile(filepath.Join(work, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exec.Mustex(work, "git", "add", "cloud")
+	exec.Mustex(work, "git", "commit", "-q", "-m", "init")
+	exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/master")
+	render := filepath.Join(dir, "render.sh")
+	script := "#!/bin/sh\nmkdir -p \"$3/cloud/prod\"\necho 'kind: ConfigMap' > \"$3/cloud/prod/app.yaml\"\necho 'kind: Service' > \"$3/cloud/prod/svc.yaml\"\n" +
+		"echo \"$3/cloud/prod/app.yaml\"\necho \"$3/cloud/prod/svc.yaml\"\n"
+	if err := os.WriteFile(render, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.GitRepo = remote
+	cfg.GitOpsTmpDir = dir
+	cfg.PRTargetBranch = "master"
+	cfg.ResolvedBinaries = []string{"prod:" + render}
+	cfg.ResolvedPushes = []string{"true"}
+	cfg.GitServer = git.ServerFunc(func(from, to, title, body string) error {
+		*prs = append(*prs, title)
+		return nil
+	})
+	return cfg, remote
+}
+
+func TestRunWithoutBuildkite(t *testing.T) {
+	var prs []string
+	cfg, remote := runFixture(t, &prs)
+	if cfg.GitCommit != "unknown" {
+		t.Fatalf("unexpected default git_commit %q", cfg.GitCommit)
+	}
+	if err := Run(cfg); ExitCode(err) != ExitConfig || !strings.Contains(err.Error(), "git_commit") {
+		t.Errorf("expected git_commit configuration error, got %v", err)
+	}
+	if len(prs) != 0 {
+		t.Errorf("PRs created without a commit: %v", prs)
+	}
+
+	cfg.GitCommit = "1a2b3c4d5e6f"
+	if err := Run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(prs, []string{"GitOps deployment deploy/prod"}) {
+		t.Errorf("unexpected PRs %v", prs)
+	}
+	if msg := exec.Mustex(remote, "git", "log", "-1", "--format=%B", "deploy/prod"); !strings.Contains(msg, "commit 1a2b3c4d5e6f") {
+		t.Errorf("unexpected deployment commit message %q", msg)
+	}
+}
+
+func TestPublishAfterPush(t *testing.T) {
+	var prs []string
+	cfg, remote := runFixture(t, &prs)
+	cfg.GitCommit = "1a2b3c4"
+	cfg.PublishURL = "s3://bucket/gitops"
+	// the fake aws cli fails unless the deployment branch was pushed before the upload
+	bin := t.TempDir()
+	out := filepath.Join(t.TempDir(), "published")
+	script := fmt.Sprintf("#!/bin/sh\ngit --git-dir=%s rev-parse -q --verify deploy/prod || exit 1\necho \"$6\" > %s.dest\ncp -r \"$5\" %s\n", remote, out, out)
+	if err := os.WriteFile(filepath.Join(bin, "aws"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	if err := Run(cfg); err != nil {
+		t.Fatal(err)
+	}
+	commit := strings.TrimSpace(exec.Mustex(remote, "git", "rev-parse", "deploy/prod"))
+	if dest, _ := os.ReadFile(out + ".dest"); strings.TrimSpace(string(dest)) != "s3://bucket/gitops/prod/"+commit+"/" {
+		t.Errorf("unexpected destination %q", dest)
+	}
+	for name, want := range map[string]string{"cloud/prod/app.yaml": "kind: ConfigMap\n", "cloud/prod/svc.yaml": "kind: Service\n"} {
+		if b, err := os.ReadFile(filepath.Join(out, name)); err != nil || string(b) != want {
+			t.Errorf("published %s = %q, %v", name, b, err)
+		}
+	}
+}
+
+func TestPublishVersion(t *testing.T) {
+	var prs []string
+	cfg, remote := runFixture(t, &prs)
+	cfg.PublishURL = "s3://bucket/gitops"
+	bin := t.TempDir()
+	out := filepath.Join(t.TempDir(), "dest")
+	if err := os.WriteFile(filepath.Join(bin, "aws"), []byte("#!/bin/sh\necho \"$6\" > "+out+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	workdir := &git.Repo{Dir: t.TempDir()}
+	exec.Mustex("", "git", "clone", "-q", remote, workdir.Dir)
+	pub, err := newPublication(workdir, "prod", targetFiles{"//app:prod": {"cloud/prod/app.yaml"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// github_app creates its own commit, the upload is named after it
+	pub.version = "0123abcd"
+	if err := publishTrains(workdir, []publication{pub}, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if dest, _ := os.ReadFile(out); strings.TrimSpace(string(dest)) != "s3://bucket/gitops/prod/0123abcd/" {
+		t.Errorf("unexpected destination %q", dest)
+	}
+}
+
+func TestRunFrozen(t *testing.T) {
+	var prs []string
+	cfg, remote := runFixture(t, &prs)
+	cfg.GitCommit = "1a2b3c4"
+	cfg.FreezeWindows = []string{"2000-01-01T00:00:00Z/2100-01-01T00:00:00Z"}
+	cfg.PublishURL = "s3://bucket/gitops"
+	if err := Run(cfg); err != nil {
+		t.Errorf("frozen run without detailed exit codes: %v", err)
+	}
+	cfg.DetailedExitCodes = true
+	if err := Run(cfg); ExitCode(err) != ExitFrozen {
+		t.Errorf("expected exit code %d, got %v", ExitFrozen, err)
+	}
+	if exists, _ := git.RemoteBranchExists(remote, "deploy/prod"); exists || len(prs) != 0 {
+		t.Errorf("frozen run pushed the deployment branch or created PRs %v", prs)
+	}
+}
+
+func TestRollbackTrainFiles(t *testing.T) {
+	var prs []string
+	cfg, remote := runFixture(t, &prs)
+	cfg.OwnershipIndex = ".gitops/index/{train}.yaml"
+	work := filepath.Join(t.TempDir(), "work")
+	exec.Mustex("", "git", "clone", "-q", remote, work)
+	commit := func(msg string, files map[string]string) string {
+		for name, content := range files {
+			if err := os.MkdirAll(filepath.Dir(filepath.Join(work, name)), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(work, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		exec.Mustex(work, "git", "add", "-A")
+		exec.Mustex(work, "git", "commit", "-q", "-m", msg)
+		exec.Mustex(work, "git", "push", "-q", "origin", "HEAD:refs/heads/master")
+		return strings.TrimSpace(exec.Mustex(work, "git", "rev-parse", "HEAD"))
+	}
+	// the dev train has no ownership index, its files are described by the commit metadata
+	metadata, err := commitmsg.GenerateMetadata(commitmsg.Metadata{Train: "dev", Targets: []commitmsg.Target{{Label: "//app:dev", Files: []string{"cloud/dev/app.yaml"}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit("deploy dev\n"+metadata, map[string]string{"cloud/dev/app.yaml": "image: app@sha256:0\n"})
+	prev := commit("deploy", map[string]string{
+		"cloud/prod/app.yaml":     "image: app@sha256:1\n",
+		"cloud/dev/app.yaml":      "image: app@sha256:1\n",
+		".gitops/index/prod.yaml": "train: prod\ntargets:\n  //app:prod: [cloud/prod/app.yaml]\n",
+	})
+	commit("deploy", map[string]string{
+		"cloud/prod/app.yaml":     "image: app@sha256:2\n",
+		"cloud/prod/new.yaml":     "kind: Service\n",
+		"cloud/dev/app.yaml":      "image: app@sha256:2\n",
+		".gitops/index/prod.yaml": "train: prod\ntargets:\n  //app:prod: [cloud/prod/app.yaml, cloud/prod/new.yaml]\n",
+	})
+
+	cfg.RollbackTrain = "staging"
+	cfg.RollbackTo = prev
+	if err := rollback(cfg); ExitCode(err) != ExitConfig || !strings.Contains(err.Error(), "rollback_path") {
+		t.Errorf("expected rollback_path error without an index or gitops commit of the train, got %v", err)
+	}
+
+	cfg.RollbackTrain = "dev"
+	if err := rollback(cfg); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"cloud/prod/app.yaml": "image: app@sha256:2\n", "cloud/dev/app.yaml": "image: app@sha256:1\n"} {
+		if got := exec.Mustex(remote, "git", "show", "rollback/dev:"+name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	cfg.RollbackTrain = "prod"
+	if err := rollback(cfg); err != nil {
+		t.Fatal(err)
+	}
+	files := exec.Mustex(remote, "git", "ls-tree", "-r", "--name-only", "rollback/prod", "--", "cloud")
+	if files != "cloud/dev/app.yaml\ncloud/prod/app.yaml\ncloud/prod/svc.yaml\n" {
+		t.Errorf("unexpected files of the rollback branch %q", files)
+	}
+	for name, want := range map[string]string{"cloud/prod/app.yaml": "image: app@sha256:1\n", "cloud/dev/app.yaml": "image: app@sha256:2\n"} {
+		if got := exec.Mustex(remote, "git", "show", "rollback/prod:"+name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if len(prs) != 2 {
+		t.Errorf("unexpected PRs %v", prs)
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// promote copies manifests of one environment directory into another one and opens a PR.
+// Files are copied verbatim, so image digests deployed in the source environment are preserved.
+func promote(cfg *Config) error {
+	from := strings.Trim(cfg.PromoteFrom, "/")
+	to := strings.Trim(cfg.PromoteTo, "/")
+	fromBranch := cfg.PromoteFromBranch
+	if fromBranch == "" {
+		fromBranch = cfg.PRTargetBranch
+	}
+
+	gitopsDir, workdir, err := cloneRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gitopsDir)
+
+	files, err := workdir.ReadTree("origin/"+fromBranch, from)
+	if err != nil {
+		return phaseError(err)
+	}
+	if len(files) == 0 {
+		return errorf("no files found in %s at %s", from, fromBranch)
+	}
+
+	branch := branchNamespace("promote", cfg) + strings.ReplaceAll(to, "/", "-") + cfg.DeploymentBranchSuffix
+	workdir.RecreateBranch(branch, cfg.PRTargetBranch)
+
+	// replace the destination content so files removed in the source are removed as well
+	if err := os.RemoveAll(filepath.Join(gitopsDir, to)); err != nil {
+		return phaseError(err)
+	}
+	for name, content := range files {
+		dst := filepath.Join(gitopsDir, to, strings.TrimPrefix(name, from+"/"))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return phaseError(err)
+		}
+		if err := os.WriteFile(dst, content, 0644); err != nil {
+			return phaseError(err)
+		}
+	}
+
+	msg := fmt.Sprintf("GitOps promotion of %s from %s into %s", from, fromBranch, to)
+	if !workdir.Commit(commitMessage(to, "promote from "+from, msg, cfg), to) {
+		log.Printf("%s is up to date with %s, nothing to promote", to, from)
+		return noChanges(cfg)
+	}
+
+	if cfg.DryRun {
+		log.Printf("Dry run: would push %s and create a PR into %s", branch, cfg.PRTargetBranch)
+		return nil
+	}
+	workdir.Push([]string{branch})
+	title := cfg.PRTitle
+	if title == "" {
+		title = fmt.Sprintf("GitOps promotion %s to %s", from, to)
+	}
+	body := cfg.PRBody
+	if body == "" {
+		body = msg
+	}
+	body = withBuildFooter(body)
+	server, err := gitServer(cfg)
+	if err != nil {
+		return err
+	}
+	if err := git.CreatePRIdempotent(server, prHead(branch, cfg), cfg.PRTargetBranch, title, body, git.ReviewPolicy{}, idempotencyKey(branch, cfg)); err != nil {
+		return errorf("failed to create PR: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// parseTrainValues parses values in the train=value format. The value may contain '='.
+func parseTrainValues(flagName string, values []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, v := range values {
+		train, value, found := strings.Cut(v, "=")
+		if !found || train == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected train=value", flagName, v)
+		}
+		result[train] = value
+	}
+	return result, nil
+}
+
+// trainValue returns the value of the release train. Trains expanded per environment
+// or canary (train-suffix) inherit the value of their base train.
+func trainValue[V any](values map[string]V, train string) (V, bool) {
+	for t := train; ; {
+		if v, ok := values[t]; ok {
+			return v, true
+		}
+		i := strings.LastIndex(t, "-")
+		if i <= 0 {
+			var zero V
+			return zero, false
+		}
+		t = t[:i]
+	}
+}
+
+// setTrainValue records the value of the release train unless it is already set
+func setTrainValue(values *map[string]string, train, value string) {
+	if value == "" {
+		return
+	}
+	if *values == nil {
+		*values = make(map[string]string)
+	}
+	if _, ok := (*values)[train]; !ok {
+		(*values)[train] = value
+	}
+}
+
+// prText returns the PR title and body of the release train deployed from branch.
+// Per train values take precedence over --gitops_pr_title and --gitops_pr_body,
+// which take precedence over the defaults. {train} and {branch} are replaced in all of them.
+func prText(train, branch, defaultTitle, defaultBody string, cfg *Config) (title, body string) {
+	title, body = cfg.PRTitle, cfg.PRBody
+	if title == "" {
+		title = defaultTitle
+	}
+	if body == "" {
+		body = defaultBody
+	}
+	if v, ok := trainValue(cfg.TrainPRTitles, train); ok {
+		title = v
+	}
+	if v, ok := trainValue(cfg.TrainPRBodies, train); ok {
+		body = v
+	}
+	r := strings.NewReplacer("{train}", train, "{branch}", branch)
+	return r.Replace(title), r.Replace(body)
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// prunePRs closes the open deployment PRs and deletes the deployment branches of release trains
+// that are no longer discovered in --targets, e.g. of decommissioned services
+func prunePRs(cfg *Config) error {
+	setPhase("", PhaseDiscovery)
+	return pruneRetired(cfg)
+}
+
+// pruneRetired closes the open deployment PRs and deletes the deployment branches of release trains
+// that no gitops target of --targets defines, whatever its release branch
+func pruneRetired(cfg *Config) error {
+	trains, err := allTrains(cfg)
+	if err != nil {
+		return err
+	}
+	return pruneTrains(trains, cfg)
+}
+
+// pruneTrains closes the open deployment PRs and deletes the deployment branches of release trains other than trains
+func pruneTrains(trains map[string][]string, cfg *Config) error {
+	if len(trains) == 0 {
+		// a broken query must not retire every train
+		return errorf("no release trains found in %s, refusing to prune all deployment branches", cfg.Targets)
+	}
+	active := make(map[string]bool)
+	for train := range trains {
+		active[trainBranch(train, cfg)] = true
+	}
+	namespace := branchNamespace("deploy", cfg)
+	retired := func(branch string) bool {
+		return strings.HasPrefix(branch, namespace) && strings.HasSuffix(branch, cfg.DeploymentBranchSuffix) && !active[branch]
+	}
+
+	setPhase("", PhasePR)
+	server, err := gitServer(cfg)
+	if err != nil {
+		return err
+	}
+	ps, ok := server.(git.PruneServer)
+	if !ok {
+		return errorf("git server %s is unable to list and close PRs", cfg.GitHost)
+	}
+	prs, err := ps.ListOpenPRs(namespace, cfg.PRTargetBranch)
+	if err != nil {
+		return errorf("%w", err)
+	}
+	for _, pr := range prs {
+		if !retired(pr.Branch) {
+			continue
+		}
+		if cfg.DryRun {
+			log.Printf("Dry run: would close PR %d of retired branch %s", pr.Number, pr.Branch)
+			continue
+		}
+		if err := ps.ClosePR(pr, pruneComment(pr.Branch, cfg)); err != nil {
+			return errorf("failed to close PR of branch %s: %w", pr.Branch, err)
+		}
+	}
+
+	setPhase("", PhasePush)
+	repo := cfg.GitRepo
+	if cfg.GitPushRepo != "" {
+		repo = cfg.GitPushRepo
+	}
+	branches, err := git.RemoteBranches(repo, namespace)
+	if err != nil {
+		return errorf("%w", err)
+	}
+	var stale []string
+	for _, b := range branches {
+		if retired(b) {
+			stale = append(stale, b)
+		}
+	}
+	if len(stale) == 0 {
+		log.Println("No deployment branches of retired release trains")
+		return nil
+	}
+	sort.Strings(stale)
+	if cfg.DryRun {
+		log.Printf("Dry run: would delete branches %s", strings.Join(stale, ", "))
+		return nil
+	}
+	scratch, err := os.MkdirTemp(cfg.GitOpsTmpDir, "prune")
+	if err != nil {
+		return errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+	if err := git.DeleteRemoteBranches(scratch, repo, stale); err != nil {
+		return errorf("%w", err)
+	}
+	log.Printf("Deleted branches %s", strings.Join(stale, ", "))
+	return nil
+}
+
+// pruneComment explains why the PR of the retired deployment branch is closed
+func pruneComment(branch string, cfg *Config) string {
+	return fmt.Sprintf("Closing this PR: the release train `%s` is no longer defined by any gitops target in the source repository, "+
+		"e.g. because its service was decommissioned. The deployment branch `%s` is deleted.\n\n"+
+		"Manifests already deployed by the train are not removed.", trainOfBranch(branch, cfg), branch)
+}
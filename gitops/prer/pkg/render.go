@@ -0,0 +1,152 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+)
+
+// renderAll renders every release train into its own <train> directory under --render_dir.
+// Nothing is cloned, committed or pushed.
+func renderAll(cfg *Config) error {
+	if err := startRenders(cfg); err != nil {
+		return err
+	}
+	defer cfg.renders.finish()
+	root, err := filepath.Abs(cfg.RenderDir)
+	if err != nil {
+		return errorf("invalid --render_dir: %w", err)
+	}
+	setPhase("", PhaseDiscovery)
+	trains, err := findTrains(cfg)
+	if err != nil {
+		return err
+	}
+	if len(trains) == 0 {
+		log.Println("No matching targets found")
+		return nil
+	}
+
+	names := make([]string, 0, len(trains))
+	for train := range trains {
+		names = append(names, train)
+	}
+	sort.Strings(names)
+
+	owners := make(outputOwners)
+	for _, train := range names {
+		setPhase(train, PhaseRender)
+		dir := filepath.Join(root, train)
+		// remove manifests of the previous run so that the directory shows exactly what would be committed
+		if err := os.RemoveAll(dir); err != nil {
+			return errorf("failed to clean %s: %w", dir, err)
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return errorf("failed to create %s: %w", dir, err)
+		}
+		rendered, err := renderTrain(train, trains[train], dir, cfg)
+		if err != nil {
+			return err
+		}
+		if err := owners.claim(rendered); err != nil {
+			return err
+		}
+		if cfg.FluxPath != "" {
+			if err := writeFluxKustomization(dir, train, cfg); err != nil {
+				return err
+			}
+		}
+		targets := make([]string, 0, len(rendered))
+		for target := range rendered {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+		fmt.Printf("%s: %s\n", train, dir)
+		for _, target := range targets {
+			files := append([]string{}, rendered[target]...)
+			sort.Strings(files)
+			fmt.Printf("  %s\n", target)
+			for _, f := range files {
+				fmt.Printf("    %s\n", f)
+			}
+		}
+	}
+	return nil
+}
+
+// parseStdoutTargets parses --stdout_target target=path values into paths relative to the deployment root
+func parseStdoutTargets(values []string, gitopsPath string) (map[string]string, error) {
+	paths := make(map[string]string)
+	for _, v := range values {
+		target, path, found := strings.Cut(v, "=")
+		path = filepath.Clean(strings.ReplaceAll(path, "{gitops_path}", gitopsPath))
+		if !found || target == "" || path == "." || filepath.IsAbs(path) || path == ".." || strings.HasPrefix(path, "../") {
+			return nil, fmt.Errorf("invalid stdout_target %q, expected target=path with a path relative to the deployment root", v)
+		}
+		paths[target] = path
+	}
+	return paths, nil
+}
+
+// renderStdout runs the gitops binary bin writing its stdout into the manifest file path.
+// Stderr is logged.
+func renderStdout(bin string, args []string, path string) error {
+	log.Println("executing:", bin, redact.String(strings.Join(args, " ")), ">", path)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(bin, args...)
+	cmd.Stdout = f
+	cmd.Stderr = redact.NewWriter(os.Stderr)
+	err = cmd.Run()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// parseTrainArgs parses train=arg values into the arguments of every release train
+func parseTrainArgs(flagName string, values []string) (map[string][]string, error) {
+	args := make(map[string][]string)
+	for _, v := range values {
+		train, arg, found := strings.Cut(v, "=")
+		if !found || train == "" || arg == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected train=arg", flagName, v)
+		}
+		args[train] = append(args[train], arg)
+	}
+	return args, nil
+}
+
+// binaryArgs returns the extra arguments of the gitops binaries of the release train.
+// Trains expanded per environment or canary use the arguments of their base train.
+func binaryArgs(train string, cfg *Config) []string {
+	trainArgs, _ := trainValue(cfg.TrainBinaryArgs, train)
+	return append(append([]string{}, cfg.BinaryArgs...), trainArgs...)
+}
+
+// reservedBinaryArg reports whether arg is a flag of gitops binaries set by prer itself
+func reservedBinaryArg(arg string) bool {
+	name, _, _ := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+	return strings.HasPrefix(arg, "-") && (name == "deployment_root" || name == "nopush")
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// renderCache records the manifests rendered by gitops binaries, so a target shared by
+// several release trains runs once per distinct output instead of once per train
+type renderCache struct {
+	mu      sync.Mutex
+	entries map[string]renderedTarget
+	tmpDir  string
+	// state persists rendered targets between runs, see incremental.go
+	state     *renderState
+	statePath string
+	// recorded are the entries of state written by the run, merged into the state file by saveState
+	recorded *renderState
+	// bazelDigests are file digests of the --execution_log by exec root relative path
+	bazelDigests map[string]string
+}
+
+// renderedTarget is a copy of the files written by a target, relative to the deployment root.
+// Copies are kept on disk, so the cache does not hold manifests in memory.
+type renderedTarget struct {
+	files []string
+	dir   string
+}
+
+// newRenderCache returns the cache keeping copies of rendered files under tmpDir
+func newRenderCache(tmpDir string) *renderCache {
+	return &renderCache{entries: make(map[string]renderedTarget), tmpDir: tmpDir}
+}
+
+// renderKey identifies the output of the target rendered with args, independent of the deployment root
+func renderKey(target string, args []string) string {
+	return strings.Join(append([]string{target}, args...), "\x00")
+}
+
+// replay writes the cached files of the target rendered with args into deploymentRoot.
+// It returns the written files and false if the target was not rendered before. A nil cache is always empty.
+func (c *renderCache) replay(target string, args []string, deploymentRoot string) ([]string, bool, error) {
+	if c == nil {
+		return nil, false, nil
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[renderKey(target, args)]
+	c.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	log.Printf("Reusing manifests of %s rendered for another release train", target)
+	for _, f := range entry.files {
+		if err := copyFile(filepath.Join(entry.dir, f), filepath.Join(deploymentRoot, f)); err != nil {
+			return nil, false, err
+		}
+	}
+	return entry.files, true, nil
+}
+
+// record copies the files the target rendered with args has written into deploymentRoot
+func (c *renderCache) record(target string, args []string, deploymentRoot string, files []string) error {
+	if c == nil {
+		return nil
+	}
+	dir, err := os.MkdirTemp(c.tmpDir, "rendered")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := copyFile(filepath.Join(deploymentRoot, f), filepath.Join(dir, f)); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+	}
+	c.mu.Lock()
+	if prev, ok := c.entries[renderKey(target, args)]; ok {
+		os.RemoveAll(prev.dir)
+	}
+	c.entries[renderKey(target, args)] = renderedTarget{files: files, dir: dir}
+	c.mu.Unlock()
+	return nil
+}
+
+// finish saves the --render_state and removes the cached files of the run
+func (c *renderCache) finish() {
+	if c == nil {
+		return
+	}
+	c.saveState()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, entry := range c.entries {
+		os.RemoveAll(entry.dir)
+	}
+	c.entries = make(map[string]renderedTarget)
+}
+
+// copyFile streams the content of src into dst, creating the parent directories of dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// trainPattern is a list of values applying to release trains matching the pattern
+type trainPattern struct {
+	Pattern string
+	Values  []string
+}
+
+// parseTrainPatterns parses values in the pattern=value1,value2 format
+func parseTrainPatterns(flagName string, values []string) ([]trainPattern, error) {
+	var patterns []trainPattern
+	for _, v := range values {
+		pattern, list, found := strings.Cut(v, "=")
+		if !found || pattern == "" || list == "" {
+			return nil, fmt.Errorf("invalid %s %q, expected train_pattern=value1,value2", flagName, v)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", flagName, pattern, err)
+		}
+		patterns = append(patterns, trainPattern{Pattern: pattern, Values: strings.Split(list, ",")})
+	}
+	return patterns, nil
+}
+
+// matchTrain returns values of all patterns matching the train
+func matchTrain(train string, patterns []trainPattern) []string {
+	var values []string
+	for _, p := range patterns {
+		if ok, _ := path.Match(p.Pattern, train); ok {
+			values = append(values, p.Values...)
+		}
+	}
+	return values
+}
+
+// splitValues returns the values of flags accepting comma-separated lists, without empty values
+func splitValues(flags []string) []string {
+	var values []string
+	for _, f := range flags {
+		for _, v := range strings.Split(f, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = appendUnique(values, v)
+			}
+		}
+	}
+	return values
+}
+
+// reviewPolicy returns the review policy of the release train PR
+func reviewPolicy(train string, cfg *Config) git.ReviewPolicy {
+	policy := git.ReviewPolicy{
+		Reviewers:     appendUnique(slices.Clone(cfg.PRDefaultReviewers), matchTrain(train, cfg.PRReviewers)...),
+		TeamReviewers: appendUnique(slices.Clone(cfg.PRDefaultTeamReviewers), matchTrain(train, cfg.PRTeamReviewers)...),
+		Labels:        slices.Clone(cfg.PRLabels),
+		Assignees:     slices.Clone(cfg.PRAssignees),
+		AutoMerge:     cfg.PRAutoMerge,
+	}
+	for _, pattern := range cfg.AutoMergeTrains {
+		if ok, _ := path.Match(pattern, train); ok {
+			policy.AutoMerge = true
+		}
+	}
+	// the merge queue merges the PR, auto-merge would bypass or race it
+	policy.AutoMerge = policy.AutoMerge && !mergeQueue(train, cfg)
+	return policy
+}
+
+// mergeQueue reports whether PRs of the release train are added to the merge queue
+func mergeQueue(train string, cfg *Config) bool {
+	for _, pattern := range cfg.MergeQueueTrains {
+		if ok, _ := path.Match(pattern, train); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// combinedMergeQueue reports whether a single PR deploying several release trains is added
+// to the merge queue, which requires all trains to use it
+func combinedMergeQueue(trains []string, cfg *Config) bool {
+	for _, train := range trains {
+		if !mergeQueue(train, cfg) {
+			return false
+		}
+	}
+	return len(trains) > 0
+}
+
+// enqueuePR adds the PR from head to the merge queue of --gitops_pr_into and records its entry for the run summary
+func enqueuePR(server git.Server, train, head string, cfg *Config) error {
+	entry, err := git.EnqueuePR(server, head, cfg.PRTargetBranch)
+	if err != nil {
+		return errorf("failed to add the PR of %s to the merge queue: %w", train, err)
+	}
+	queuedPRs = append(queuedPRs, queuedPR{Train: train, Entry: *entry})
+	return nil
+}
+
+// combinedReviewPolicy returns the policy of a single PR deploying several release trains.
+// It requests reviewers of all trains, adds their labels and assignees and enables auto-merge only if all trains allow it.
+func combinedReviewPolicy(trains []string, cfg *Config) git.ReviewPolicy {
+	var combined git.ReviewPolicy
+	combined.AutoMerge = len(trains) > 0
+	for _, train := range trains {
+		p := reviewPolicy(train, cfg)
+		combined.Reviewers = appendUnique(combined.Reviewers, p.Reviewers...)
+		combined.TeamReviewers = appendUnique(combined.TeamReviewers, p.TeamReviewers...)
+		combined.Labels = appendUnique(combined.Labels, p.Labels...)
+		combined.Assignees = appendUnique(combined.Assignees, p.Assignees...)
+		combined.AutoMerge = combined.AutoMerge && p.AutoMerge
+	}
+	return combined
+}
+
+func appendUnique(list []string, values ...string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if l == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/commitmsg"
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// rollback restores the manifests of a release train to a previous deployment commit and opens a PR.
+// Without --rollback_path only the files of the train are restored, see rollbackFiles.
+func rollback(cfg *Config) error {
+	gitopsDir, workdir, err := cloneRepo(cfg)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gitopsDir)
+
+	branch := branchNamespace("rollback", cfg) + cfg.RollbackTrain + cfg.DeploymentBranchSuffix
+	workdir.RecreateBranch(branch, cfg.PRTargetBranch)
+	paths, commitPath := []string{cfg.RollbackPath}, cfg.RollbackPath
+	if cfg.RollbackPath == "" {
+		if paths, err = rollbackFiles(workdir, cfg); err != nil {
+			return err
+		}
+		commitPath = cfg.GitOpsPath
+	}
+	if err := workdir.Restore(cfg.RollbackTo, paths...); err != nil {
+		return phaseError(err)
+	}
+
+	msg := fmt.Sprintf("GitOps rollback of release train %s to %s", cfg.RollbackTrain, cfg.RollbackTo)
+	if !workdir.Commit(commitMessage(cfg.RollbackTrain, "roll back to "+cfg.RollbackTo, msg, cfg), commitPath) {
+		log.Printf("%s already matches %s, nothing to roll back", strings.Join(paths, " "), cfg.RollbackTo)
+		return noChanges(cfg)
+	}
+
+	if cfg.DryRun {
+		log.Printf("Dry run: would push %s and create a PR into %s", branch, cfg.PRTargetBranch)
+		return nil
+	}
+	workdir.Push([]string{branch})
+	title, body := prText(cfg.RollbackTrain, branch, fmt.Sprintf("GitOps rollback %s to %s", cfg.RollbackTrain, cfg.RollbackTo), msg, cfg)
+	body = withBuildFooter(body)
+	policy := reviewPolicy(cfg.RollbackTrain, cfg)
+	server, err := gitServer(cfg)
+	if err != nil {
+		return err
+	}
+	if err := git.CreatePRIdempotent(server, prHead(branch, cfg), cfg.PRTargetBranch, title, body, policy, idempotencyKey(branch+"@"+cfg.RollbackTo, cfg)); err != nil {
+		return errorf("failed to create PR: %w", err)
+	}
+	return nil
+}
+
+// rollbackFiles returns the files --rollback_train owned at --rollback_to, and the files it owns at the
+// rollback branch, which are removed if they were added since. Files of other release trains under
+// --gitops_path are left alone. Without the ownership index or a gitops commit of the train at
+// --rollback_to the files are unknown and --rollback_path must be set.
+func rollbackFiles(workdir *git.Repo, cfg *Config) ([]string, error) {
+	then, found, err := trainFiles(workdir, cfg.RollbackTo, cfg.RollbackTrain, cfg)
+	if err != nil {
+		return nil, phaseError(err)
+	}
+	if !found {
+		return nil, phaseError(ConfigError{fmt.Sprintf("rollback_path must be set, %s has no ownership index or gitops commit of release train %s", cfg.RollbackTo, cfg.RollbackTrain)})
+	}
+	owned := make(map[string]bool)
+	for _, f := range then {
+		owned[f] = true
+	}
+	if now, _, err := trainFiles(workdir, "HEAD", cfg.RollbackTrain, cfg); err == nil {
+		for _, f := range now {
+			if _, err := os.Stat(filepath.Join(workdir.Dir, f)); err == nil {
+				owned[f] = true
+			}
+		}
+	}
+	if len(owned) == 0 {
+		return nil, phaseError(ConfigError{fmt.Sprintf("rollback_path must be set, release train %s owned no files at %s", cfg.RollbackTrain, cfg.RollbackTo)})
+	}
+	paths := make([]string, 0, len(owned))
+	for f := range owned {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// trainFiles returns the files owned by the targets of the release train at ref: the files of its ownership index,
+// or of the most recent gitops commit of the train reachable from ref. found is false if neither exists.
+func trainFiles(workdir *git.Repo, ref, train string, cfg *Config) (files []string, found bool, err error) {
+	index, err := readOwnershipIndex(workdir, ref, train, cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	if index != nil {
+		for _, targetFiles := range index.Targets {
+			files = append(files, targetFiles...)
+		}
+		return files, true, nil
+	}
+	messages, err := workdir.CommitMessages(ref, fmt.Sprintf("%q: %q", "train", train), 0)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, msg := range messages {
+		m, err := commitmsg.ExtractMetadata(msg)
+		if err != nil || m == nil || m.Train != train {
+			continue
+		}
+		for _, targetFiles := range m.TargetFiles() {
+			files = append(files, targetFiles...)
+		}
+		return files, true, nil
+	}
+	return nil, false, nil
+}
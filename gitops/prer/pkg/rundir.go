@@ -0,0 +1,147 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// runDirPrefix names the run directories in --gitops_tmpdir
+const runDirPrefix = "gitops-"
+
+// maxRunDirs bounds the directories of concurrent runs with the same run id
+const maxRunDirs = 100
+
+// ciRunIDs are the environment variables identifying the pipeline, build and job of CI systems
+var ciRunIDs = [][]string{
+	{"BUILDKITE_PIPELINE_SLUG", "BUILDKITE_BUILD_NUMBER", "BUILDKITE_JOB_ID"},
+	{"GITHUB_REPOSITORY", "GITHUB_RUN_ID", "GITHUB_RUN_ATTEMPT", "GITHUB_JOB"},
+	{"CI_PROJECT_PATH_SLUG", "CI_PIPELINE_ID", "CI_JOB_ID"},
+	{"BUILD_TAG"}, // Jenkins
+}
+
+// defaultRunID returns the pipeline and build id of the CI job, "local" outside of CI
+func defaultRunID() string {
+	for _, names := range ciRunIDs {
+		var parts []string
+		for _, name := range names {
+			if v := os.Getenv(name); v != "" {
+				parts = append(parts, v)
+			}
+		}
+		if len(parts) == len(names) {
+			return strings.Join(parts, "-")
+		}
+	}
+	return "local"
+}
+
+var unsafeRunIDChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// runDir is the directory of the temporary files of a run, named after the run id.
+// Its lock file is locked while the run is in progress, so concurrent runs never share a directory.
+type runDir struct {
+	dir  string
+	lock *fileLock
+}
+
+// openRunDir creates the directory of the run in tmpDir and removes the directories of runs that are
+// no longer running. A concurrent run with the same id gets the next free directory, e.g. gitops-<id>-2.
+func openRunDir(tmpDir, runID string) (*runDir, error) {
+	base := filepath.Join(tmpDir, runDirPrefix+unsafeRunIDChars.ReplaceAllString(runID, "_"))
+	for i := 1; i <= maxRunDirs; i++ {
+		dir := base
+		if i > 1 {
+			dir = fmt.Sprintf("%s-%d", base, i)
+		}
+		lock, err := tryLockFile(dir + ".lock")
+		if errors.Is(err, errLocked) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		// a leftover of a crashed attempt of the same run
+		if err := os.RemoveAll(dir); err != nil {
+			lock.release()
+			return nil, err
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			lock.release()
+			return nil, err
+		}
+		cleanStaleRunDirs(tmpDir, dir)
+		log.Printf("Using run directory %s", dir)
+		return &runDir{dir: dir, lock: lock}, nil
+	}
+	return nil, fmt.Errorf("%d runs of %s are in progress", maxRunDirs, runID)
+}
+
+// cleanStaleRunDirs removes the run directories in tmpDir other than current whose lock is not held,
+// i.e. of runs that crashed or were killed before removing their directory
+func cleanStaleRunDirs(tmpDir, current string) {
+	if !fileLocking {
+		return
+	}
+	locks, _ := filepath.Glob(filepath.Join(tmpDir, runDirPrefix+"*.lock"))
+	for _, path := range locks {
+		dir := strings.TrimSuffix(path, ".lock")
+		if dir == current {
+			continue
+		}
+		lock, err := tryLockFile(path)
+		if err != nil {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("WARNING: unable to remove stale run directory %s: %v", dir, err)
+			lock.unlock()
+			continue
+		}
+		log.Printf("Removed stale run directory %s", dir)
+		lock.release()
+	}
+}
+
+// close removes the directory and releases its lock
+func (d *runDir) close() {
+	if err := os.RemoveAll(d.dir); err != nil {
+		log.Printf("WARNING: unable to remove run directory %s: %v", d.dir, err)
+		d.lock.unlock()
+		return
+	}
+	d.lock.release()
+}
+
+// lockMirror locks the lock file of the git mirror, gitops.lock in the mirror repository: shared while the mirror
+// is read and exclusive while it is written. Jobs updating the mirror use the same lock, e.g. flock(1).
+// It returns a no-op unlock function if the mirror is not set or a read-only mirror has no lock file.
+func lockMirror(mirror string, exclusive bool) (func(), error) {
+	if mirror == "" {
+		return func() {}, nil
+	}
+	lock, err := lockFile(filepath.Join(mirror, "gitops.lock"), exclusive)
+	if err != nil {
+		if exclusive {
+			return nil, fmt.Errorf("unable to lock git mirror %s: %w", mirror, err)
+		}
+		log.Printf("WARNING: reading git mirror %s without a lock: %v", mirror, err)
+		return func() {}, nil
+	}
+	return lock.unlock, nil
+}
@@ -0,0 +1,107 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	osexec "os/exec"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+	"github.com/fasterci/rules_gitops/gitops/metrics"
+	"github.com/fasterci/rules_gitops/gitops/serve"
+)
+
+// runPipeline checks out the triggering commit, or the head of the branch for scheduled runs, in the
+// pipeline workspace and runs create_gitops_prs for it in a separate process. The runs send metrics
+// to the DogStatsD agent of cfg.
+func runPipeline(ctx context.Context, p serve.Pipeline, t serve.Trigger, cfg *Config) error {
+	if t.Commit == "" {
+		if _, err := exec.Ex(p.Workspace, "git", "fetch", "origin", "--", t.Branch); err != nil {
+			return fmt.Errorf("unable to fetch %s: %w", t.Branch, err)
+		}
+		head, err := exec.Ex(p.Workspace, "git", "rev-parse", "FETCH_HEAD")
+		if err != nil {
+			return fmt.Errorf("unable to resolve the head of %s: %w", t.Branch, err)
+		}
+		t.Commit = strings.TrimSpace(head)
+	}
+	if _, err := exec.Ex(p.Workspace, "git", "fetch", "origin", "--", t.Commit); err != nil {
+		return fmt.Errorf("unable to fetch %s: %w", t.Commit, err)
+	}
+	if _, err := exec.Ex(p.Workspace, "git", "checkout", "-f", "--detach", t.Commit, "--"); err != nil {
+		return fmt.Errorf("unable to checkout %s: %w", t.Commit, err)
+	}
+	metricsFile, err := os.CreateTemp("", "gitops-metrics-*.json")
+	if err != nil {
+		return err
+	}
+	metricsFile.Close()
+	defer os.Remove(metricsFile.Name())
+	args := append(append([]string{}, p.Args...), "--workspace", p.Workspace, "--branch_name", t.Branch, "--git_commit", t.Commit, "--metrics_file", metricsFile.Name())
+	args = append(args, statsdArgs(cfg)...)
+	if t.Command != "" {
+		args = append(args, t.Command)
+	}
+	cmd := osexec.CommandContext(ctx, os.Args[0], args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	start := time.Now()
+	err = childError(cmd.Run())
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	metrics.Add(metricRuns, 1, "pipeline", p.Name, "result", result)
+	metrics.Observe(metricRunDuration, time.Since(start).Seconds(), "pipeline", p.Name)
+	if run, loadErr := metrics.Load(metricsFile.Name()); loadErr == nil {
+		metrics.Default.Merge(run)
+	}
+	return err
+}
+
+// childError returns the error of a create_gitops_prs process, nil if it exited because there were no changes
+// or because of a deployment freeze
+func childError(err error) error {
+	var ee *osexec.ExitError
+	if errors.As(err, &ee) && (ee.ExitCode() == ExitNoChanges || ee.ExitCode() == ExitFrozen) {
+		return nil
+	}
+	return err
+}
+
+// serveWebhooks runs create_gitops_prs as a service triggered by git push webhooks
+func serveWebhooks(cfg *Config) error {
+	sc, err := serve.LoadConfig(cfg.ServeConfig)
+	if err != nil {
+		return phaseError(err)
+	}
+	if cfg.WebhookSecret == "" {
+		log.Print("WARNING: --insecure_webhooks is set, webhook requests are not verified")
+	}
+	srv := serve.New(sc, cfg.WebhookSecret, cfg.Debounce, func(ctx context.Context, p serve.Pipeline, t serve.Trigger) error {
+		return runPipeline(ctx, p, t, cfg)
+	})
+	srv.SetAPIToken(cfg.APIToken)
+	srv.SetStatusRuns(cfg.StatusRuns)
+	if cfg.ServeMetrics {
+		srv.Handle("/metrics", metrics.Default.Handler())
+	}
+	srv.Start(context.Background())
+	log.Printf("Listening on %s for %d pipelines", cfg.Listen, len(sc.Pipelines))
+	return phaseError(http.ListenAndServe(cfg.Listen, srv.Handler()))
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+	"github.com/fasterci/rules_gitops/gitops/servicenow"
+)
+
+// trainOfBranch returns the release train of a deployment branch
+func trainOfBranch(branch string, cfg *Config) string {
+	return strings.TrimSuffix(strings.TrimPrefix(branch, branchNamespace("deploy", cfg)), cfg.DeploymentBranchSuffix)
+}
+
+// changeRequired reports whether deployments of the train need a change request
+func changeRequired(train string, cfg *Config) bool {
+	if cfg.ServiceNowURL == "" {
+		return false
+	}
+	for _, pattern := range cfg.ServiceNowTrains {
+		if ok, _ := path.Match(pattern, train); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// changeRequestRe matches the change request section of PR bodies
+var changeRequestRe = regexp.MustCompile(`(?m)^Change request: \[[^\]]+\]\([^)]+\)$`)
+
+// changeTrains returns the trains among trains whose deployments need a change request
+func changeTrains(trains []string, cfg *Config) []string {
+	var production []string
+	for _, train := range trains {
+		if changeRequired(train, cfg) {
+			production = append(production, train)
+		}
+	}
+	return production
+}
+
+// findChangeRequest returns the change request section of the open PR from head, empty if there is none.
+// Updates and retries of the PR reuse it instead of creating another change request.
+func findChangeRequest(server git.Server, head string, cfg *Config) (string, error) {
+	ds, ok := server.(git.DedupServer)
+	if !ok {
+		return "", nil
+	}
+	pr, err := ds.FindOpenPR(head, cfg.PRTargetBranch)
+	if err != nil {
+		return "", errorf("failed to find the PR of %s: %w", head, err)
+	}
+	if pr == nil {
+		return "", nil
+	}
+	return changeRequestRe.FindString(pr.Body), nil
+}
+
+// attachChangeRequest creates a change request for the production trains of the open PR from head and
+// adds it to the PR body. It is called once the PR exists, so failed runs leave no change requests behind.
+// body is the PR body without the build footer and the idempotency key.
+func attachChangeRequest(server git.Server, production []string, head, branch, title, body string, policy git.ReviewPolicy, key string, cfg *Config) error {
+	section, err := createChangeRequest(production, branch, title, body, cfg)
+	if err != nil {
+		return err
+	}
+	ds, ok := server.(git.DedupServer)
+	if !ok {
+		log.Printf("WARNING: the git server can not update PRs, %s is not linked from the PR of %s", section, head)
+		return nil
+	}
+	pr, err := ds.FindOpenPR(head, cfg.PRTargetBranch)
+	if err != nil {
+		return errorf("failed to find the PR of %s: %w", head, err)
+	}
+	if pr == nil {
+		log.Printf("WARNING: no open PR of %s, %s is not linked", head, section)
+		return nil
+	}
+	body = withBuildFooter(body+"\n\n"+section) + "\n\n" + git.Marker(key)
+	if err := ds.UpdatePR(pr, title, body, policy); err != nil {
+		return errorf("failed to link the change request from %s: %w", pr.URL, err)
+	}
+	return nil
+}
+
+// createChangeRequest creates a change request for the production trains and returns the PR body section referencing it
+func createChangeRequest(production []string, branch, title, body string, cfg *Config) (string, error) {
+	tmpl := servicenow.DefaultTemplate
+	if cfg.ServiceNowTemplate != "" {
+		var err error
+		if tmpl, err = servicenow.LoadTemplate(cfg.ServiceNowTemplate); err != nil {
+			return "", errorf("failed to load change request template: %w", err)
+		}
+	}
+	fields := tmpl.Fields(servicenow.Vars{
+		Train:  strings.Join(production, ", "),
+		Branch: branch,
+		Commit: cfg.GitCommit,
+		Title:  title,
+		Body:   body,
+	})
+	if cfg.ServiceNowAssignmentGroup != "" {
+		fields["assignment_group"] = cfg.ServiceNowAssignmentGroup
+	}
+	c := &servicenow.Client{URL: cfg.ServiceNowURL, User: cfg.ServiceNowUser, Password: cfg.ServiceNowPassword}
+	cr, err := c.Create(fields)
+	if err != nil {
+		return "", errorf("failed to create change request for %v: %w", production, err)
+	}
+	log.Printf("Created change request %s for %v", cr.Number, production)
+	link := fmt.Sprintf("%s/nav_to.do?uri=change_request.do?sys_id=%s", strings.TrimSuffix(cfg.ServiceNowURL, "/"), cr.SysID)
+	return fmt.Sprintf("Change request: [%s](%s)", cr.Number, link), nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/git"
+)
+
+// queuedPR is a PR added to the merge queue by the run
+type queuedPR struct {
+	Train string
+	Entry git.QueueEntry
+}
+
+// queuedPRs are the PRs added to merge queues during the run, reported by the run summary
+var queuedPRs []queuedPR
+
+// orderedPR is a PR created by the run of a release train with prerequisites
+type orderedPR struct {
+	Train   string
+	Pending []pendingPrerequisite
+}
+
+// orderedPRs are the PRs created during the run in dependency order when --train_depends_on is set
+var orderedPRs []orderedPR
+
+// frozenReason is the deployment freeze that stopped the run before the push, reported by the run summary
+var frozenReason string
+
+// logRunSummary logs the duration, the peak memory and the metrics of the run,
+// the merge queue position and state of the PRs it has queued and the order of the PRs it has created
+func logRunSummary(trains int, start time.Time) {
+	endPhase()
+	self, children := peakMemory()
+	log.Printf("Run summary: %d release trains in %s, peak memory %s, largest gitops binary %s",
+		trains, time.Since(start).Round(time.Millisecond), formatBytes(self), formatBytes(children))
+	log.Printf("Run metrics: %s", metricsSummary())
+	if frozenReason != "" {
+		log.Printf("Deployment freeze: nothing was pushed (%s)", frozenReason)
+		frozenReason = ""
+	}
+	if len(queuedPRs) > 0 {
+		log.Printf("Merge queue: %s", mergeQueueSummary(queuedPRs))
+		queuedPRs = nil
+	}
+	if len(orderedPRs) > 0 {
+		log.Printf("PR order: %s", prOrderSummary(orderedPRs))
+		orderedPRs = nil
+	}
+}
+
+// prOrderSummary describes the PRs in creation order and their pending prerequisites, e.g. infra, app (waits for infra)
+func prOrderSummary(ordered []orderedPR) string {
+	var entries []string
+	for _, o := range ordered {
+		entry := o.Train
+		if len(o.Pending) > 0 {
+			var trains []string
+			for _, p := range o.Pending {
+				trains = append(trains, p.Train)
+			}
+			entry += fmt.Sprintf(" (waits for %s)", strings.Join(trains, ", "))
+		}
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ", ")
+}
+
+// mergeQueueSummary describes the queue entries, e.g. prod #2 (AWAITING_CHECKS)
+func mergeQueueSummary(queued []queuedPR) string {
+	var entries []string
+	for _, q := range queued {
+		entries = append(entries, fmt.Sprintf("%s #%d (%s)", q.Train, q.Entry.Position, q.Entry.State))
+	}
+	return strings.Join(entries, ", ")
+}
+
+// formatBytes formats n bytes in binary units, e.g. 1.5 MiB
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
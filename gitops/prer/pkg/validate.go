@@ -0,0 +1,397 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"os"
+	osexec "os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/fasterci/rules_gitops/gitops/freeze"
+	"github.com/fasterci/rules_gitops/gitops/git/azuredevops"
+	"github.com/fasterci/rules_gitops/gitops/git/bitbucket"
+	"github.com/fasterci/rules_gitops/gitops/git/codecommit"
+	"github.com/fasterci/rules_gitops/gitops/git/external"
+	"github.com/fasterci/rules_gitops/gitops/git/gerrit"
+	"github.com/fasterci/rules_gitops/gitops/git/gitea"
+	"github.com/fasterci/rules_gitops/gitops/git/github"
+	"github.com/fasterci/rules_gitops/gitops/git/github_app"
+	"github.com/fasterci/rules_gitops/gitops/git/gitlab"
+	"github.com/fasterci/rules_gitops/gitops/git/local"
+	"github.com/fasterci/rules_gitops/gitops/vault"
+)
+
+// ConfigError lists all problems of an invalid Config
+type ConfigError []string
+
+func (e ConfigError) Error() string {
+	return "invalid configuration:\n  " + strings.Join(e, "\n  ")
+}
+
+// add records err, every error of errors joined with errors.Join separately
+func (e *ConfigError) add(err error) {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, err := range joined.Unwrap() {
+			e.add(err)
+		}
+		return
+	}
+	*e = append(*e, err.Error())
+}
+
+func (e *ConfigError) addf(format string, args ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, args...))
+}
+
+// checkPath records a problem if the path of the flag does not exist
+func (e *ConfigError) checkPath(flag, path string) {
+	if _, err := os.Stat(path); err != nil {
+		e.addf("%s: %v", flag, err)
+	}
+}
+
+// checkDir records a problem if the path of the flag is not a directory
+func (e *ConfigError) checkDir(flag, path string) {
+	if fi, err := os.Stat(path); err != nil {
+		e.addf("%s: %v", flag, err)
+	} else if !fi.IsDir() {
+		e.addf("%s: %s is not a directory", flag, path)
+	}
+}
+
+// checkExecutable records a problem if the executable of the flag is not found
+func (e *ConfigError) checkExecutable(flag, name string) {
+	if _, err := osexec.LookPath(name); err != nil {
+		e.addf("%s: %v", flag, err)
+	}
+}
+
+// branchPrefixRe matches --deploy_branch_prefix values usable in git branch names
+var branchPrefixRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*(/[A-Za-z0-9_-][A-Za-z0-9._-]*)*$`)
+
+// commitRe matches full and abbreviated git commit SHAs
+var commitRe = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// checkCommit returns a ConfigError unless --git_commit is the SHA of the source commit,
+// which the PRs of runs pushing deployment branches are titled after
+func checkCommit(cfg *Config) error {
+	if !commitRe.MatchString(cfg.GitCommit) {
+		return ConfigError{fmt.Sprintf("git_commit must be a commit SHA of 7 to 40 hex characters, got %q", cfg.GitCommit)}
+	}
+	return nil
+}
+
+// serverValidators report missing configuration of the git servers without contacting them
+var serverValidators = map[string]func() error{
+	"github":      github.Validate,
+	"gitlab":      gitlab.Validate,
+	"bitbucket":   bitbucket.Validate,
+	"azuredevops": azuredevops.Validate,
+	"codecommit":  codecommit.Validate,
+	"gerrit":      gerrit.Validate,
+	"gitea":       gitea.Validate,
+	"github_app":  github_app.Validate,
+	"local":       local.Validate,
+	"exec":        external.ValidateExec,
+	"webhook":     external.ValidateWebhook,
+}
+
+// Validate checks the Config for the command cmd, the PR creation pipeline if cmd is empty.
+// It returns a ConfigError listing all problems found.
+func (cfg *Config) Validate(cmd string) error {
+	var problems ConfigError
+	clones := cmd == "" || cmd == "drift" || cmd == "diff-stats" || cmd == "promote" || cmd == "rollback"
+	createsPRs := (cmd == "" || cmd == "promote" || cmd == "rollback" || cmd == "publish-prs") && !cfg.DryRun
+	// runs with --prune_prs list PRs in dry runs as well
+	prunes := cmd == "prune-prs" || (cmd == "" && cfg.PrunePRs)
+
+	// git
+	if (clones || cmd == "publish-prs" || cmd == "prune-prs") && cfg.GitRepo == "" {
+		problems.addf("git_repo must be set")
+	}
+	if cfg.Offline || cmd == "publish-prs" {
+		// publish-prs applies bundles without a mirror
+		if cfg.GitMirror == "" && (cmd != "publish-prs" || cfg.BundleDir == "") {
+			problems.addf("offline and publish-prs require git_mirror")
+		}
+		if cfg.PRManifest == "" && cfg.BundleDir == "" {
+			problems.addf("offline and publish-prs require pr_manifest or bundle_dir")
+		}
+	}
+	if cfg.BundleDir != "" {
+		if cmd != "" && cmd != "publish-prs" {
+			problems.addf("bundle_dir is not supported by %s", cmd)
+		}
+		if cmd == "" && !cfg.Offline {
+			problems.addf("bundle_dir requires offline")
+		}
+		if cmd == "" && cfg.PublishURL != "" {
+			problems.addf("publish_url can not be combined with bundle_dir, release trains are published once their deployment branch is pushed")
+		}
+	}
+	if cfg.Offline && (cmd == "publish-prs" || cmd == "prune-prs") {
+		problems.addf("%s calls the git_server API and can not run offline", cmd)
+	}
+	if cfg.PrunePRs {
+		if cmd != "" {
+			problems.addf("prune_prs is not supported by %s, use the prune-prs command", cmd)
+		} else if cfg.Offline {
+			problems.addf("prune_prs calls the git_server API and can not run offline, use the prune-prs command of the publishing job")
+		} else if cfg.GitHost == "gerrit" && cfg.GitServer == nil {
+			problems.addf("prune_prs is not supported by the gerrit git_server, which has no pull requests")
+		}
+	}
+	if cfg.GitMirror != "" {
+		problems.checkDir("git_mirror", cfg.GitMirror)
+	}
+	if cfg.GitPushRepo != "" {
+		if cfg.Offline {
+			problems.addf("git_push_repo is not supported offline, deployment branches are pushed to git_mirror")
+		}
+		if cfg.GitHost == "github_app" && cfg.GitServer == nil {
+			problems.addf("git_push_repo is not supported by the github_app git_server, which commits through the API")
+		}
+		if cfg.GitHost == "gerrit" && cfg.GitServer == nil {
+			problems.addf("git_push_repo is not supported by the gerrit git_server, which pushes changes to git_repo")
+		}
+		if pushOwner(cfg) == "" {
+			problems.addf("unable to derive the owner of git_push_repo %q, set git_push_owner", cfg.GitPushRepo)
+		}
+	} else if cfg.GitPushOwner != "" {
+		problems.addf("git_push_owner requires git_push_repo")
+	}
+	if cfg.CABundle != "" {
+		problems.checkPath("ca_bundle", cfg.CABundle)
+	}
+	if (cfg.ClientCert == "") != (cfg.ClientKey == "") {
+		problems.addf("client_cert and client_key must be set together")
+	} else if cfg.ClientCert != "" {
+		problems.checkPath("client_cert", cfg.ClientCert)
+		problems.checkPath("client_key", cfg.ClientKey)
+	}
+	if cfg.GitHost == "gerrit" && cfg.GitServer == nil && !cfg.Offline && cmd != "" && (createsPRs || prunes) {
+		problems.addf("%s is not supported by the gerrit git_server, which has no pull requests", cmd)
+	}
+	if (createsPRs || prunes) && cfg.GitServer == nil && !cfg.Offline {
+		if validate, ok := serverValidators[cfg.GitHost]; !ok {
+			problems.addf("unsupported git_server %q", cfg.GitHost)
+		} else if err := validate(); err != nil {
+			problems.add(err)
+		}
+	}
+
+	// gitops
+	if p := filepath.Clean(cfg.GitOpsPath); cfg.GitOpsPath == "" || filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+		problems.addf("gitops_path %q must be a relative path inside the deployment repository", cfg.GitOpsPath)
+	}
+	if p := filepath.Clean(cfg.DeploymentLayout); cfg.DeploymentLayout != "" && (filepath.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../")) {
+		problems.addf("deployment_layout %q must be a relative path inside the deployment repository", cfg.DeploymentLayout)
+	}
+	problems.checkDir("gitops_tmpdir", cfg.GitOpsTmpDir)
+	if p := strings.Trim(cfg.DeployBranchPrefix, "/"); p != "" && (!branchPrefixRe.MatchString(p) || strings.Contains(p, "..")) {
+		problems.addf("invalid deploy_branch_prefix %q: use letters, digits, '.', '_', '-' and '/'", cfg.DeployBranchPrefix)
+	}
+	if cfg.RenderState != "" {
+		problems.checkDir("render_state", filepath.Dir(cfg.RenderState))
+	}
+	if cfg.ExecutionLog != "" {
+		if cfg.RenderState == "" {
+			problems.addf("execution_log requires render_state")
+		}
+		problems.checkPath("execution_log", cfg.ExecutionLog)
+	}
+	if cfg.PushParallelism < 1 {
+		problems.addf("push_parallelism must be at least 1, got %d", cfg.PushParallelism)
+	}
+	if cfg.RenderParallelism < 1 {
+		problems.addf("render_parallelism must be at least 1, got %d", cfg.RenderParallelism)
+	}
+	for _, arg := range cfg.BinaryArgs {
+		if reservedBinaryArg(arg) {
+			problems.addf("gitops_binary_arg %q overrides an argument set by prer", arg)
+		}
+	}
+	for train, args := range cfg.TrainBinaryArgs {
+		for _, arg := range args {
+			if reservedBinaryArg(arg) {
+				problems.addf("train_binary_arg %q of %s overrides an argument set by prer", arg, train)
+			}
+		}
+	}
+	if cfg.OwnershipIndex != "" && !strings.Contains(cfg.OwnershipIndex, "{train}") {
+		problems.addf("ownership_index %q must contain the {train} placeholder, every release train has its own index", cfg.OwnershipIndex)
+	}
+	if cfg.MaxDiffFiles < 0 || cfg.MaxDiffLines < 0 {
+		problems.addf("max_diff_files and max_diff_lines must not be negative")
+	}
+	if len(cfg.ResolvedPushes) > 0 && len(cfg.ResolvedBinaries) == 0 {
+		problems.addf("resolved_push requires resolved_binary")
+	}
+	if cfg.Interactive && (cmd == "serve" || cmd == "operator") {
+		problems.addf("interactive can not be used with the %s command", cmd)
+	}
+	if cfg.StatusRuns < 0 {
+		problems.addf("status_runs must not be negative, got %d", cfg.StatusRuns)
+	}
+	if cfg.AffectedLabels && cfg.GitServer == nil && !cfg.Offline && cfg.GitHost == "bitbucket" {
+		problems.addf("pr_affected_labels is not supported by the bitbucket git_server, use pr_affected_section")
+	}
+	if len(cfg.PRAssignees) > 0 && cfg.GitServer == nil && !cfg.Offline && cfg.GitHost != "github" && cfg.GitHost != "github_app" {
+		problems.addf("gitops_pr_assignees requires the github or github_app git_server, got %s", cfg.GitHost)
+	}
+	if cfg.PRAutoMerge && cfg.GitServer == nil && !cfg.Offline && (cfg.GitHost == "codecommit" || cfg.GitHost == "gerrit") {
+		problems.addf("gitops_pr_automerge is not supported by the %s git_server", cfg.GitHost)
+	}
+	if cfg.GitHubDeployments && cfg.GitServer == nil {
+		switch {
+		case cfg.Offline:
+			problems.addf("github_deployments is not supported with offline, deployments are not recorded in the pr_manifest")
+		case cfg.GitHost != "github" && cfg.GitHost != "github_app":
+			problems.addf("github_deployments requires the github or github_app git_server, got %s", cfg.GitHost)
+		case cfg.GitPushRepo != "":
+			problems.addf("github_deployments is not supported with git_push_repo, deployment branches of forks can not be deployed")
+		}
+	}
+	if cfg.GitHubDeployments && strings.TrimSpace(cfg.DeploymentEnvironment) == "" {
+		problems.addf("github_deployment_environment must not be empty")
+	}
+	if len(cfg.MergeQueueTrains) > 0 && cfg.GitServer == nil {
+		if cfg.Offline {
+			problems.addf("merge_queue is not supported with offline, merge queues are not recorded in the pr_manifest")
+		} else if cfg.GitHost != "github" && cfg.GitHost != "github_app" {
+			problems.addf("merge_queue requires the github or github_app git_server, got %s", cfg.GitHost)
+		}
+	}
+	if cfg.CommitStyle != commitStyleDefault && cfg.CommitStyle != commitStyleConventional {
+		problems.addf("invalid commit_style %q, expected %s or %s", cfg.CommitStyle, commitStyleDefault, commitStyleConventional)
+	}
+
+	// validation gates
+	if cfg.ScanSecretsEntropy && !cfg.ScanSecrets {
+		problems.addf("scan_secrets_entropy requires scan_secrets")
+	}
+	if cfg.SecretsAllowlist != "" {
+		if !cfg.ScanSecrets {
+			problems.addf("secrets_allowlist requires scan_secrets")
+		}
+		problems.checkPath("secrets_allowlist", cfg.SecretsAllowlist)
+	}
+	if cfg.PolicyPath != "" {
+		problems.checkPath("policy", cfg.PolicyPath)
+		problems.checkExecutable("conftest", cfg.Conftest)
+	}
+	if (cfg.CRDSchemas != "" || cfg.KubernetesVersion != "") && !cfg.ValidateSchemas {
+		problems.addf("crd_schemas and kubernetes_version require validate_schemas")
+	}
+	if _, err := compilePlaceholderAllowlist(cfg.AllowedPlaceholders); err != nil {
+		problems.add(err)
+	}
+	if cfg.ValidateSchemas {
+		problems.checkExecutable("kubeconform", cfg.Kubeconform)
+		if cfg.CRDSchemas != "" {
+			problems.checkDir("crd_schemas", cfg.CRDSchemas)
+		}
+	}
+
+	// integrations
+	if len(cfg.VaultSecrets) > 0 {
+		if cfg.VaultAddr == "" {
+			problems.addf("vault_secret requires vault_addr")
+		}
+		if !vault.Supported(cfg.VaultAuthMethod) {
+			problems.addf("unsupported vault_auth_method %q", cfg.VaultAuthMethod)
+		}
+		if (cfg.VaultAuthMethod == "jwt" || cfg.VaultAuthMethod == "kubernetes" || cfg.VaultAuthMethod == "approle") && cfg.VaultRole == "" {
+			problems.addf("vault_auth_method %s requires vault_role", cfg.VaultAuthMethod)
+		}
+	}
+	if cfg.JiraTransition != "" && (cfg.JiraURL == "" || cfg.JiraUser == "" || cfg.JiraToken == "") {
+		problems.addf("jira_transition requires jira_url, jira_user and jira_token")
+	}
+	if cfg.JiraTransition != "" && len(cfg.JiraProjects) == 0 {
+		// without projects tokens like UTF-8 or SHA-256 are taken for ticket keys
+		problems.addf("jira_transition requires jira_project, only tickets of the listed projects are transitioned")
+	}
+	if len(cfg.ServiceNowTrains) > 0 && cfg.ServiceNowURL == "" {
+		problems.addf("servicenow_train requires servicenow_url")
+	}
+	if cfg.ServiceNowURL != "" && (cfg.ServiceNowUser == "" || cfg.ServiceNowPassword == "") {
+		problems.addf("servicenow_url requires servicenow_user and servicenow_password")
+	}
+	if cfg.ServiceNowTemplate != "" {
+		problems.checkPath("servicenow_template", cfg.ServiceNowTemplate)
+	}
+	if cfg.StatsDHost != "" && (cfg.StatsDPort < 1 || cfg.StatsDPort > 65535) {
+		problems.addf("invalid statsd_port %d", cfg.StatsDPort)
+	}
+
+	// deployment freezes
+	if loc, err := time.LoadLocation(cfg.FreezeTimezone); err != nil {
+		problems.addf("invalid freeze_timezone: %v", err)
+	} else {
+		for _, fw := range cfg.FreezeWindows {
+			if _, err := freeze.ParseWindow(fw, loc); err != nil {
+				problems.addf("invalid freeze_window: %v", err)
+			}
+		}
+	}
+
+	// commands
+	switch cmd {
+	case "render":
+		if cfg.RenderDir == "" {
+			problems.addf("render_dir must be set")
+		}
+	case "list-trains", "diff-stats":
+		if cfg.ListFormat != "json" && cfg.ListFormat != "table" {
+			problems.addf("invalid list_format %q: must be json or table", cfg.ListFormat)
+		}
+	case "promote":
+		from, to := strings.Trim(cfg.PromoteFrom, "/"), strings.Trim(cfg.PromoteTo, "/")
+		if from == "" || to == "" {
+			problems.addf("promote_from and promote_to must be set")
+		} else if from == to && cfg.PromoteFromBranch == "" {
+			problems.addf("promote_from and promote_to are the same")
+		}
+	case "rollback":
+		if cfg.RollbackTrain == "" || cfg.RollbackTo == "" {
+			problems.addf("rollback_train and rollback_to must be set")
+		}
+	case "serve":
+		if cfg.ServeConfig == "" {
+			problems.addf("serve_config must be set")
+		} else {
+			problems.checkPath("serve_config", cfg.ServeConfig)
+		}
+		if cfg.Debounce <= 0 {
+			problems.addf("debounce must be positive")
+		}
+		if cfg.WebhookSecret == "" && !cfg.InsecureWebhooks {
+			problems.addf("webhook_secret must be set to verify webhooks, or --insecure_webhooks to accept them unverified")
+		}
+	case "operator":
+		if cfg.Kubeconfig != "" {
+			problems.checkPath("kubeconfig", cfg.Kubeconfig)
+		}
+		if cfg.OperatorInterval <= 0 {
+			problems.addf("operator_interval must be positive")
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
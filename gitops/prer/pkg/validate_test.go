@@ -0,0 +1,104 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GitRepo = "https://github.com/example/deploy.git"
+	cfg.GitOpsTmpDir = t.TempDir()
+	cfg.DryRun = true
+	if err := cfg.Validate(""); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	cfg.DryRun = false
+	cfg.GitRepo = ""
+	cfg.PushParallelism = 0
+	cfg.JiraTransition = "Deployed"
+	cfg.CommitStyle = "fancy"
+	cfg.StatsDHost = "localhost"
+	cfg.StatsDPort = 0
+	cfg.DeployBranchPrefix = "my app"
+	cfg.VaultAddr = ""
+	cfg.VaultSecrets = map[string]string{"jira_token": "secret/data/jira#token"}
+	cfg.MergeQueueTrains = []string{"prod"}
+	cfg.BundleDir = "bundles"
+	cfg.OwnershipIndex = ".gitops/index.yaml"
+	err := cfg.Validate("")
+	var problems ConfigError
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected ConfigError, got %v", err)
+	}
+	for _, want := range []string{"git_repo", "push_parallelism", "jira_transition", "requires jira_project", "commit_style", "statsd_port", "deploy_branch_prefix", "bitbucket_user", "vault_addr", "merge_queue requires the github", "bundle_dir requires offline", "ownership_index"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %s problem in %v", want, err)
+		}
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.GitOpsTmpDir = t.TempDir()
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"render", "render_dir"},
+		{"promote", "promote_from"},
+		{"rollback", "rollback_train"},
+		{"serve", "serve_config"},
+		{"drift", "git_repo"},
+	}
+	for _, tt := range tests {
+		err := cfg.Validate(tt.cmd)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: expected %s problem, got %v", tt.cmd, tt.want, err)
+		}
+	}
+	if err := cfg.Validate("list-trains"); err != nil {
+		t.Errorf("list-trains: unexpected error %v", err)
+	}
+	cfg.ServeConfig = filepath.Join(cfg.GitOpsTmpDir, "pipelines.json")
+	if err := os.WriteFile(cfg.ServeConfig, []byte(`{"pipelines": []}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate("serve"); err == nil || !strings.Contains(err.Error(), "webhook_secret") {
+		t.Errorf("serve: expected webhook_secret problem, got %v", err)
+	}
+	cfg.InsecureWebhooks = true
+	if err := cfg.Validate("serve"); err != nil {
+		t.Errorf("serve: unexpected error %v", err)
+	}
+	cfg.GitHost = "gerrit"
+	if err := cfg.Validate("prune-prs"); err == nil || !strings.Contains(err.Error(), "not supported by the gerrit git_server") {
+		t.Errorf("prune-prs: expected gerrit problem, got %v", err)
+	}
+	cfg.PRAutoMerge = true
+	if err := cfg.Validate(""); err == nil || !strings.Contains(err.Error(), "gitops_pr_automerge is not supported by the gerrit git_server") {
+		t.Errorf("expected gitops_pr_automerge problem, got %v", err)
+	}
+	cfg.PrunePRs = true
+	if err := cfg.Validate(""); err == nil || !strings.Contains(err.Error(), "prune_prs is not supported by the gerrit git_server") {
+		t.Errorf("expected gerrit prune_prs problem, got %v", err)
+	}
+	cfg.GitHost = "github"
+	if err := cfg.Validate("drift"); err == nil || !strings.Contains(err.Error(), "prune_prs is not supported by drift") {
+		t.Errorf("expected drift prune_prs problem, got %v", err)
+	}
+}
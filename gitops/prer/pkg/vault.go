@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/git/github_app"
+	"github.com/fasterci/rules_gitops/gitops/redact"
+	"github.com/fasterci/rules_gitops/gitops/vault"
+)
+
+// kubernetesTokenPath is the service account token of the pod, the default jwt of the kubernetes auth method
+const kubernetesTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// dockerConfigSecret is the vault_secret name of the registry credentials, a docker config.json
+const dockerConfigSecret = "docker_config"
+
+// parseVaultSecrets parses --vault_secret values flag=path#field
+func parseVaultSecrets(values []string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, v := range values {
+		name, ref, found := strings.Cut(v, "=")
+		if !found || name == "" {
+			return nil, fmt.Errorf("invalid vault_secret %q, expected flag=path#field", v)
+		}
+		if _, _, err := vault.ParseRef(ref); err != nil {
+			return nil, err
+		}
+		result[name] = ref
+	}
+	return result, nil
+}
+
+// loadVaultSecrets logs in to Vault and sets the flags of --vault_secret to the secret values.
+// The GitHub App private key is kept in memory and the registry credentials are written to a
+// private DOCKER_CONFIG directory of the gitops binaries, removed by the returned cleanup.
+func loadVaultSecrets(fs *flag.FlagSet, cfg *Config) (func(), error) {
+	cleanup := func() {}
+	// without vault_addr validation reports the problem
+	if len(cfg.VaultSecrets) == 0 || cfg.VaultAddr == "" {
+		return cleanup, nil
+	}
+	c := &vault.Client{Addr: cfg.VaultAddr, Namespace: cfg.VaultNamespace, Token: cfg.VaultToken}
+	params := map[string]string{
+		"role":      cfg.VaultRole,
+		"role_id":   cfg.VaultRole,
+		"secret_id": cfg.VaultSecretID,
+		"jwt":       cfg.VaultJWT,
+	}
+	if cfg.VaultAuthMethod == "kubernetes" && params["jwt"] == "" {
+		b, err := os.ReadFile(kubernetesTokenPath)
+		if err != nil {
+			return cleanup, errorf("unable to read the service account token of vault login: %w", err)
+		}
+		params["jwt"] = strings.TrimSpace(string(b))
+	}
+	if err := c.Login(cfg.VaultAuthMethod, cfg.VaultAuthMount, params); err != nil {
+		return cleanup, errorf("vault login failed: %w", err)
+	}
+	redact.Add(c.Token)
+
+	names := make([]string, 0, len(cfg.VaultSecrets))
+	for name := range cfg.VaultSecrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	secrets := &vault.Secrets{Client: c}
+	for _, name := range names {
+		value, err := secrets.Get(cfg.VaultSecrets[name])
+		if err != nil {
+			cleanup()
+			return func() {}, errorf("vault_secret %s: %w", name, err)
+		}
+		redact.Add(value)
+		switch name {
+		case "private_key":
+			github_app.SetPrivateKey([]byte(value))
+		case dockerConfigSecret:
+			dir, err := writeDockerConfig(value)
+			if err != nil {
+				cleanup()
+				return func() {}, errorf("vault_secret %s: %w", name, err)
+			}
+			cleanup = func() { os.RemoveAll(dir) }
+		default:
+			if err := fs.Set(name, value); err != nil {
+				cleanup()
+				return func() {}, errorf("vault_secret %s: %w", name, err)
+			}
+		}
+	}
+	log.Printf("Read %d credentials from vault %s", len(names), cfg.VaultAddr)
+	return cleanup, nil
+}
+
+// writeDockerConfig writes the registry credentials to a private directory and points DOCKER_CONFIG to it
+func writeDockerConfig(config string) (string, error) {
+	dir, err := os.MkdirTemp("", "gitops-docker-config")
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, os.Setenv("DOCKER_CONFIG", dir)
+}
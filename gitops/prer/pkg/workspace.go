@@ -0,0 +1,49 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package prer
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+)
+
+// maxDirtyFiles limits the uncommitted files listed by checkWorkspace
+const maxDirtyFiles = 10
+
+// checkWorkspace fails if the source workspace in dir has uncommitted changes or its HEAD is not --git_commit,
+// so the rendered manifests always match a source commit
+func checkWorkspace(dir string, cfg *Config) error {
+	out, err := exec.Ex(dir, "git", "status", "--porcelain")
+	if err != nil {
+		return fmt.Errorf("unable to get the workspace status: %w: %s", err, strings.TrimSpace(out))
+	}
+	if out != "" {
+		dirty := strings.Split(strings.TrimRight(out, "\n"), "\n")
+		if len(dirty) > maxDirtyFiles {
+			dirty = append(dirty[:maxDirtyFiles], fmt.Sprintf("and %d more", len(dirty)-maxDirtyFiles))
+		}
+		return fmt.Errorf("workspace has uncommitted changes:\n%s", strings.Join(dirty, "\n"))
+	}
+	if cfg.GitCommit == "" || cfg.GitCommit == "unknown" {
+		return nil
+	}
+	out, err = exec.Ex(dir, "git", "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("unable to resolve the workspace HEAD: %w: %s", err, strings.TrimSpace(out))
+	}
+	if head := strings.TrimSpace(out); !strings.HasPrefix(head, cfg.GitCommit) {
+		return fmt.Errorf("workspace HEAD %s does not match --git_commit %s", head, cfg.GitCommit)
+	}
+	return nil
+}
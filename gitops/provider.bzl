@@ -16,6 +16,8 @@ GitopsArtifactsInfo = provider(
     fields = {
         "image_pushes": "List of of executable targets required to be executed before deployment, typically pushes images to a registry.",
         "deployment_branch": "Branch to merge manifests into and create a PR from.",
+        "pr_title": "PR title of the deployment_branch release train, empty for the default.",
+        "pr_body": "PR body of the deployment_branch release train, empty for the default.",
     },
 )
 
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package publish uploads rendered manifests to object storage.
+package publish
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fasterci/rules_gitops/gitops/exec"
+)
+
+// Upload copies files and directories (relative to root) to dest, preserving their relative paths.
+// dest is an object storage location such as s3://bucket/prefix or gs://bucket/prefix.
+// Uploads use the aws and gcloud command line tools and their default credentials.
+func Upload(root string, files []string, dest string) error {
+	name, args, err := uploadCommand(dest)
+	if err != nil {
+		return err
+	}
+	staging, err := os.MkdirTemp("", "publish")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+	for _, f := range files {
+		if err := copyTree(filepath.Join(root, f), filepath.Join(staging, f)); err != nil {
+			return fmt.Errorf("unable to stage %s: %w", f, err)
+		}
+	}
+	args = append(args, staging+"/", strings.TrimSuffix(dest, "/")+"/")
+	if _, err := exec.Ex("", name, args...); err != nil {
+		return fmt.Errorf("unable to upload to %s: %w", dest, err)
+	}
+	return nil
+}
+
+// uploadCommand returns the command copying a directory recursively to dest
+func uploadCommand(dest string) (string, []string, error) {
+	switch {
+	case strings.HasPrefix(dest, "s3://"):
+		return "aws", []string{"s3", "cp", "--recursive", "--only-show-errors"}, nil
+	case strings.HasPrefix(dest, "gs://"):
+		return "gcloud", []string{"storage", "cp", "--recursive"}, nil
+	}
+	return "", nil, fmt.Errorf("unsupported publish destination %q, expected s3:// or gs://", dest)
+}
+
+// copyTree copies src file or directory to dst. Missing src (deleted files) is ignored.
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+}
+
+func copyFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
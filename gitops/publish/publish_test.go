@@ -0,0 +1,57 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package publish
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUploadCommand(t *testing.T) {
+	tests := []struct {
+		dest    string
+		want    string
+		wantErr bool
+	}{
+		{"s3://bucket/prefix", "aws", false},
+		{"gs://bucket/prefix", "gcloud", false},
+		{"/local/dir", "", true},
+	}
+	for _, tt := range tests {
+		name, _, err := uploadCommand(tt.dest)
+		if (err != nil) != tt.wantErr || name != tt.want {
+			t.Errorf("uploadCommand(%q) = %q, %v; want %q, error %v", tt.dest, name, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "a/b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a/b/c.yaml"), []byte("c"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := copyTree(filepath.Join(src, "a"), filepath.Join(dst, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTree(filepath.Join(src, "deleted.yaml"), filepath.Join(dst, "deleted.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(dst, "a/b/c.yaml"))
+	if err != nil || string(b) != "c" {
+		t.Errorf("unexpected copy result %q, %v", b, err)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package schema validates rendered manifests against kubernetes schemas using kubeconform.
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	oe "os/exec"
+	"path/filepath"
+)
+
+// Error is a manifest failing schema validation
+type Error struct {
+	File    string
+	Kind    string
+	Name    string
+	Message string
+}
+
+func (e Error) String() string {
+	return fmt.Sprintf("%s: %s %s: %s", e.File, e.Kind, e.Name, e.Message)
+}
+
+// Kubeconform validates manifests with kubeconform
+type Kubeconform struct {
+	// Binary is the kubeconform executable
+	Binary string
+	// CRDSchemas is an optional directory with CRD json schemas named {kind}_{version}.json
+	CRDSchemas string
+	// KubernetesVersion to validate against. Default is the latest.
+	KubernetesVersion string
+}
+
+func (k *Kubeconform) args() []string {
+	args := []string{"-output", "json", "-strict", "-schema-location", "default"}
+	if k.CRDSchemas != "" {
+		args = append(args, "-schema-location", filepath.Join(k.CRDSchemas, "{{ .ResourceKind }}_{{ .ResourceAPIVersion }}.json"))
+	} else {
+		args = append(args, "-ignore-missing-schemas")
+	}
+	if k.KubernetesVersion != "" {
+		args = append(args, "-kubernetes-version", k.KubernetesVersion)
+	}
+	return args
+}
+
+// Validate validates files and directories relative to root and returns invalid resources.
+// Paths that do not exist (deleted files) are skipped.
+func (k *Kubeconform) Validate(root string, paths []string) ([]Error, error) {
+	args := k.args()
+	n := 0
+	for _, p := range paths {
+		if _, err := os.Stat(filepath.Join(root, p)); err == nil {
+			args = append(args, p)
+			n++
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	cmd := oe.Command(k.Binary, args...)
+	cmd.Dir = root
+	out, err := cmd.Output()
+	if err != nil {
+		// kubeconform exits with 1 when resources are invalid
+		if ee, ok := err.(*oe.ExitError); !ok || ee.ExitCode() != 1 {
+			return nil, fmt.Errorf("kubeconform failed: %w", err)
+		}
+	}
+	return parseResults(out)
+}
+
+type results struct {
+	Resources []struct {
+		Filename string `json:"filename"`
+		Kind     string `json:"kind"`
+		Name     string `json:"name"`
+		Status   string `json:"status"`
+		Msg      string `json:"msg"`
+	} `json:"resources"`
+}
+
+// parseResults parses kubeconform json output
+func parseResults(out []byte) ([]Error, error) {
+	var r results
+	if err := json.Unmarshal(out, &r); err != nil {
+		return nil, fmt.Errorf("unable to parse kubeconform output: %w", err)
+	}
+	var errs []Error
+	for _, res := range r.Resources {
+		if res.Status != "statusInvalid" && res.Status != "statusError" {
+			continue
+		}
+		errs = append(errs, Error{File: res.Filename, Kind: res.Kind, Name: res.Name, Message: res.Msg})
+	}
+	return errs, nil
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseResults(t *testing.T) {
+	out := `{
+  "resources": [
+    {"filename": "cloud/app.yaml", "kind": "Deployment", "name": "app", "version": "apps/v1", "status": "statusInvalid", "msg": "problem validating schema. Check JSON formatting: jsonschema: '/spec/replicas' does not validate: expected integer, but got string"},
+    {"filename": "cloud/cr.yaml", "kind": "Widget", "name": "w", "version": "example.com/v1", "status": "statusSkipped", "msg": ""}
+  ],
+  "summary": {"valid": 3, "invalid": 1, "errors": 0, "skipped": 1}
+}`
+	got, err := parseResults([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Error{{
+		File:    "cloud/app.yaml",
+		Kind:    "Deployment",
+		Name:    "app",
+		Message: "problem validating schema. Check JSON formatting: jsonschema: '/spec/replicas' does not validate: expected integer, but got string",
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseResults() = %v, want %v", got, want)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	k := &Kubeconform{CRDSchemas: "/schemas", KubernetesVersion: "1.26.1"}
+	want := []string{"-output", "json", "-strict", "-schema-location", "default", "-schema-location", "/schemas/{{ .ResourceKind }}_{{ .ResourceAPIVersion }}.json", "-kubernetes-version", "1.26.1"}
+	if got := k.args(); !reflect.DeepEqual(got, want) {
+		t.Errorf("args() = %v, want %v", got, want)
+	}
+}
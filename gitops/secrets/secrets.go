@@ -0,0 +1,234 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package secrets detects credentials in rendered manifests before they are committed.
+package secrets
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Finding is a suspected secret
+type Finding struct {
+	File string
+	Line int
+	Rule string
+	// Match is the offending text, truncated so it is safe to log
+	Match string
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s:%d: %s (%s)", f.File, f.Line, f.Rule, f.Match)
+}
+
+type rule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+var rules = []rule{
+	{"private key", regexp.MustCompile(`-----BEGIN ([A-Z]+ )*PRIVATE KEY( BLOCK)?-----`)},
+	{"aws access key id", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{"github token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{"gitlab token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_\-]{20,}\b`)},
+	{"slack token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`)},
+	{"kubeconfig credentials", regexp.MustCompile(`\b(client-key-data|client-certificate-data|token):\s*\S{20,}`)},
+}
+
+var (
+	candidate = regexp.MustCompile(`[A-Za-z0-9+/=_\-]{32,}`)
+	allowLine = regexp.MustCompile(`gitops:allow-secret`)
+)
+
+const (
+	// minimal length of a base64 token that is decoded and scanned again
+	minEncodedLen = 40
+	// entropy in bits per character above which a token is considered random
+	entropyThreshold = 4.5
+)
+
+// Scanner scans files for secrets
+type Scanner struct {
+	// Allow is a list of expressions. A finding matching any of them by file path or by
+	// matched text is ignored.
+	Allow []*regexp.Regexp
+	// Entropy enables reporting of high entropy strings
+	Entropy bool
+}
+
+// LoadAllowlist reads the allowlist file. Every non-empty line not starting with # is a
+// regular expression matched against the file path and the suspected secret.
+func LoadAllowlist(path string) ([]*regexp.Regexp, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var allow []*regexp.Regexp
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		re, err := regexp.Compile(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		allow = append(allow, re)
+	}
+	return allow, s.Err()
+}
+
+// ScanPaths scans files and directories (recursively) relative to root
+func (s *Scanner) ScanPaths(root string, paths []string) ([]Finding, error) {
+	var findings []Finding
+	for _, p := range paths {
+		err := filepath.Walk(filepath.Join(root, p), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				// deleted files
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			found, err := s.ScanReader(rel, f)
+			findings = append(findings, found...)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to scan %s: %w", p, err)
+		}
+	}
+	return findings, nil
+}
+
+// Scan returns secrets found in the content of the named file
+func (s *Scanner) Scan(name, content string) []Finding {
+	findings, _ := s.ScanReader(name, strings.NewReader(content))
+	return findings
+}
+
+// maxLineLength is the longest line ScanReader reads, larger than any base64 encoded secret
+const maxLineLength = 16 << 20
+
+// ScanReader returns secrets found in the content of the named file read from r line by line,
+// so large manifests are scanned with bounded memory
+func (s *Scanner) ScanReader(name string, r io.Reader) ([]Finding, error) {
+	if s.allowed(name) {
+		return nil, nil
+	}
+	var findings []Finding
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), maxLineLength)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if allowLine.MatchString(line) {
+			continue
+		}
+		for _, f := range s.scanLine(line) {
+			f.File = name
+			f.Line = n
+			findings = append(findings, f)
+		}
+	}
+	return findings, sc.Err()
+}
+
+func (s *Scanner) scanLine(line string) []Finding {
+	var findings []Finding
+	for _, r := range rules {
+		if m := r.re.FindString(line); m != "" && !s.allowed(m) {
+			findings = append(findings, Finding{Rule: r.name, Match: truncate(m)})
+		}
+	}
+	for _, tok := range candidate.FindAllString(line, -1) {
+		if s.allowed(tok) {
+			continue
+		}
+		if len(tok) >= minEncodedLen {
+			if f, ok := scanEncoded(tok); ok {
+				findings = append(findings, f)
+				continue
+			}
+		}
+		if s.Entropy && entropy(tok) > entropyThreshold {
+			findings = append(findings, Finding{Rule: "high entropy string", Match: truncate(tok)})
+		}
+	}
+	return findings
+}
+
+// scanEncoded reports a finding if tok is base64 encoded content matching any rule
+func scanEncoded(tok string) (Finding, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(tok)
+	if err != nil {
+		return Finding{}, false
+	}
+	for _, r := range rules {
+		if r.re.Match(decoded) {
+			return Finding{Rule: "base64 encoded " + r.name, Match: truncate(tok)}, true
+		}
+	}
+	return Finding{}, false
+}
+
+func (s *Scanner) allowed(str string) bool {
+	for _, re := range s.Allow {
+		if re.MatchString(str) {
+			return true
+		}
+	}
+	return false
+}
+
+// entropy returns Shannon entropy of s in bits per character
+func entropy(s string) float64 {
+	freq := make(map[rune]float64)
+	for _, r := range s {
+		freq[r]++
+	}
+	var e float64
+	n := float64(len(s))
+	for _, c := range freq {
+		p := c / n
+		e -= p * math.Log2(p)
+	}
+	return e
+}
+
+func truncate(s string) string {
+	if len(s) <= 12 {
+		return s
+	}
+	return s[:8] + "..."
+}
@@ -0,0 +1,123 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package serve
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// commitRe matches the full and abbreviated commit SHAs accepted by the API
+var commitRe = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+
+// SetAPIToken enables the REST API at /api/v1/ authenticated with the bearer token
+func (s *Server) SetAPIToken(token string) {
+	s.apiToken = token
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return found && subtle.ConstantTimeCompare([]byte(token), []byte(s.apiToken)) == 1
+}
+
+// checkTrigger rejects API triggers of commits that are not SHAs, of branches not triggering the pipeline
+// and of commands other than those of scheduled runs
+func (s *Server) checkTrigger(t Trigger) error {
+	p, ok := s.pipelines[t.Pipeline]
+	if !ok {
+		return fmt.Errorf("unknown pipeline %s", t.Pipeline)
+	}
+	if !commitRe.MatchString(t.Commit) {
+		return errors.New("commit must be a commit SHA of 7 to 40 hex characters")
+	}
+	if t.Branch == "" || !p.matches(p.Repo, t.Branch) {
+		return fmt.Errorf("branch %q does not trigger pipeline %s", t.Branch, t.Pipeline)
+	}
+	if t.Command != "" && t.Command != "drift" {
+		return errors.New("command must be empty or drift")
+	}
+	return nil
+}
+
+// handleRuns serves
+//
+//	GET  /api/v1/runs       recent runs, newest first
+//	POST /api/v1/runs       trigger a run: {"pipeline": "...", "branch": "...", "commit": "...", "command": "drift"}
+//	GET  /api/v1/runs/<id>  run status
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/v1/runs"), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, s.Runs())
+	case id == "" && r.Method == http.MethodPost:
+		var t Trigger
+		if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := s.checkTrigger(t); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		t.Source = "api"
+		run, err := s.Enqueue(t)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, run)
+	case id != "" && r.Method == http.MethodGet:
+		run, ok := s.Get(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "run not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, run)
+	default:
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+	}
+}
+
+// Handle serves pattern with h in addition to the webhook and the API, e.g. /metrics
+func (s *Server) Handle(pattern string, h http.Handler) {
+	s.handlers[pattern] = h
+}
+
+// Handler returns the http handler of the server
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", s.handleWebhook)
+	HandleHealth(mux, s.Status, s.statusRuns)
+	if s.apiToken != "" {
+		mux.HandleFunc("/api/v1/runs", s.handleRuns)
+		mux.HandleFunc("/api/v1/runs/", s.handleRuns)
+	}
+	for pattern, h := range s.handlers {
+		mux.Handle(pattern, h)
+	}
+	return mux
+}
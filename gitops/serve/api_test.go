@@ -0,0 +1,161 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func apiRequest(t *testing.T, h http.Handler, method, path, token, body string) (int, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code, w.Body.Bytes()
+}
+
+func TestAPI(t *testing.T) {
+	release := make(chan struct{})
+	cfg := &Config{Pipelines: []Pipeline{{Name: "app", Repo: "org/app", Workspace: "/src/app", Branches: []string{"main"}}}}
+	s := New(cfg, "", time.Millisecond, func(ctx context.Context, p Pipeline, tr Trigger) error {
+		<-release
+		return errors.New("boom")
+	})
+	s.SetAPIToken("token")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	h := s.Handler()
+
+	if code, _ := apiRequest(t, h, http.MethodGet, "/api/v1/runs", "wrong", ""); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: status %d", code)
+	}
+	if code, _ := apiRequest(t, h, http.MethodPost, "/api/v1/runs", "token", `{"pipeline":"nope","commit":"aaa"}`); code != http.StatusBadRequest {
+		t.Errorf("unknown pipeline: status %d", code)
+	}
+	for _, body := range []string{
+		`{"pipeline":"app","branch":"main"}`,
+		`{"pipeline":"app","branch":"main","commit":"--upload-pack=touch /tmp/x"}`,
+		`{"pipeline":"app","branch":"main","commit":"aaa"}`,
+		`{"pipeline":"app","branch":"feature","commit":"1a2b3c4"}`,
+		`{"pipeline":"app","commit":"1a2b3c4"}`,
+		`{"pipeline":"app","branch":"main","commit":"1a2b3c4","command":"rollback"}`,
+		`{"pipeline":"app","branch":"main","commit":"1a2b3c4","command":"--git_repo=https://evil.example.com"}`,
+	} {
+		if code, _ := apiRequest(t, h, http.MethodPost, "/api/v1/runs", "token", body); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", body, code)
+		}
+	}
+	code, body := apiRequest(t, h, http.MethodPost, "/api/v1/runs", "token", `{"pipeline":"app","branch":"main","commit":"1a2b3c4"}`)
+	if code != http.StatusAccepted {
+		t.Fatalf("trigger: status %d %s", code, body)
+	}
+	var run Run
+	if err := json.Unmarshal(body, &run); err != nil {
+		t.Fatal(err)
+	}
+	if run.ID == "" || run.State != StateQueued || run.Source != "api" {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		code, body = apiRequest(t, h, http.MethodGet, "/api/v1/runs/"+run.ID, "token", "")
+		if code != http.StatusOK {
+			t.Fatalf("status: %d %s", code, body)
+		}
+		if err := json.Unmarshal(body, &run); err != nil {
+			t.Fatal(err)
+		}
+		if run.State == StateFailed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("run did not finish: %+v", run)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if run.Error != "boom" || run.Started == nil || run.Finished == nil {
+		t.Errorf("unexpected run %+v", run)
+	}
+
+	code, body = apiRequest(t, h, http.MethodGet, "/api/v1/runs", "token", "")
+	var runs []Run
+	if err := json.Unmarshal(body, &runs); err != nil || code != http.StatusOK || len(runs) != 1 {
+		t.Errorf("list: status %d %s", code, body)
+	}
+	if code, _ := apiRequest(t, h, http.MethodGet, "/api/v1/runs/missing", "token", ""); code != http.StatusNotFound {
+		t.Errorf("missing run: status %d", code)
+	}
+}
+
+func TestAPIDisabled(t *testing.T) {
+	s := New(&Config{}, "", time.Second, nil)
+	if code, _ := apiRequest(t, s.Handler(), http.MethodGet, "/api/v1/runs", "", ""); code != http.StatusNotFound {
+		t.Errorf("status %d, want 404", code)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	s := New(&Config{}, "", time.Second, nil)
+	s.Handle("/metrics", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Write([]byte("prer_runs_total 1\n"))
+	}))
+	if code, body := apiRequest(t, s.Handler(), http.MethodGet, "/metrics", "", ""); code != http.StatusOK || string(body) != "prer_runs_total 1\n" {
+		t.Errorf("status %d %q", code, body)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	cfg := &Config{Pipelines: []Pipeline{{Name: "app", Repo: "org/app"}}}
+	s := New(cfg, "", time.Hour, nil)
+	h := s.Handler()
+	if code, _ := apiRequest(t, h, http.MethodGet, "/healthz", "", ""); code != http.StatusOK {
+		t.Errorf("healthz: status %d", code)
+	}
+	if code, _ := apiRequest(t, h, http.MethodGet, "/readyz", "", ""); code != http.StatusServiceUnavailable {
+		t.Errorf("readyz before start: status %d", code)
+	}
+	for _, commit := range []string{"aaa", "bbb"} {
+		if _, err := s.Enqueue(Trigger{Pipeline: "app", Branch: "main", Commit: commit}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	if code, _ := apiRequest(t, h, http.MethodGet, "/readyz", "", ""); code != http.StatusOK {
+		t.Errorf("readyz: status %d", code)
+	}
+	code, body := apiRequest(t, h, http.MethodGet, "/status?runs=1", "", "")
+	var st Status
+	if err := json.Unmarshal(body, &st); err != nil || code != http.StatusOK {
+		t.Fatalf("status: status %d %s", code, body)
+	}
+	if !st.Ready || len(st.Runs) != 1 || st.Runs[0].Commit != "bbb" || st.Counts[StateQueued]+st.Counts[StateSuperseded] != 2 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	if code, _ := apiRequest(t, h, http.MethodGet, "/status?runs=x", "", ""); code != http.StatusBadRequest {
+		t.Errorf("invalid runs: status %d", code)
+	}
+}
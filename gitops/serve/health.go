@@ -0,0 +1,87 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package serve
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// Status summarizes a long running service for probes and monitoring
+type Status struct {
+	Ready bool `json:"ready"`
+	// Reason the service is not ready
+	Reason string `json:"reason,omitempty"`
+	// Counts are the numbers of recorded runs by state
+	Counts map[string]int `json:"counts"`
+	// Runs are the most recent runs, newest first
+	Runs []Run `json:"runs"`
+}
+
+// StatusFunc returns the status of the service with at most n recent runs
+type StatusFunc func(n int) Status
+
+// HandleHealth serves on mux
+//
+//	GET /healthz  200 while the process is serving requests
+//	GET /readyz   200 if the service is ready, 503 otherwise
+//	GET /status   the status with the last n runs, or ?runs=<n>
+func HandleHealth(mux *http.ServeMux, status StatusFunc, n int) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		st := status(0)
+		if !st.Ready {
+			http.Error(w, st.Reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		runs := n
+		if v := r.URL.Query().Get("runs"); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed < 0 {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid runs"})
+				return
+			}
+			runs = parsed
+		}
+		writeJSON(w, http.StatusOK, status(runs))
+	})
+}
+
+// SetStatusRuns sets the number of recent runs listed by /status
+func (s *Server) SetStatusRuns(n int) {
+	s.statusRuns = n
+}
+
+// Status returns the status of the server with at most n recent runs.
+// The server is ready once its workers are started.
+func (s *Server) Status(n int) Status {
+	s.mu.Lock()
+	st := Status{Ready: s.started, Counts: make(map[string]int), Runs: []Run{}}
+	for _, r := range s.runs {
+		st.Counts[r.State]++
+	}
+	s.mu.Unlock()
+	if !st.Ready {
+		st.Reason = "workers are not started"
+	}
+	runs := s.Runs()
+	if len(runs) > n {
+		runs = runs[:n]
+	}
+	st.Runs = append(st.Runs, runs...)
+	return st
+}
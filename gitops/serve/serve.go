@@ -0,0 +1,360 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package serve runs gitops pipelines in a long running service triggered by git webhooks.
+package serve
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pipeline describes a source repository the service creates gitops PRs for
+type Pipeline struct {
+	// Name identifies the pipeline
+	Name string `json:"name"`
+	// Repo is the repository name as reported by webhooks, e.g. org/app
+	Repo string `json:"repo"`
+	// Workspace is a checkout of the repository used to render release trains
+	Workspace string `json:"workspace"`
+	// Branches triggering the pipeline. All branches if empty.
+	Branches []string `json:"branches"`
+	// Args are additional create_gitops_prs flags
+	Args []string `json:"args"`
+	// Schedule runs the pipeline for the head of each of its branches periodically, see ParseSchedule
+	Schedule string `json:"schedule"`
+	// ScheduleCommand is the create_gitops_prs command of scheduled runs: empty to create PRs, drift to report drift only
+	ScheduleCommand string `json:"schedule_command"`
+}
+
+// Config is the service configuration file
+type Config struct {
+	Pipelines []Pipeline `json:"pipelines"`
+}
+
+// LoadConfig reads the json service configuration
+func LoadConfig(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	names := make(map[string]bool)
+	for _, p := range cfg.Pipelines {
+		if p.Name == "" || p.Repo == "" || p.Workspace == "" {
+			return nil, fmt.Errorf("%s: pipeline name, repo and workspace are required", path)
+		}
+		if names[p.Name] {
+			return nil, fmt.Errorf("%s: duplicate pipeline %s", path, p.Name)
+		}
+		if p.Schedule != "" {
+			if _, err := ParseSchedule(p.Schedule); err != nil {
+				return nil, fmt.Errorf("%s: pipeline %s: %w", path, p.Name, err)
+			}
+			if len(p.Branches) == 0 {
+				return nil, fmt.Errorf("%s: pipeline %s: schedule requires branches", path, p.Name)
+			}
+		}
+		if p.ScheduleCommand != "" && p.ScheduleCommand != "drift" {
+			return nil, fmt.Errorf("%s: pipeline %s: schedule_command must be empty or drift", path, p.Name)
+		}
+		names[p.Name] = true
+	}
+	return cfg, nil
+}
+
+func (p *Pipeline) matches(repo, branch string) bool {
+	if p.Repo != repo {
+		return false
+	}
+	if len(p.Branches) == 0 {
+		return true
+	}
+	for _, b := range p.Branches {
+		if b == branch {
+			return true
+		}
+	}
+	return false
+}
+
+// Trigger requests a pipeline run for a commit
+type Trigger struct {
+	// ID of the run, assigned by Enqueue
+	ID       string `json:"id"`
+	Pipeline string `json:"pipeline"`
+	Branch   string `json:"branch"`
+	// Commit to run, the head of the branch if empty
+	Commit string `json:"commit"`
+	// Command is the create_gitops_prs command of the run, empty to create PRs
+	Command string `json:"command,omitempty"`
+	// Source describes what triggered the run, e.g. webhook or schedule
+	Source string `json:"source"`
+}
+
+// Run states
+const (
+	StateQueued     = "queued"
+	StateRunning    = "running"
+	StateSucceeded  = "succeeded"
+	StateFailed     = "failed"
+	StateSuperseded = "superseded"
+)
+
+// Run is the record of a triggered pipeline run
+type Run struct {
+	Trigger
+	State    string     `json:"state"`
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// maxRuns is the number of run records kept in memory
+const maxRuns = 200
+
+// Runner executes a pipeline run
+type Runner func(ctx context.Context, p Pipeline, t Trigger) error
+
+// Server queues triggers per repository and runs them sequentially.
+// Triggers of the same pipeline and branch received within the debounce period are coalesced
+// and only the latest commit is run.
+type Server struct {
+	pipelines map[string]Pipeline
+	secret    string
+	debounce  time.Duration
+	run       Runner
+	queues    map[string]chan Trigger
+	schedules map[string]*Schedule
+	apiToken  string
+	handlers  map[string]http.Handler
+	// statusRuns is the number of recent runs listed by /status
+	statusRuns int
+
+	mu      sync.Mutex
+	started bool
+	seq     int
+	runs    map[string]*Run
+	order   []string
+}
+
+// New creates a server. secret is used to verify webhook signatures and may be empty.
+func New(cfg *Config, secret string, debounce time.Duration, run Runner) *Server {
+	s := &Server{
+		pipelines:  make(map[string]Pipeline),
+		secret:     secret,
+		debounce:   debounce,
+		run:        run,
+		queues:     make(map[string]chan Trigger),
+		schedules:  make(map[string]*Schedule),
+		runs:       make(map[string]*Run),
+		handlers:   make(map[string]http.Handler),
+		statusRuns: 10,
+	}
+	for _, p := range cfg.Pipelines {
+		s.pipelines[p.Name] = p
+		if _, ok := s.queues[p.Repo]; !ok {
+			s.queues[p.Repo] = make(chan Trigger, 100)
+		}
+		if p.Schedule != "" {
+			sched, err := ParseSchedule(p.Schedule)
+			if err != nil {
+				log.Printf("pipeline %s is not scheduled: %v", p.Name, err)
+				continue
+			}
+			s.schedules[p.Name] = sched
+		}
+	}
+	return s
+}
+
+// Start starts the queue workers and the schedulers of scheduled pipelines. They stop when ctx is done.
+func (s *Server) Start(ctx context.Context) {
+	for repo, q := range s.queues {
+		go s.worker(ctx, repo, q)
+	}
+	for name, sched := range s.schedules {
+		go s.scheduler(ctx, s.pipelines[name], sched)
+	}
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+}
+
+// Enqueue schedules the pipeline run and returns its record
+func (s *Server) Enqueue(t Trigger) (Run, error) {
+	p, ok := s.pipelines[t.Pipeline]
+	if !ok {
+		return Run{}, fmt.Errorf("unknown pipeline %s", t.Pipeline)
+	}
+	run := s.record(&t)
+	select {
+	case s.queues[p.Repo] <- t:
+	default:
+		s.forget(t.ID)
+		return Run{}, fmt.Errorf("queue of %s is full", p.Repo)
+	}
+	log.Printf("queued %s run %s of %s for %s@%s", t.Source, t.ID, t.Pipeline, t.Branch, t.Commit)
+	return run, nil
+}
+
+// record assigns the run ID and adds a queued run, dropping the oldest records
+func (s *Server) record(t *Trigger) Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	t.ID = fmt.Sprintf("%d-%d", time.Now().Unix(), s.seq)
+	r := &Run{Trigger: *t, State: StateQueued, Queued: time.Now()}
+	s.runs[t.ID] = r
+	s.order = append(s.order, t.ID)
+	if len(s.order) > maxRuns {
+		delete(s.runs, s.order[0])
+		s.order = s.order[1:]
+	}
+	return *r
+}
+
+// forget removes the run record
+func (s *Server) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runs, id)
+	for i, o := range s.order {
+		if o == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// update modifies the run record
+func (s *Server) update(id string, f func(r *Run)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.runs[id]; ok {
+		f(r)
+	}
+}
+
+// Get returns the run record
+func (s *Server) Get(id string) (Run, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.runs[id]
+	if !ok {
+		return Run{}, false
+	}
+	return *r, true
+}
+
+// Runs returns the most recent runs, newest first
+func (s *Server) Runs() []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	runs := make([]Run, 0, len(s.order))
+	for i := len(s.order) - 1; i >= 0; i-- {
+		runs = append(runs, *s.runs[s.order[i]])
+	}
+	return runs
+}
+
+// scheduler enqueues runs of the head of every branch of the pipeline at the times of the schedule
+func (s *Server) scheduler(ctx context.Context, p Pipeline, sched *Schedule) {
+	for {
+		next := sched.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("schedule %q of %s has no next run", p.Schedule, p.Name)
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		s.enqueueScheduled(p)
+	}
+}
+
+// enqueueScheduled enqueues the scheduled runs of the pipeline branches
+func (s *Server) enqueueScheduled(p Pipeline) {
+	for _, branch := range p.Branches {
+		if _, err := s.Enqueue(Trigger{Pipeline: p.Name, Branch: branch, Command: p.ScheduleCommand, Source: "schedule"}); err != nil {
+			log.Printf("scheduled run of %s for %s was not queued: %v", p.Name, branch, err)
+		}
+	}
+}
+
+func (s *Server) worker(ctx context.Context, repo string, q <-chan Trigger) {
+	pending := make(map[string]Trigger)
+	var timer <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-q:
+			key := t.Pipeline + "\x00" + t.Branch + "\x00" + t.Command
+			if prev, ok := pending[key]; ok {
+				s.update(prev.ID, func(r *Run) { r.State = StateSuperseded })
+			}
+			pending[key] = t
+			if timer == nil {
+				timer = time.After(s.debounce)
+			}
+		case <-timer:
+			timer = nil
+			keys := make([]string, 0, len(pending))
+			for k := range pending {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				s.execute(ctx, pending[k])
+			}
+			pending = make(map[string]Trigger)
+		}
+	}
+}
+
+func (s *Server) execute(ctx context.Context, t Trigger) {
+	log.Printf("running %s for %s@%s", t.Pipeline, t.Branch, t.Commit)
+	start := time.Now()
+	s.update(t.ID, func(r *Run) {
+		r.State = StateRunning
+		r.Started = &start
+	})
+	err := s.run(ctx, s.pipelines[t.Pipeline], t)
+	end := time.Now()
+	s.update(t.ID, func(r *Run) {
+		r.Finished = &end
+		r.State = StateSucceeded
+		if err != nil {
+			r.State = StateFailed
+			r.Error = err.Error()
+		}
+	})
+	if err != nil {
+		log.Printf("run of %s for %s@%s failed after %v: %v", t.Pipeline, t.Branch, t.Commit, end.Sub(start), err)
+		return
+	}
+	log.Printf("run of %s for %s@%s succeeded after %v", t.Pipeline, t.Branch, t.Commit, end.Sub(start))
+}
@@ -0,0 +1,182 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package serve
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const payload = `{"ref":"refs/heads/main","after":"%s","repository":{"full_name":"org/app"}}`
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookDebounce(t *testing.T) {
+	var mu sync.Mutex
+	var runs []Trigger
+	done := make(chan struct{}, 10)
+	cfg := &Config{Pipelines: []Pipeline{
+		{Name: "app", Repo: "org/app", Workspace: "/src/app", Branches: []string{"main"}},
+		{Name: "other", Repo: "org/other", Workspace: "/src/other"},
+	}}
+	s := New(cfg, "secret", 50*time.Millisecond, func(ctx context.Context, p Pipeline, tr Trigger) error {
+		mu.Lock()
+		runs = append(runs, tr)
+		mu.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	for _, commit := range []string{"aaaaaaa", "bbbbbbb"} {
+		body := strings.Replace(payload, "%s", commit, 1)
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/webhook", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", sign("secret", body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status %d", resp.StatusCode)
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline did not run")
+	}
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(runs) != 1 || runs[0].Commit != "bbbbbbb" || runs[0].Pipeline != "app" || runs[0].Branch != "main" {
+		t.Errorf("expected a single run of the latest commit, got %+v", runs)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	s := New(&Config{}, "secret", time.Second, nil)
+	body := strings.Replace(payload, "%s", "aaaaaaa", 1)
+	for _, tt := range []struct {
+		header, value string
+		want          int
+	}{
+		{"X-Hub-Signature-256", sign("wrong", body), http.StatusUnauthorized},
+		{"X-Hub-Signature-256", sign("secret", body), http.StatusOK},
+		{"X-Gitlab-Token", "wrong", http.StatusUnauthorized},
+		{"X-Gitlab-Token", "secret", http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s=%s: status %d, want %d", tt.header, tt.value, w.Code, tt.want)
+		}
+	}
+}
+
+func TestWebhookCommit(t *testing.T) {
+	s := New(&Config{}, "secret", time.Second, nil)
+	for commit, want := range map[string]int{
+		"aaaaaaa":         http.StatusOK,
+		"--upload-pack=x": http.StatusBadRequest,
+		"HEAD":            http.StatusBadRequest,
+	} {
+		body := strings.Replace(payload, "%s", commit, 1)
+		req := httptest.NewRequest(http.MethodPost, "/webhook", strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", sign("secret", body))
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s: status %d, want %d", commit, w.Code, want)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	start := time.Date(2024, time.January, 31, 10, 7, 30, 0, time.UTC)
+	for _, tt := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"*/15 * * * *", time.Date(2024, time.January, 31, 10, 15, 0, 0, time.UTC)},
+		{"0 3 * * *", time.Date(2024, time.February, 1, 3, 0, 0, 0, time.UTC)},
+		{"30 9 * * 1-5", time.Date(2024, time.February, 1, 9, 30, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, time.January, 31, 11, 0, 0, 0, time.UTC)},
+		{"@every 45m", start.Add(45 * time.Minute)},
+	} {
+		sched, err := ParseSchedule(tt.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := sched.Next(start); !got.Equal(tt.want) {
+			t.Errorf("%q: Next() = %v, want %v", tt.expr, got, tt.want)
+		}
+	}
+	for _, expr := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "@every 10s"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestScheduledRuns(t *testing.T) {
+	dir := t.TempDir()
+	path := dir + "/pipelines.json"
+	os.WriteFile(path, []byte(`{"pipelines": [{"name": "app", "repo": "org/app", "workspace": "/src/app", "schedule": "0 * * * *"}]}`), 0644)
+	if _, err := LoadConfig(path); err == nil || !strings.Contains(err.Error(), "schedule requires branches") {
+		t.Errorf("LoadConfig() without branches = %v", err)
+	}
+
+	runs := make(chan Trigger, 10)
+	cfg := &Config{Pipelines: []Pipeline{
+		{Name: "app", Repo: "org/app", Workspace: "/src/app", Branches: []string{"main"}, Schedule: "@every 1m", ScheduleCommand: "drift"},
+	}}
+	s := New(cfg, "", 10*time.Millisecond, func(ctx context.Context, p Pipeline, tr Trigger) error {
+		runs <- tr
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.Start(ctx)
+	s.enqueueScheduled(cfg.Pipelines[0])
+	select {
+	case tr := <-runs:
+		if tr.Branch != "main" || tr.Commit != "" || tr.Command != "drift" || tr.Source != "schedule" {
+			t.Errorf("unexpected scheduled run %+v", tr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduled run did not run")
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package serve
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// pushEvent contains the fields of GitHub and GitLab push webhook payloads used by the server
+type pushEvent struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		FullName string `json:"full_name"`
+	} `json:"repository"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+	} `json:"project"`
+}
+
+func (e *pushEvent) repo() string {
+	if e.Repository.FullName != "" {
+		return e.Repository.FullName
+	}
+	return e.Project.PathWithNamespace
+}
+
+// verify checks the GitHub payload signature or the GitLab token
+func (s *Server) verify(r *http.Request, body []byte) bool {
+	if s.secret == "" {
+		return true
+	}
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(s.secret)) == 1
+	}
+	sig, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !found {
+		return false
+	}
+	expected, err := hex.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// handleWebhook queues runs of all pipelines matching a push event
+func (s *Server) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 25<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !s.verify(r, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	if event := r.Header.Get("X-GitHub-Event"); event == "ping" {
+		fmt.Fprintln(w, "pong")
+		return
+	}
+	var e pushEvent
+	if err := json.Unmarshal(body, &e); err != nil {
+		http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	branch, isBranch := strings.CutPrefix(e.Ref, "refs/heads/")
+	if !isBranch || e.Deleted || e.After == "" || strings.Trim(e.After, "0") == "" {
+		fmt.Fprintln(w, "ignored")
+		return
+	}
+	// the commit is passed to git and the pipeline, like commits of API triggers
+	if !commitRe.MatchString(e.After) {
+		http.Error(w, "invalid payload: after must be a commit SHA", http.StatusBadRequest)
+		return
+	}
+	queued := 0
+	for _, p := range s.pipelines {
+		if !p.matches(e.repo(), branch) {
+			continue
+		}
+		if _, err := s.Enqueue(Trigger{Pipeline: p.Name, Branch: branch, Commit: e.After, Source: "webhook"}); err != nil {
+			log.Printf("unable to queue %s: %v", p.Name, err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		queued++
+	}
+	fmt.Fprintf(w, "queued %d runs\n", queued)
+}
@@ -0,0 +1,118 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package servicenow creates ServiceNow change requests for deployments.
+package servicenow
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Template is the set of change request fields. Values may reference {train}, {branch}, {commit}, {title} and {body}.
+type Template map[string]string
+
+// DefaultTemplate is used when no template file is configured
+var DefaultTemplate = Template{
+	"short_description": "GitOps deployment {train}",
+	"description":       "{title}\n\n{body}",
+}
+
+// LoadTemplate reads a JSON object of change request fields
+func LoadTemplate(path string) (Template, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var t Template
+	if err := json.Unmarshal(b, &t); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return t, nil
+}
+
+// Vars are the values substituted in template fields
+type Vars struct {
+	Train  string
+	Branch string
+	Commit string
+	Title  string
+	Body   string
+}
+
+// Fields expands the template
+func (t Template) Fields(v Vars) map[string]string {
+	r := strings.NewReplacer("{train}", v.Train, "{branch}", v.Branch, "{commit}", v.Commit, "{title}", v.Title, "{body}", v.Body)
+	fields := make(map[string]string, len(t))
+	for k, val := range t {
+		fields[k] = r.Replace(val)
+	}
+	return fields
+}
+
+// ChangeRequest is a created change request
+type ChangeRequest struct {
+	Number string `json:"number"`
+	SysID  string `json:"sys_id"`
+}
+
+// Client calls the ServiceNow table API
+type Client struct {
+	// URL of the instance, e.g. https://example.service-now.com
+	URL      string
+	User     string
+	Password string
+	HTTP     *http.Client
+}
+
+// Create creates a change request with the fields
+func (c *Client) Create(fields map[string]string) (*ChangeRequest, error) {
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.URL, "/")+"/api/now/table/change_request", bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(c.User, c.Password)
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("create change request: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	var out struct {
+		Result ChangeRequest `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("create change request: %w", err)
+	}
+	if out.Result.Number == "" {
+		return nil, fmt.Errorf("create change request: response without number")
+	}
+	return &out.Result, nil
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package servicenow
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cr.json")
+	os.WriteFile(path, []byte(`{"short_description":"Deploy {train} at {commit}","assignment_group":"sre"}`), 0644)
+	tmpl, err := LoadTemplate(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tmpl.Fields(Vars{Train: "prod", Commit: "abc"})
+	want := map[string]string{"short_description": "Deploy prod at abc", "assignment_group": "sre"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	var fields map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "bot" || p != "secret" || r.URL.Path != "/api/now/table/change_request" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"message":"User Not Authenticated"}}`)
+			return
+		}
+		json.NewDecoder(r.Body).Decode(&fields)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"result":{"number":"CHG0030001","sys_id":"abc123"}}`)
+	}))
+	defer ts.Close()
+
+	c := &Client{URL: ts.URL, User: "bot", Password: "secret"}
+	cr, err := c.Create(map[string]string{"short_description": "GitOps deployment prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Number != "CHG0030001" || cr.SysID != "abc123" || fields["short_description"] != "GitOps deployment prod" {
+		t.Errorf("unexpected change request %+v, fields %v", cr, fields)
+	}
+	if _, err := (&Client{URL: ts.URL}).Create(nil); err == nil {
+		t.Error("expected authentication error")
+	}
+}
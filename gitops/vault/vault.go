@@ -0,0 +1,181 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package vault reads credentials from HashiCorp Vault at runtime, so they are not stored on CI agents.
+package vault
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Client calls the Vault HTTP API
+type Client struct {
+	// Addr of the Vault server, e.g. https://vault.example.com:8200
+	Addr      string
+	Namespace string
+	Token     string
+	HTTP      *http.Client
+}
+
+// loginParams are the parameters of the login request of each auth method besides token
+var loginParams = map[string][]string{
+	"approle":    {"role_id", "secret_id"},
+	"jwt":        {"role", "jwt"},
+	"kubernetes": {"role", "jwt"},
+}
+
+// Supported returns true if the auth method is supported
+func Supported(method string) bool {
+	_, ok := loginParams[method]
+	return ok || method == "token"
+}
+
+// Login authenticates with the auth method mounted at mount, the method name if empty, and
+// replaces the client token. The token method uses the client token as is.
+func (c *Client) Login(method, mount string, params map[string]string) error {
+	if method == "token" {
+		if c.Token == "" {
+			return fmt.Errorf("vault token must be set for the token auth method")
+		}
+		return nil
+	}
+	names, ok := loginParams[method]
+	if !ok {
+		return fmt.Errorf("unsupported vault auth method %q", method)
+	}
+	req := make(map[string]string)
+	for _, name := range names {
+		if params[name] == "" {
+			return fmt.Errorf("vault %s login requires %s", method, name)
+		}
+		req[name] = params[name]
+	}
+	if mount == "" {
+		mount = method
+	}
+	var resp struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := c.do(http.MethodPost, "/v1/auth/"+mount+"/login", req, &resp); err != nil {
+		return err
+	}
+	if resp.Auth.ClientToken == "" {
+		return fmt.Errorf("vault %s login returned no token", method)
+	}
+	c.Token = resp.Auth.ClientToken
+	return nil
+}
+
+// Read returns the string fields of the secret at path. The fields of KV version 2 secrets,
+// read from <mount>/data/<path>, are unwrapped from their metadata.
+func (c *Client) Read(path string) (map[string]string, error) {
+	var resp struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := c.do(http.MethodGet, "/v1/"+strings.TrimPrefix(path, "/"), nil, &resp); err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = nested
+		}
+	}
+	fields := make(map[string]string, len(data))
+	for k, v := range data {
+		if s, ok := v.(string); ok {
+			fields[k] = s
+		}
+	}
+	return fields, nil
+}
+
+// ParseRef splits the secret reference path#field
+func ParseRef(ref string) (path, field string, err error) {
+	i := strings.LastIndex(ref, "#")
+	if i <= 0 || i == len(ref)-1 {
+		return "", "", fmt.Errorf("invalid vault secret %q, expected path#field", ref)
+	}
+	return ref[:i], ref[i+1:], nil
+}
+
+// Secrets resolves secret references, reading every secret path once
+type Secrets struct {
+	Client *Client
+	cache  map[string]map[string]string
+}
+
+// Get returns the field of the secret reference path#field
+func (s *Secrets) Get(ref string) (string, error) {
+	path, field, err := ParseRef(ref)
+	if err != nil {
+		return "", err
+	}
+	fields, ok := s.cache[path]
+	if !ok {
+		if fields, err = s.Client.Read(path); err != nil {
+			return "", err
+		}
+		if s.cache == nil {
+			s.cache = make(map[string]map[string]string)
+		}
+		s.cache[path] = fields
+	}
+	value, ok := fields[field]
+	if !ok {
+		return "", fmt.Errorf("vault secret %s has no field %s", path, field)
+	}
+	return value, nil
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Addr, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		req.Header.Set("X-Vault-Token", c.Token)
+	}
+	if c.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.Namespace)
+	}
+	hc := c.HTTP
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+package vault
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLoginAndRead(t *testing.T) {
+	reads := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/ci-jwt/login", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]string
+		json.NewDecoder(r.Body).Decode(&req)
+		if req["role"] != "gitops" || req["jwt"] != "oidc-token" {
+			t.Errorf("unexpected login request %v", req)
+		}
+		w.Write([]byte(`{"auth": {"client_token": "s.token"}}`))
+	})
+	mux.HandleFunc("/v1/secret/data/gitops", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" || r.Header.Get("X-Vault-Namespace") != "ci" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		reads++
+		w.Write([]byte(`{"data": {"data": {"token": "ghp_secret", "user": "deploy"}, "metadata": {"version": 3}}}`))
+	})
+	mux.HandleFunc("/v1/kv1/registry", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": {"config": "{}"}}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	c := &Client{Addr: ts.URL, Namespace: "ci"}
+	if err := c.Login("jwt", "ci-jwt", map[string]string{"role": "gitops", "jwt": "oidc-token"}); err != nil {
+		t.Fatal(err)
+	}
+	s := &Secrets{Client: c}
+	for ref, want := range map[string]string{
+		"secret/data/gitops#token": "ghp_secret",
+		"secret/data/gitops#user":  "deploy",
+		"kv1/registry#config":      "{}",
+	} {
+		got, err := s.Get(ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("Get(%s) = %q, want %q", ref, got, want)
+		}
+	}
+	if reads != 1 {
+		t.Errorf("secret read %d times", reads)
+	}
+	if _, err := s.Get("secret/data/gitops#password"); err == nil {
+		t.Error("expected missing field error")
+	}
+}
+
+func TestLoginValidation(t *testing.T) {
+	if err := (&Client{}).Login("token", "", nil); err == nil {
+		t.Error("expected error of token login without token")
+	}
+	if err := (&Client{}).Login("approle", "", map[string]string{"role_id": "r"}); err == nil {
+		t.Error("expected error of approle login without secret_id")
+	}
+	if err := (&Client{}).Login("ldap", "", nil); err == nil {
+		t.Error("expected error of unsupported method")
+	}
+}
+
+func TestParseRef(t *testing.T) {
+	for _, ref := range []string{"secret/data/gitops", "#token", "secret/data/gitops#"} {
+		if _, _, err := ParseRef(ref); err == nil {
+			t.Errorf("ParseRef(%q) expected error", ref)
+		}
+	}
+}
@@ -14,6 +14,7 @@ package resolver
 import (
 	"fmt"
 	"io"
+	"regexp"
 	"strings"
 
 	yamlenc "github.com/ghodss/yaml"
@@ -21,10 +22,25 @@ import (
 	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
+// Options of the image resolution
+type Options struct {
+	// Comments annotates substituted image lines with the "# gitops: <image reference>" comment,
+	// tracing every image back to its bazel target
+	Comments bool
+}
+
 // ResolveImages reads yaml or json stream from in, deserialize it and replace images with ones specified in imagemap
 // and serialize it back into out stream.
 func ResolveImages(in io.Reader, out io.Writer, imgmap map[string]string) error {
+	return ResolveImagesWithOptions(in, out, imgmap, Options{})
+}
+
+// ResolveImagesWithOptions is ResolveImages with the output customized by opts
+func ResolveImagesWithOptions(in io.Reader, out io.Writer, imgmap map[string]string, opts Options) error {
 	pt := imageTagTransformer{images: imgmap}
+	if opts.Comments {
+		pt.sources = make(map[string]string)
+	}
 	decoder := yaml.NewYAMLOrJSONDecoder(in, 1024)
 	var err error
 	firstObj := true
@@ -45,6 +61,9 @@ func ResolveImages(in io.Reader, out io.Writer, imgmap map[string]string) error
 		if err != nil {
 			return fmt.Errorf("Unable to marshal object %v", obj)
 		}
+		if pt.sources != nil {
+			buf = pt.annotate(buf)
+		}
 		if firstObj {
 			firstObj = false
 		} else {
@@ -71,6 +90,34 @@ func isEmptyYamlError(err error) bool {
 
 type imageTagTransformer struct {
 	images map[string]string
+	// sources maps substituted images to their references in the input. nil if comments are disabled
+	sources map[string]string
+}
+
+var imageLineRe = regexp.MustCompile(`^(\s*(?:-\s+)?image:\s*)(["']?)([^"'\s#]+)(["']?)\s*$`)
+
+// annotate appends the source reference comment to substituted image lines of the marshaled object
+func (pt *imageTagTransformer) annotate(buf []byte) []byte {
+	lines := strings.Split(string(buf), "\n")
+	for i, line := range lines {
+		m := imageLineRe.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		if source, ok := pt.sources[m[3]]; ok {
+			lines[i] = strings.TrimRight(line, " ") + " # gitops: " + source
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// substitute returns the image the reference is resolved to and records its source
+func (pt *imageTagTransformer) substitute(imagename string) (string, bool) {
+	newname, ok := pt.resolveImageName(imagename)
+	if ok && pt.sources != nil {
+		pt.sources[newname] = imagename
+	}
+	return newname, ok
 }
 
 /*
@@ -180,7 +227,7 @@ func (pt *imageTagTransformer) updateContainers(obj map[string]interface{}, path
 		}
 		imagename, imagenameOk := image.(string)
 		if imagenameOk {
-			if newname, ok := pt.resolveImageName(imagename); ok {
+			if newname, ok := pt.substitute(imagename); ok {
 				container["image"] = newname
 				continue
 			}
@@ -202,7 +249,7 @@ func (pt *imageTagTransformer) updateContainer(obj map[string]interface{}, path
 			if strings.HasPrefix(imagename, "//") {
 				return fmt.Errorf("unresolved image found: %s", imagename)
 			}
-			if newname, ok := pt.resolveImageName(imagename); ok {
+			if newname, ok := pt.substitute(imagename); ok {
 				container["image"] = newname
 			}
 		}
@@ -77,3 +77,26 @@ func TestNoError(t *testing.T) {
 		})
 	}
 }
+
+func TestComments(t *testing.T) {
+	inf, err := os.Open("testdata/comments.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inf.Close()
+	expected, err := ioutil.ReadFile("testdata/comments.expected.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgmap := map[string]string{
+		"//cmd/app:image":     "docker.io/cmd/app@sha256:1111",
+		"//cmd/migrate:image": "docker.io/cmd/migrate@sha256:2222",
+	}
+	var outbuf bytes.Buffer
+	if err := resolver.ResolveImagesWithOptions(inf, &outbuf, imgmap, resolver.Options{Comments: true}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+	if strings.TrimSpace(outbuf.String()) != strings.TrimSpace(string(expected)) {
+		t.Errorf("Unexpected output: %s", outbuf.String())
+	}
+}
@@ -38,9 +38,10 @@ func (i *imagesFlags) Set(value string) error {
 }
 
 var (
-	inf    = flag.String("infile", "", "Input file")
-	outf   = flag.String("outfile", "", "Out file")
-	images = make(imagesFlags)
+	inf      = flag.String("infile", "", "Input file")
+	outf     = flag.String("outfile", "", "Out file")
+	comments = flag.Bool("comments", false, "Annotate substituted image lines with a '# gitops: <image reference>' comment")
+	images   = make(imagesFlags)
 )
 
 func main() {
@@ -65,7 +66,7 @@ func main() {
 		outfile = f
 	}
 
-	err := resolver.ResolveImages(infile, outfile, images)
+	err := resolver.ResolveImagesWithOptions(infile, outfile, images, resolver.Options{Comments: *comments})
 	if err != nil {
 		log.Fatalf("Unable to process: %s", err)
 	}
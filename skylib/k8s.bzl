@@ -127,7 +127,9 @@ def k8s_deploy(
         patches = None,
         image_name_patches = {},
         image_tag_patches = {},
+        image_comments = False,  # annotate substituted image lines with a '# gitops: <image reference>' comment
         substitutions = {},  # dict of template parameter substitutions. CLUSTER and NAMESPACE parameters are added automatically.
+        substitutions_files = [],  # JSON or dotenv files of template parameters, overridden by substitutions.
         configurations = [],  # additional kustomize configuration files. rules_gitops provides
         common_labels = {},  # list of common labels to apply to all objects see commonLabels kustomize docs
         common_annotations = {},  # list of common annotations to apply to all objects see commonAnnotations kustomize docs
@@ -144,6 +146,8 @@ def k8s_deploy(
         app_name = "myapp",
         deployment_branch = None,
         release_branch_prefix = "main",
+        pr_title = None,  # PR title of the deployment_branch release train. {train} and {branch} are replaced.
+        pr_body = None,  # PR body of the deployment_branch release train. {train} and {branch} are replaced.
         start_tag = "{{",
         end_tag = "}}",
         tags = [],  # tags to add to all generated rules.
@@ -190,6 +194,7 @@ def k8s_deploy(
             images = image_pushes,
             manifests = manifests,
             substitutions = substitutions,
+            substitutions_files = substitutions_files,
             deps = deps,
             deps_aliases = deps_aliases,
             start_tag = start_tag,
@@ -203,6 +208,7 @@ def k8s_deploy(
             objects = objects,
             image_name_patches = image_name_patches,
             image_tag_patches = image_tag_patches,
+            image_comments = image_comments,
             openapi_path = openapi_path,
             tags = tags,
             visibility = visibility,
@@ -257,6 +263,7 @@ def k8s_deploy(
             manifests = manifests,
             visibility = visibility,
             substitutions = substitutions,
+            substitutions_files = substitutions_files,
             deps = deps,
             deps_aliases = deps_aliases,
             start_tag = start_tag,
@@ -269,6 +276,7 @@ def k8s_deploy(
             patches = patches,
             image_name_patches = image_name_patches,
             image_tag_patches = image_tag_patches,
+            image_comments = image_comments,
             openapi_path = openapi_path,
             tags = tags,
         )
@@ -299,6 +307,8 @@ def k8s_deploy(
             ],
             deployment_branch = deployment_branch,
             release_branch_prefix = release_branch_prefix,
+            pr_title = pr_title,
+            pr_body = pr_body,
             tags = tags,
             visibility = ["//visibility:public"],
         )
@@ -500,6 +510,18 @@ k8s_test_namespace = rule(
     implementation = _k8s_test_namespace_impl,
 )
 
+def _apply_object_commands(ctx, obj, ns_var, files, transitive):
+    """Returns commands applying the objects target into the namespace stored in the ns_var shell variable."""
+    if obj.files_to_run.executable:
+        # add object' targets and excutables to runfiles
+        files.append(obj.files_to_run.executable)
+        transitive.append(obj.default_runfiles.files)
+
+        # add object' execution command
+        return [get_runfile_path(ctx, obj.files_to_run.executable) + " | ${IT_MANIFEST_FILTER} --namespace=$%s | ${SET_NAMESPACE} $%s | ${KUBECTL} apply -f -" % (ns_var, ns_var)]
+    files += obj.files.to_list()
+    return [ctx.executable._template_engine.short_path + " --template=" + filename.short_path + " --variable=NAMESPACE=${%s} | ${IT_MANIFEST_FILTER} --namespace=$%s | ${SET_NAMESPACE} $%s | ${KUBECTL} apply -f -" % (ns_var, ns_var, ns_var) for filename in obj.files.to_list()]
+
 def _k8s_test_setup_impl(ctx):
     kustomize_bin = ctx.toolchains["@rules_gitops//gitops:kustomize_toolchain_type"].kustomizeinfo.bin
     files = []  # runfiles list
@@ -511,30 +533,51 @@ def _k8s_test_setup_impl(ctx):
     files += ctx.files._set_namespace
     files += ctx.files.cluster
 
-    push_statements, files, pushes_runfiles = imagePushStatements(ctx, [o for o in ctx.attr.objects if GitopsArtifactsInfo in o], files)
+    all_objects = ctx.attr.objects + ctx.attr.namespace_objects.keys()
+    push_statements, files, pushes_runfiles = imagePushStatements(ctx, [o for o in all_objects if GitopsArtifactsInfo in o], files)
 
     # execute all objects targets
     for obj in ctx.attr.objects:
-        if obj.files_to_run.executable:
-            # add object' targets and excutables to runfiles
-            files.append(obj.files_to_run.executable)
-            transitive.append(obj.default_runfiles.files)
-
-            # add object' execution command
-            commands.append(get_runfile_path(ctx, obj.files_to_run.executable) + " | ${SET_NAMESPACE} $NAMESPACE | ${IT_MANIFEST_FILTER} | ${KUBECTL} apply -f -")
-        else:
-            files += obj.files.to_list()
-            commands += [ctx.executable._template_engine.short_path + " --template=" + filename.short_path + " --variable=NAMESPACE=${NAMESPACE} | ${SET_NAMESPACE} $NAMESPACE | ${IT_MANIFEST_FILTER} | ${KUBECTL} apply -f -" for filename in obj.files.to_list()]
+        commands += _apply_object_commands(ctx, obj, "NAMESPACE", files, transitive)
+
+    # create additional namespaces and execute their objects targets
+    sidecar_namespaces = []
+    aliases = []
+    for obj, alias in ctx.attr.namespace_objects.items():
+        if not alias.replace("_", "").isalnum():
+            fail("namespace_objects alias '%s' must contain only letters, digits and underscores" % alias)
+        ns_var = "NAMESPACE_" + alias
+        if alias not in aliases:
+            aliases.append(alias)
+            commands.append("create_namespace %s ${NAMESPACE}-%s" % (ns_var, alias.replace("_", "-").lower()))
+            sidecar_namespaces.append("--namespace_alias=%s=${%s}" % (alias, ns_var))
+        commands += _apply_object_commands(ctx, obj, ns_var, files, transitive)
 
     files.append(ctx.executable._template_engine)
 
-    sidecar_args = []
+    # images loaded into the ephemeral cluster
+    load_images = list(ctx.attr.cluster_docker_images)
+    for f in ctx.files.cluster_images:
+        files.append(f)
+        load_images.append(f.short_path)
+
+    sidecar_args = sidecar_namespaces
     if ctx.attr.setup_timeout:
         sidecar_args.append("-timeout=%s" % ctx.attr.setup_timeout)
+    if ctx.attr.resource_timeout:
+        sidecar_args.append("-resource_timeout=%s" % ctx.attr.resource_timeout)
+    if ctx.attr.portforward_retries >= 0:
+        sidecar_args.append("-portforward_retries=%d" % ctx.attr.portforward_retries)
     for service in ctx.attr.portforward_services:
         sidecar_args.append("--portforward=%s" % service)
     for app in ctx.attr.wait_for_apps:
         sidecar_args.append("--waitforapp=%s" % app)
+    for condition in ctx.attr.wait_for_conditions:
+        sidecar_args.append("--wait_for_condition=%s" % condition)
+    for endpoint in ctx.attr.wait_for_http:
+        sidecar_args.append("--wait_for_http=%s" % endpoint)
+    for pods in ctx.attr.wait_for_pods:
+        sidecar_args.append("--wait_for_pods=%s" % pods)
     if ctx.attr.allow_errors:
         sidecar_args.append("--allow_errors")
     if ctx.attr.disable_pod_logs:
@@ -553,6 +596,9 @@ def _k8s_test_setup_impl(ctx):
             "%{it_manifest_filter}": ctx.executable._it_manifest_filter.short_path,
             "%{statements}": "\n".join(commands),
             "%{sidecar_args}": " ".join(sidecar_args),
+            "%{cluster_provider}": ctx.attr.cluster_provider,
+            "%{cluster_timeout}": ctx.attr.cluster_timeout,
+            "%{load_images}": " ".join(["-load_image=" + image for image in load_images]),
         },
         output = ctx.outputs.executable,
     )
@@ -583,9 +629,21 @@ k8s_test_setup = rule(
         "objects": attr.label_list(
             cfg = "target",
         ),
+        "namespace_objects": attr.label_keyed_string_dict(
+            cfg = "target",
+            doc = "objects to deploy into additional namespaces, keyed by target with the namespace alias as a value. Other attributes refer to objects in these namespaces with the alias/ prefix",
+        ),
         "portforward_services": attr.string_list(),
         "setup_timeout": attr.string(default = "10m"),
+        "resource_timeout": attr.string(doc = "the time to wait for each of apps, services and readiness checks"),
+        "portforward_retries": attr.int(
+            default = -1,
+            doc = "the number of consecutive attempts to re-establish a dropped port forward. The sidecar default is used if negative",
+        ),
         "wait_for_apps": attr.string_list(),
+        "wait_for_conditions": attr.string_list(doc = "status conditions to wait for in form of resource.version.group/name=Condition"),
+        "wait_for_http": attr.string_list(doc = "service endpoints to wait for a 2xx response in form of service:port/path"),
+        "wait_for_pods": attr.string_list(doc = "label selectors to wait for a number of ready pods in form of selector:count"),
         "allow_errors": attr.bool(
             default = False,
             doc = "If true, the test will ignore any kuberntetes errors. Use only in situations when error is a part of the normal workflow, like crashlooping to wait for dependencies.",
@@ -599,6 +657,21 @@ k8s_test_setup = rule(
             allow_single_file = True,
             mandatory = True,
         ),
+        "cluster_provider": attr.string(
+            values = ["", "kind", "k3d"],
+            doc = "If set, the test provisions an ephemeral kind or k3d cluster instead of using the configured cluster. Can be overridden with the K8S_TEST_CLUSTER_PROVIDER environment variable",
+        ),
+        "cluster_timeout": attr.string(
+            default = "10m",
+            doc = "the time to wait for the ephemeral cluster to be created or deleted",
+        ),
+        "cluster_images": attr.label_list(
+            allow_files = [".tar"],
+            doc = "image tarballs to load into the ephemeral cluster",
+        ),
+        "cluster_docker_images": attr.string_list(
+            doc = "images from the local docker daemon to load into the ephemeral cluster",
+        ),
         "_it_sidecar": attr.label(
             default = Label("//testing/it_sidecar:it_sidecar"),
             cfg = "exec",
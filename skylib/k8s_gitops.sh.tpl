@@ -14,6 +14,7 @@ set -o pipefail
 
 DEPLOYMENT_ROOT=""
 PERFORM_PUSH="1"
+VARIABLES=()
 # parse command line parameters
 while [[ $# -gt 0 ]]
 do
@@ -28,6 +29,11 @@ do
     PERFORM_PUSH=""
     shift
     ;;
+    --variable)
+    VARIABLES+=("--variable=$2")
+    shift # past argument
+    shift # past value
+    ;;
     *)    # unknown option
     echo Unsupported parameter $1
     exit 1
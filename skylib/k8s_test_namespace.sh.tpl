@@ -38,6 +38,28 @@ IT_MANIFEST_FILTER=%{it_manifest_filter}
 NAMESPACE_NAME_FILE=${TEST_UNDECLARED_OUTPUTS_DIR}/namespace
 KUBECONFIG_FILE=${TEST_UNDECLARED_OUTPUTS_DIR}/kubeconfig
 
+CLUSTER_PROVIDER=${K8S_TEST_CLUSTER_PROVIDER:-%{cluster_provider}}
+EPHEMERAL_CLUSTER=
+
+cluster_cleanup() {
+    if [ -n "${K8S_TEST_KEEP_CLUSTER:-}" ]; then
+        echo "Keeping ${CLUSTER_PROVIDER} cluster ${EPHEMERAL_CLUSTER}, kubeconfig: ${EPHEMERAL_KUBECONFIG}" >&2
+        return
+    fi
+    echo "Deleting ${CLUSTER_PROVIDER} cluster ${EPHEMERAL_CLUSTER}..."
+    %{it_sidecar} -cluster_provider=${CLUSTER_PROVIDER} -cluster_name=${EPHEMERAL_CLUSTER} -kubeconfig=${EPHEMERAL_KUBECONFIG} -timeout=%{cluster_timeout} -delete_cluster
+}
+
+if [ -n "${CLUSTER_PROVIDER}" ]
+then
+    # provision an ephemeral cluster for this test
+    EPHEMERAL_CLUSTER=it-$(( (RANDOM) + 32767 ))
+    EPHEMERAL_KUBECONFIG=${TEST_TMPDIR:-$(mktemp -d)}/${EPHEMERAL_CLUSTER}.kubeconfig
+    trap cluster_cleanup EXIT
+    K8S_TEST_CLUSTER=$(%{it_sidecar} -cluster_provider=${CLUSTER_PROVIDER} -cluster_name=${EPHEMERAL_CLUSTER} -kubeconfig=${EPHEMERAL_KUBECONFIG} -timeout=%{cluster_timeout} %{load_images} -create_cluster | sed -n 's/^CLUSTER //p')
+    KUBECONFIG=${EPHEMERAL_KUBECONFIG}
+fi
+
 # get cluster and username from provided configuration
 if [ -n "${K8S_TEST_CLUSTER:-}" ]
 then
@@ -53,9 +75,21 @@ echo "User: ${USER}" >&2
 
 set +e
 
+# additional namespaces created by create_namespace
+EXTRA_NAMESPACES=()
+
 ns_cleanup() {
+    if [ -n "${EPHEMERAL_CLUSTER}" ]; then
+        # the namespace is deleted with the cluster
+        cluster_cleanup
+        return
+    fi
     echo "Performing namespace ${NAMESPACE} cleanup..."
-    ${KUBECTL} --kubeconfig=${KUBECONFIG} --cluster=${CLUSTER} --user=${USER} delete namespace --wait=false ${NAMESPACE}
+    ${KUBECTL} --kubeconfig=${KUBECONFIG} --cluster=${CLUSTER} --user=${USER} delete namespace --wait=false ${NAMESPACE} ${EXTRA_NAMESPACES[@]+"${EXTRA_NAMESPACES[@]}"}
+    # cluster scoped objects renamed by it_manifest_filter
+    for ns in ${NAMESPACE} ${EXTRA_NAMESPACES[@]+"${EXTRA_NAMESPACES[@]}"}; do
+        ${KUBECTL} --kubeconfig=${KUBECONFIG} --cluster=${CLUSTER} --user=${USER} delete --wait=false clusterrole,clusterrolebinding,mutatingwebhookconfiguration,validatingwebhookconfiguration -l rules-gitops/test-namespace=${ns}
+    done
 }
 
 if [ -n "${K8S_TEST_NAMESPACE:-}" ]
@@ -80,6 +114,7 @@ else
     done
     # delete namespace after the test is complete or failed
     trap ns_cleanup EXIT
+    CLEANUP_NAMESPACES=1
 fi
 echo "Namespace: ${NAMESPACE}" >&2
 set -e
@@ -106,6 +141,17 @@ function async() {
     PIDS+=($!)
 }
 
+function create_namespace() {
+    # Create the additional namespace $2 and store its name in the variable $1.
+    # Namespaces are deleted with the test namespace if it was created by this script.
+    ${KUBECTL} create namespace $2 --dry-run=client -o yaml | ${KUBECTL} apply -f - >&2
+    if [ -n "${CLEANUP_NAMESPACES:-}" ]; then
+        EXTRA_NAMESPACES+=($2)
+    fi
+    printf -v $1 '%s' $2
+    echo "Namespace $1: $2" >&2
+}
+
 function waitpids() {
     # Wait for all of the subprocesses, failing the script if any of them failed.
     if [ "${#PIDS[@]}" != 0 ]; then
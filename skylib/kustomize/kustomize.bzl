@@ -205,6 +205,8 @@ unsetOnly: true
     resolver_part = ""
     if ctx.attr.images:
         resolver_part += " | {resolver} ".format(resolver = ctx.executable._resolver.path)
+        if ctx.attr.image_comments:
+            resolver_part += " --comments"
         tmpfiles.append(ctx.executable._resolver)
         for img in ctx.attr.images:
             kpi = img[GitopsPushInfo]
@@ -221,10 +223,15 @@ unsetOnly: true
                 resolver_part += " --image {}={}@$(cat {})".format(alias, regrepo, kpi.digestfile.path)
 
     template_part = ""
-    if ctx.attr.substitutions or ctx.attr.deps or ctx.attr.images:
+    if ctx.attr.substitutions or ctx.files.substitutions_files or ctx.attr.deps or ctx.attr.images:
         template_part += "| {} --stamp_info_file={} ".format(ctx.executable._template_engine.path, ctx.file._info_file.path)
         tmpfiles.append(ctx.executable._template_engine)
         tmpfiles.append(ctx.file._info_file)
+
+        # variables files first, so substitutions override them
+        for f in ctx.files.substitutions_files:
+            template_part += "--variables_file=%s " % f.path
+            tmpfiles.append(f)
         for k in ctx.attr.substitutions:
             template_part += "--variable=%s=%s " % (k, ctx.attr.substitutions[k])
         if ctx.attr.start_tag:
@@ -314,6 +321,7 @@ kustomize = rule(
         "disable_name_suffix_hash": attr.bool(default = True),
         "end_tag": attr.string(default = "}}"),
         "images": attr.label_list(doc = "a list of images used in manifests", providers = (GitopsPushInfo,)),
+        "image_comments": attr.bool(default = False, doc = "annotate substituted image lines with a '# gitops: <image reference>' comment"),
         "manifests": attr.label_list(allow_files = True),
         "name_prefix": attr.string(),
         "name_suffix": attr.string(),
@@ -328,6 +336,7 @@ kustomize = rule(
         "image_tag_patches": attr.string_dict(default = {}, doc = "set new tags for selected images"),
         "start_tag": attr.string(default = "{{"),
         "substitutions": attr.string_dict(default = {}),
+        "substitutions_files": attr.label_list(default = [], allow_files = [".json", ".env"], doc = "JSON or dotenv files of template variables. Files listed later override earlier ones; substitutions override all files"),
         "deps": attr.label_list(default = [], allow_files = True),
         "configurations": attr.label_list(allow_files = True),
         "common_labels": attr.string_dict(default = {}),
@@ -431,8 +440,21 @@ def imagePushStatements(
     dep_runfiles = [obj[DefaultInfo].default_runfiles for obj in trans_img_pushes]
     return statements, files, dep_runfiles
 
+def _expand_deployment_branch(ctx):
+    """Replaces {cluster}, {namespace} and {app_name} in the deployment_branch attribute"""
+    branch = ctx.attr.deployment_branch
+    for name in ["cluster", "namespace", "app_name"]:
+        placeholder = "{" + name + "}"
+        if placeholder in branch:
+            value = getattr(ctx.attr, name)
+            if not value:
+                fail("variable %s of deployment_branch %s is empty" % (placeholder, branch))
+            branch = branch.replace(placeholder, value)
+    return branch
+
 def _gitops_impl(ctx):
     cluster = ctx.attr.cluster
+    deployment_branch = _expand_deployment_branch(ctx)
     strip_prefixes = ctx.attr.strip_prefixes
     files = []
 
@@ -451,7 +473,7 @@ fi
             statements += ("echo $TARGET_DIR/{gitops_path}/{app_name}/{cluster}/{file}\n" +
                            "mkdir -p $TARGET_DIR/{gitops_path}/{app_name}/{cluster}\n" +
                            "echo '# GENERATED BY {rulename} -> {gitopsrulename}' > $TARGET_DIR/{gitops_path}/{app_name}/{cluster}/{file}\n" +
-                           "{template_engine} --template={infile} {ns_arg} --stamp_info_file={info_file} >> $TARGET_DIR/{gitops_path}/{app_name}/{cluster}/{file}\n").format(
+                           "{template_engine} --template={infile} {ns_arg} --stamp_info_file={info_file} ${{VARIABLES[@]+\"${{VARIABLES[@]}}\"}} >> $TARGET_DIR/{gitops_path}/{app_name}/{cluster}/{file}\n").format(
                 infile = get_runfile_path(ctx, infile),
                 rulename = inattr.label,
                 gitopsrulename = ctx.label,
@@ -467,7 +489,7 @@ fi
     ctx.actions.expand_template(
         template = ctx.file._template,
         substitutions = {
-            "%{deployment_branch}": ctx.attr.deployment_branch,
+            "%{deployment_branch}": deployment_branch,
             "%{statements}": statements,
         },
         output = ctx.outputs.executable,
@@ -482,7 +504,9 @@ fi
         DefaultInfo(runfiles = rf),
         GitopsArtifactsInfo(
             image_pushes = depset(transitive = [obj[GitopsArtifactsInfo].image_pushes for obj in ctx.attr.srcs]),
-            deployment_branch = ctx.attr.deployment_branch,
+            deployment_branch = deployment_branch,
+            pr_title = ctx.attr.pr_title,
+            pr_body = ctx.attr.pr_body,
         ),
     ]
 
@@ -495,6 +519,8 @@ gitops = rule(
         "gitops_path": attr.string(),
         "app_name": attr.string(),
         "release_branch_prefix": attr.string(),
+        "pr_title": attr.string(),
+        "pr_body": attr.string(),
         "strip_prefixes": attr.string_list(),
         "_info_file": attr.label(
             default = Label("//skylib:more_stable_status.txt"),
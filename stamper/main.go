@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/fasterci/rules_gitops/templating/fasttemplate"
+	"github.com/fasterci/rules_gitops/templating/variables"
 )
 
 type arrayFlags []string
@@ -34,12 +35,14 @@ func (i *arrayFlags) Set(value string) error {
 
 var (
 	stampInfoFile      arrayFlags
+	variablesFiles     arrayFlags
 	output             string
 	format, formatFile string
 )
 
 func init() {
 	flag.Var(&stampInfoFile, "stamp-info-file", "Paths to info_file and version_file files for stamping.")
+	flag.Var(&variablesFiles, "variables-file", "Paths to JSON (.json) or dotenv files of variables. Variables override stamp variables and variables of earlier files")
 	flag.StringVar(&output, "output", "", "The output file")
 	flag.StringVar(&formatFile, "format-file", "", "The file containing stamp variables placeholders")
 	flag.StringVar(&format, "format", "", "The format string containing stamp variables")
@@ -66,6 +69,15 @@ func main() {
 	var err error
 	flag.Parse()
 	stamps := workspaceStatusDict(stampInfoFile)
+	for _, f := range variablesFiles {
+		vars, err := variables.Load(f)
+		if err != nil {
+			log.Fatalf("Unable to load variables: %v", err)
+		}
+		for k, v := range vars {
+			stamps[k] = v
+		}
+	}
 	if formatFile != "" {
 		if format != "" {
 			log.Fatal("only one of --format or --format-file should be used")
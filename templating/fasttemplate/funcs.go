@@ -0,0 +1,203 @@
+package fasttemplate
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Func is a template function.
+//
+// in is the value piped into the function, nil if the function starts
+// the pipeline or the piped value is missing.
+type Func func(in *string, args ...string) (string, error)
+
+// FuncMap maps function names to functions
+type FuncMap map[string]Func
+
+// StdFuncs returns the standard template functions:
+//   - default VALUE - VALUE if the piped value is missing or empty
+//   - env NAME - the environment variable NAME, which must be in allowedEnv
+//   - base64 - the base64 encoded value
+//   - sha256 - the hex encoded SHA-256 hash of the value
+//   - toUpper, toLower - the value in upper or lower case
+//   - indent N - the value with every line indented by N spaces
+//   - nindent N - same as indent, prefixed with a new line
+func StdFuncs(allowedEnv ...string) FuncMap {
+	allowed := make(map[string]bool)
+	for _, name := range allowedEnv {
+		allowed[name] = true
+	}
+	return FuncMap{
+		"default": func(in *string, args ...string) (string, error) {
+			if len(args) != 1 {
+				return "", fmt.Errorf("default expects 1 argument, got %d", len(args))
+			}
+			if in == nil || *in == "" {
+				return args[0], nil
+			}
+			return *in, nil
+		},
+		"env": func(in *string, args ...string) (string, error) {
+			if len(args) != 1 {
+				return "", fmt.Errorf("env expects 1 argument, got %d", len(args))
+			}
+			if !allowed[args[0]] {
+				return "", fmt.Errorf("environment variable %s is not allowed", args[0])
+			}
+			return os.Getenv(args[0]), nil
+		},
+		"base64": unary(func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }),
+		"sha256": unary(func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		}),
+		"toUpper": unary(strings.ToUpper),
+		"toLower": unary(strings.ToLower),
+		"indent":  indentFunc(""),
+		"nindent": indentFunc("\n"),
+	}
+}
+
+// unary returns a function transforming the piped value
+func unary(f func(string) string) Func {
+	return func(in *string, args ...string) (string, error) {
+		if len(args) != 0 {
+			return "", fmt.Errorf("unexpected arguments %q", args)
+		}
+		if in == nil {
+			return "", missingTag
+		}
+		return f(*in), nil
+	}
+}
+
+func indentFunc(prefix string) Func {
+	return func(in *string, args ...string) (string, error) {
+		if len(args) != 1 {
+			return "", fmt.Errorf("indent expects 1 argument, got %d", len(args))
+		}
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			return "", fmt.Errorf("invalid indent %q", args[0])
+		}
+		if in == nil {
+			return "", missingTag
+		}
+		pad := strings.Repeat(" ", n)
+		return prefix + pad + strings.ReplaceAll(*in, "\n", "\n"+pad), nil
+	}
+}
+
+// ExecuteFuncs substitutes template tags (placeholders) like Execute and
+// additionally evaluates function pipelines:
+//
+//	{{variables.NAME | default "value" | toUpper}}
+//	{{env "HOME"}}
+//
+// A pipeline starts with a value from the map m or a function call, followed
+// by functions separated by '|'. Function arguments are bare words or double
+// quoted strings. Tags which are not valid pipelines of known functions and
+// pipelines of missing values are left intact.
+func ExecuteFuncs(template, startTag, endTag string, w io.Writer, m map[string]interface{}, funcs FuncMap) (int64, error) {
+	return executeFunc(template, startTag, endTag, w, func(w io.Writer, tag string) (int, error) { return funcsTagFunc(w, tag, m, funcs) })
+}
+
+func funcsTagFunc(w io.Writer, tag string, m map[string]interface{}, funcs FuncMap) (int, error) {
+	pipeline, ok := parsePipeline(tag, funcs)
+	if !ok {
+		return stdTagFunc(w, tag, m)
+	}
+	var value *string
+	for i, call := range pipeline {
+		if i == 0 && funcs[call[0]] == nil {
+			// value lookup
+			var bb bytes.Buffer
+			if _, err := stdTagFunc(&bb, call[0], m); err == nil {
+				s := bb.String()
+				value = &s
+			} else if err != missingTag {
+				return 0, err
+			}
+			continue
+		}
+		s, err := funcs[call[0]](value, call[1:]...)
+		if err == missingTag {
+			return 0, err
+		}
+		if err != nil {
+			return 0, fmt.Errorf("tag %q: %w", tag, err)
+		}
+		value = &s
+	}
+	if value == nil {
+		return 0, missingTag
+	}
+	return w.Write([]byte(*value))
+}
+
+// parsePipeline splits the tag into function calls. ok is false if the tag
+// has no function calls or contains unknown functions.
+func parsePipeline(tag string, funcs FuncMap) (pipeline [][]string, ok bool) {
+	words, ok := splitWords(tag)
+	if !ok || len(words) == 0 {
+		return nil, false
+	}
+	var call []string
+	for _, w := range append(words, "|") {
+		if w != "|" {
+			call = append(call, w)
+			continue
+		}
+		if len(call) == 0 {
+			return nil, false
+		}
+		pipeline = append(pipeline, call)
+		call = nil
+	}
+	for i, call := range pipeline {
+		if funcs[call[0]] == nil && (i > 0 || len(call) > 1) {
+			return nil, false
+		}
+	}
+	if len(pipeline) == 1 && funcs[pipeline[0][0]] == nil {
+		// plain value
+		return nil, false
+	}
+	return pipeline, true
+}
+
+// splitWords splits s into space separated words, double quoted strings and '|' separators
+func splitWords(s string) (words []string, ok bool) {
+	for {
+		s = strings.TrimLeft(s, " \t")
+		switch {
+		case s == "":
+			return words, true
+		case s[0] == '|':
+			words = append(words, "|")
+			s = s[1:]
+		case s[0] == '"':
+			prefix, err := strconv.QuotedPrefix(s)
+			if err != nil {
+				return nil, false
+			}
+			word, _ := strconv.Unquote(prefix)
+			words = append(words, word)
+			s = s[len(prefix):]
+		default:
+			n := strings.IndexAny(s, " \t|\"")
+			if n < 0 {
+				n = len(s)
+			}
+			words = append(words, s[:n])
+			s = s[n:]
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package fasttemplate
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestExecuteFuncs(t *testing.T) {
+	os.Setenv("FASTTEMPLATE_TEST", "from env")
+	m := map[string]interface{}{
+		"name":  "App",
+		"empty": "",
+		"multi": "a: 1\nb: 2",
+	}
+	funcs := StdFuncs("FASTTEMPLATE_TEST")
+	for _, tc := range []struct {
+		template, want string
+	}{
+		{"{{name}}", "App"},
+		{"{{ name | toUpper }}", "APP"},
+		{"{{name|toLower}}", "app"},
+		{"{{missing | default \"dflt\"}}", "dflt"},
+		{"{{empty | default dflt}}", "dflt"},
+		{"{{name | default \"dflt\"}}", "App"},
+		{"{{env \"FASTTEMPLATE_TEST\"}}", "from env"},
+		{"{{env FASTTEMPLATE_TEST | toUpper}}", "FROM ENV"},
+		{"{{name | base64}}", "QXBw"},
+		{"{{name | sha256}}", "0d04bfeb7d64b71c74fc925cca93d683154e8cc7e6e5838faced498e34c9984d"},
+		{"x:\n{{multi | indent 2}}", "x:\n  a: 1\n  b: 2"},
+		{"x:{{multi | nindent 2}}", "x:\n  a: 1\n  b: 2"},
+		// left intact
+		{"{{missing | toUpper}}", "{{missing | toUpper}}"},
+		{"{{name | unknown}}", "{{name | unknown}}"},
+		{"{{ .Values.x | quote }}", "{{ .Values.x | quote }}"},
+		{"{{missing}}", "{{missing}}"},
+	} {
+		var bb bytes.Buffer
+		if _, err := ExecuteFuncs(tc.template, "{{", "}}", &bb, m, funcs); err != nil {
+			t.Errorf("ExecuteFuncs(%q) error: %v", tc.template, err)
+			continue
+		}
+		if got := bb.String(); got != tc.want {
+			t.Errorf("ExecuteFuncs(%q) = %q, want %q", tc.template, got, tc.want)
+		}
+	}
+}
+
+func TestExecuteFuncsErrors(t *testing.T) {
+	m := map[string]interface{}{"name": "App"}
+	for _, template := range []string{
+		"{{env \"FASTTEMPLATE_SECRET\"}}",
+		"{{name | indent x}}",
+		"{{name | default}}",
+	} {
+		var bb bytes.Buffer
+		if _, err := ExecuteFuncs(template, "{{", "}}", &bb, m, StdFuncs()); err == nil {
+			t.Errorf("ExecuteFuncs(%q) = %q, expected error", template, bb.String())
+		}
+	}
+}
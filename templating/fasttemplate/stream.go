@@ -0,0 +1,52 @@
+package fasttemplate
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+// ExecuteDocuments executes the YAML stream read from r with ExecuteFuncs one
+// document at a time, writing every document to w before the next one is read.
+// Memory use is bounded by the largest document instead of the whole stream.
+// Tags must not span document separators (--- lines).
+//
+// Returns the number of bytes written to w.
+func ExecuteDocuments(r io.Reader, startTag, endTag string, w io.Writer, m map[string]interface{}, funcs FuncMap) (int64, error) {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	var nn int64
+	var doc strings.Builder
+	flush := func() error {
+		n, err := ExecuteFuncs(doc.String(), startTag, endTag, bw, m, funcs)
+		nn += n
+		doc.Reset()
+		return err
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nn, err
+		}
+		if strings.TrimRight(line, "\r\n") == "---" {
+			if err := flush(); err != nil {
+				return nn, err
+			}
+			n, err := bw.WriteString(line)
+			nn += int64(n)
+			if err != nil {
+				return nn, err
+			}
+		} else {
+			doc.WriteString(line)
+		}
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+	if err := flush(); err != nil {
+		return nn, err
+	}
+	return nn, bw.Flush()
+}
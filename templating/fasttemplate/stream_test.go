@@ -0,0 +1,28 @@
+package fasttemplate
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExecuteDocuments(t *testing.T) {
+	m := map[string]interface{}{"name": "App"}
+	for _, tc := range []struct {
+		template, want string
+	}{
+		{"", ""},
+		{"name: {{name}}", "name: App"},
+		{"a: {{name}}\n---\nb: {{name | toLower}}\n", "a: App\n---\nb: app\n"},
+		{"---\na: 1\n---\r\nb: {{missing}}", "---\na: 1\n---\r\nb: {{missing}}"},
+	} {
+		var out bytes.Buffer
+		n, err := ExecuteDocuments(strings.NewReader(tc.template), "{{", "}}", &out, m, StdFuncs())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.want || n != int64(len(tc.want)) {
+			t.Errorf("ExecuteDocuments(%q) = %q (%d bytes), want %q", tc.template, out.String(), n, tc.want)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"strings"
 
 	"github.com/fasterci/rules_gitops/templating/fasttemplate"
+	tplvars "github.com/fasterci/rules_gitops/templating/variables"
 )
 
 type arrayFlags []string
@@ -32,18 +33,32 @@ func (i *arrayFlags) Set(value string) error {
 	return nil
 }
 
+// variableSource is a --variable NAME=VALUE or a --variables_file path
+type variableSource struct {
+	variable, file string
+}
+
 var (
 	stampInfoFile     arrayFlags
 	output, template  string
-	variable, imports arrayFlags
+	variables         []variableSource
+	imports, allowEnv arrayFlags
 	executable        bool
 	startTag, endTag  string
 )
 
 func init() {
 	flag.Var(&stampInfoFile, "stamp_info_file", "Paths to info_file and version_file files for stamping. Content of stamp_info_file files will be used to substitute variable values so --variable VAR={BUILD_USER}/value will result in {{VAR}} being expanded to builduser/value")
-	flag.Var(&variable, "variable", "A variable to expand in the template, in the format NAME=VALUE")
+	flag.Func("variable", "A variable to expand in the template, in the format NAME=VALUE", func(v string) error {
+		variables = append(variables, variableSource{variable: v})
+		return nil
+	})
+	flag.Func("variables_file", "A JSON (.json) or dotenv file of variables to expand in the template. Variables and files specified later override earlier ones", func(v string) error {
+		variables = append(variables, variableSource{file: v})
+		return nil
+	})
 	flag.Var(&imports, "imports", "A file to import as another template, in the format NAME=filename")
+	flag.Var(&allowEnv, "allow_env", "An environment variable templates may read with the env function")
 	flag.StringVar(&output, "output", "", "The output file")
 	flag.StringVar(&template, "template", "", "The input file, mandatory")
 	flag.BoolVar(&executable, "executable", false, "Whether to adds the executable bit to the output")
@@ -72,15 +87,29 @@ func main() {
 	var err error
 	flag.Parse()
 	stamps := workspaceStatusDict(stampInfoFile)
+	funcs := fasttemplate.StdFuncs(allowEnv...)
 	ctx := map[string]interface{}{}
-	for _, v := range variable {
-		sv := strings.SplitN(v, "=", 2)
+	setVariable := func(name, value string) {
+		val := fasttemplate.ExecuteString(value, "{", "}", stamps)
+		ctx[name] = val
+		ctx["variables."+name] = val
+	}
+	for _, v := range variables {
+		if v.file != "" {
+			vars, err := tplvars.Load(v.file)
+			if err != nil {
+				log.Fatalf("Unable to load variables: %v", err)
+			}
+			for name, value := range vars {
+				setVariable(name, value)
+			}
+			continue
+		}
+		sv := strings.SplitN(v.variable, "=", 2)
 		if len(sv) != 2 {
-			log.Fatalf("variable must be VAR=value, got %s", v)
+			log.Fatalf("variable must be VAR=value, got %s", v.variable)
 		}
-		val := fasttemplate.ExecuteString(sv[1], "{", "}", stamps)
-		ctx[sv[0]] = val
-		ctx["variables."+sv[0]] = val
+		setVariable(sv[0], sv[1])
 	}
 
 	for _, v := range imports {
@@ -92,24 +121,21 @@ func main() {
 		if err != nil {
 			log.Fatalf("Unable to parse file %s: %v", sv[1], err)
 		}
-		val := fasttemplate.ExecuteString(string(imp), startTag, endTag, ctx)
-		// if err != nil {
-		// 	log.Fatalf("Unable to execute template %s: %v", sv[1], err)
-		// }
-		ctx["imports."+sv[0]] = fasttemplate.ExecuteString(val, "{", "}", stamps)
+		var val strings.Builder
+		if _, err := fasttemplate.ExecuteFuncs(string(imp), startTag, endTag, &val, ctx, funcs); err != nil {
+			log.Fatalf("Unable to execute template %s: %v", sv[1], err)
+		}
+		ctx["imports."+sv[0]] = fasttemplate.ExecuteString(val.String(), "{", "}", stamps)
 	}
 
-	var tpl []byte
+	// the template is streamed one YAML document at a time to bound memory of large manifests
+	in := os.Stdin
 	if template != "" {
-		tpl, err = ioutil.ReadFile(template)
+		in, err = os.Open(template)
 		if err != nil {
 			log.Fatalf("Unable to parse template %s: %v", template, err)
 		}
-	} else {
-		tpl, err = ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			log.Fatalf("Unable to parse template from stdin: %v", err)
-		}
+		defer in.Close()
 	}
 	outf := os.Stdout
 	if output != "" {
@@ -123,7 +149,7 @@ func main() {
 		}
 		defer outf.Close()
 	}
-	_, err = fasttemplate.Execute(string(tpl), startTag, endTag, outf, ctx)
+	_, err = fasttemplate.ExecuteDocuments(in, startTag, endTag, outf, ctx, funcs)
 	if err != nil {
 		log.Fatalf("Unable to execute template %s: %v", template, err)
 	}
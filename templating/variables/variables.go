@@ -0,0 +1,104 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+// Package variables loads substitution variables from data files.
+package variables
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Load reads variables of the JSON (.json) or dotenv (any other extension) file
+func Load(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var vars map[string]string
+	if filepath.Ext(path) == ".json" {
+		vars, err = ParseJSON(content)
+	} else {
+		vars, err = ParseDotenv(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return vars, nil
+}
+
+// ParseJSON parses a JSON object of string, number or boolean values
+func ParseJSON(content []byte) (map[string]string, error) {
+	var obj map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(content))
+	d.UseNumber()
+	if err := d.Decode(&obj); err != nil {
+		return nil, err
+	}
+	vars := make(map[string]string, len(obj))
+	for k, v := range obj {
+		switch value := v.(type) {
+		case string:
+			vars[k] = value
+		case json.Number:
+			vars[k] = value.String()
+		case bool:
+			vars[k] = strconv.FormatBool(value)
+		case nil:
+			vars[k] = ""
+		default:
+			return nil, fmt.Errorf("variable %s must be a string, number or boolean", k)
+		}
+	}
+	return vars, nil
+}
+
+// ParseDotenv parses NAME=VALUE lines. Empty lines and lines starting with # are ignored,
+// an optional "export " prefix is dropped, and single or double quoted values are unquoted.
+func ParseDotenv(content []byte) (map[string]string, error) {
+	vars := make(map[string]string)
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		name, value, found := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !found || name == "" {
+			return nil, fmt.Errorf("line %d: expected NAME=VALUE, got %q", i+1, line)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", i+1, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			// inline comment of an unquoted value
+			if n := strings.Index(value, " #"); n >= 0 {
+				value = strings.TrimSpace(value[:n])
+			}
+		}
+		vars[name] = value
+	}
+	return vars, nil
+}
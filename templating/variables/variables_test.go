@@ -0,0 +1,79 @@
+/*
+Copyright 2020 Adobe. All rights reserved.
+This file is licensed to you under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License. You may obtain a copy
+of the License at http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software distributed under
+the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR REPRESENTATIONS
+OF ANY KIND, either express or implied. See the License for the specific language
+governing permissions and limitations under the License.
+*/
+
+package variables
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseDotenv(t *testing.T) {
+	vars, err := ParseDotenv([]byte(`# comment
+REPLICAS=3
+export REGION = us-east-1
+QUOTED="a b\nc"
+SINGLE='x # y'
+INLINE=value # comment
+EMPTY=
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"REPLICAS": "3",
+		"REGION":   "us-east-1",
+		"QUOTED":   "a b\nc",
+		"SINGLE":   "x # y",
+		"INLINE":   "value",
+		"EMPTY":    "",
+	}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("ParseDotenv() = %v, want %v", vars, want)
+	}
+	if _, err := ParseDotenv([]byte("NOVALUE\n")); err == nil {
+		t.Error("ParseDotenv() of invalid line succeeded")
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	vars, err := ParseJSON([]byte(`{"REPLICAS": 3, "RATIO": 0.5, "ENABLED": true, "NAME": "app", "NONE": null}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"REPLICAS": "3", "RATIO": "0.5", "ENABLED": "true", "NAME": "app", "NONE": ""}
+	if !reflect.DeepEqual(vars, want) {
+		t.Errorf("ParseJSON() = %v, want %v", vars, want)
+	}
+	if _, err := ParseJSON([]byte(`{"NESTED": {"a": 1}}`)); err == nil {
+		t.Error("ParseJSON() of nested object succeeded")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	jsonFile := filepath.Join(dir, "prod.json")
+	envFile := filepath.Join(dir, "prod.env")
+	os.WriteFile(jsonFile, []byte(`{"A": "json"}`), 0644)
+	os.WriteFile(envFile, []byte("A=dotenv\n"), 0644)
+	for path, want := range map[string]string{jsonFile: "json", envFile: "dotenv"} {
+		vars, err := Load(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if vars["A"] != want {
+			t.Errorf("Load(%s) = %v", path, vars)
+		}
+	}
+}
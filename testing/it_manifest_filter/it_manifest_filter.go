@@ -11,6 +11,7 @@ import (
 var (
 	inf  = flag.String("infile", "", "Input file")
 	outf = flag.String("outfile", "", "Out file")
+	ns   = flag.String("namespace", "", "Test namespace. If set, references to namespaces of the input objects are rewritten to it")
 )
 
 func main() {
@@ -34,7 +35,7 @@ func main() {
 		outfile = f
 	}
 
-	err := filter.ReplacePDWithEmptyDirs(infile, outfile)
+	err := filter.Filter(infile, outfile, filter.Options{Namespace: *ns})
 	if err != nil {
 		log.Fatalf("Unable to process: %s", err)
 	}
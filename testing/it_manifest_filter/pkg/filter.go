@@ -15,13 +15,25 @@ import (
 	"k8s.io/client-go/util/jsonpath"
 )
 
+// Options configures the manifest filter
+type Options struct {
+	// Namespace is the test namespace. If set, references to the namespaces of the filtered objects are rewritten to Namespace
+	// and cluster scoped objects are renamed to be unique per test namespace
+	Namespace string
+}
+
 // ReplacePDWithEmptyDirs reads yaml or json stream from in, deserialize it and replace references to all PVC volumes with EmptyDir
 // remove all PersistemtVolumeClaim objects
 // then serialize it back into out stream.
 func ReplacePDWithEmptyDirs(in io.Reader, out io.Writer) error {
+	return Filter(in, out, Options{})
+}
+
+// Filter is ReplacePDWithEmptyDirs that also rewrites namespace references according to opts
+func Filter(in io.Reader, out io.Writer, opts Options) error {
 	decoder := yaml.NewYAMLOrJSONDecoder(in, 1024)
+	var objs []unstructured.Unstructured
 	var err error
-	firstObj := true
 	for err == nil || isEmptyYamlError(err) {
 		var obj unstructured.Unstructured
 		err = decoder.Decode(&obj)
@@ -34,6 +46,18 @@ func ReplacePDWithEmptyDirs(in io.Reader, out io.Writer) error {
 		if obj.GetKind() == "" {
 			return fmt.Errorf("Missing kind in object %v", obj)
 		}
+		objs = append(objs, obj)
+	}
+	if err != io.EOF {
+		return err
+	}
+
+	var rewriter *namespaceRewriter
+	if opts.Namespace != "" {
+		rewriter = newNamespaceRewriter(opts.Namespace, objs)
+	}
+	firstObj := true
+	for _, obj := range objs {
 		if obj.GetKind() == "PersistentVolumeClaim" {
 			continue // skip all PVCs
 		}
@@ -56,6 +80,11 @@ func ReplacePDWithEmptyDirs(in io.Reader, out io.Writer) error {
 		if obj.GetKind() == "Certificate" {
 			findAndReplaceIssuerName(obj.Object)
 		}
+		if rewriter != nil {
+			if err := rewriter.rewrite(&obj); err != nil {
+				return fmt.Errorf("Unable to rewrite namespaces in %s %s: %v", obj.GetKind(), obj.GetName(), err)
+			}
+		}
 
 		findAndReplacePVC(obj.Object)
 		buf, err := yamlenc.Marshal(obj.Object)
@@ -74,10 +103,6 @@ func ReplacePDWithEmptyDirs(in io.Reader, out io.Writer) error {
 		if err != nil {
 			return err
 		}
-
-	}
-	if err != io.EOF {
-		return err
 	}
 	return nil
 }
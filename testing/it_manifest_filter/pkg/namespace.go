@@ -0,0 +1,157 @@
+package filter
+
+import (
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// TestNamespaceLabel is set on renamed cluster scoped objects to the test namespace they belong to
+const TestNamespaceLabel = "rules-gitops/test-namespace"
+
+// renamedKinds are cluster scoped kinds renamed to be unique per test namespace
+var renamedKinds = map[string]bool{
+	"ClusterRole":                    true,
+	"ClusterRoleBinding":             true,
+	"MutatingWebhookConfiguration":   true,
+	"ValidatingWebhookConfiguration": true,
+}
+
+// caInjectionAnnotations reference namespace/name of the CA source
+var caInjectionAnnotations = []string{
+	"cert-manager.io/inject-ca-from",
+	"cert-manager.io/inject-ca-from-secret",
+}
+
+// namespaceRewriter rewrites references to the namespaces of the manifest objects to the test namespace
+type namespaceRewriter struct {
+	namespace  string
+	namespaces map[string]bool
+	// clusterRoles maps names of cluster roles in the manifest to their new names
+	clusterRoles map[string]string
+}
+
+func newNamespaceRewriter(namespace string, objs []unstructured.Unstructured) *namespaceRewriter {
+	r := &namespaceRewriter{
+		namespace:    namespace,
+		namespaces:   map[string]bool{namespace: true},
+		clusterRoles: make(map[string]string),
+	}
+	for _, obj := range objs {
+		if ns := obj.GetNamespace(); ns != "" {
+			r.namespaces[ns] = true
+		}
+		if obj.GetKind() == "ClusterRole" {
+			r.clusterRoles[obj.GetName()] = r.uniqueName(obj.GetName())
+		}
+	}
+	return r
+}
+
+func (r *namespaceRewriter) uniqueName(name string) string {
+	return name + "-" + r.namespace
+}
+
+// rewrite updates namespace references in obj and renames cluster scoped objects
+func (r *namespaceRewriter) rewrite(obj *unstructured.Unstructured) error {
+	kind := obj.GetKind()
+	if renamedKinds[kind] {
+		obj.SetName(r.uniqueName(obj.GetName()))
+		labels := obj.GetLabels()
+		if labels == nil {
+			labels = make(map[string]string)
+		}
+		labels[TestNamespaceLabel] = r.namespace
+		obj.SetLabels(labels)
+	}
+	r.rewriteAnnotations(obj)
+	switch kind {
+	case "RoleBinding", "ClusterRoleBinding":
+		if roleKind, _, _ := unstructured.NestedString(obj.Object, "roleRef", "kind"); roleKind == "ClusterRole" {
+			name, _, _ := unstructured.NestedString(obj.Object, "roleRef", "name")
+			if newName, ok := r.clusterRoles[name]; ok {
+				if err := unstructured.SetNestedField(obj.Object, newName, "roleRef", "name"); err != nil {
+					return err
+				}
+			}
+		}
+		return r.rewriteItems(obj.Object, []string{"subjects"}, "namespace")
+	case "MutatingWebhookConfiguration", "ValidatingWebhookConfiguration":
+		return r.rewriteItems(obj.Object, []string{"webhooks"}, "clientConfig", "service", "namespace")
+	case "APIService":
+		return r.rewriteField(obj.Object, "spec", "service", "namespace")
+	case "CustomResourceDefinition":
+		return r.rewriteField(obj.Object, "spec", "conversion", "webhook", "clientConfig", "service", "namespace")
+	case "Certificate":
+		return r.rewriteDNSNames(obj.Object)
+	}
+	return nil
+}
+
+// rewriteField rewrites the namespace in the string field at path
+func (r *namespaceRewriter) rewriteField(obj map[string]interface{}, path ...string) error {
+	ns, found, err := unstructured.NestedString(obj, path...)
+	if err != nil || !found || !r.namespaces[ns] {
+		return err
+	}
+	return unstructured.SetNestedField(obj, r.namespace, path...)
+}
+
+// rewriteItems rewrites the namespace field at path in every item of the list at listPath
+func (r *namespaceRewriter) rewriteItems(obj map[string]interface{}, listPath []string, path ...string) error {
+	items, found, err := unstructured.NestedSlice(obj, listPath...)
+	if err != nil || !found {
+		return err
+	}
+	for _, item := range items {
+		if m, ok := item.(map[string]interface{}); ok {
+			if err := r.rewriteField(m, path...); err != nil {
+				return err
+			}
+		}
+	}
+	return unstructured.SetNestedSlice(obj, items, listPath...)
+}
+
+func (r *namespaceRewriter) rewriteAnnotations(obj *unstructured.Unstructured) {
+	annotations := obj.GetAnnotations()
+	changed := false
+	for _, key := range caInjectionAnnotations {
+		ns, name, found := strings.Cut(annotations[key], "/")
+		if found && r.namespaces[ns] {
+			annotations[key] = r.namespace + "/" + name
+			changed = true
+		}
+	}
+	if changed {
+		obj.SetAnnotations(annotations)
+	}
+}
+
+// rewriteDNSNames rewrites service DNS names like service.namespace.svc in certificates
+func (r *namespaceRewriter) rewriteDNSNames(obj map[string]interface{}) error {
+	dnsNames, found, err := unstructured.NestedStringSlice(obj, "spec", "dnsNames")
+	if err != nil {
+		return err
+	}
+	if found {
+		for i, name := range dnsNames {
+			dnsNames[i] = r.rewriteDNSName(name)
+		}
+		if err := unstructured.SetNestedStringSlice(obj, dnsNames, "spec", "dnsNames"); err != nil {
+			return err
+		}
+	}
+	if commonName, found, _ := unstructured.NestedString(obj, "spec", "commonName"); found {
+		return unstructured.SetNestedField(obj, r.rewriteDNSName(commonName), "spec", "commonName")
+	}
+	return nil
+}
+
+func (r *namespaceRewriter) rewriteDNSName(name string) string {
+	parts := strings.Split(name, ".")
+	if len(parts) >= 3 && parts[2] == "svc" && r.namespaces[parts[1]] {
+		parts[1] = r.namespace
+	}
+	return strings.Join(parts, ".")
+}
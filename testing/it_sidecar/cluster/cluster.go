@@ -0,0 +1,119 @@
+// Package cluster provisions ephemeral kind or k3d clusters for integration tests.
+// The provider command line tool must be installed on the test host.
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Supported providers
+const (
+	Kind = "kind"
+	K3d  = "k3d"
+)
+
+// Cluster is an ephemeral Kubernetes cluster managed by the provider command line tool
+type Cluster struct {
+	Provider string
+	Name     string
+	// Kubeconfig is the path of the kubeconfig file the cluster credentials are written to
+	Kubeconfig string
+	// Binary is the path to the provider tool. The provider name is looked up in PATH if empty
+	Binary string
+	// Output receives the provider tool output. Defaults to os.Stderr
+	Output io.Writer
+}
+
+// New returns a cluster of the provider named name with credentials written to kubeconfig
+func New(provider, name, kubeconfig string) (*Cluster, error) {
+	if provider != Kind && provider != K3d {
+		return nil, fmt.Errorf("unsupported cluster provider %q: must be %s or %s", provider, Kind, K3d)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("cluster name is required")
+	}
+	if kubeconfig == "" {
+		return nil, fmt.Errorf("kubeconfig path is required")
+	}
+	return &Cluster{Provider: provider, Name: name, Kubeconfig: kubeconfig}, nil
+}
+
+// Context returns the name of the cluster, user and context in the kubeconfig written by the provider
+func (c *Cluster) Context() string {
+	return c.Provider + "-" + c.Name
+}
+
+// Create creates the cluster, waits for it to be ready and writes its kubeconfig
+func (c *Cluster) Create(ctx context.Context) error {
+	return c.run(ctx, c.createCommands())
+}
+
+// LoadImages loads images into the cluster nodes. An image is either a docker image
+// reference available in the local docker daemon or a path to an image tarball (*.tar).
+func (c *Cluster) LoadImages(ctx context.Context, images ...string) error {
+	return c.run(ctx, c.loadCommands(images))
+}
+
+// Delete deletes the cluster
+func (c *Cluster) Delete(ctx context.Context) error {
+	return c.run(ctx, c.deleteCommands())
+}
+
+func (c *Cluster) createCommands() [][]string {
+	if c.Provider == K3d {
+		return [][]string{
+			{"cluster", "create", c.Name, "--wait", "--kubeconfig-update-default=false", "--kubeconfig-switch-context=false"},
+			{"kubeconfig", "write", c.Name, "--output", c.Kubeconfig},
+		}
+	}
+	return [][]string{
+		{"create", "cluster", "--name", c.Name, "--kubeconfig", c.Kubeconfig, "--wait", "5m"},
+	}
+}
+
+func (c *Cluster) loadCommands(images []string) [][]string {
+	var commands [][]string
+	for _, image := range images {
+		switch {
+		case c.Provider == K3d:
+			commands = append(commands, []string{"image", "import", image, "--cluster", c.Name})
+		case strings.HasSuffix(image, ".tar"):
+			commands = append(commands, []string{"load", "image-archive", image, "--name", c.Name})
+		default:
+			commands = append(commands, []string{"load", "docker-image", image, "--name", c.Name})
+		}
+	}
+	return commands
+}
+
+func (c *Cluster) deleteCommands() [][]string {
+	if c.Provider == K3d {
+		return [][]string{{"cluster", "delete", c.Name}}
+	}
+	return [][]string{{"delete", "cluster", "--name", c.Name, "--kubeconfig", c.Kubeconfig}}
+}
+
+func (c *Cluster) run(ctx context.Context, commands [][]string) error {
+	binary := c.Binary
+	if binary == "" {
+		binary = c.Provider
+	}
+	output := c.Output
+	if output == nil {
+		output = os.Stderr
+	}
+	for _, args := range commands {
+		cmd := exec.CommandContext(ctx, binary, args...)
+		cmd.Stdout = output
+		cmd.Stderr = output
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s %s: %w", binary, strings.Join(args, " "), err)
+		}
+	}
+	return nil
+}
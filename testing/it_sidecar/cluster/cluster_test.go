@@ -0,0 +1,102 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNew(t *testing.T) {
+	if _, err := New("minikube", "test", "kubeconfig"); err == nil {
+		t.Error("expected error for unsupported provider")
+	}
+	if _, err := New(Kind, "", "kubeconfig"); err == nil {
+		t.Error("expected error for missing name")
+	}
+	c, err := New(K3d, "test", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Context() != "k3d-test" {
+		t.Errorf("unexpected context %s", c.Context())
+	}
+}
+
+func TestCommands(t *testing.T) {
+	testcases := []struct {
+		provider string
+		create   [][]string
+		load     [][]string
+		delete   [][]string
+	}{
+		{
+			provider: Kind,
+			create:   [][]string{{"create", "cluster", "--name", "it", "--kubeconfig", "/tmp/kubeconfig", "--wait", "5m"}},
+			load: [][]string{
+				{"load", "docker-image", "example.com/app:dev", "--name", "it"},
+				{"load", "image-archive", "app/image.tar", "--name", "it"},
+			},
+			delete: [][]string{{"delete", "cluster", "--name", "it", "--kubeconfig", "/tmp/kubeconfig"}},
+		},
+		{
+			provider: K3d,
+			create: [][]string{
+				{"cluster", "create", "it", "--wait", "--kubeconfig-update-default=false", "--kubeconfig-switch-context=false"},
+				{"kubeconfig", "write", "it", "--output", "/tmp/kubeconfig"},
+			},
+			load: [][]string{
+				{"image", "import", "example.com/app:dev", "--cluster", "it"},
+				{"image", "import", "app/image.tar", "--cluster", "it"},
+			},
+			delete: [][]string{{"cluster", "delete", "it"}},
+		},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.provider, func(t *testing.T) {
+			c, err := New(tc.provider, "it", "/tmp/kubeconfig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tc.create, c.createCommands()); diff != "" {
+				t.Errorf("unexpected create commands (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.load, c.loadCommands([]string{"example.com/app:dev", "app/image.tar"})); diff != "" {
+				t.Errorf("unexpected load commands (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(tc.delete, c.deleteCommands()); diff != "" {
+				t.Errorf("unexpected delete commands (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	binary := filepath.Join(dir, "kind")
+	if err := os.WriteFile(binary, []byte("#!/bin/sh\necho \"$@\"\n[ \"$1\" != delete ]\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	c, err := New(Kind, "it", "kubeconfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Binary = binary
+	c.Output = &out
+	if err := c.LoadImages(context.Background(), "a.tar", "b:dev"); err != nil {
+		t.Fatal(err)
+	}
+	want := "load image-archive a.tar --name it\nload docker-image b:dev --name it\n"
+	if out.String() != want {
+		t.Errorf("unexpected output %q, want %q", out.String(), want)
+	}
+	err = c.Delete(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "delete cluster --name it") {
+		t.Errorf("expected delete error, got %v", err)
+	}
+}
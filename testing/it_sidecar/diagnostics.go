@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// dumpDiagnostics writes a describe-style summary of pods, events and pod logs of the namespace ns
+// to the log and, if dir is set, to files in dir. It is called when the namespace fails to become ready.
+func dumpDiagnostics(clientset *kubernetes.Clientset, ns string, dir string) {
+	// the setup context is already done at this point
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+
+	log.Printf("DIAGNOSTICS namespace %s", ns)
+	var summary bytes.Buffer
+	pods, err := clientset.CoreV1().Pods(ns).List(ctx, meta_v1.ListOptions{})
+	if err != nil {
+		log.Printf("unable to list pods: %v", err)
+	} else {
+		for i := range pods.Items {
+			describePod(&summary, &pods.Items[i])
+		}
+	}
+	events, err := clientset.CoreV1().Events(ns).List(ctx, meta_v1.ListOptions{})
+	if err != nil {
+		log.Printf("unable to list events: %v", err)
+	} else {
+		describeEvents(&summary, events.Items)
+	}
+	os.Stdout.Write(summary.Bytes())
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("unable to create diagnostics directory: %v", err)
+			dir = ""
+		} else if err := os.WriteFile(filepath.Join(dir, ns+".txt"), summary.Bytes(), 0644); err != nil {
+			log.Printf("unable to write diagnostics: %v", err)
+		}
+	}
+	if pods == nil {
+		return
+	}
+	for _, pod := range pods.Items {
+		for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			logs := containerLogs(ctx, clientset, ns, &pod, c.Name)
+			fmt.Printf("--- logs %s/%s ---\n%s\n", pod.Name, c.Name, logs)
+			if dir != "" {
+				name := fmt.Sprintf("%s.%s.%s.log", ns, pod.Name, c.Name)
+				if err := os.WriteFile(filepath.Join(dir, name), logs, 0644); err != nil {
+					log.Printf("unable to write logs: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// describePod writes pod status in the kubectl describe style
+func describePod(w io.Writer, pod *v1.Pod) {
+	fmt.Fprintf(w, "Pod: %s\n", pod.Name)
+	fmt.Fprintf(w, "  Node: %s\n", pod.Spec.NodeName)
+	fmt.Fprintf(w, "  Phase: %s\n", pod.Status.Phase)
+	if pod.Status.Reason != "" {
+		fmt.Fprintf(w, "  Reason: %s %s\n", pod.Status.Reason, pod.Status.Message)
+	}
+	fmt.Fprintln(w, "  Conditions:")
+	for _, c := range pod.Status.Conditions {
+		fmt.Fprintf(w, "    %s=%s %s %s\n", c.Type, c.Status, c.Reason, c.Message)
+	}
+	fmt.Fprintln(w, "  Containers:")
+	for _, cs := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		fmt.Fprintf(w, "    %s: image=%s ready=%t restarts=%d\n", cs.Name, cs.Image, cs.Ready, cs.RestartCount)
+		fmt.Fprintf(w, "      State: %s\n", describeState(cs.State))
+		if cs.LastTerminationState.Terminated != nil {
+			fmt.Fprintf(w, "      Last State: %s\n", describeState(cs.LastTerminationState))
+		}
+	}
+}
+
+func describeState(s v1.ContainerState) string {
+	switch {
+	case s.Waiting != nil:
+		return fmt.Sprintf("Waiting %s %s", s.Waiting.Reason, s.Waiting.Message)
+	case s.Running != nil:
+		return fmt.Sprintf("Running since %s", s.Running.StartedAt.Format(time.RFC3339))
+	case s.Terminated != nil:
+		return fmt.Sprintf("Terminated %s exit code %d %s", s.Terminated.Reason, s.Terminated.ExitCode, s.Terminated.Message)
+	}
+	return "Unknown"
+}
+
+// describeEvents writes events ordered by time
+func describeEvents(w io.Writer, events []v1.Event) {
+	sort.Slice(events, func(i, j int) bool {
+		return eventTime(&events[i]).Before(eventTime(&events[j]))
+	})
+	fmt.Fprintln(w, "Events:")
+	for _, e := range events {
+		fmt.Fprintf(w, "  %s %s %s/%s %s (x%d): %s\n", eventTime(&e).Format(time.RFC3339), e.Type, strings.ToLower(e.InvolvedObject.Kind), e.InvolvedObject.Name, e.Reason, e.Count, e.Message)
+	}
+}
+
+func eventTime(e *v1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+// containerLogs returns the log tail of the container, including the previous instance if it has restarted
+func containerLogs(ctx context.Context, clientset *kubernetes.Clientset, ns string, pod *v1.Pod, container string) []byte {
+	tail := int64(diagnosticsLogLines)
+	var out bytes.Buffer
+	for _, cs := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+		if cs.Name == container && cs.RestartCount > 0 {
+			b, err := clientset.CoreV1().Pods(ns).GetLogs(pod.Name, &v1.PodLogOptions{Container: container, TailLines: &tail, Previous: true}).DoRaw(ctx)
+			if err == nil {
+				out.WriteString("(previous instance)\n")
+				out.Write(b)
+				out.WriteString("(current instance)\n")
+			}
+		}
+	}
+	b, err := clientset.CoreV1().Pods(ns).GetLogs(pod.Name, &v1.PodLogOptions{Container: container, TailLines: &tail}).DoRaw(ctx)
+	if err != nil {
+		fmt.Fprintf(&out, "unable to get logs: %v\n", err)
+	}
+	out.Write(b)
+	return out.Bytes()
+}
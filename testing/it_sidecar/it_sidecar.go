@@ -14,7 +14,6 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -66,23 +65,55 @@ func (i *arrayFlags) Set(value string) error {
 }
 
 var (
-	namespace      string
-	timeout        time.Duration
-	pfconfig       = portForwardConf{services: make(map[string][]uint16)}
-	kubeconfig     string
-	waitForApps    arrayFlags
-	allowErrors    bool
-	disablePodLogs bool
+	namespace       string
+	timeout         time.Duration
+	overallTimeout  time.Duration
+	resourceTimeout time.Duration
+	pfRetries       int
+	pfRetryDelay    time.Duration
+	pfconfig        = portForwardConf{services: make(map[string][]uint16)}
+	kubeconfig      string
+	waitForApps     arrayFlags
+	allowErrors     bool
+	disablePodLogs  bool
+	checkFlags      []checkFlag
+	checks          []readinessCheck
+	diagnosticsDir  string
+	aliases         = make(namespaceAliases)
+	clusterProvider string
+	clusterName     string
+	loadImages      arrayFlags
+	createCluster   bool
+	removeCluster   bool
+)
+
+const (
+	diagnosticsTimeout  = time.Minute
+	diagnosticsLogLines = 200
 )
 
 func init() {
 	flag.StringVar(&namespace, "namespace", os.Getenv("NAMESPACE"), "kubernetes namespace")
-	flag.DurationVar(&timeout, "timeout", time.Second*30, "execution timeout")
-	flag.Var(&pfconfig, "portforward", "set a port forward item in form of servicename:port")
+	flag.Var(aliases, "namespace_alias", "an additional namespace in form of alias=namespace. Other parameters refer to objects in the namespace with the alias/ prefix, e.g. alias/servicename:port")
+	flag.DurationVar(&timeout, "timeout", time.Second*30, "setup timeout: the time to wait until all apps, services and readiness checks are ready")
+	flag.DurationVar(&overallTimeout, "overall_timeout", 0, "execution timeout including the test run. If not set, the sidecar runs until stdin is closed or it is terminated")
+	flag.DurationVar(&resourceTimeout, "resource_timeout", 0, "the time to wait for each of apps, services and readiness checks. If not set, only the setup timeout applies")
+	flag.IntVar(&pfRetries, "portforward_retries", 10, "the number of consecutive attempts to re-establish a dropped port forward")
+	flag.DurationVar(&pfRetryDelay, "portforward_retry_delay", 2*time.Second, "the delay between attempts to re-establish a dropped port forward")
+	flag.Var(&pfconfig, "portforward", "set a port forward item in form of servicename:port or alias/servicename:port")
 	flag.StringVar(&kubeconfig, "kubeconfig", os.Getenv("KUBECONFIG"), "path to kubernetes config file")
-	flag.Var(&waitForApps, "waitforapp", "wait for pods with label app=<this parameter>")
+	flag.Var(&waitForApps, "waitforapp", "wait for pods with label app=<this parameter>, optionally prefixed with alias/")
 	flag.BoolVar(&allowErrors, "allow_errors", false, "do not treat Failed in events as error. Use only if crashloop is expected")
 	flag.BoolVar(&disablePodLogs, "disable_pod_logs", false, "do not forward pod logs")
+	flag.StringVar(&diagnosticsDir, "diagnostics_dir", os.Getenv("TEST_UNDECLARED_OUTPUTS_DIR"), "directory to write pod descriptions, events and logs to if the namespace fails to become ready")
+	flag.Var(checkFlagValue(parseConditionCheck), "wait_for_condition", "wait for a status condition of an object in form of resource.version.group/name=Condition, e.g. kafkas.v1beta2.kafka.strimzi.io/my-cluster=Ready")
+	flag.Var(checkFlagValue(parseHTTPCheck), "wait_for_http", "wait for a 2xx response of a service in form of service:port/path, e.g. myapp:8080/healthz")
+	flag.StringVar(&clusterProvider, "cluster_provider", "", "ephemeral cluster provider: kind or k3d")
+	flag.StringVar(&clusterName, "cluster_name", "", "ephemeral cluster name")
+	flag.Var(&loadImages, "load_image", "docker image or image tarball to load into the ephemeral cluster")
+	flag.BoolVar(&createCluster, "create_cluster", false, "create the ephemeral cluster, write its kubeconfig to the -kubeconfig path and exit")
+	flag.BoolVar(&removeCluster, "delete_cluster", false, "delete the ephemeral cluster and exit")
+	flag.Var(checkFlagValue(parsePodsCheck), "wait_for_pods", "wait for ready pods matching a label selector in form of selector:count, e.g. app=kafka,tier=broker:3")
 }
 
 // contains returns true if slice v contains an item
@@ -97,7 +128,7 @@ func contains(v []string, item string) bool {
 
 // listReadyApps converts a list returned from podsInformer.GetStore().List() to a map containing apps with ready status
 // app is determined by app label
-func listReadyApps(list []interface{}) (readypods, notReady []string) {
+func listReadyApps(list []interface{}, apps []string) (readypods, notReady []string) {
 	var readyApps []string
 	for _, it := range list {
 		pod, ok := it.(*v1.Pod)
@@ -121,7 +152,7 @@ func listReadyApps(list []interface{}) (readypods, notReady []string) {
 			}
 		}
 	}
-	for _, app := range waitForApps {
+	for _, app := range apps {
 		if !contains(readyApps, app) {
 			notReady = append(notReady, app)
 		}
@@ -130,9 +161,9 @@ func listReadyApps(list []interface{}) (readypods, notReady []string) {
 }
 
 // listenForEvents listens for events and prints them to stdout. if event reason is "Failed" it will call the failure callback
-func listenForEvents(ctx context.Context, clientset *kubernetes.Clientset, onFailure func(*v1.Event)) {
+func listenForEvents(ctx context.Context, clientset *kubernetes.Clientset, ns string, onFailure func(*v1.Event)) {
 
-	kubeInformerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+	kubeInformerFactory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(ns))
 	eventsInformer := kubeInformerFactory.Core().V1().Events().Informer()
 
 	fn := func(obj interface{}) {
@@ -173,17 +204,35 @@ func waitForPods(ctx context.Context, clientset *kubernetes.Clientset) error {
 		},
 	}
 
-	kubeInformerFactory := informers.NewFilteredSharedInformerFactory(clientset, time.Second*30, namespace, nil)
-	podsInformer := kubeInformerFactory.Core().V1().Pods().Informer()
-	podsInformer.AddEventHandler(handler)
-	go kubeInformerFactory.Start(ctx.Done())
+	apps := make(map[string][]string)
+	for _, ref := range waitForApps {
+		ns, app := resolveNamespace(ref)
+		apps[ns] = append(apps[ns], app)
+	}
+	podsInformers := make(map[string]cache.SharedIndexInformer)
+	for ns := range apps {
+		kubeInformerFactory := informers.NewFilteredSharedInformerFactory(clientset, time.Second*30, ns, nil)
+		podsInformers[ns] = kubeInformerFactory.Core().V1().Pods().Informer()
+		podsInformers[ns].AddEventHandler(handler)
+		go kubeInformerFactory.Start(ctx.Done())
+	}
 
+	var notReady []string
 waitForPodsUp:
 	for {
 		select {
 		case <-events:
-			v := podsInformer.GetStore().List()
-			ready, notReady := listReadyApps(v)
+			var ready []string
+			notReady = nil
+			for ns, informer := range podsInformers {
+				nsReady, nsNotReady := listReadyApps(informer.GetStore().List(), apps[ns])
+				for _, pod := range nsReady {
+					ready = append(ready, namespaceRef(ns, pod))
+				}
+				for _, app := range nsNotReady {
+					notReady = append(notReady, namespaceRef(ns, app))
+				}
+			}
 			log.Print("ready pods:", ready)
 			if len(notReady) != 0 {
 				log.Print("waiting for apps:", notReady)
@@ -192,14 +241,14 @@ waitForPodsUp:
 				break waitForPodsUp
 			}
 		case <-ctx.Done():
-			return errors.New("timed out waiting for apps")
+			return fmt.Errorf("timed out waiting for apps: %v", notReady)
 		}
 	}
 	return nil
 }
 
 // listReadyServices converts a list returned from endpointsInformer.GetStore().List() to a list of services with ready status
-func listReadyServices(list []interface{}) (ready, notReady []string) {
+func listReadyServices(list []interface{}, services map[string][]uint16) (ready, notReady []string) {
 	for _, it := range list {
 		ep, ok := it.(*v1.Endpoints)
 		if !ok {
@@ -212,7 +261,7 @@ func listReadyServices(list []interface{}) (ready, notReady []string) {
 			}
 		}
 	}
-	for service, _ := range pfconfig.services {
+	for service := range services {
 		if !contains(ready, service) {
 			notReady = append(notReady, service)
 		}
@@ -220,7 +269,8 @@ func listReadyServices(list []interface{}) (ready, notReady []string) {
 	return
 }
 
-func waitForEndpoints(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config) error {
+// waitForEndpoints waits for services endpoints until waitCtx is done and forwards service ports until ctx is done
+func waitForEndpoints(ctx, waitCtx context.Context, clientset *kubernetes.Clientset, config *rest.Config) error {
 	events := make(chan interface{})
 	fn := func(obj interface{}) {
 		events <- obj
@@ -234,30 +284,48 @@ func waitForEndpoints(ctx context.Context, clientset *kubernetes.Clientset, conf
 		},
 	}
 
-	kubeInformerFactory := informers.NewFilteredSharedInformerFactory(clientset, time.Second*30, namespace, nil)
-	endpointsInformer := kubeInformerFactory.Core().V1().Endpoints().Informer()
-	endpointsInformer.AddEventHandler(handler)
-	go kubeInformerFactory.Start(ctx.Done())
+	services := make(map[string]map[string][]uint16)
+	for ref, ports := range pfconfig.services {
+		ns, svc := resolveNamespace(ref)
+		if services[ns] == nil {
+			services[ns] = make(map[string][]uint16)
+		}
+		services[ns][svc] = append(services[ns][svc], ports...)
+	}
+	endpointsInformers := make(map[string]cache.SharedIndexInformer)
+	for ns := range services {
+		kubeInformerFactory := informers.NewFilteredSharedInformerFactory(clientset, time.Second*30, ns, nil)
+		endpointsInformers[ns] = kubeInformerFactory.Core().V1().Endpoints().Informer()
+		endpointsInformers[ns].AddEventHandler(handler)
+		go kubeInformerFactory.Start(waitCtx.Done())
+	}
 
 	allReadyServices := make(map[string]bool)
+	var notReady []string
 waitForServicesUp:
 	for {
 		select {
 		case <-events:
-			v := endpointsInformer.GetStore().List()
-			ready, notReady := listReadyServices(v)
-			log.Print("ready services:", ready)
-			for _, svc := range ready {
-				if !allReadyServices[svc] {
-					allReadyServices[svc] = true
-					log.Print("SERVICE_READY ", svc)
-					if ports := pfconfig.services[svc]; len(ports) > 0 {
-						err := portForward(ctx, clientset, config, svc, ports)
-						if err != nil {
-							return err
+			notReady = nil
+			for ns, informer := range endpointsInformers {
+				ready, nsNotReady := listReadyServices(informer.GetStore().List(), services[ns])
+				log.Print("ready services:", ready)
+				for _, svc := range ready {
+					ref := namespaceRef(ns, svc)
+					if !allReadyServices[ref] {
+						allReadyServices[ref] = true
+						log.Print("SERVICE_READY ", ref)
+						if ports := services[ns][svc]; len(ports) > 0 {
+							err := portForward(ctx, clientset, config, ns, svc, ports)
+							if err != nil {
+								return err
+							}
 						}
 					}
 				}
+				for _, svc := range nsNotReady {
+					notReady = append(notReady, namespaceRef(ns, svc))
+				}
 			}
 			if len(notReady) != 0 {
 				log.Print("waiting for endpoints:", notReady)
@@ -265,70 +333,149 @@ waitForServicesUp:
 				log.Println("all services are ready")
 				break waitForServicesUp
 			}
-		case <-ctx.Done():
-			return errors.New("timed out waiting for services")
+		case <-waitCtx.Done():
+			return fmt.Errorf("timed out waiting for services: %v", notReady)
 		}
 	}
 	return nil
 }
 
-func portForward(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config, serviceName string, ports []uint16) error {
-	// port forward
-	var wg sync.WaitGroup
-	wg.Add(len(ports))
+// portForward forwards service ports to random local ports. Dropped forwards are re-established on the same local ports until ctx is done
+func portForward(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config, ns, serviceName string, ports []uint16) error {
 	for _, port := range ports {
-		ep, err := clientset.CoreV1().Endpoints(namespace).Get(ctx, serviceName, meta_v1.GetOptions{})
+		pf, done, err := startPortForward(ctx, clientset, config, ns, serviceName, 0, port)
 		if err != nil {
-			return fmt.Errorf("error listing endpoints for service %s: %v", serviceName, err)
+			return err
 		}
-		var podnamespace, podname string
-		for _, subset := range ep.Subsets {
-			if len(subset.Addresses) == 0 {
-				continue
-			}
-			podnamespace = subset.Addresses[0].TargetRef.Namespace
-			podname = subset.Addresses[0].TargetRef.Name
-			break
+		forwarded, err := pf.GetPorts()
+		if err != nil {
+			return fmt.Errorf("could not get forwarded ports for %s:%d : %v", serviceName, port, err)
 		}
-		if podnamespace == "" || podname == "" {
-			return fmt.Errorf("no pods are available for service %s", serviceName)
+		for _, fp := range forwarded {
+			fmt.Printf("FORWARD %s:%d:%d\n", namespaceRef(ns, serviceName), fp.Remote, fp.Local)
+			go keepPortForward(ctx, clientset, config, ns, serviceName, fp.Local, fp.Remote, done)
 		}
-		log.Printf("%s -> %s/%s", serviceName, podnamespace, podname)
+	}
+	return nil
+}
 
-		url := clientset.CoreV1().RESTClient().Post().Resource("pods").Namespace(podnamespace).Name(podname).SubResource("portforward").URL()
-		transport, upgrader, err := spdy.RoundTripperFor(config)
-		if err != nil {
-			return fmt.Errorf("could not create round tripper: %v", err)
+// startPortForward forwards the local port to the remote port of a pod backing the service.
+// The returned channel receives the result of the forwarding when the connection is closed.
+func startPortForward(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config, ns, serviceName string, local, remote uint16) (*portforward.PortForwarder, <-chan error, error) {
+	ep, err := clientset.CoreV1().Endpoints(ns).Get(ctx, serviceName, meta_v1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing endpoints for service %s: %v", serviceName, err)
+	}
+	var podnamespace, podname string
+	for _, subset := range ep.Subsets {
+		if len(subset.Addresses) == 0 {
+			continue
 		}
-		dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
-		ports := []string{fmt.Sprintf(":%d", port)}
-		readyChan := make(chan struct{}, 1)
-		pf, err := portforward.New(dialer, ports, ctx.Done(), readyChan, os.Stderr, os.Stderr)
-		if err != nil {
-			return fmt.Errorf("could not port forward into pod: %v", err)
+		podnamespace = subset.Addresses[0].TargetRef.Namespace
+		podname = subset.Addresses[0].TargetRef.Name
+		break
+	}
+	if podnamespace == "" || podname == "" {
+		return nil, nil, fmt.Errorf("no pods are available for service %s", serviceName)
+	}
+	log.Printf("%s -> %s/%s", serviceName, podnamespace, podname)
+
+	url := clientset.CoreV1().RESTClient().Post().Resource("pods").Namespace(podnamespace).Name(podname).SubResource("portforward").URL()
+	transport, upgrader, err := spdy.RoundTripperFor(config)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not create round tripper: %v", err)
+	}
+	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", url)
+	ports := []string{fmt.Sprintf("%d:%d", local, remote)}
+	readyChan := make(chan struct{}, 1)
+	pf, err := portforward.New(dialer, ports, ctx.Done(), readyChan, os.Stderr, os.Stderr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not port forward into pod: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- pf.ForwardPorts()
+	}()
+	select {
+	case <-readyChan:
+		return pf, done, nil
+	case err := <-done:
+		return nil, nil, fmt.Errorf("could not forward ports for %s:%d : %v", serviceName, remote, err)
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+// keepPortForward re-establishes the port forward when it is dropped, e.g. due to a kubelet connection failure or a pod restart
+func keepPortForward(ctx context.Context, clientset *kubernetes.Clientset, config *rest.Config, ns, serviceName string, local, remote uint16, done <-chan error) {
+	ref := namespaceRef(ns, serviceName)
+	for {
+		select {
+		case err := <-done:
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("port forward %s:%d:%d dropped: %v", ref, remote, local, err)
+		case <-ctx.Done():
+			return
 		}
-		go func(port uint16) {
-			err := pf.ForwardPorts()
-			if err != nil {
-				log.Fatalf("Could not forward ports for %s:%d : %v", serviceName, port, err)
+		for attempt := 1; ; attempt++ {
+			if attempt > pfRetries {
+				log.Fatalf("Could not re-establish port forward %s:%d:%d in %d attempts", ref, remote, local, pfRetries)
 			}
-		}(port)
-		go func(port uint16) {
-			<-pf.Ready
-			ports, err := pf.GetPorts()
-			if err != nil {
-				log.Fatalf("Could not get forwarded ports for %s:%d : %v", serviceName, port, err)
+			select {
+			case <-time.After(pfRetryDelay):
+			case <-ctx.Done():
+				return
 			}
-			for _, port := range ports {
-				fmt.Printf("FORWARD %s:%d:%d\n", serviceName, port.Remote, port.Local)
+			var err error
+			if _, done, err = startPortForward(ctx, clientset, config, ns, serviceName, local, remote); err == nil {
+				log.Printf("FORWARD_RESTORED %s:%d:%d", ref, remote, local)
+				break
 			}
-			wg.Done()
-		}(port)
+			log.Printf("attempt %d to re-establish port forward %s:%d:%d failed: %v", attempt, ref, remote, local, err)
+		}
+	}
+}
+
+// waitForReady waits for apps, services and readiness checks until readyCtx is done.
+// Port forwards are kept until ctx is done
+func waitForReady(ctx, readyCtx context.Context, clientset *kubernetes.Clientset, config *rest.Config) error {
+	if len(waitForApps) > 0 {
+		waitCtx, cancel := resourceContext(readyCtx)
+		err := waitForPods(waitCtx, clientset)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if len(pfconfig.services) > 0 {
+		waitCtx, cancel := resourceContext(readyCtx)
+		err := waitForEndpoints(ctx, waitCtx, clientset, config)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+	if len(checks) > 0 {
+		waitCtx, cancel := resourceContext(readyCtx)
+		err := waitForChecks(waitCtx, clientset, checks)
+		cancel()
+		if err != nil {
+			return err
+		}
 	}
-	wg.Wait()
 	return nil
 }
 
+// resourceContext limits the time to wait for a kind of resources by the resource timeout
+func resourceContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if resourceTimeout > 0 {
+		return context.WithTimeoutCause(ctx, resourceTimeout, ErrTimedOut)
+	}
+	return context.WithCancel(ctx)
+}
+
 var ErrTimedOut = errors.New("timed out")
 var ErrStdinClosed = errors.New("stdin closed")
 var ErrTermSignalReceived = errors.New("TERM signal received")
@@ -336,9 +483,29 @@ var ErrTermSignalReceived = errors.New("TERM signal received")
 func main() {
 	flag.Parse()
 	log.SetOutput(os.Stdout)
-	ctx, timeoutCancel := context.WithTimeoutCause(context.Background(), timeout, ErrTimedOut)
-	defer timeoutCancel()
-	ctx, cancel := context.WithCancelCause(ctx)
+	if err := parseChecks(); err != nil {
+		log.Fatal(err)
+	}
+	if createCluster || removeCluster {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		var err error
+		if createCluster {
+			err = provisionCluster(ctx)
+		} else {
+			err = deleteCluster(ctx)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	if overallTimeout > 0 {
+		var timeoutCancel context.CancelFunc
+		ctx, timeoutCancel = context.WithTimeoutCause(ctx, overallTimeout, ErrTimedOut)
+		defer timeoutCancel()
+	}
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
@@ -372,35 +539,42 @@ func main() {
 	}
 	clientset = kubernetes.NewForConfigOrDie(config)
 
-	go func() {
-		err := stern.Run(ctx, namespace, clientset, allowErrors, disablePodLogs)
-		if err != nil {
-			log.Print(err)
-		}
-		cancel(fmt.Errorf("terminate due to kubernetes listening failure: %w", err))
-	}()
+	for _, ns := range allNamespaces() {
+		go func(ns string) {
+			err := stern.Run(ctx, ns, clientset, allowErrors, disablePodLogs)
+			if err != nil {
+				log.Print(err)
+			}
+			cancel(fmt.Errorf("terminate due to kubernetes listening failure: %w", err))
+		}(ns)
 
-	listenForEvents(ctx, clientset, func(event *v1.Event) {
-		if !allowErrors {
-			cancel(fmt.Errorf("terminate due to event %s/%s %s %s", event.Namespace, event.InvolvedObject.Name, event.Reason, event.Message))
-		}
-	})
+		listenForEvents(ctx, clientset, ns, func(event *v1.Event) {
+			if !allowErrors {
+				cancel(fmt.Errorf("terminate due to event %s/%s %s %s", event.Namespace, event.InvolvedObject.Name, event.Reason, event.Message))
+			}
+		})
+	}
 
-	if len(waitForApps) > 0 {
-		err = waitForPods(ctx, clientset)
-		if err != nil {
-			log.Print(err)
-			return
+	readyCtx, readyCancel := context.WithTimeoutCause(ctx, timeout, ErrTimedOut)
+	defer readyCancel()
+	if err := waitForReady(ctx, readyCtx, clientset, config); err != nil {
+		log.Print(err)
+		cause := context.Cause(readyCtx)
+		if cause != nil {
+			log.Print("ctx.Done: ", cause.Error())
 		}
-	}
-	if len(pfconfig.services) > 0 {
-		err = waitForEndpoints(ctx, clientset, config)
-		if err != nil {
-			log.Print(err)
-			return
+		// the namespace failed to become ready unless the test was stopped
+		if cause != ErrStdinClosed && cause != ErrTermSignalReceived {
+			for _, ns := range allNamespaces() {
+				dumpDiagnostics(clientset, ns, diagnosticsDir)
+			}
 		}
+		return
 	}
 
+	for alias, ns := range aliases {
+		fmt.Printf("NAMESPACE %s=%s\n", alias, ns)
+	}
 	fmt.Println("READY")
 	<-ctx.Done()
 	if cause := context.Cause(ctx); cause != nil {
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// namespaceAliases maps aliases of additional test namespaces to namespace names
+type namespaceAliases map[string]string
+
+func (na namespaceAliases) String() string {
+	return fmt.Sprintf("%v", map[string]string(na))
+}
+
+func (na namespaceAliases) Set(value string) error {
+	alias, ns, found := strings.Cut(value, "=")
+	if !found || alias == "" || ns == "" {
+		return fmt.Errorf("incorrect namespace alias '%s': must be in form of alias=namespace", value)
+	}
+	na[alias] = ns
+	return nil
+}
+
+// resolveNamespace splits the alias/value reference into the namespace and the value.
+// References without a known alias prefix belong to the test namespace.
+func resolveNamespace(ref string) (ns, value string) {
+	if alias, value, found := strings.Cut(ref, "/"); found {
+		if ns, ok := aliases[alias]; ok {
+			return ns, value
+		}
+	}
+	return namespace, ref
+}
+
+// namespaceRef returns the reference of name in ns as printed in FORWARD lines: name for the test namespace, alias/name otherwise
+func namespaceRef(ns, name string) string {
+	for alias, n := range aliases {
+		if n == ns && ns != namespace {
+			return alias + "/" + name
+		}
+	}
+	return name
+}
+
+// allNamespaces returns the test namespace followed by additional namespaces
+func allNamespaces() []string {
+	result := []string{namespace}
+	var extra []string
+	for _, ns := range aliases {
+		if ns != namespace && !contains(extra, ns) {
+			extra = append(extra, ns)
+		}
+	}
+	sort.Strings(extra)
+	return append(result, extra...)
+}
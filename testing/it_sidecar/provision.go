@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/fasterci/rules_gitops/testing/it_sidecar/cluster"
+)
+
+// provisionCluster creates an ephemeral cluster, loads images into it and prints the cluster name
+func provisionCluster(ctx context.Context) error {
+	c, err := cluster.New(clusterProvider, clusterName, kubeconfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("creating %s cluster %s", c.Provider, c.Name)
+	if err := c.Create(ctx); err != nil {
+		return err
+	}
+	if len(loadImages) > 0 {
+		log.Printf("loading images %v", loadImages)
+		if err := c.LoadImages(ctx, loadImages...); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("CLUSTER %s\n", c.Context())
+	return nil
+}
+
+// deleteCluster deletes the ephemeral cluster
+func deleteCluster(ctx context.Context) error {
+	c, err := cluster.New(clusterProvider, clusterName, kubeconfig)
+	if err != nil {
+		return err
+	}
+	log.Printf("deleting %s cluster %s", c.Provider, c.Name)
+	return c.Delete(ctx)
+}
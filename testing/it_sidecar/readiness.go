@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+)
+
+// readinessCheck is a user defined condition the sidecar waits for before reporting READY
+type readinessCheck interface {
+	fmt.Stringer
+	// ready reports whether the condition is met. Errors are retried until the timeout
+	ready(ctx context.Context, clientset *kubernetes.Clientset) (bool, error)
+}
+
+// checkFlag is a raw readiness check flag value. It is parsed after all flags are set
+// as the optional alias/ prefix depends on the namespace_alias flags.
+type checkFlag struct {
+	value string
+	parse func(ns, value string) (readinessCheck, error)
+}
+
+// checkFlagValue is a repeatable flag of readiness checks parsed by parse
+type checkFlagValue func(ns, value string) (readinessCheck, error)
+
+func (parse checkFlagValue) String() string {
+	return ""
+}
+
+func (parse checkFlagValue) Set(value string) error {
+	checkFlags = append(checkFlags, checkFlag{value: value, parse: parse})
+	return nil
+}
+
+// parseChecks parses readiness check flags into checks
+func parseChecks() error {
+	for _, f := range checkFlags {
+		c, err := f.parse(resolveNamespace(f.value))
+		if err != nil {
+			return err
+		}
+		checks = append(checks, c)
+	}
+	return nil
+}
+
+// conditionCheck waits for a status condition of an object, typically a custom resource
+type conditionCheck struct {
+	namespace string
+	gvr       schema.GroupVersionResource
+	name      string
+	condition string
+}
+
+// parseConditionCheck parses resource.version.group/name=Condition, e.g. kafkas.v1beta2.kafka.strimzi.io/my-cluster=Ready
+func parseConditionCheck(ns, value string) (readinessCheck, error) {
+	resource, condition, found := strings.Cut(value, "=")
+	resource, name, hasName := strings.Cut(resource, "/")
+	if !found || !hasName || name == "" || condition == "" {
+		return nil, fmt.Errorf("incorrect condition check '%s': must be in form of resource.version.group/name=Condition", value)
+	}
+	gvr, _ := schema.ParseResourceArg(resource)
+	if gvr == nil {
+		return nil, fmt.Errorf("incorrect condition check '%s': resource must include version, e.g. deployments.v1.apps", value)
+	}
+	return &conditionCheck{namespace: ns, gvr: *gvr, name: name, condition: condition}, nil
+}
+
+func (c *conditionCheck) String() string {
+	return fmt.Sprintf("%s/%s condition %s", c.gvr.GroupResource(), namespaceRef(c.namespace, c.name), c.condition)
+}
+
+func (c *conditionCheck) ready(ctx context.Context, clientset *kubernetes.Clientset) (bool, error) {
+	path := "/apis/" + c.gvr.Group + "/" + c.gvr.Version
+	if c.gvr.Group == "" {
+		path = "/api/" + c.gvr.Version
+	}
+	path += "/namespaces/" + c.namespace + "/" + c.gvr.Resource + "/" + c.name
+	b, err := clientset.Discovery().RESTClient().Get().AbsPath(path).DoRaw(ctx)
+	if err != nil {
+		return false, err
+	}
+	var obj struct {
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return false, err
+	}
+	for _, cond := range obj.Status.Conditions {
+		if cond.Type == c.condition {
+			return cond.Status == string(v1.ConditionTrue), nil
+		}
+	}
+	return false, nil
+}
+
+// httpCheck waits for a service endpoint to respond with a 2xx status through the API server service proxy
+type httpCheck struct {
+	namespace string
+	service   string
+	port      string
+	path      string
+}
+
+// parseHTTPCheck parses service:port/path, e.g. myapp:8080/healthz
+func parseHTTPCheck(ns, value string) (readinessCheck, error) {
+	hostport, path, _ := strings.Cut(value, "/")
+	service, port, found := strings.Cut(hostport, ":")
+	if !found || service == "" || port == "" {
+		return nil, fmt.Errorf("incorrect http check '%s': must be in form of service:port/path", value)
+	}
+	return &httpCheck{namespace: ns, service: service, port: port, path: "/" + path}, nil
+}
+
+func (c *httpCheck) String() string {
+	return fmt.Sprintf("http %s:%s%s", namespaceRef(c.namespace, c.service), c.port, c.path)
+}
+
+func (c *httpCheck) ready(ctx context.Context, clientset *kubernetes.Clientset) (bool, error) {
+	_, err := clientset.CoreV1().Services(c.namespace).ProxyGet("http", c.service, c.port, c.path, nil).DoRaw(ctx)
+	// non 2xx responses are returned as errors
+	return err == nil, err
+}
+
+// podsCheck waits for a number of ready pods matching a label selector
+type podsCheck struct {
+	namespace string
+	selector  string
+	count     int
+}
+
+// parsePodsCheck parses selector:count, e.g. app=kafka,tier=broker:3
+func parsePodsCheck(ns, value string) (readinessCheck, error) {
+	n := strings.LastIndex(value, ":")
+	if n <= 0 {
+		return nil, fmt.Errorf("incorrect pods check '%s': must be in form of selector:count", value)
+	}
+	count, err := strconv.Atoi(value[n+1:])
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("incorrect count in pods check '%s'", value)
+	}
+	return &podsCheck{namespace: ns, selector: value[:n], count: count}, nil
+}
+
+func (c *podsCheck) String() string {
+	return fmt.Sprintf("%d ready pods %s", c.count, namespaceRef(c.namespace, c.selector))
+}
+
+func (c *podsCheck) ready(ctx context.Context, clientset *kubernetes.Clientset) (bool, error) {
+	pods, err := clientset.CoreV1().Pods(c.namespace).List(ctx, meta_v1.ListOptions{LabelSelector: c.selector})
+	if err != nil {
+		return false, err
+	}
+	ready := 0
+	for _, pod := range pods.Items {
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == v1.PodReady && cond.Status == v1.ConditionTrue {
+				ready++
+			}
+		}
+	}
+	return ready >= c.count, nil
+}
+
+// waitForChecks polls the readiness checks until all of them are met
+func waitForChecks(ctx context.Context, clientset *kubernetes.Clientset, checks []readinessCheck) error {
+	pending := checks
+	for {
+		var notReady []readinessCheck
+		for _, c := range pending {
+			ok, err := c.ready(ctx, clientset)
+			if err != nil {
+				log.Printf("check %s: %v", c, err)
+			}
+			if ok {
+				log.Print("CHECK_READY ", c)
+			} else {
+				notReady = append(notReady, c)
+			}
+		}
+		if len(notReady) == 0 {
+			log.Println("all readiness checks passed")
+			return nil
+		}
+		pending = notReady
+		log.Print("waiting for checks:", pending)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-ctx.Done():
+			return errors.New("timed out waiting for readiness checks")
+		}
+	}
+}